@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -11,10 +12,20 @@ import (
 	"github.com/adevinta/noe/pkg/httputils"
 	"github.com/adevinta/noe/pkg/log"
 
+	noev1alpha1 "github.com/adevinta/noe/pkg/apis/noe/v1alpha1"
 	"github.com/adevinta/noe/pkg/arch"
 	"github.com/adevinta/noe/pkg/controllers"
+	"github.com/adevinta/noe/pkg/events"
+	"github.com/adevinta/noe/pkg/policy"
 	"github.com/adevinta/noe/pkg/registry"
+	"github.com/adevinta/noe/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	k8sevents "k8s.io/client-go/tools/events"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
@@ -35,12 +46,32 @@ func main() {
 	var certDir string
 	var kubeletImageCredentialProviderBinBir, kubeletImageCredentialProviderConfig string
 	var privateregistriesPatterns string
+	var ignoredImages string
+	var archTagTemplates string
+	var archRulesFile string
+	var emulation string
+	var cpuFeatureLabelsFile string
+	var enableCPUFeatureMatching bool
+	var enableDigestPinning bool
+	var schedulingGateBudget, schedulingGateMaxWait time.Duration
+	var admissionBudget time.Duration
+	var decisionCacheTTL time.Duration
+	var eventsQPS float64
+	var eventsBurst int
+	var registryConcurrency, registryQueueSize int
+	var registryQueueWait time.Duration
 	var enableLeaderElection bool
+	var enableImagePlatformOverrides bool
+	var enableNoePolicies bool
+	var enableImageSubstitutions bool
+	var enableExplain bool
+	var tracingEndpoint string
+	var tracingSampleRatio float64
 	const leaderElectionID string = "noe-controller-leader"
 
 	flag.StringVar(&preferredArch, "preferred-arch", "amd64", "Preferred architecture when placing pods")
 	flag.StringVar(&schedulableArchs, "cluster-schedulable-archs", "", "Comma separated list of architectures schedulable in the cluster")
-	flag.StringVar(&systemOS, "system-os", "linux", "Sole OS supported by the system")
+	flag.StringVar(&systemOS, "system-os", "linux", "Comma separated list of OSes schedulable in the cluster, by order of preference")
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&healthProbeAddr, "health-probe-addr", ":8081", "The address the health probe endpoint binds to.")
 	flag.StringVar(&certDir, "cert-dir", "./", "The directory where the TLS certificates are stored")
@@ -50,6 +81,28 @@ func main() {
 	flag.StringVar(&kubeletImageCredentialProviderBinBir, "image-credential-provider-bin-dir", "", "The path to the directory where credential provider plugin binaries are located.")
 	flag.StringVar(&kubeletImageCredentialProviderConfig, "image-credential-provider-config", "", "The path to the credential provider plugin config file.")
 	flag.StringVar(&privateregistriesPatterns, "private-registries", "", "Comma separated list to match private registries. Any image matching those patterns will be considered as private and anonymous pull will be disabled. The patterns are matched using kubelet matching rules. (see https://kubernetes.io/docs/tasks/administer-cluster/kubelet-credential-provider/#configure-image-matching)")
+	flag.BoolVar(&enableImagePlatformOverrides, "image-platform-overrides", false, "Watch ImagePlatformOverride objects to correct the platforms reported by image manifests. Requires the ImagePlatformOverride CRD to be installed.")
+	flag.BoolVar(&enableNoePolicies, "noe-policies", false, "Watch NoePolicy objects to override the configuration flags at runtime, cluster-wide or per namespace. Requires the NoePolicy CRD to be installed.")
+	flag.BoolVar(&enableImageSubstitutions, "image-substitutions", false, "Watch ImageSubstitution objects to replace images by their multi-arch equivalents in the pods annotated with arch.noe.adevinta.com/substitute-images. Requires the ImageSubstitution CRD to be installed.")
+	flag.StringVar(&archRulesFile, "arch-rules", "", "The path to a YAML file containing a list of CEL rules to prefer or restrict architectures, evaluated before the preferred architecture label and flag.")
+	flag.StringVar(&emulation, "emulation", string(arch.EmulationDisabled), "When to schedule pods on nodes emulating a foreign architecture, as declared by the noe.adevinta.com/emulates node label. One of disabled, fallback (only when images have no common architecture) or allow (native nodes being preferred).")
+	flag.BoolVar(&enableCPUFeatureMatching, "cpu-feature-matching", false, "Require nodes to have the Node Feature Discovery labels matching the CPU features and architecture variants (e.g. amd64/v3) of the images. Requires Node Feature Discovery to be deployed.")
+	flag.StringVar(&cpuFeatureLabelsFile, "cpu-feature-labels", "", "The path to a YAML file mapping image CPU features and architecture variants to node labels, replacing the default table. Requires --cpu-feature-matching.")
+	flag.StringVar(&archTagTemplates, "arch-tag-templates", "", "Comma separated list of images published with a tag per architecture instead of a manifest list, in the form of vendor.io/product:*={tag}-{arch}. The architecture specific tags are probed and the container image is replaced by the tag of the selected architecture.")
+	flag.BoolVar(&enableDigestPinning, "pin-image-digests", false, "Pin the container images to the digest their tag resolved to when selecting the architecture, in the form of repo:tag@sha256:..., so that the pulled content matches the selected architecture.")
+	flag.IntVar(&registryConcurrency, "registry-concurrency", 0, "When set, the maximum number of concurrent registry lookups, shared across admissions. Pods whose lookups are shed are admitted unmodified.")
+	flag.IntVar(&registryQueueSize, "registry-queue-size", 0, "The maximum number of registry lookups waiting for a worker before shedding new ones, 0 meaning unbounded. Requires --registry-concurrency.")
+	flag.DurationVar(&registryQueueWait, "registry-queue-wait", 2*time.Second, "The maximum time a registry lookup waits for a worker before being shed, 0 meaning unbounded. Requires --registry-concurrency.")
+	flag.DurationVar(&admissionBudget, "admission-budget", 0, "When set, the maximum duration spent resolving the image platforms of a pod. Images still unresolved are excluded from the architecture selection with a warning. Must be lower than the webhook timeout.")
+	flag.DurationVar(&decisionCacheTTL, "decision-cache-ttl", 0, "When set, the duration the admission decision of a pod is reused for the pods with the same images, labels, annotations, pull secrets and namespace policy, such as the replicas of a Deployment. Decisions are invalidated when image platform overrides, substitutions or noe policies change.")
+	flag.DurationVar(&schedulingGateBudget, "scheduling-gate-budget", 0, "When set, pods whose image platforms are not resolved within this duration are admitted with a scheduling gate, removed once their node selection is computed asynchronously. Must be lower than the webhook timeout.")
+	flag.DurationVar(&schedulingGateMaxWait, "scheduling-gate-max-wait", 5*time.Minute, "The maximum duration a pod can be gated by Noe, after which it is scheduled without node selection. Requires --scheduling-gate-budget.")
+	flag.Float64Var(&eventsQPS, "events-qps", 10, "The maximum rate of Kubernetes events emitted per second, events exceeding it are dropped.")
+	flag.IntVar(&eventsBurst, "events-burst", 100, "The maximum burst of Kubernetes events emitted above --events-qps.")
+	flag.BoolVar(&enableExplain, "explain", false, "Serve POST /explain on the webhook server, reporting the decision Noe would take for a Pod, a workload or a PodSpec without creating it. Callers must be allowed to post to the /explain non-resource URL.")
+	flag.StringVar(&tracingEndpoint, "tracing-endpoint", "", "When set, the URL of the OTLP/HTTP collector to export traces to, e.g. http://otel-collector.observability:4318. Admissions, image pull secret reads, registry lookups and authentications are traced, continuing the W3C trace context propagated by the API server.")
+	flag.Float64Var(&tracingSampleRatio, "tracing-sample-ratio", 1, "The ratio of the traces to sample, when not already sampled by the API server. Requires --tracing-endpoint.")
+	flag.StringVar(&ignoredImages, "ignored-images", "", "Comma separated list of image patterns to exclude from the architecture selection, in the form of docker.io/fluent/fluent-bit:*,*/istio/proxyv2:*. Images are matched both as written in the pod spec and normalized to registry/repository:tag, e.g. docker.io/library/ubuntu:latest for ubuntu.")
 
 	flag.Parse()
 
@@ -64,10 +117,51 @@ func main() {
 		log.DefaultLogger.WithError(err).Error("refusing to continue")
 		os.Exit(1)
 	}
+	emulationMode, err := arch.ParseEmulationMode(emulation)
+	if err != nil {
+		log.DefaultLogger.WithError(err).Error("refusing to continue")
+		os.Exit(1)
+	}
+	var archRules arch.Rules
+	if archRulesFile != "" {
+		rules, err := arch.LoadRules(archRulesFile)
+		if err != nil {
+			log.DefaultLogger.WithError(err).Error("unable to load architecture rules")
+			os.Exit(1)
+		}
+		archRules, err = arch.CompileRules(rules)
+		if err != nil {
+			log.DefaultLogger.WithError(err).Error("invalid architecture rules, refusing to continue")
+			os.Exit(1)
+		}
+	}
+	var cpuFeatureLabels arch.CPUFeatureLabels
+	if enableCPUFeatureMatching {
+		cpuFeatureLabels = arch.DefaultCPUFeatureLabels
+		if cpuFeatureLabelsFile != "" {
+			cpuFeatureLabels, err = arch.LoadCPUFeatureLabels(cpuFeatureLabelsFile)
+			if err != nil {
+				log.DefaultLogger.WithError(err).Error("unable to load cpu feature labels")
+				os.Exit(1)
+			}
+		}
+	}
+	var tracerProvider *sdktrace.TracerProvider
+	if tracingEndpoint != "" {
+		tracerProvider, err = tracing.Setup(mainContext, tracing.WithEndpointURL(tracingEndpoint), tracing.WithSampleRatio(tracingSampleRatio))
+		if err != nil {
+			log.DefaultLogger.WithError(err).Error("unable to set up tracing")
+			os.Exit(1)
+		}
+	}
 	ctrllog.SetLogger(log.NewLogr(log.DefaultLogger))
 	// Setup a Manager
 	log.DefaultLogger.WithContext(mainContext).Println("setting up manager")
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(noev1alpha1.AddToScheme(scheme))
 	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{
+		Scheme: scheme,
 		Metrics: metricsserver.Options{
 			BindAddress: metricsAddr,
 		},
@@ -95,8 +189,43 @@ func main() {
 		os.Exit(1)
 	}
 
+	if tracerProvider != nil {
+		// flush the remaining spans when the manager stops
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return tracerProvider.Shutdown(shutdownCtx)
+		})); err != nil {
+			log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to set up tracing shutdown")
+			os.Exit(1)
+		}
+	}
+
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to create kubernetes client")
+		os.Exit(1)
+	}
+	eventBroadcaster := k8sevents.NewBroadcaster(&k8sevents.EventSinkImpl{Interface: clientset.EventsV1()})
+	if err := eventBroadcaster.StartRecordingToSinkWithContext(mainContext); err != nil {
+		log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to start recording events")
+		os.Exit(1)
+	}
+	eventRecorder := events.NewRecorder(
+		eventBroadcaster.NewRecorder(scheme, "noe"),
+		events.WithBudget(float32(eventsQPS), eventsBurst),
+		events.WithMetricsRegistry(metrics.Registry),
+	)
+	if err := mgr.Add(eventRecorder); err != nil {
+		log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to set up event recorder")
+		os.Exit(1)
+	}
+
 	var containerRegistry registry.Registry = registry.NewPlainRegistry(
 		registry.WithDockerProxies(registry.ParseRegistryProxies(registryProxies)),
+		registry.WithArchTagTemplates(registry.ParseArchTagTemplates(archTagTemplates)),
+		registry.WithDigestResolution(enableDigestPinning),
 		registry.WithTransport(httputils.NewMonitoredRoundTripper(
 			metrics.Registry,
 			prometheus.Opts{
@@ -109,35 +238,141 @@ func main() {
 		registry.WithSchedulableArchitectures(schedulableArchSlice),
 		registry.WithAuthenticator(registry.NewAuthenticator(kubeletImageCredentialProviderConfig, kubeletImageCredentialProviderBinBir, strings.Split(privateregistriesPatterns, ","))),
 	)
+	if registryConcurrency > 0 {
+		containerRegistry = registry.NewLimitedRegistry(
+			containerRegistry,
+			registryConcurrency,
+			registry.WithMaxQueue(registryQueueSize),
+			registry.WithMaxQueueWait(registryQueueWait),
+			registry.WithLimiterMetricsRegistry(metrics.Registry),
+		)
+	}
 	containerRegistry = registry.NewCachedRegistry(containerRegistry, 1*time.Hour, registry.WithCacheMetricsRegistry(metrics.Registry))
 
+	var decisions *arch.DecisionCache
+	var invalidator controllers.Invalidator
+	if decisionCacheTTL > 0 {
+		decisions = arch.NewDecisionCache(decisionCacheTTL, arch.WithDecisionCacheMetricsRegistry(metrics.Registry))
+		invalidator = decisions
+	}
+
+	if enableImagePlatformOverrides {
+		overrides := registry.NewPlatformOverrideStore()
+		containerRegistry = registry.NewOverrideRegistry(containerRegistry, overrides)
+		if err = controllers.NewImagePlatformOverrideReconciler(
+			controllers.WithOverrideClient(mgr.GetClient()),
+			controllers.WithOverrideStore(overrides),
+			controllers.WithOverrideInvalidator(invalidator),
+		).SetupWithManager(mgr); err != nil {
+			log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to create image platform override controller")
+			os.Exit(1)
+		}
+	}
+
+	var substitutions *registry.ImageSubstitutionStore
+	if enableImageSubstitutions {
+		substitutions = registry.NewImageSubstitutionStore()
+		if err = controllers.NewImageSubstitutionReconciler(
+			controllers.WithSubstitutionClient(mgr.GetClient()),
+			controllers.WithSubstitutionStore(substitutions),
+			controllers.WithSubstitutionInvalidator(invalidator),
+		).SetupWithManager(mgr); err != nil {
+			log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to create image substitution controller")
+			os.Exit(1)
+		}
+	}
+
+	var policies *policy.Store
+	if enableNoePolicies {
+		policies = policy.NewStore(mgr.GetClient())
+		if err = controllers.NewNoePolicyReconciler(
+			controllers.WithPolicyClient(mgr.GetClient()),
+			controllers.WithPolicyStore(policies),
+			controllers.WithPolicyInvalidator(invalidator),
+			controllers.WithPolicyDefaults(policy.Policy{
+				PreferredArchitecture:    preferredArch,
+				SchedulableArchitectures: schedulableArchSlice,
+				SystemOSes:               arch.ParseOSes(systemOS),
+				MatchNodeLabels:          arch.ParseMatchNodeLabels(matchNodeLabels),
+			}),
+		).SetupWithManager(mgr); err != nil {
+			log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to create noe policy controller")
+			os.Exit(1)
+		}
+	}
+
 	if err = controllers.NewPodReconciler(
 		"noe",
 		controllers.WithClient(mgr.GetClient()),
 		controllers.WithRegistry(containerRegistry),
 		controllers.WithMetricsRegistry(metrics.Registry),
+		controllers.WithEventRecorder(eventRecorder),
 	).SetupWithManager(mgr); err != nil {
 		log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to create pod controller")
 		os.Exit(1)
 	}
 
+	if err = controllers.NewDaemonSetCoverageReconciler(
+		controllers.WithCoverageClient(mgr.GetClient()),
+		controllers.WithCoverageEventRecorder(eventRecorder),
+		controllers.WithCoverageMetricsRegistry(metrics.Registry),
+	).SetupWithManager(mgr); err != nil {
+		log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to create daemonset coverage controller")
+		os.Exit(1)
+	}
+
 	// Setup webhooks
 	log.DefaultLogger.WithContext(mainContext).Println("setting up webhook server")
 	hookServer := mgr.GetWebhookServer()
 
 	decoder := admission.NewDecoder(mgr.GetScheme())
 
+	handlerOptions := []arch.HandlerOption{
+		arch.WithMetricsRegistry(metrics.Registry),
+		arch.WithArchitecture(preferredArch),
+		arch.WithSchedulableArchitectures(schedulableArchSlice),
+		arch.WithOS(systemOS),
+		arch.WithDecoder(decoder),
+		arch.WithMatchNodeLabels(arch.ParseMatchNodeLabels(matchNodeLabels)),
+		arch.WithIgnoredImages(arch.ParseIgnoredImages(ignoredImages)),
+		arch.WithRules(archRules),
+		arch.WithEmulation(emulationMode),
+		arch.WithCPUFeatureLabels(cpuFeatureLabels),
+		arch.WithDigestPinning(enableDigestPinning),
+		arch.WithSchedulingGateBudget(schedulingGateBudget),
+		arch.WithAdmissionBudget(admissionBudget),
+		arch.WithEventRecorder(eventRecorder),
+		arch.WithNamespaceReader(mgr.GetCache()),
+	}
+	if policies != nil {
+		handlerOptions = append(handlerOptions, arch.WithPolicies(policies))
+	}
+	if substitutions != nil {
+		handlerOptions = append(handlerOptions, arch.WithSubstitutions(substitutions))
+	}
+	if decisions != nil {
+		handlerOptions = append(handlerOptions, arch.WithDecisionCache(decisions))
+	}
+
+	handler := arch.NewHandler(
+		mgr.GetClient(),
+		containerRegistry,
+		handlerOptions...,
+	)
 	admissionHook := &webhook.Admission{
-		Handler: arch.NewHandler(
-			mgr.GetClient(),
-			containerRegistry,
-			arch.WithMetricsRegistry(metrics.Registry),
-			arch.WithArchitecture(preferredArch),
-			arch.WithSchedulableArchitectures(schedulableArchSlice),
-			arch.WithOS(systemOS),
-			arch.WithDecoder(decoder),
-			arch.WithMatchNodeLabels(arch.ParseMatchNodeLabels(matchNodeLabels)),
-		),
+		Handler: handler,
+	}
+
+	if schedulingGateBudget > 0 {
+		if err = controllers.NewSchedulingGateReconciler(
+			controllers.WithGateClient(mgr.GetClient()),
+			controllers.WithGatedPodUpdater(handler),
+			controllers.WithGateMaxWait(schedulingGateMaxWait),
+			controllers.WithGateMetricsRegistry(metrics.Registry),
+		).SetupWithManager(mgr); err != nil {
+			log.DefaultLogger.WithContext(mainContext).WithError(err).Error("unable to create scheduling gate controller")
+			os.Exit(1)
+		}
 	}
 
 	log.DefaultLogger.WithContext(mainContext).Println("registering webhooks to the webhook server")
@@ -150,9 +385,23 @@ func main() {
 				Subsystem: "webhook",
 			},
 			httputils.StandardHandlerLabeller,
-			admissionHook,
+			tracing.Handler("admission", admissionHook),
 		),
 	)
+	if enableExplain {
+		hookServer.Register(
+			"/explain",
+			httputils.InstrumentHandler(
+				metrics.Registry,
+				prometheus.Opts{
+					Namespace: "noe",
+					Subsystem: "explain",
+				},
+				httputils.StandardHandlerLabeller,
+				tracing.Handler("explain", httputils.RequireAuthorization(mgr.GetClient(), handler.ExplainHandler())),
+			),
+		)
+	}
 
 	log.DefaultLogger.WithContext(mainContext).Println("starting manager")
 	if err := mgr.Start(mainContext); err != nil {
@@ -0,0 +1,76 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImagePlatformOverrideMode defines how the declared platforms are combined with the ones found in the registry.
+// +kubebuilder:validation:Enum=Replace;Add
+type ImagePlatformOverrideMode string
+
+const (
+	// ImagePlatformOverrideReplace ignores the registry and only considers the declared platforms.
+	ImagePlatformOverrideReplace ImagePlatformOverrideMode = "Replace"
+	// ImagePlatformOverrideAdd adds the declared platforms to the ones found in the registry.
+	ImagePlatformOverrideAdd ImagePlatformOverrideMode = "Add"
+)
+
+const (
+	// ImagePlatformOverrideConditionReady reports whether the override is valid and applied by Noe.
+	ImagePlatformOverrideConditionReady = "Ready"
+)
+
+// ImagePlatformOverrideSpec defines the platforms supported by a set of images
+type ImagePlatformOverrideSpec struct {
+	// Images is a list of glob patterns matched against the images as written in the pod specs.
+	// e.g. docker.io/vendor/*:1.2.*
+	// +kubebuilder:validation:MinItems=1
+	Images []string `json:"images"`
+	// Platforms supported by the matching images, in the form of os/arch[/variant]
+	// e.g. linux/amd64
+	// +kubebuilder:validation:MinItems=1
+	Platforms []string `json:"platforms"`
+	// Mode defines whether the platforms replace the ones found in the registry, or are added to them.
+	// Defaults to Replace.
+	// +optional
+	Mode ImagePlatformOverrideMode `json:"mode,omitempty"`
+}
+
+// ImagePlatformOverrideStatus defines the observed state of ImagePlatformOverride
+type ImagePlatformOverrideStatus struct {
+	// ObservedGeneration is the last generation reconciled by Noe
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// AffectedPods is the number of running pods with at least one image matching the override
+	// +optional
+	AffectedPods int32 `json:"affectedPods"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ImagePlatformOverride declares the platforms supported by images, regardless of their manifests.
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Mode",type=string,JSONPath=`.spec.mode`
+// +kubebuilder:printcolumn:name="Affected Pods",type=integer,JSONPath=`.status.affectedPods`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+type ImagePlatformOverride struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImagePlatformOverrideSpec   `json:"spec,omitempty"`
+	Status ImagePlatformOverrideStatus `json:"status,omitempty"`
+}
+
+// ImagePlatformOverrideList contains a list of ImagePlatformOverride
+// +kubebuilder:object:root=true
+type ImagePlatformOverrideList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImagePlatformOverride `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImagePlatformOverride{}, &ImagePlatformOverrideList{})
+}
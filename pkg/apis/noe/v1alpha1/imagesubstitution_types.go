@@ -0,0 +1,59 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ImageSubstitutionConditionReady reports whether the substitution is valid and applied by Noe.
+	ImageSubstitutionConditionReady = "Ready"
+)
+
+// ImageSubstitutionSpec defines the replacement repository of a set of images
+type ImageSubstitutionSpec struct {
+	// Images is a list of glob patterns matched against the images as written in the pod specs.
+	// e.g. docker.io/vendor/nginx:*
+	// +kubebuilder:validation:MinItems=1
+	Images []string `json:"images"`
+	// Repository replaces the repository of the matching images, keeping their tag.
+	// e.g. docker.io/bitnami/nginx
+	// +kubebuilder:validation:MinLength=1
+	Repository string `json:"repository"`
+}
+
+// ImageSubstitutionStatus defines the observed state of ImageSubstitution
+type ImageSubstitutionStatus struct {
+	// ObservedGeneration is the last generation reconciled by Noe
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ImageSubstitution declares a drop-in multi-arch replacement for images.
+// Noe only substitutes the images of pods annotated with arch.noe.adevinta.com/substitute-images: "true",
+// when the substitution makes the preferred architecture available.
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Repository",type=string,JSONPath=`.spec.repository`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+type ImageSubstitution struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageSubstitutionSpec   `json:"spec,omitempty"`
+	Status ImageSubstitutionStatus `json:"status,omitempty"`
+}
+
+// ImageSubstitutionList contains a list of ImageSubstitution
+// +kubebuilder:object:root=true
+type ImageSubstitutionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageSubstitution `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageSubstitution{}, &ImageSubstitutionList{})
+}
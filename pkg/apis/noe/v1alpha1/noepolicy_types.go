@@ -0,0 +1,85 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// NoePolicyConditionReady reports whether the policy is valid for every namespace it applies to.
+	NoePolicyConditionReady = "Ready"
+)
+
+// RegistryProxy substitutes a registry with a proxy when fetching image manifests
+type RegistryProxy struct {
+	// Registry is a glob pattern matching the registry host, e.g. docker.io
+	Registry string `json:"registry"`
+	// Proxy is the registry host to use instead, e.g. docker-proxy.company.corp
+	Proxy string `json:"proxy"`
+}
+
+// NoePolicySpec defines the configuration Noe applies to pods.
+// Omitted fields inherit from less specific policies, then from the command line flags.
+type NoePolicySpec struct {
+	// NamespaceSelector restricts the policy to the namespaces matching the selector.
+	// When omitted, the policy applies to the whole cluster.
+	// Namespaced policies take precedence over cluster wide ones.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// PreferredArchitecture is the architecture selected when all images support it
+	// +optional
+	PreferredArchitecture string `json:"preferredArchitecture,omitempty"`
+	// SchedulableArchitectures is the list of architectures schedulable in the cluster
+	// +optional
+	SchedulableArchitectures []string `json:"schedulableArchitectures,omitempty"`
+	// SystemOSes is the list of OSes schedulable in the cluster, by order of preference
+	// +optional
+	SystemOSes []string `json:"systemOSes,omitempty"`
+	// MatchNodeLabels is a list of pod label keys to match against node labels
+	// +optional
+	MatchNodeLabels []string `json:"matchNodeLabels,omitempty"`
+	// RegistryProxies substitutes registries when fetching image manifests
+	// +optional
+	RegistryProxies []RegistryProxy `json:"registryProxies,omitempty"`
+	// PrivateRegistries is a list of patterns matching private registries, for which anonymous pull is disabled.
+	// The patterns are matched using kubelet matching rules.
+	// +optional
+	PrivateRegistries []string `json:"privateRegistries,omitempty"`
+}
+
+// NoePolicyStatus defines the observed state of NoePolicy
+type NoePolicyStatus struct {
+	// ObservedGeneration is the last generation reconciled by Noe
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Namespaces is the list of namespaces the policy applies to
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// NoePolicy configures Noe at runtime, for the whole cluster or a set of namespaces.
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Preferred Arch",type=string,JSONPath=`.spec.preferredArchitecture`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+type NoePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NoePolicySpec   `json:"spec,omitempty"`
+	Status NoePolicyStatus `json:"status,omitempty"`
+}
+
+// NoePolicyList contains a list of NoePolicy
+// +kubebuilder:object:root=true
+type NoePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NoePolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NoePolicy{}, &NoePolicyList{})
+}
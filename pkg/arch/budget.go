@@ -0,0 +1,73 @@
+package arch
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/adevinta/noe/pkg/log"
+)
+
+const (
+	// ResolutionComplete is the outcome of the resolutions of all the pod images within the admission budget
+	ResolutionComplete = "complete"
+	// ResolutionPartial is the outcome of the resolutions of some of the pod images within the admission budget
+	ResolutionPartial = "partial"
+	// ResolutionTimeout is the outcome of the resolutions of none of the pod images within the admission budget
+	ResolutionTimeout = "timeout"
+)
+
+// WithAdmissionBudget limits the time spent resolving the pod image platforms.
+// Images still unresolved when the budget runs out are handled like images whose platforms can't be listed:
+// they are excluded from the architecture selection and reported in a warning.
+// A zero budget waits for all the images.
+func WithAdmissionBudget(budget time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.admissionBudget = budget
+	}
+}
+
+// collectImagePlatforms receives the platforms of the requested images until all of them are resolved or the admission budget runs out.
+// It returns the received platforms and the images that were not resolved in time.
+func (h *Handler) collectImagePlatforms(ctx context.Context, namespace string, requested []podImage, results <-chan imageArchResult) ([]imageArchResult, []string) {
+	var budget <-chan time.Time
+	if h.admissionBudget > 0 {
+		timer := time.NewTimer(h.admissionBudget)
+		defer timer.Stop()
+		budget = timer.C
+	}
+	pending := map[podImage]int{}
+	for _, image := range requested {
+		pending[image]++
+	}
+	received := []imageArchResult{}
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				h.metrics.ImageResolution.WithLabelValues(namespace, ResolutionComplete).Inc()
+				return received, nil
+			}
+			received = append(received, result)
+			image := podImage{container: result.container, image: result.image}
+			if pending[image]--; pending[image] <= 0 {
+				delete(pending, image)
+			}
+		case <-budget:
+			timedOut := []string{}
+			for image, count := range pending {
+				for i := 0; i < count; i++ {
+					timedOut = append(timedOut, image.image)
+				}
+			}
+			slices.Sort(timedOut)
+			outcome := ResolutionPartial
+			if len(received) == 0 {
+				outcome = ResolutionTimeout
+			}
+			log.DefaultLogger.WithContext(ctx).WithField("images", timedOut).WithField("budget", h.admissionBudget).Warn("image platforms not resolved within the admission budget")
+			h.metrics.ImageResolution.WithLabelValues(namespace, outcome).Inc()
+			return received, timedOut
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package arch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUpdatePodSpecHonorsAdmissionBudget(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slowRegistry := RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+		if image == "slow" {
+			<-release
+			return []registry.Platform{{OS: "linux", Architecture: "amd64"}}, nil
+		}
+		return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+	})
+	newHandler := func() *Handler {
+		return NewHandler(fake.NewClientBuilder().Build(), slowRegistry, WithOS("linux"), WithAdmissionBudget(20*time.Millisecond))
+	}
+
+	t.Run("When all images are resolved within the budget, the decision is complete", func(t *testing.T) {
+		h := newHandler()
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "fast"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("arm64")), podSpec.Affinity)
+		assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.ImageResolution.WithLabelValues("ns", ResolutionComplete)))
+	})
+
+	t.Run("When some images are not resolved within the budget, they are excluded with a warning", func(t *testing.T) {
+		h := newHandler()
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "fast"}, {Name: "sidecar", Image: "slow"}}}
+		err := h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec)
+		var warningErr warning
+		require.ErrorAs(t, err, &warningErr)
+		assert.Equal(t, "platforms of images slow not resolved within the admission budget of 20ms, they are excluded from the architecture selection", err.Error())
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("arm64")), podSpec.Affinity)
+		assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.ImageResolution.WithLabelValues("ns", ResolutionPartial)))
+	})
+
+	t.Run("When no image is resolved within the budget, the pod is not modified", func(t *testing.T) {
+		h := newHandler()
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "slow"}}}
+		err := h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec)
+		var warningErr warning
+		require.ErrorAs(t, err, &warningErr)
+		assert.Nil(t, podSpec.Affinity)
+		assert.Nil(t, podSpec.NodeSelector)
+		assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.ImageResolution.WithLabelValues("ns", ResolutionTimeout)))
+	})
+}
+
+func TestHookSkipsPodsWhenOverloaded(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			if image == "shed" {
+				return nil, registry.ErrOverloaded
+			}
+			return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+		}),
+		WithOS("linux"),
+	)
+	resp := runWebhookTest(t, h, &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "ubuntu"}, {Name: "sidecar", Image: "shed"}}},
+	})
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, "skipped: overloaded", resp.Result.Message)
+	assert.Len(t, resp.Patches, 0)
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.UpdateSkept.WithLabelValues("overloaded")))
+}
@@ -0,0 +1,125 @@
+package arch
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strings"
+
+	"gomodules.xyz/jsonpatch/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DecisionInput is the pod, or pod template, to select the nodes of.
+type DecisionInput struct {
+	Namespace  string
+	ObjectMeta metav1.ObjectMeta
+	Spec       v1.PodSpec
+	// DaemonSet reports the pod template is the one of a DaemonSet: the preferred architectures are ignored,
+	// so that the daemon runs on all the nodes its images support.
+	DaemonSet bool
+}
+
+// DaemonSetOSAnnotation and DaemonSetArchitecturesAnnotation record on DaemonSets the OS selected for their pods,
+// and the architectures supported by all their images, possibly none.
+// They allow reporting the nodes that will not run the daemon without looking the images up again.
+const (
+	DaemonSetOSAnnotation            = "arch.noe.adevinta.com/daemonset-os"
+	DaemonSetArchitecturesAnnotation = "arch.noe.adevinta.com/daemonset-architectures"
+)
+
+type daemonSetKey struct{}
+
+func isDaemonSet(ctx context.Context) bool {
+	daemonSet, _ := ctx.Value(daemonSetKey{}).(bool)
+	return daemonSet
+}
+
+// Decision is the node selection Noe takes for a pod, or pod template.
+type Decision struct {
+	// ObjectMeta and Spec are the pod metadata and spec, updated with the node selection.
+	ObjectMeta metav1.ObjectMeta
+	Spec       v1.PodSpec
+	// Warning reports the problems that didn't prevent the decision, such as a preferred architecture not supported by all the images.
+	Warning string
+	// Reasons are the structured reasons of the warning, or of the denial, listing the architectures of each container.
+	Reasons []Reason
+	// OS is the OS selected for the pod, empty when the pod images were not considered, e.g. when the pod already selects its architecture.
+	OS string
+	// CommonArchitectures are the architectures supported by all the images, allowed by the rules,
+	// and restricted to a single one for the images with architecture specific tags.
+	CommonArchitectures []string
+
+	input DecisionInput
+}
+
+// Patch returns the JSON patch turning the input into the decision.
+// metaPath and specPath are the locations of the pod metadata and spec in the patched object, e.g. /metadata and /spec for pods.
+func (d Decision) Patch(metaPath, specPath string) ([]jsonpatch.JsonPatchOperation, error) {
+	return podTemplatePatch(metaPath, specPath, &d.input.ObjectMeta, &d.ObjectMeta, &d.input.Spec, &d.Spec)
+}
+
+// Decide selects the nodes a pod, or pod template, can run on, exactly as the admission webhook does, without admitting anything.
+// The input is left untouched, and the handler can be built without any admission decoder, for instance to embed Noe in controllers or CI checks.
+// Errors report the pods Noe denies, or registry.ErrOverloaded when the registry lookups were shed and the pod would be admitted unmodified.
+// Unlike admissions, decisions never defer the pod scheduling nor use the admission decision cache.
+func (h *Handler) Decide(ctx context.Context, in DecisionInput) (Decision, error) {
+	d := Decision{
+		ObjectMeta: *in.ObjectMeta.DeepCopy(),
+		Spec:       *in.Spec.DeepCopy(),
+		input: DecisionInput{
+			Namespace:  in.Namespace,
+			ObjectMeta: *in.ObjectMeta.DeepCopy(),
+			Spec:       *in.Spec.DeepCopy(),
+		},
+	}
+	if in.DaemonSet {
+		ctx = context.WithValue(ctx, daemonSetKey{}, true)
+	}
+	// the selection is collected the same way as the explanations, reusing the one of the explained decisions
+	explanation := explanationFromContext(ctx)
+	if explanation == nil {
+		explanation = &Explanation{}
+		ctx = context.WithValue(ctx, explanationKey{}, explanation)
+	}
+	err := h.updatePodTemplate(ctx, in.Namespace, &d.ObjectMeta, &d.Spec)
+	d.OS, d.CommonArchitectures = explanation.OS, explanation.CommonArchitectures
+	d.Reasons = reasonsOf(err)
+	var warningErr warning
+	if errors.As(err, &warningErr) {
+		d.Warning = err.Error()
+		return d, nil
+	}
+	return d, err
+}
+
+// decidePod updates the pod with the decision, returning the decision warning as an error.
+func (h *Handler) decidePod(ctx context.Context, pod *v1.Pod) error {
+	d, err := h.Decide(ctx, DecisionInput{Namespace: pod.Namespace, ObjectMeta: pod.ObjectMeta, Spec: pod.Spec})
+	pod.ObjectMeta, pod.Spec = d.ObjectMeta, d.Spec
+	if err != nil {
+		return err
+	}
+	if d.Warning != "" {
+		return warning{msg: d.Warning, reasons: d.Reasons}
+	}
+	return nil
+}
+
+// daemonSetCoverageAnnotations returns the daemonset annotations updated with the OS and the architectures
+// supported by all its images, or without them when the decision didn't consider the images.
+func daemonSetCoverageAnnotations(annotations map[string]string, d Decision) map[string]string {
+	updated := maps.Clone(annotations)
+	delete(updated, DaemonSetOSAnnotation)
+	delete(updated, DaemonSetArchitecturesAnnotation)
+	if d.OS == "" {
+		return updated
+	}
+	if updated == nil {
+		updated = map[string]string{}
+	}
+	updated[DaemonSetOSAnnotation] = d.OS
+	updated[DaemonSetArchitecturesAnnotation] = strings.Join(d.CommonArchitectures, ",")
+	return updated
+}
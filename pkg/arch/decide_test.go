@@ -0,0 +1,74 @@
+package arch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gomodules.xyz/jsonpatch/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDecide(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			switch image {
+			case "amd64-only":
+				return []registry.Platform{{OS: "linux", Architecture: "amd64"}}, nil
+			case "arm64-only":
+				return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+			}
+			return []registry.Platform{{OS: "linux", Architecture: "arm64"}, {OS: "linux", Architecture: "amd64"}}, nil
+		}),
+		WithOS("linux"),
+		WithArchitecture("amd64"),
+	)
+	input := func(images ...string) DecisionInput {
+		in := DecisionInput{
+			Namespace:  "ns",
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+		}
+		for _, image := range images {
+			in.Spec.Containers = append(in.Spec.Containers, v1.Container{Name: image, Image: image})
+		}
+		return in
+	}
+
+	t.Run("When the images share the preferred architecture, it is selected without changing the input", func(t *testing.T) {
+		in := input("ubuntu")
+		d, err := h.Decide(context.Background(), in)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{archKey: "amd64"}, d.Spec.NodeSelector)
+		assert.Empty(t, d.Warning)
+		assert.Nil(t, in.Spec.NodeSelector)
+		assert.Empty(t, in.ObjectMeta.Annotations)
+
+		patches, err := d.Patch("/spec/template/metadata", "/spec/template/spec")
+		require.NoError(t, err)
+		assert.Contains(t, patches, jsonpatch.JsonPatchOperation{Operation: "add", Path: "/spec/template/spec/nodeSelector", Value: map[string]interface{}{archKey: "amd64"}})
+	})
+
+	t.Run("When the preferred architecture can't be selected, the decision has a warning", func(t *testing.T) {
+		in := input("arm64-only")
+		in.ObjectMeta.Labels["arch.noe.adevinta.com/preferred"] = "amd64"
+		d, err := h.Decide(context.Background(), in)
+		require.NoError(t, err)
+		assert.Equal(t, "could not select preferred arch: amd64 (excluded by arm64-only); container architectures: arm64-only (arm64-only) arm64", d.Warning)
+		assert.Equal(t, []Reason{{
+			Code:       ReasonPreferredArchitectureUnavailable,
+			Summary:    "could not select preferred arch: amd64",
+			Containers: []ContainerArchitectures{{Container: "arm64-only", Image: "arm64-only", Architectures: []string{"arm64"}, Excludes: []string{"amd64"}}},
+		}}, d.Reasons)
+		assert.NotNil(t, d.Spec.Affinity)
+	})
+
+	t.Run("When the images have no common architecture, the pod is denied", func(t *testing.T) {
+		_, err := h.Decide(context.Background(), input("amd64-only", "arm64-only"))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,213 @@
+package arch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/registry"
+	"gomodules.xyz/jsonpatch/v2"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// podDecision is the outcome of the admission of a pod, replayed for the pods sharing the same decision inputs.
+type podDecision struct {
+	patches      []jsonpatch.JsonPatchOperation
+	warning      string
+	substitution string
+}
+
+type DecisionCacheOption func(*DecisionCache)
+
+// DecisionCache memoizes the admission decisions of pods sharing the same decision inputs, e.g. the replicas of a Deployment.
+// Decisions are keyed by a fingerprint of the pod template, of the namespace policy and, when rules are configured,
+// of the namespace labels, so that changes to those lead to new decisions.
+// Changes to other inputs, such as image platform overrides, require an invalidation.
+type DecisionCache struct {
+	cache      registry.Cache[podDecision]
+	generation atomic.Uint64
+	metrics    *registry.CacheMetrics
+}
+
+func NewDecisionCache(ttl time.Duration, opts ...DecisionCacheOption) *DecisionCache {
+	c := &DecisionCache{
+		metrics: registry.NewCacheMetrics("noe", "admission_decision"),
+	}
+	c.cache.CacheDuration = ttl
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func WithDecisionCacheMetricsRegistry(reg metrics.RegistererGatherer) DecisionCacheOption {
+	return func(c *DecisionCache) {
+		c.metrics.MustRegister(reg)
+	}
+}
+
+// WithDecisionCache memoizes the pod admission decisions in the cache.
+func WithDecisionCache(cache *DecisionCache) HandlerOption {
+	return func(h *Handler) {
+		h.decisions = cache
+	}
+}
+
+// Invalidate discards all the decisions taken so far.
+func (c *DecisionCache) Invalidate() {
+	c.generation.Add(1)
+}
+
+func (c *DecisionCache) load(fingerprint string) (podDecision, bool) {
+	c.metrics.Requests.WithLabelValues().Inc()
+	defer func() { go c.cache.CleanUp(time.Now()) }()
+	if d, ok := c.cache.Load(fingerprint); ok {
+		c.metrics.Responses.WithLabelValues("hit").Inc()
+		return *d, true
+	}
+	c.metrics.Responses.WithLabelValues("miss").Inc()
+	return podDecision{}, false
+}
+
+func (c *DecisionCache) store(fingerprint string, d podDecision) {
+	c.cache.Store(fingerprint, &d)
+}
+
+// decisionInputs are the inputs of a pod admission decision.
+type decisionInputs struct {
+	Generation               uint64            `json:"generation"`
+	Namespace                string            `json:"namespace"`
+	PreferredArchitecture    string            `json:"preferredArchitecture"`
+	SchedulableArchitectures []string          `json:"schedulableArchitectures"`
+	SystemOSes               []string          `json:"systemOSes"`
+	MatchNodeLabels          []string          `json:"matchNodeLabels"`
+	Registry                 string            `json:"registry"`
+	Labels                   map[string]string `json:"labels"`
+	Annotations              map[string]string `json:"annotations"`
+	NamespaceLabels          map[string]string `json:"namespaceLabels"`
+	Owners                   []decisionOwner   `json:"owners"`
+	Spec                     v1.PodSpec        `json:"spec"`
+}
+
+// decisionOwner is an owner of the pod, as seen by the architecture rules.
+type decisionOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// templateSpec returns the pod spec without the fields differing across the pods of the same template,
+// such as the service account token volume injected with a random name.
+// Only image volumes take part in the decision.
+func templateSpec(podSpec *v1.PodSpec) v1.PodSpec {
+	spec := *podSpec.DeepCopy()
+	spec.Volumes = slices.DeleteFunc(spec.Volumes, func(volume v1.Volume) bool {
+		return volume.Image == nil
+	})
+	for _, containers := range [][]v1.Container{spec.Containers, spec.InitContainers} {
+		for i := range containers {
+			containers[i].VolumeMounts = nil
+		}
+	}
+	for i := range spec.EphemeralContainers {
+		spec.EphemeralContainers[i].VolumeMounts = nil
+	}
+	spec.Hostname = ""
+	spec.Subdomain = ""
+	return spec
+}
+
+// decisionFingerprint returns the hash of the inputs of the pod admission decision.
+func (h *Handler) decisionFingerprint(ctx context.Context, pod *v1.Pod) (string, error) {
+	ctx, scoped := h.forNamespace(ctx, pod.Namespace)
+	inputs := decisionInputs{
+		Generation:               h.decisions.generation.Load(),
+		Namespace:                pod.Namespace,
+		PreferredArchitecture:    scoped.preferredArchitecture,
+		SchedulableArchitectures: scoped.schedulableArchitectures,
+		SystemOSes:               scoped.systemOSes,
+		MatchNodeLabels:          scoped.matchNodeLabels,
+		Labels:                   pod.Labels,
+		Annotations:              pod.Annotations,
+		Spec:                     templateSpec(&pod.Spec),
+	}
+	if config, ok := registry.ConfigFromContext(ctx); ok {
+		inputs.Registry = config.Key()
+	}
+	if len(h.rules) > 0 {
+		ns, err := h.getNamespace(ctx, pod.Namespace)
+		if err != nil {
+			return "", err
+		}
+		inputs.NamespaceLabels = ns.Labels
+		// rules can select the architectures from the pod owners, e.g. for Jobs
+		for _, owner := range pod.OwnerReferences {
+			inputs.Owners = append(inputs.Owners, decisionOwner{Kind: owner.Kind, Name: owner.Name})
+		}
+	}
+	b, err := json.Marshal(inputs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+func (d podDecision) response() admission.Response {
+	resp := admission.Patched("", slices.Clone(d.patches)...)
+	if d.warning != "" {
+		resp = resp.WithWarnings(d.warning)
+	}
+	return resp
+}
+
+// decisionState records whether the decision was taken with all the image platforms.
+type decisionState struct {
+	incomplete atomic.Bool
+}
+
+type decisionStateKey struct{}
+
+func withDecisionState(ctx context.Context) (context.Context, *decisionState) {
+	state := &decisionState{}
+	return context.WithValue(ctx, decisionStateKey{}, state), state
+}
+
+// markIncompleteDecision records that the decision was taken without the platforms of some images.
+func markIncompleteDecision(ctx context.Context) {
+	if state, ok := ctx.Value(decisionStateKey{}).(*decisionState); ok {
+		state.incomplete.Store(true)
+	}
+}
+
+// cachedPodDecision returns the fingerprint of the pod decision inputs and the decision previously taken for them.
+// Pods reading their architecture overlays from a ConfigMap are never memoized, as the ConfigMap content is not part of the fingerprint.
+func (h *Handler) cachedPodDecision(ctx context.Context, pod *v1.Pod) (string, podDecision, bool) {
+	if h.decisions == nil {
+		return "", podDecision{}, false
+	}
+	if _, ok := pod.Annotations[OverlaysConfigMapAnnotation]; ok {
+		return "", podDecision{}, false
+	}
+	fingerprint, err := h.decisionFingerprint(ctx, pod)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("unable to compute the pod decision fingerprint")
+		return "", podDecision{}, false
+	}
+	d, ok := h.decisions.load(fingerprint)
+	return fingerprint, d, ok
+}
+
+// storePodDecision memoizes the decision when it only depends on the fingerprinted inputs.
+func (h *Handler) storePodDecision(ctx context.Context, fingerprint string, state *decisionState, updated *v1.Pod, d podDecision) {
+	if fingerprint == "" || state.incomplete.Load() || HasSchedulingGate(updated) {
+		return
+	}
+	log.DefaultLogger.WithContext(ctx).Debug("memoizing the pod admission decision")
+	h.decisions.store(fingerprint, d)
+}
@@ -0,0 +1,108 @@
+package arch
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestHookReusesDecisionsOfIdenticalPods(t *testing.T) {
+	lookups := atomic.Int32{}
+	failing := atomic.Bool{}
+	newHandler := func(opts ...HandlerOption) (*Handler, *DecisionCache) {
+		lookups.Store(0)
+		failing.Store(false)
+		cache := NewDecisionCache(time.Minute)
+		return NewHandler(
+			fake.NewClientBuilder().Build(),
+			RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+				lookups.Add(1)
+				if failing.Load() {
+					return nil, assert.AnError
+				}
+				return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+			}),
+			append([]HandlerOption{WithOS("linux"), WithDecisionCache(cache)}, opts...)...,
+		), cache
+	}
+	replica := func(name string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, Labels: map[string]string{"app": "web"}},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{{
+					Name:         "app",
+					Image:        "ubuntu",
+					VolumeMounts: []v1.VolumeMount{{Name: "kube-api-access-" + name, MountPath: "/var/run/secrets"}},
+				}},
+				Volumes: []v1.Volume{{Name: "kube-api-access-" + name}},
+			},
+		}
+	}
+
+	t.Run("When replicas of the same template are admitted, the decision is computed once", func(t *testing.T) {
+		h, cache := newHandler()
+		first := runWebhookTest(t, h, replica("web-1"))
+		second := runWebhookTest(t, h, replica("web-2"))
+		assert.True(t, second.Allowed)
+		assert.NotEmpty(t, second.Patches)
+		assert.Equal(t, first.Patches, second.Patches)
+		assert.Equal(t, first.Patch, second.Patch)
+		assert.EqualValues(t, 1, lookups.Load())
+		assert.Equal(t, 1.0, testutil.ToFloat64(cache.metrics.Responses.WithLabelValues("hit")))
+		assert.Equal(t, 1.0, testutil.ToFloat64(cache.metrics.Responses.WithLabelValues("miss")))
+	})
+
+	t.Run("When the pod template differs, the decision is computed again", func(t *testing.T) {
+		h, _ := newHandler()
+		runWebhookTest(t, h, replica("web-1"))
+		other := replica("web-2")
+		other.Labels["version"] = "v2"
+		runWebhookTest(t, h, other)
+		assert.EqualValues(t, 2, lookups.Load())
+	})
+
+	t.Run("When rules are set and the pod owners differ, the decision is computed again", func(t *testing.T) {
+		rules, err := CompileRules([]Rule{{
+			Name:       "jobs-on-arm",
+			Effect:     RuleEffectPrefer,
+			Expression: `has(pod.metadata.ownerReferences) && pod.metadata.ownerReferences.exists(o, o.kind == "Job") ? ["arm64"] : []`,
+		}})
+		require.NoError(t, err)
+		h, _ := newHandler(WithRules(rules), WithNamespaceReader(fake.NewClientBuilder().WithObjects(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns"}}).Build()))
+		job := replica("web-1")
+		job.OwnerReferences = []metav1.OwnerReference{{Kind: "Job", Name: "web"}}
+		runWebhookTest(t, h, job)
+		replicaSet := replica("web-2")
+		replicaSet.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web"}}
+		runWebhookTest(t, h, replicaSet)
+		assert.EqualValues(t, 2, lookups.Load())
+	})
+
+	t.Run("When the cache is invalidated, the decision is computed again", func(t *testing.T) {
+		h, cache := newHandler()
+		runWebhookTest(t, h, replica("web-1"))
+		cache.Invalidate()
+		runWebhookTest(t, h, replica("web-2"))
+		assert.EqualValues(t, 2, lookups.Load())
+		assert.Equal(t, 2.0, testutil.ToFloat64(cache.metrics.Responses.WithLabelValues("miss")))
+	})
+
+	t.Run("When some image platforms could not be resolved, the decision is not reused", func(t *testing.T) {
+		h, _ := newHandler()
+		failing.Store(true)
+		runWebhookTest(t, h, replica("web-1"))
+		failing.Store(false)
+		resp := runWebhookTest(t, h, replica("web-2"))
+		assert.EqualValues(t, 2, lookups.Load())
+		assert.Contains(t, resp.Patches, archNodeSelectorPatchForArchs("arm64"))
+	})
+}
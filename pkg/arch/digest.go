@@ -0,0 +1,85 @@
+package arch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/adevinta/noe/pkg/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// WithDigestPinning pins the container images to the digest their tag resolved to when selecting the architecture,
+// so that the pulled content is the one the architecture was selected for.
+// The registry must record the digests (see registry.WithDigestResolution).
+func WithDigestPinning(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.pinDigests = enabled
+	}
+}
+
+// imageDigests returns, for each container, the digest of each image it may use.
+// Images published with architecture specific tags have one digest per tag.
+func imageDigests(images []imageArchResult) map[string]map[string]string {
+	r := map[string]map[string]string{}
+	for _, image := range images {
+		if image.container == "" || len(image.platforms) == 0 {
+			continue
+		}
+		digests := map[string]string{}
+		for _, platform := range image.platforms {
+			if platform.Digest == "" {
+				continue
+			}
+			if platform.Image != "" {
+				digests[platform.Image] = platform.Digest
+			} else {
+				digests[image.image] = platform.Digest
+			}
+		}
+		r[image.container] = digests
+	}
+	return r
+}
+
+// pinnedImage returns the image reference with both its tag and digest, e.g. ubuntu:22.04@sha256:...
+func pinnedImage(image, digest string) string {
+	if strings.LastIndex(image, ":") <= strings.LastIndex(image, "/") {
+		image += ":latest"
+	}
+	return image + "@" + digest
+}
+
+// pinImageDigests rewrites the container images to reference the digest their tag resolved to.
+// Images that are already referenced by digest are kept. A warning is returned for the images
+// whose digest is unknown, e.g. when their platforms are overridden.
+func (h *Handler) pinImageDigests(ctx context.Context, namespace string, podSpec *v1.PodSpec, images []imageArchResult) error {
+	if !h.pinDigests {
+		return nil
+	}
+	digests := imageDigests(images)
+	unpinned := []string{}
+	for _, containers := range [][]v1.Container{podSpec.Containers, podSpec.InitContainers} {
+		for i := range containers {
+			candidates, ok := digests[containers[i].Name]
+			if !ok || strings.Contains(containers[i].Image, "@") {
+				continue
+			}
+			digest, ok := candidates[containers[i].Image]
+			if !ok {
+				unpinned = append(unpinned, containers[i].Image)
+				continue
+			}
+			image := pinnedImage(containers[i].Image, digest)
+			log.DefaultLogger.WithContext(ctx).WithField("container", containers[i].Name).WithField("pinnedImage", image).Info("pinning image to its resolved digest")
+			containers[i].Image = image
+			h.metrics.ImagePinned.WithLabelValues(namespace).Inc()
+		}
+	}
+	if len(unpinned) > 0 {
+		log.DefaultLogger.WithContext(ctx).WithField("images", unpinned).Info("unknown image digests, keeping the images tags")
+		markIncompleteDecision(ctx)
+		return warning{msg: fmt.Sprintf("images %s could not be pinned to a digest", strings.Join(unpinned, ", "))}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package arch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func digestTestRegistry(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+	switch image {
+	case "vendor.io/product:1.2.3":
+		return []registry.Platform{
+			{Architecture: "amd64", Image: "vendor.io/product:1.2.3-amd64", Digest: "sha256:amd64-tag"},
+			{Architecture: "arm64", Image: "vendor.io/product:1.2.3-arm64", Digest: "sha256:arm64-tag"},
+		}, nil
+	case "neutral":
+		return []registry.Platform{}, nil
+	case "undigested":
+		return []registry.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}, nil
+	}
+	return []registry.Platform{
+		{OS: "linux", Architecture: "amd64", Digest: "sha256:" + image},
+		{OS: "linux", Architecture: "arm64", Digest: "sha256:" + image},
+	}, nil
+}
+
+func TestUpdatePodSpecPinsImageDigests(t *testing.T) {
+	t.Run("images are pinned to the digest their tag resolved to", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(digestTestRegistry), WithOS("linux"), WithArchitecture("arm64"), WithDigestPinning(true))
+		podSpec := &v1.PodSpec{
+			InitContainers: []v1.Container{{Name: "init", Image: "ubuntu"}},
+			Containers: []v1.Container{
+				{Name: "app", Image: "vendor.io/product:1.2.3"},
+				{Name: "sidecar", Image: "envoy:1.30"},
+				{Name: "pinned", Image: "envoy:1.30@sha256:user"},
+				{Name: "data", Image: "neutral"},
+			},
+		}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{"kubernetes.io/arch": "arm64"}, podSpec.NodeSelector)
+		assert.Equal(t, "ubuntu:latest@sha256:ubuntu", podSpec.InitContainers[0].Image)
+		assert.Equal(t, "vendor.io/product:1.2.3-arm64@sha256:arm64-tag", podSpec.Containers[0].Image)
+		assert.Equal(t, "envoy:1.30@sha256:envoy:1.30", podSpec.Containers[1].Image)
+		assert.Equal(t, "envoy:1.30@sha256:user", podSpec.Containers[2].Image)
+		assert.Equal(t, "neutral", podSpec.Containers[3].Image)
+		assert.Equal(t, 3.0, testutil.ToFloat64(h.metrics.ImagePinned.WithLabelValues("ns")))
+	})
+
+	t.Run("images are kept when digest pinning is disabled", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(digestTestRegistry), WithOS("linux"), WithArchitecture("arm64"))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "sidecar", Image: "envoy:1.30"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, "envoy:1.30", podSpec.Containers[0].Image)
+	})
+
+	t.Run("images with an unknown digest are kept with a warning", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(digestTestRegistry), WithOS("linux"), WithDigestPinning(true))
+		podSpec := &v1.PodSpec{
+			Containers: []v1.Container{{Name: "app", Image: "undigested"}, {Name: "sidecar", Image: "envoy:1.30"}},
+		}
+		err := h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec)
+		var warningErr warning
+		require.ErrorAs(t, err, &warningErr)
+		assert.Contains(t, err.Error(), "images undigested could not be pinned to a digest")
+		assert.Equal(t, "undigested", podSpec.Containers[0].Image)
+		assert.Equal(t, "envoy:1.30@sha256:envoy:1.30", podSpec.Containers[1].Image)
+	})
+}
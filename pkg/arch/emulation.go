@@ -0,0 +1,167 @@
+package arch
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/adevinta/noe/pkg/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EmulatesLabel is the node label declaring the foreign architecture a node can execute
+// through binfmt_misc handlers (e.g. QEMU), e.g. noe.adevinta.com/emulates: amd64
+const EmulatesLabel = "noe.adevinta.com/emulates"
+
+// EmulationAnnotation records on the pod the architectures Noe allowed to be emulated.
+const EmulationAnnotation = "arch.noe.adevinta.com/emulation"
+
+// NativeArchitectureWeight is the weight of the preferred affinity favouring nodes running
+// all the images natively over nodes emulating some of them.
+const NativeArchitectureWeight = 100
+
+type EmulationMode string
+
+const (
+	// EmulationDisabled never schedules pods on nodes emulating an architecture.
+	EmulationDisabled EmulationMode = "disabled"
+	// EmulationFallback schedules pods on emulating nodes only when images have no common architecture.
+	EmulationFallback EmulationMode = "fallback"
+	// EmulationAllow also considers emulating nodes when images have a common architecture,
+	// native nodes being preferred.
+	EmulationAllow EmulationMode = "allow"
+)
+
+func ParseEmulationMode(mode string) (EmulationMode, error) {
+	switch EmulationMode(mode) {
+	case "", EmulationDisabled:
+		return EmulationDisabled, nil
+	case EmulationFallback, EmulationAllow:
+		return EmulationMode(mode), nil
+	}
+	return EmulationDisabled, fmt.Errorf("unsupported emulation mode %q, expecting one of %s, %s, %s", mode, EmulationDisabled, EmulationFallback, EmulationAllow)
+}
+
+// WithEmulation configures when pods can be scheduled on nodes emulating an architecture.
+func WithEmulation(mode EmulationMode) HandlerOption {
+	return func(h *Handler) {
+		h.emulation = mode
+	}
+}
+
+// emulationTerms returns the node selector terms matching nodes able to run all the images,
+// natively or by emulating an architecture, along with the emulated architectures.
+// imageArchitectures holds the architectures supported by each non architecture neutral image.
+// Like the native terms, emulation terms require the OS of the pod and the CPU features of the images run natively.
+func (h *Handler) emulationTerms(ctx context.Context, os string, podSpec *v1.PodSpec, images []imageArchResult, imageArchitectures []map[string]struct{}) ([]v1.NodeSelectorTerm, []string) {
+	runnable := []imageArchResult{}
+	for _, image := range images {
+		if len(image.platforms) > 0 {
+			runnable = append(runnable, image)
+		}
+	}
+	all := map[string]struct{}{}
+	for _, archs := range imageArchitectures {
+		for arch := range archs {
+			all[arch] = struct{}{}
+		}
+	}
+	osRequirements, err := h.osRequirements(os, podSpec, images, all)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Println("no OS requirement matching all images, skipping emulation")
+		return nil, nil
+	}
+	terms := []v1.NodeSelectorTerm{}
+	emulated := []string{}
+	for _, emulatedArch := range keys(all) {
+		// The node native architecture must run the images not supporting the emulated architecture
+		var native map[string]struct{}
+		nativeImages := []imageArchResult{}
+		for i, archs := range imageArchitectures {
+			if _, ok := archs[emulatedArch]; ok {
+				continue
+			}
+			nativeImages = append(nativeImages, runnable[i])
+			if native == nil {
+				native = maps.Clone(archs)
+				continue
+			}
+			for arch := range native {
+				if _, ok := archs[arch]; !ok {
+					delete(native, arch)
+				}
+			}
+		}
+		emulates := v1.NodeSelectorRequirement{
+			Key:      EmulatesLabel,
+			Operator: v1.NodeSelectorOpIn,
+			Values:   []string{emulatedArch},
+		}
+		if native == nil {
+			terms = append(terms, v1.NodeSelectorTerm{
+				MatchExpressions: append([]v1.NodeSelectorRequirement{emulates}, osRequirements...),
+			})
+			emulated = append(emulated, emulatedArch)
+			continue
+		}
+		for arch := range native {
+			if !h.isArchSupported(arch) {
+				delete(native, arch)
+			}
+		}
+		if len(native) == 0 {
+			continue
+		}
+		for _, term := range architectureTerms(keys(native), osRequirements, h.cpuFeatureRequirements(os, nativeImages, native)) {
+			term.MatchExpressions = append([]v1.NodeSelectorRequirement{emulates}, term.MatchExpressions...)
+			terms = append(terms, term)
+		}
+		emulated = append(emulated, emulatedArch)
+	}
+	return terms, emulated
+}
+
+// injectEmulation requires the pod to match one of the terms, which include the emulation ones,
+// and records the emulated architectures in the pod annotations.
+func injectEmulation(meta *metav1.ObjectMeta, podSpec *v1.PodSpec, terms []v1.NodeSelectorTerm, emulated []string) {
+	addRequiredTerms(podSpec, terms)
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[EmulationAnnotation] = strings.Join(emulated, ",")
+}
+
+// preferNativeArchitectures penalises emulating nodes by preferring nodes running the architectures natively.
+func preferNativeArchitectures(podSpec *v1.PodSpec, archs []string) {
+	ensureRequiredNodeSelector(podSpec)
+	podSpec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(
+		podSpec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+		v1.PreferredSchedulingTerm{
+			Weight: NativeArchitectureWeight,
+			Preference: v1.NodeSelectorTerm{
+				MatchExpressions: []v1.NodeSelectorRequirement{
+					{
+						Key:      archKey,
+						Operator: v1.NodeSelectorOpIn,
+						Values:   archs,
+					},
+				},
+			},
+		},
+	)
+}
+
+func ensureRequiredNodeSelector(podSpec *v1.PodSpec) *v1.NodeSelector {
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &v1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity == nil {
+		podSpec.Affinity.NodeAffinity = &v1.NodeAffinity{}
+	}
+	if podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &v1.NodeSelector{}
+	}
+	return podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+}
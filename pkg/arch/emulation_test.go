@@ -0,0 +1,175 @@
+package arch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func emulationTestRegistry(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+	switch image {
+	case "amd64-only":
+		return []registry.Platform{{OS: "linux", Architecture: "amd64"}}, nil
+	case "arm64-only":
+		return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+	}
+	return []registry.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}, nil
+}
+
+func emulationTerm(emulated string, native ...string) v1.NodeSelectorTerm {
+	term := v1.NodeSelectorTerm{
+		MatchExpressions: []v1.NodeSelectorRequirement{
+			{Key: EmulatesLabel, Operator: v1.NodeSelectorOpIn, Values: []string{emulated}},
+		},
+	}
+	if len(native) > 0 {
+		term.MatchExpressions = append(term.MatchExpressions, v1.NodeSelectorRequirement{Key: archKey, Operator: v1.NodeSelectorOpIn, Values: native})
+	}
+	return term
+}
+
+func TestParseEmulationMode(t *testing.T) {
+	mode, err := ParseEmulationMode("")
+	require.NoError(t, err)
+	assert.Equal(t, EmulationDisabled, mode)
+	mode, err = ParseEmulationMode("fallback")
+	require.NoError(t, err)
+	assert.Equal(t, EmulationFallback, mode)
+	_, err = ParseEmulationMode("always")
+	assert.Error(t, err)
+}
+
+func TestUpdatePodSpecWithEmulation(t *testing.T) {
+	t.Run("when disabled, pods without common architecture are rejected", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "amd64-only"}, {Image: "arm64-only"}}}
+		assert.Error(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+	})
+
+	t.Run("in fallback mode, nodes emulating the missing architecture are selected", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"), WithEmulation(EmulationFallback))
+		meta := &metav1.ObjectMeta{}
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "amd64-only"}, {Image: "arm64-only"}}}
+		err := h.updatePodSpec(context.Background(), "ns", meta, podSpec)
+		var warningErr warning
+		require.ErrorAs(t, err, &warningErr)
+		assert.Equal(
+			t,
+			requiredAffinity(emulationTerm("amd64", "arm64"), emulationTerm("arm64", "amd64")),
+			podSpec.Affinity,
+		)
+		assert.Equal(t, "amd64,arm64", meta.Annotations[EmulationAnnotation])
+		assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.EmulationInjected.WithLabelValues("ns", "fallback")))
+	})
+
+	t.Run("in fallback mode, pods with a common architecture run natively", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"), WithEmulation(EmulationFallback))
+		meta := &metav1.ObjectMeta{}
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "amd64-only"}, {Image: "multi-arch"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("amd64")), podSpec.Affinity)
+		assert.NotContains(t, meta.Annotations, EmulationAnnotation)
+	})
+
+	t.Run("in allow mode, native nodes are preferred", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"), WithEmulation(EmulationAllow))
+		meta := &metav1.ObjectMeta{}
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "amd64-only"}, {Image: "multi-arch"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+		require.NotNil(t, podSpec.Affinity)
+		assert.Equal(
+			t,
+			[]v1.NodeSelectorTerm{archNodeSelectorTerm("amd64"), emulationTerm("amd64"), emulationTerm("arm64", "amd64")},
+			podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms,
+		)
+		assert.Equal(
+			t,
+			[]v1.PreferredSchedulingTerm{{Weight: NativeArchitectureWeight, Preference: archNodeSelectorTerm("amd64")}},
+			podSpec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+		)
+		assert.Equal(t, "amd64,arm64", meta.Annotations[EmulationAnnotation])
+	})
+
+	t.Run("emulation is only selected for schedulable native architectures", func(t *testing.T) {
+		h := NewHandler(
+			fake.NewClientBuilder().Build(),
+			RegistryFunc(emulationTestRegistry),
+			WithOS("linux"),
+			WithEmulation(EmulationFallback),
+			WithSchedulableArchitectures([]string{"arm64"}),
+		)
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "amd64-only"}, {Image: "arm64-only"}}}
+		err := h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec)
+		var warningErr warning
+		require.ErrorAs(t, err, &warningErr)
+		assert.Equal(t, requiredAffinity(emulationTerm("amd64", "arm64")), podSpec.Affinity)
+	})
+
+	t.Run("emulation terms require the OS and the CPU features of the images run natively", func(t *testing.T) {
+		h := NewHandler(
+			fake.NewClientBuilder().Build(),
+			RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+				switch image {
+				case "amd64-avx512":
+					return []registry.Platform{{OS: "linux", Architecture: "amd64", Features: []string{"AVX512F"}}}, nil
+				}
+				return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+			}),
+			WithOS("linux,windows"),
+			WithEmulation(EmulationFallback),
+			WithCPUFeatureLabels(DefaultCPUFeatureLabels),
+		)
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "amd64-avx512"}, {Image: "arm64-only"}}}
+		err := h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec)
+		var warningErr warning
+		require.ErrorAs(t, err, &warningErr)
+		linux := v1.NodeSelectorRequirement{Key: osKey, Operator: v1.NodeSelectorOpIn, Values: []string{"linux"}}
+		avx512 := v1.NodeSelectorRequirement{Key: nfdCPUIDPrefix + "AVX512F", Operator: v1.NodeSelectorOpExists}
+		assert.Equal(
+			t,
+			requiredAffinity(
+				v1.NodeSelectorTerm{MatchExpressions: append(emulationTerm("amd64", "arm64").MatchExpressions, linux)},
+				v1.NodeSelectorTerm{MatchExpressions: append(emulationTerm("arm64", "amd64").MatchExpressions, linux, avx512)},
+			),
+			podSpec.Affinity,
+		)
+	})
+}
+
+func TestUpdatePodTemplateRecomputesEmulation(t *testing.T) {
+	images := map[string][]registry.Platform{}
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			return images[image], nil
+		}),
+		WithOS("linux"),
+		WithEmulation(EmulationAllow),
+	)
+	images["app"] = []registry.Platform{{OS: "linux", Architecture: "amd64"}}
+	meta := &metav1.ObjectMeta{}
+	podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "app"}}}
+	require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+	require.Len(t, preferredSchedulingTerms(podSpec), 1)
+	assert.Equal(t, "amd64", meta.Annotations[EmulationAnnotation])
+
+	images["app"] = []registry.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+	require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+	assert.Equal(
+		t,
+		[]v1.NodeSelectorTerm{archNodeSelectorTerm("amd64", "arm64"), emulationTerm("amd64"), emulationTerm("arm64")},
+		requiredNodeSelectorTerms(podSpec),
+	)
+	assert.Len(t, preferredSchedulingTerms(podSpec), 1)
+	assert.Equal(t, "amd64,arm64", meta.Annotations[EmulationAnnotation])
+}
@@ -0,0 +1,343 @@
+package arch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/adevinta/noe/pkg/httputils"
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/registry"
+	"gomodules.xyz/jsonpatch/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Sources of the preferred architecture reported by the explanations.
+const (
+	PreferenceSourceLabel   = "label"
+	PreferenceSourcePolicy  = "policy"
+	PreferenceSourceRule    = "rule"
+	PreferenceSourceDefault = "default"
+)
+
+// Sources of the image platforms reported by the explanations.
+const (
+	PlatformSourceRegistry   = "registry"
+	PlatformSourceAnnotation = "annotation"
+	PlatformSourceIgnored    = "ignored"
+)
+
+// ErrInvalidObject is returned when the explained object can't be decoded.
+var ErrInvalidObject = errors.New("invalid object")
+
+// ErrForbidden is returned when the user requesting the explanation is not allowed to see it.
+var ErrForbidden = errors.New("forbidden")
+
+// maxExplainRequestSize bounds the size of the explain requests, in line with the API server object size limit.
+const maxExplainRequestSize = 3 * 1024 * 1024
+
+// ExplainRequest asks what Noe would do with a pod, without creating anything.
+// Object is a Pod, a workload with a pod template (Deployment, StatefulSet, DaemonSet, ReplicaSet, Job or CronJob),
+// or a bare PodSpec, identified by the lack of kind.
+// Namespace defaults to the namespace of the object, then to the default namespace.
+type ExplainRequest struct {
+	Namespace string          `json:"namespace,omitempty"`
+	Object    json.RawMessage `json:"object"`
+}
+
+// ImageExplanation describes the platforms of an image of the pod.
+type ImageExplanation struct {
+	// Container is the name of the container running the image. It is empty for image volumes.
+	Container  string              `json:"container,omitempty"`
+	Image      string              `json:"image"`
+	Source     string              `json:"source"`
+	Platforms  []registry.Platform `json:"platforms,omitempty"`
+	Resolution registry.Resolution `json:"resolution"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// Explanation describes the decision Noe takes for a pod.
+type Explanation struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	// Skipped is the reason why Noe leaves the pod untouched, if any.
+	Skipped string             `json:"skipped,omitempty"`
+	Images  []ImageExplanation `json:"images"`
+	OS      string             `json:"os,omitempty"`
+	// CommonArchitectures is the intersection of the architectures of all the images, restricted by the rules,
+	// and to a single architecture for the images with architecture specific tags.
+	CommonArchitectures   []string `json:"commonArchitectures"`
+	PreferredArchitecture string   `json:"preferredArchitecture,omitempty"`
+	PreferenceSource      string   `json:"preferenceSource,omitempty"`
+	// Patch is the JSON patch Noe would apply to the object.
+	Patch   []jsonpatch.JsonPatchOperation `json:"patch"`
+	Warning string                         `json:"warning,omitempty"`
+	// Denied is the reason why Noe would deny the pod, if any.
+	Denied string `json:"denied,omitempty"`
+	// Reasons are the structured reasons of the warning or of the denial.
+	Reasons []Reason `json:"reasons,omitempty"`
+
+	trace            *registry.ResolutionTrace
+	policyPreference bool
+}
+
+type explanationKey struct{}
+
+// explanationFromContext returns the explanation being collected, nil when the decision is not explained.
+func explanationFromContext(ctx context.Context) *Explanation {
+	e, _ := ctx.Value(explanationKey{}).(*Explanation)
+	return e
+}
+
+func (e *Explanation) skip(reason string) {
+	if e == nil {
+		return
+	}
+	e.Skipped = reason
+}
+
+func (e *Explanation) image(image podImage, source string, platforms []registry.Platform, err error) {
+	if e == nil {
+		return
+	}
+	explained := ImageExplanation{
+		Container: image.container,
+		Image:     image.image,
+		Source:    source,
+		Platforms: platforms,
+	}
+	if source == PlatformSourceRegistry && e.trace != nil {
+		explained.Resolution, _ = e.trace.Get(image.image)
+	}
+	if err != nil {
+		explained.Error = err.Error()
+	}
+	e.Images = append(e.Images, explained)
+}
+
+// preferenceFromPolicy records that the default preferred architecture comes from the namespace policy.
+func (e *Explanation) preferenceFromPolicy() {
+	if e == nil {
+		return
+	}
+	e.policyPreference = true
+}
+
+func (e *Explanation) preference(arch, source string) {
+	if e == nil {
+		return
+	}
+	if source == PreferenceSourceDefault && e.policyPreference {
+		source = PreferenceSourcePolicy
+	}
+	e.PreferredArchitecture, e.PreferenceSource = arch, source
+}
+
+func (e *Explanation) selection(os string, commonArchitectures map[string]struct{}) {
+	if e == nil {
+		return
+	}
+	e.OS = os
+	e.CommonArchitectures = keys(commonArchitectures)
+	slices.Sort(e.CommonArchitectures)
+}
+
+// explainedTemplate locates the pod template of an explained object.
+type explainedTemplate struct {
+	kind      string
+	namespace string
+	meta      *metav1.ObjectMeta
+	spec      *v1.PodSpec
+	metaPath  string
+	specPath  string
+}
+
+func decodeExplainedObject(raw []byte) (explainedTemplate, error) {
+	typeMeta := metav1.TypeMeta{}
+	if err := json.Unmarshal(raw, &typeMeta); err != nil {
+		return explainedTemplate{}, err
+	}
+	var template explainedTemplate
+	var err error
+	switch typeMeta.Kind {
+	case "":
+		spec := &v1.PodSpec{}
+		err = json.Unmarshal(raw, spec)
+		// bare pod specs are explained as pods
+		template = explainedTemplate{kind: "PodSpec", meta: &metav1.ObjectMeta{}, spec: spec, metaPath: "/metadata", specPath: "/spec"}
+	case "Pod":
+		pod := &v1.Pod{}
+		err = json.Unmarshal(raw, pod)
+		template = explainedTemplate{namespace: pod.Namespace, meta: &pod.ObjectMeta, spec: &pod.Spec, metaPath: "/metadata", specPath: "/spec"}
+	case "Deployment":
+		obj := &appsv1.Deployment{}
+		err = json.Unmarshal(raw, obj)
+		template = explainedTemplate{namespace: obj.Namespace, meta: &obj.Spec.Template.ObjectMeta, spec: &obj.Spec.Template.Spec}
+	case "StatefulSet":
+		obj := &appsv1.StatefulSet{}
+		err = json.Unmarshal(raw, obj)
+		template = explainedTemplate{namespace: obj.Namespace, meta: &obj.Spec.Template.ObjectMeta, spec: &obj.Spec.Template.Spec}
+	case "DaemonSet":
+		obj := &appsv1.DaemonSet{}
+		err = json.Unmarshal(raw, obj)
+		template = explainedTemplate{namespace: obj.Namespace, meta: &obj.Spec.Template.ObjectMeta, spec: &obj.Spec.Template.Spec}
+	case "ReplicaSet":
+		obj := &appsv1.ReplicaSet{}
+		err = json.Unmarshal(raw, obj)
+		template = explainedTemplate{namespace: obj.Namespace, meta: &obj.Spec.Template.ObjectMeta, spec: &obj.Spec.Template.Spec}
+	case "Job":
+		obj := &batchv1.Job{}
+		err = json.Unmarshal(raw, obj)
+		template = explainedTemplate{namespace: obj.Namespace, meta: &obj.Spec.Template.ObjectMeta, spec: &obj.Spec.Template.Spec}
+	case "CronJob":
+		obj := &batchv1.CronJob{}
+		err = json.Unmarshal(raw, obj)
+		template = explainedTemplate{namespace: obj.Namespace, meta: &obj.Spec.JobTemplate.Spec.Template.ObjectMeta, spec: &obj.Spec.JobTemplate.Spec.Template.Spec, metaPath: "/spec/jobTemplate/spec/template/metadata", specPath: "/spec/jobTemplate/spec/template/spec"}
+	default:
+		return explainedTemplate{}, fmt.Errorf("unsupported kind %s", typeMeta.Kind)
+	}
+	if err != nil {
+		return explainedTemplate{}, err
+	}
+	if template.kind == "" {
+		template.kind = typeMeta.Kind
+	}
+	if template.metaPath == "" {
+		template.metaPath, template.specPath = "/spec/template/metadata", "/spec/template/spec"
+	}
+	return template, nil
+}
+
+// Explain runs the decision path on the object of the request, without admitting anything,
+// and reports the platforms of the images, how they were resolved and the resulting patch.
+// Unlike the admissions, explanations wait for the platforms of all the images rather than deferring the pod scheduling,
+// and don't use the admission decision cache.
+// When the context holds the user of the request (see httputils.RequireAuthorization), the user must be allowed
+// to create pods in the namespace, and to get the ConfigMap holding the architecture overlays, if any.
+func (h *Handler) Explain(ctx context.Context, req ExplainRequest) (Explanation, error) {
+	template, err := decodeExplainedObject(req.Object)
+	if err != nil {
+		return Explanation{}, fmt.Errorf("%w: %w", ErrInvalidObject, err)
+	}
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = template.namespace
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	if err := h.authorizeExplanation(ctx, namespace, template.meta); err != nil {
+		return Explanation{}, err
+	}
+	ctx, trace := registry.ContextWithResolutionTrace(ctx)
+	explanation := &Explanation{
+		Kind:                template.kind,
+		Namespace:           namespace,
+		Images:              []ImageExplanation{},
+		CommonArchitectures: []string{},
+		trace:               trace,
+	}
+	ctx = context.WithValue(ctx, explanationKey{}, explanation)
+
+	decision, err := h.Decide(ctx, DecisionInput{Namespace: namespace, ObjectMeta: *template.meta, Spec: *template.spec, DaemonSet: template.kind == "DaemonSet"})
+	switch {
+	case errors.Is(err, registry.ErrOverloaded):
+		explanation.skip("overloaded")
+	case err != nil:
+		explanation.Denied = err.Error()
+	}
+	explanation.Warning = decision.Warning
+	explanation.Reasons = decision.Reasons
+	slices.SortStableFunc(explanation.Images, func(a, b ImageExplanation) int {
+		return strings.Compare(a.Container+"\x00"+a.Image, b.Container+"\x00"+b.Image)
+	})
+	explanation.Patch = []jsonpatch.JsonPatchOperation{}
+	if err == nil {
+		explanation.Patch, err = decision.Patch(template.metaPath, template.specPath)
+		if err != nil {
+			return Explanation{}, err
+		}
+	}
+	return *explanation, nil
+}
+
+// authorizeExplanation checks the user of the request can create the explained pod,
+// and read the overlays the explanation would reveal.
+func (h *Handler) authorizeExplanation(ctx context.Context, namespace string, meta *metav1.ObjectMeta) error {
+	user, ok := httputils.UserFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	required := []authorizationv1.ResourceAttributes{{Namespace: namespace, Verb: "create", Resource: "pods"}}
+	if name, ok := meta.Annotations[OverlaysConfigMapAnnotation]; ok {
+		required = append(required, authorizationv1.ResourceAttributes{Namespace: namespace, Verb: "get", Resource: "configmaps", Name: name})
+	}
+	for _, attributes := range required {
+		allowed, err := httputils.AuthorizeResource(ctx, h.Client, user, attributes)
+		if err != nil {
+			return fmt.Errorf("failed to authorize the explanation: %w", err)
+		}
+		if !allowed {
+			resource := attributes.Resource
+			if attributes.Name != "" {
+				resource += "/" + attributes.Name
+			}
+			return fmt.Errorf("%w: user %s can not %s %s in namespace %s", ErrForbidden, user.Username, attributes.Verb, resource, namespace)
+		}
+	}
+	return nil
+}
+
+// ExplainHandler serves the explanations of the JSON encoded ExplainRequests POSTed to it.
+// It doesn't authenticate the requests, it is meant to be wrapped by an authorizing handler.
+func (h *Handler) ExplainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxExplainRequestSize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read the request: %v", err), http.StatusBadRequest)
+			return
+		}
+		req := ExplainRequest{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode the request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(req.Object) == 0 {
+			http.Error(w, "missing object", http.StatusBadRequest)
+			return
+		}
+		explanation, err := h.Explain(ctx, req)
+		if err != nil {
+			if errors.Is(err, ErrInvalidObject) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, ErrForbidden) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			log.DefaultLogger.WithContext(ctx).WithError(err).Warn("failed to explain the decision")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(explanation); err != nil {
+			log.DefaultLogger.WithContext(ctx).WithError(err).Warn("failed to write the explanation")
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package arch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adevinta/noe/pkg/httputils"
+	"github.com/adevinta/noe/pkg/policy"
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gomodules.xyz/jsonpatch/v2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestExplain(t *testing.T) {
+	policies := policy.NewStore(fake.NewClientBuilder().WithObjects(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "arm-team", Labels: map[string]string{"team": "arm"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+	).Build())
+	policies.Set(policy.NamedPolicy{
+		Name:              "arm",
+		NamespaceSelector: labels.SelectorFromSet(labels.Set{"team": "arm"}),
+		Policy:            policy.Policy{PreferredArchitecture: "arm64"},
+	})
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		registry.NewCachedRegistry(RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			switch image {
+			case "amd64-only":
+				return []registry.Platform{{OS: "linux", Architecture: "amd64"}}, nil
+			case "arm64-only":
+				return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+			case "broken":
+				return nil, assert.AnError
+			}
+			return []registry.Platform{{OS: "linux", Architecture: "arm64"}, {OS: "linux", Architecture: "amd64"}}, nil
+		}), time.Hour),
+		WithOS("linux"),
+		WithArchitecture("amd64"),
+		WithPolicies(policies),
+		WithIgnoredImages([]string{"ignored/*"}),
+	)
+	explain := func(t *testing.T, namespace, object string) Explanation {
+		t.Helper()
+		explanation, err := h.Explain(context.Background(), ExplainRequest{Namespace: namespace, Object: json.RawMessage(object)})
+		require.NoError(t, err)
+		return explanation
+	}
+
+	t.Run("When a pod is explained, the images, the intersection and the patch are reported", func(t *testing.T) {
+		explanation := explain(t, "", `{"kind":"Pod","metadata":{"namespace":"arm-team"},"spec":{"containers":[{"name":"app","image":"ubuntu"},{"name":"proxy","image":"ignored/envoy"}]}}`)
+		assert.Equal(t, "Pod", explanation.Kind)
+		assert.Equal(t, "arm-team", explanation.Namespace)
+		assert.Equal(t, []ImageExplanation{
+			{Container: "app", Image: "ubuntu", Source: PlatformSourceRegistry, Platforms: []registry.Platform{{OS: "linux", Architecture: "arm64"}, {OS: "linux", Architecture: "amd64"}}},
+			{Container: "proxy", Image: "ignored/envoy", Source: PlatformSourceIgnored},
+		}, explanation.Images)
+		assert.Equal(t, "linux", explanation.OS)
+		assert.Equal(t, []string{"amd64", "arm64"}, explanation.CommonArchitectures)
+		assert.Equal(t, "arm64", explanation.PreferredArchitecture)
+		assert.Equal(t, PreferenceSourcePolicy, explanation.PreferenceSource)
+		assert.Contains(t, explanation.Patch, jsonpatch.JsonPatchOperation{Operation: "add", Path: "/spec/nodeSelector", Value: map[string]interface{}{archKey: "arm64"}})
+	})
+
+	t.Run("When the platforms were already resolved, the cached resolution is reported", func(t *testing.T) {
+		explanation := explain(t, "arm-team", `{"kind":"Pod","spec":{"containers":[{"name":"app","image":"ubuntu"}]}}`)
+		require.Len(t, explanation.Images, 1)
+		assert.True(t, explanation.Images[0].Resolution.Cached)
+	})
+
+	t.Run("When a workload is explained, the patch targets its pod template", func(t *testing.T) {
+		explanation := explain(t, "", `{"kind":"Deployment","spec":{"template":{"metadata":{"labels":{"arch.noe.adevinta.com/preferred":"arm64"}},"spec":{"containers":[{"name":"app","image":"ubuntu"}]}}}}`)
+		assert.Equal(t, "default", explanation.Namespace)
+		assert.Equal(t, PreferenceSourceLabel, explanation.PreferenceSource)
+		assert.Contains(t, explanation.Patch, jsonpatch.JsonPatchOperation{Operation: "add", Path: "/spec/template/spec/nodeSelector", Value: map[string]interface{}{archKey: "arm64"}})
+	})
+
+	t.Run("When a bare pod spec is explained, it is explained as a pod", func(t *testing.T) {
+		explanation := explain(t, "default", `{"containers":[{"name":"app","image":"ubuntu"}]}`)
+		assert.Equal(t, "PodSpec", explanation.Kind)
+		assert.Equal(t, PreferenceSourceDefault, explanation.PreferenceSource)
+		assert.Contains(t, explanation.Patch, jsonpatch.JsonPatchOperation{Operation: "add", Path: "/spec/nodeSelector", Value: map[string]interface{}{archKey: "amd64"}})
+	})
+
+	t.Run("When the platforms of an image can't be listed, the error is reported", func(t *testing.T) {
+		explanation := explain(t, "default", `{"containers":[{"name":"app","image":"amd64-only"},{"name":"side","image":"broken"}]}`)
+		assert.Equal(t, assert.AnError.Error(), explanation.Images[1].Error)
+		assert.Equal(t, []string{"amd64"}, explanation.CommonArchitectures)
+	})
+
+	t.Run("When the images have no common architecture, the denial is reported", func(t *testing.T) {
+		explanation := explain(t, "default", `{"containers":[{"name":"app","image":"amd64-only"},{"name":"side","image":"arm64-only"}]}`)
+		assert.Empty(t, explanation.Patch)
+		assert.Empty(t, explanation.CommonArchitectures)
+		assert.Equal(t, "could not find a common image architecture across all containers (excluded by app, side); container architectures: app (amd64-only) amd64; side (arm64-only) arm64", explanation.Denied)
+		require.Len(t, explanation.Reasons, 1)
+		assert.Equal(t, ReasonNoCommonArchitecture, explanation.Reasons[0].Code)
+	})
+
+	t.Run("When the object kind is not supported, the request is invalid", func(t *testing.T) {
+		_, err := h.Explain(context.Background(), ExplainRequest{Object: json.RawMessage(`{"kind":"Service"}`)})
+		assert.ErrorIs(t, err, ErrInvalidObject)
+	})
+
+	t.Run("When the explanation is requested over HTTP, it is returned as JSON", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ExplainHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/explain", strings.NewReader(`{"namespace":"default","object":{"containers":[{"name":"app","image":"ubuntu"}]}}`)))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		explanation := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &explanation))
+		assert.Equal(t, "default", explanation["preferenceSource"])
+		assert.NotEmpty(t, explanation["patch"])
+
+		w = httptest.NewRecorder()
+		h.ExplainHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/explain", strings.NewReader(`{"namespace":"default"}`)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = httptest.NewRecorder()
+		h.ExplainHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/explain", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+
+	t.Run("When the explanation is requested by a user, the user must be allowed to create the pod and read its overlays", func(t *testing.T) {
+		reviewed := []authorizationv1.ResourceAttributes{}
+		h := NewHandler(
+			fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+				Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+					review := obj.(*authorizationv1.SubjectAccessReview)
+					attributes := review.Spec.ResourceAttributes
+					reviewed = append(reviewed, *attributes)
+					review.Status.Allowed = review.Spec.User == "alice" && (attributes.Resource == "pods" || attributes.Name == "shared-overlays")
+					return nil
+				},
+			}).Build(),
+			h.Registry,
+			WithOS("linux"),
+			WithArchitecture("amd64"),
+		)
+		pod := `{"kind":"Pod","metadata":{"annotations":{"arch.noe.adevinta.com/overlays-configmap":"%s"}},"spec":{"containers":[{"name":"app","image":"ubuntu"}]}}`
+		explain := func(user, configMap string) error {
+			ctx := httputils.ContextWithUser(context.Background(), authenticationv1.UserInfo{Username: user})
+			_, err := h.Explain(ctx, ExplainRequest{Namespace: "team", Object: json.RawMessage(fmt.Sprintf(pod, configMap))})
+			return err
+		}
+
+		assert.NoError(t, explain("alice", "shared-overlays"))
+		assert.Equal(t, []authorizationv1.ResourceAttributes{
+			{Namespace: "team", Verb: "create", Resource: "pods"},
+			{Namespace: "team", Verb: "get", Resource: "configmaps", Name: "shared-overlays"},
+		}, reviewed)
+
+		err := explain("alice", "secret-overlays")
+		assert.ErrorIs(t, err, ErrForbidden)
+		assert.ErrorContains(t, err, "can not get configmaps/secret-overlays in namespace team")
+
+		err = explain("bob", "shared-overlays")
+		assert.ErrorIs(t, err, ErrForbidden)
+		assert.ErrorContains(t, err, "can not create pods in namespace team")
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/explain", strings.NewReader(`{"namespace":"team","object":{"containers":[{"name":"app","image":"ubuntu"}]}}`))
+		h.ExplainHandler().ServeHTTP(w, req.WithContext(httputils.ContextWithUser(req.Context(), authenticationv1.UserInfo{Username: "bob"})))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
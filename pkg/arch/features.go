@@ -0,0 +1,167 @@
+package arch
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/adevinta/noe/pkg/registry"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// CPUFeatureLabels maps the CPU requirements of images to the Node Feature Discovery labels
+// nodes must have to run them.
+// Keys are either a platform feature, e.g. avx2, or an architecture variant, e.g. amd64/v3.
+type CPUFeatureLabels map[string][]string
+
+const nfdCPUIDPrefix = "feature.node.kubernetes.io/cpu-cpuid."
+
+func cpuidLabels(features ...string) []string {
+	r := []string{}
+	for _, feature := range features {
+		r = append(r, nfdCPUIDPrefix+feature)
+	}
+	return r
+}
+
+var (
+	amd64V2Features = []string{"CX16", "POPCNT", "SSE3", "SSE4", "SSE42", "SSSE3"}
+	amd64V3Features = slices.Concat(amd64V2Features, []string{"AVX", "AVX2", "BMI1", "BMI2", "F16C", "FMA3", "LZCNT", "MOVBE"})
+	amd64V4Features = slices.Concat(amd64V3Features, []string{"AVX512BW", "AVX512CD", "AVX512DQ", "AVX512F", "AVX512VL"})
+)
+
+// DefaultCPUFeatureLabels maps the amd64 microarchitecture levels and the common x86 features
+// to the labels published by Node Feature Discovery.
+var DefaultCPUFeatureLabels = CPUFeatureLabels{
+	"amd64/v2":   cpuidLabels(amd64V2Features...),
+	"amd64/v3":   cpuidLabels(amd64V3Features...),
+	"amd64/v4":   cpuidLabels(amd64V4Features...),
+	"avx":        cpuidLabels("AVX"),
+	"avx2":       cpuidLabels("AVX2"),
+	"avx512f":    cpuidLabels("AVX512F"),
+	"avx512bw":   cpuidLabels("AVX512BW"),
+	"avx512cd":   cpuidLabels("AVX512CD"),
+	"avx512dq":   cpuidLabels("AVX512DQ"),
+	"avx512vl":   cpuidLabels("AVX512VL"),
+	"avxvnni":    cpuidLabels("AVXVNNI"),
+	"fma3":       cpuidLabels("FMA3"),
+	"sse4.2":     cpuidLabels("SSE42"),
+	"amx-tile":   cpuidLabels("AMXTILE"),
+	"amx-bf16":   cpuidLabels("AMXBF16"),
+	"amx-int8":   cpuidLabels("AMXINT8"),
+	"sha":        cpuidLabels("SHA"),
+	"aes":        cpuidLabels("AESNI"),
+	"vaes":       cpuidLabels("VAES"),
+	"vpclmulqdq": cpuidLabels("VPCLMULQDQ"),
+}
+
+// LoadCPUFeatureLabels reads a YAML or JSON CPU feature table from a file.
+func LoadCPUFeatureLabels(path string) (CPUFeatureLabels, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	labels := CPUFeatureLabels{}
+	if err := yaml.UnmarshalStrict(data, &labels); err != nil {
+		return nil, fmt.Errorf("failed to decode cpu feature labels from %s: %w", path, err)
+	}
+	return labels, nil
+}
+
+// WithCPUFeatureLabels requires nodes to have the labels matching the CPU features and
+// architecture variants of the images.
+func WithCPUFeatureLabels(labels CPUFeatureLabels) HandlerOption {
+	return func(h *Handler) {
+		h.cpuFeatureLabels = labels
+	}
+}
+
+// platformLabels returns the node labels required by the variant and the features of the platform.
+func (l CPUFeatureLabels) platformLabels(platform registry.Platform) map[string]struct{} {
+	r := map[string]struct{}{}
+	keys := []string{}
+	if platform.Variant != "" {
+		keys = append(keys, platform.Architecture+"/"+platform.Variant)
+	}
+	for _, feature := range platform.Features {
+		keys = append(keys, strings.ToLower(feature))
+	}
+	for _, key := range keys {
+		for _, label := range l[key] {
+			r[label] = struct{}{}
+		}
+	}
+	return r
+}
+
+// cpuFeatureRequirements returns, for each architecture, the node label requirements needed to run all the images.
+// An image requires a label only when all its platforms for the architecture require it, as the container runtime
+// can then fall back to a less demanding platform.
+func (h *Handler) cpuFeatureRequirements(os string, images []imageArchResult, archs map[string]struct{}) map[string][]v1.NodeSelectorRequirement {
+	if len(h.cpuFeatureLabels) == 0 {
+		return nil
+	}
+	r := map[string][]v1.NodeSelectorRequirement{}
+	for arch := range archs {
+		required := map[string]struct{}{}
+		for _, image := range images {
+			var imageLabels map[string]struct{}
+			for _, platform := range image.platforms {
+				if platform.Architecture != arch || platform.OS != "" && platform.OS != os {
+					continue
+				}
+				labels := h.cpuFeatureLabels.platformLabels(platform)
+				if imageLabels == nil {
+					imageLabels = maps.Clone(labels)
+					continue
+				}
+				for label := range imageLabels {
+					if _, ok := labels[label]; !ok {
+						delete(imageLabels, label)
+					}
+				}
+			}
+			maps.Copy(required, imageLabels)
+		}
+		for _, label := range keys(required) {
+			r[arch] = append(r[arch], v1.NodeSelectorRequirement{
+				Key:      label,
+				Operator: v1.NodeSelectorOpExists,
+			})
+		}
+	}
+	return r
+}
+
+// architectureTerms returns the node selector terms matching the architectures along with the requirements
+// common to all of them and the ones specific to each architecture.
+func architectureTerms(archs []string, common []v1.NodeSelectorRequirement, perArch map[string][]v1.NodeSelectorRequirement) []v1.NodeSelectorTerm {
+	if len(perArch) == 0 {
+		return []v1.NodeSelectorTerm{
+			{
+				MatchExpressions: append([]v1.NodeSelectorRequirement{
+					{
+						Key:      archKey,
+						Operator: v1.NodeSelectorOpIn,
+						Values:   archs,
+					},
+				}, common...),
+			},
+		}
+	}
+	terms := []v1.NodeSelectorTerm{}
+	for _, arch := range archs {
+		expressions := append([]v1.NodeSelectorRequirement{
+			{
+				Key:      archKey,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   []string{arch},
+			},
+		}, common...)
+		terms = append(terms, v1.NodeSelectorTerm{MatchExpressions: append(expressions, perArch[arch]...)})
+	}
+	return terms
+}
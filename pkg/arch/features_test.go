@@ -0,0 +1,142 @@
+package arch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func cpuFeaturesTestRegistry(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+	switch image {
+	case "amd64-v3":
+		return []registry.Platform{
+			{OS: "linux", Architecture: "amd64", Variant: "v3"},
+			{OS: "linux", Architecture: "arm64"},
+		}, nil
+	case "amd64-v3-with-fallback":
+		return []registry.Platform{
+			{OS: "linux", Architecture: "amd64", Variant: "v3"},
+			{OS: "linux", Architecture: "amd64"},
+		}, nil
+	case "avx512":
+		return []registry.Platform{{OS: "linux", Architecture: "amd64", Features: []string{"AVX512F"}}}, nil
+	}
+	return []registry.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}, nil
+}
+
+func cpuidRequirements(features ...string) []v1.NodeSelectorRequirement {
+	r := []v1.NodeSelectorRequirement{}
+	for _, label := range cpuidLabels(features...) {
+		r = append(r, v1.NodeSelectorRequirement{Key: label, Operator: v1.NodeSelectorOpExists})
+	}
+	return r
+}
+
+func TestLoadCPUFeatureLabels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("avx2:\n- feature.node.kubernetes.io/cpu-cpuid.AVX2\n"), 0o600))
+	labels, err := LoadCPUFeatureLabels(path)
+	require.NoError(t, err)
+	assert.Equal(t, CPUFeatureLabels{"avx2": {"feature.node.kubernetes.io/cpu-cpuid.AVX2"}}, labels)
+
+	require.NoError(t, os.WriteFile(path, []byte("avx2: feature.node.kubernetes.io/cpu-cpuid.AVX2\n"), 0o600))
+	_, err = LoadCPUFeatureLabels(path)
+	assert.Error(t, err)
+}
+
+func TestUpdatePodSpecWithCPUFeatures(t *testing.T) {
+	newHandler := func(opts ...HandlerOption) *Handler {
+		return NewHandler(
+			fake.NewClientBuilder().Build(),
+			RegistryFunc(cpuFeaturesTestRegistry),
+			append([]HandlerOption{WithOS("linux"), WithCPUFeatureLabels(DefaultCPUFeatureLabels)}, opts...)...,
+		)
+	}
+
+	t.Run("the variant labels are required along with the preferred architecture", func(t *testing.T) {
+		h := newHandler(WithArchitecture("amd64"))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "amd64-v3"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+		assert.Equal(t, requiredAffinity(v1.NodeSelectorTerm{MatchExpressions: cpuidRequirements(
+			"AVX", "AVX2", "BMI1", "BMI2", "CX16", "F16C", "FMA3", "LZCNT", "MOVBE", "POPCNT", "SSE3", "SSE4", "SSE42", "SSSE3",
+		)}), podSpec.Affinity)
+		assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.CPUFeaturesInjected.WithLabelValues("ns")))
+	})
+
+	t.Run("the affinity is split per architecture", func(t *testing.T) {
+		h := newHandler()
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "avx512"}, {Image: "multi-arch"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, requiredAffinity(v1.NodeSelectorTerm{
+			MatchExpressions: append([]v1.NodeSelectorRequirement{archNodeSelectorTerm("amd64").MatchExpressions[0]}, cpuidRequirements("AVX512F")...),
+		}), podSpec.Affinity)
+
+		podSpec = &v1.PodSpec{Containers: []v1.Container{{Image: "amd64-v3"}, {Image: "multi-arch"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		require.NotNil(t, podSpec.Affinity)
+		terms := podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		require.Len(t, terms, 2)
+		assert.Equal(t, archNodeSelectorTerm("amd64").MatchExpressions[0], terms[0].MatchExpressions[0])
+		assert.Len(t, terms[0].MatchExpressions, 15)
+		assert.Equal(t, archNodeSelectorTerm("arm64"), terms[1])
+	})
+
+	t.Run("the requirements apply to every user authored required term", func(t *testing.T) {
+		zone := func(zone string) v1.NodeSelectorRequirement {
+			return v1.NodeSelectorRequirement{Key: "topology.kubernetes.io/zone", Operator: v1.NodeSelectorOpIn, Values: []string{zone}}
+		}
+		h := newHandler(WithArchitecture("amd64"))
+		podSpec := &v1.PodSpec{
+			Affinity: requiredAffinity(
+				v1.NodeSelectorTerm{MatchExpressions: []v1.NodeSelectorRequirement{zone("eu-west-1a")}},
+				v1.NodeSelectorTerm{MatchExpressions: []v1.NodeSelectorRequirement{zone("eu-west-1b")}},
+			),
+			Containers: []v1.Container{{Image: "avx512"}},
+		}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+		assert.Equal(t, requiredAffinity(
+			v1.NodeSelectorTerm{MatchExpressions: append([]v1.NodeSelectorRequirement{zone("eu-west-1a")}, cpuidRequirements("AVX512F")...)},
+			v1.NodeSelectorTerm{MatchExpressions: append([]v1.NodeSelectorRequirement{zone("eu-west-1b")}, cpuidRequirements("AVX512F")...)},
+		), podSpec.Affinity)
+
+		h = newHandler()
+		podSpec = &v1.PodSpec{
+			Affinity:   requiredAffinity(v1.NodeSelectorTerm{MatchExpressions: []v1.NodeSelectorRequirement{zone("eu-west-1a")}}),
+			Containers: []v1.Container{{Image: "avx512"}, {Image: "multi-arch"}},
+		}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, requiredAffinity(v1.NodeSelectorTerm{
+			MatchExpressions: append([]v1.NodeSelectorRequirement{zone("eu-west-1a"), archNodeSelectorTerm("amd64").MatchExpressions[0]}, cpuidRequirements("AVX512F")...),
+		}), podSpec.Affinity)
+	})
+
+	t.Run("images with a baseline platform do not require CPU features", func(t *testing.T) {
+		h := newHandler(WithArchitecture("amd64"))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "amd64-v3-with-fallback"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+		assert.Nil(t, podSpec.Affinity)
+	})
+
+	t.Run("CPU features are ignored without a feature table", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(cpuFeaturesTestRegistry), WithOS("linux"), WithArchitecture("amd64"))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "avx512"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+		assert.Nil(t, podSpec.Affinity)
+	})
+}
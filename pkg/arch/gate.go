@@ -0,0 +1,100 @@
+package arch
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/adevinta/noe/pkg/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// SchedulingGate prevents the scheduling of pods whose image platforms were not resolved within the admission budget,
+// until their node selection is computed asynchronously.
+const SchedulingGate = "arch.noe.adevinta.com/architecture"
+
+// ErrUnresolvedImages is returned when the platforms of some images of a pod with a deferred scheduling can't be resolved.
+var ErrUnresolvedImages = errors.New("unable to resolve the platforms of images")
+
+type deferredResolutionKey struct{}
+
+func isDeferredResolution(ctx context.Context) bool {
+	deferred, _ := ctx.Value(deferredResolutionKey{}).(bool)
+	return deferred
+}
+
+// WithSchedulingGateBudget defers the node selection of the pods whose image platforms are not resolved within the budget.
+// Those pods are admitted with the SchedulingGate, to be removed once the node selection is computed.
+// A zero budget disables the deferral.
+func WithSchedulingGateBudget(budget time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.schedulingGateBudget = budget
+	}
+}
+
+// HasSchedulingGate reports whether the pod scheduling is gated by Noe.
+func HasSchedulingGate(pod *v1.Pod) bool {
+	for _, gate := range pod.Spec.SchedulingGates {
+		if gate.Name == SchedulingGate {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveSchedulingGate allows the pod to be scheduled.
+func RemoveSchedulingGate(pod *v1.Pod) {
+	gates := []v1.PodSchedulingGate{}
+	for _, gate := range pod.Spec.SchedulingGates {
+		if gate.Name != SchedulingGate {
+			gates = append(gates, gate)
+		}
+	}
+	if len(gates) == 0 {
+		gates = nil
+	}
+	pod.Spec.SchedulingGates = gates
+}
+
+// UpdateGatedPod computes the node selection of a pod whose scheduling was deferred.
+// Only the node selection, the images and the annotations of gated pods can be changed, the architecture overlays are ignored.
+// ErrUnresolvedImages is returned when the platforms of some images still can't be resolved.
+// Warnings are only logged, as they can't be returned to the user anymore.
+func (h *Handler) UpdateGatedPod(ctx context.Context, pod *v1.Pod) error {
+	ctx = context.WithValue(ctx, deferredResolutionKey{}, true)
+	err := h.decidePod(ctx, pod)
+	var warningErr warning
+	if errors.As(err, &warningErr) {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("deferred node selection computed with warnings")
+		return nil
+	}
+	return err
+}
+
+// updatePodWithinBudget updates the pod node selection, gating the pod scheduling when it can't be computed within the budget.
+func (h *Handler) updatePodWithinBudget(ctx context.Context, pod *v1.Pod) error {
+	if HasSchedulingGate(pod) {
+		log.DefaultLogger.WithContext(ctx).Info("pod scheduling already deferred, skipping")
+		return nil
+	}
+	if h.schedulingGateBudget <= 0 || pod.Spec.NodeName != "" {
+		return h.decidePod(ctx, pod)
+	}
+	candidate := pod.DeepCopy()
+	result := make(chan error, 1)
+	go func() {
+		result <- h.decidePod(ctx, candidate)
+	}()
+	timer := time.NewTimer(h.schedulingGateBudget)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		*pod = *candidate
+		return err
+	case <-timer.C:
+		log.DefaultLogger.WithContext(ctx).WithField("budget", h.schedulingGateBudget).Info("image platforms not resolved within the budget, deferring the pod scheduling")
+		pod.Spec.SchedulingGates = append(pod.Spec.SchedulingGates, v1.PodSchedulingGate{Name: SchedulingGate})
+		h.metrics.SchedulingDeferred.WithLabelValues(pod.Namespace).Inc()
+		return nil
+	}
+}
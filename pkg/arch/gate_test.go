@@ -0,0 +1,114 @@
+package arch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gomodules.xyz/jsonpatch/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestHookDefersSchedulingOfSlowPods(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slowRegistry := RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+		if image == "slow" {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+		}
+		return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+	})
+	pod := func(image string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod"},
+			Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: image}}},
+		}
+	}
+
+	t.Run("When the platforms are resolved within the budget, the node selection is injected", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), slowRegistry, WithOS("linux"), WithSchedulingGateBudget(time.Second))
+		resp := runWebhookTest(t, h, pod("fast"))
+		assert.True(t, resp.Allowed)
+		assert.Contains(t, resp.Patches, archNodeSelectorPatchForArchs("arm64"))
+		assert.Equal(t, 0.0, testutil.ToFloat64(h.metrics.SchedulingDeferred.WithLabelValues("ns")))
+	})
+
+	t.Run("When the platforms are not resolved within the budget, the pod is gated", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), slowRegistry, WithOS("linux"), WithSchedulingGateBudget(10*time.Millisecond))
+		resp := runWebhookTest(t, h, pod("slow"))
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, []jsonpatch.Operation{{
+			Operation: "add",
+			Path:      "/spec/schedulingGates",
+			Value:     []interface{}{map[string]interface{}{"name": SchedulingGate}},
+		}}, resp.Patches)
+		assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.SchedulingDeferred.WithLabelValues("ns")))
+	})
+
+	t.Run("When the pod is already gated, it is left to the controller", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), slowRegistry, WithOS("linux"), WithSchedulingGateBudget(10*time.Millisecond))
+		gated := pod("fast")
+		gated.Spec.SchedulingGates = []v1.PodSchedulingGate{{Name: SchedulingGate}}
+		resp := runWebhookTest(t, h, gated)
+		assert.True(t, resp.Allowed)
+		assert.Len(t, resp.Patches, 0)
+	})
+}
+
+func TestUpdateGatedPod(t *testing.T) {
+	failing := RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+		if image == "unavailable" {
+			return nil, errors.New("registry unavailable")
+		}
+		return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+	})
+	h := NewHandler(fake.NewClientBuilder().Build(), failing, WithOS("linux"))
+
+	t.Run("the node selection is computed when all platforms are resolved", func(t *testing.T) {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "ns",
+				Annotations: map[string]string{OverlaysAnnotation: `arm64: {containers: [{args: ["--arm"]}]}`},
+			},
+			Spec: v1.PodSpec{
+				Containers:      []v1.Container{{Name: "app", Image: "ubuntu"}},
+				SchedulingGates: []v1.PodSchedulingGate{{Name: SchedulingGate}},
+			},
+		}
+		require.NoError(t, h.UpdateGatedPod(context.Background(), pod))
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("arm64")), pod.Spec.Affinity)
+		assert.Empty(t, pod.Spec.Containers[0].Args)
+		assert.NotContains(t, pod.Annotations, OverlayAppliedAnnotation)
+	})
+
+	t.Run("an error is returned when some platforms are not resolved", func(t *testing.T) {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns"},
+			Spec: v1.PodSpec{
+				Containers:      []v1.Container{{Name: "app", Image: "ubuntu"}, {Name: "sidecar", Image: "unavailable"}},
+				SchedulingGates: []v1.PodSchedulingGate{{Name: SchedulingGate}},
+			},
+		}
+		err := h.UpdateGatedPod(context.Background(), pod)
+		assert.ErrorIs(t, err, ErrUnresolvedImages)
+		assert.Nil(t, pod.Spec.Affinity)
+	})
+}
+
+func TestRemoveSchedulingGate(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{SchedulingGates: []v1.PodSchedulingGate{{Name: "other"}, {Name: SchedulingGate}}}}
+	assert.True(t, HasSchedulingGate(pod))
+	RemoveSchedulingGate(pod)
+	assert.False(t, HasSchedulingGate(pod))
+	assert.Equal(t, []v1.PodSchedulingGate{{Name: "other"}}, pod.Spec.SchedulingGates)
+}
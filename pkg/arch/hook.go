@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
@@ -12,8 +13,12 @@ import (
 
 	"github.com/adevinta/noe/pkg/log"
 	"github.com/adevinta/noe/pkg/registry"
+	"github.com/adevinta/noe/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gomodules.xyz/jsonpatch/v2"
 	admissionv1 "k8s.io/api/admission/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
@@ -21,7 +26,7 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/json"
-	ctrl "sigs.k8s.io/controller-runtime"
+	"k8s.io/client-go/tools/events"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
@@ -36,6 +41,17 @@ type HandlerMetrics struct {
 	ArchSelectorInjected              *prometheus.CounterVec
 	PreferredArchitectureNotAvailable *prometheus.CounterVec
 	NodeMatchSelector                 *prometheus.CounterVec
+	ImageIgnored                      *prometheus.CounterVec
+	RuleApplied                       *prometheus.CounterVec
+	RuleErrors                        *prometheus.CounterVec
+	EmulationInjected                 *prometheus.CounterVec
+	CPUFeaturesInjected               *prometheus.CounterVec
+	OverlayApplied                    *prometheus.CounterVec
+	ImageRewritten                    *prometheus.CounterVec
+	ImageSubstituted                  *prometheus.CounterVec
+	ImagePinned                       *prometheus.CounterVec
+	ImageResolution                   *prometheus.CounterVec
+	SchedulingDeferred                *prometheus.CounterVec
 }
 
 func (m HandlerMetrics) MustRegister(reg metrics.RegistererGatherer) {
@@ -46,6 +62,17 @@ func (m HandlerMetrics) MustRegister(reg metrics.RegistererGatherer) {
 		m.ArchSelectorInjected,
 		m.PreferredArchitectureNotAvailable,
 		m.NodeMatchSelector,
+		m.ImageIgnored,
+		m.RuleApplied,
+		m.RuleErrors,
+		m.EmulationInjected,
+		m.CPUFeaturesInjected,
+		m.OverlayApplied,
+		m.ImageRewritten,
+		m.ImageSubstituted,
+		m.ImagePinned,
+		m.ImageResolution,
+		m.SchedulingDeferred,
 	)
 }
 
@@ -87,6 +114,72 @@ func NewHandlerMetrics(prefix string) *HandlerMetrics {
 			Name:      "node_match_injections_total",
 			Help:      "Number of times the node selection to match pod labels was injected",
 		}, []string{"namespace", "label"}),
+		ImageIgnored: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "image_ignored_total",
+			Help:      "Number of times an image was excluded from the architecture selection because it matches an ignored image pattern",
+		}, []string{"namespace", "pattern"}),
+		RuleApplied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "rule_applied_total",
+			Help:      "Number of times an architecture rule applied to a pod",
+		}, []string{"namespace", "rule"}),
+		RuleErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "rule_errors_total",
+			Help:      "Number of times an architecture rule failed to evaluate",
+		}, []string{"rule"}),
+		EmulationInjected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "emulation_injected_total",
+			Help:      "Number of times nodes emulating an architecture were allowed for a pod",
+		}, []string{"namespace", "mode"}),
+		CPUFeaturesInjected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "cpu_features_injected_total",
+			Help:      "Number of times CPU feature requirements were added to a pod",
+		}, []string{"namespace"}),
+		OverlayApplied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "overlay_applied_total",
+			Help:      "Number of times an architecture overlay was applied to a pod",
+		}, []string{"namespace", "arch"}),
+		ImageRewritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "image_rewritten_total",
+			Help:      "Number of container images replaced by their architecture specific tag",
+		}, []string{"namespace", "arch"}),
+		ImageSubstituted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "image_substituted_total",
+			Help:      "Number of container images replaced by their multi-arch substitute",
+		}, []string{"namespace"}),
+		ImagePinned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "image_pinned_total",
+			Help:      "Number of container images pinned to the digest their tag resolved to",
+		}, []string{"namespace"}),
+		ImageResolution: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "image_resolution_total",
+			Help:      "Number of pod image platforms resolutions, by outcome (complete, partial or timeout)",
+		}, []string{"namespace", "outcome"}),
+		SchedulingDeferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "hook",
+			Name:      "scheduling_deferred_total",
+			Help:      "Number of pods gated as their image platforms were not resolved within the admission budget",
+		}, []string{"namespace"}),
 	}
 	return m
 }
@@ -103,6 +196,13 @@ func (f RegistryFunc) ListArchs(ctx context.Context, imagePullSecret, image stri
 
 type warning struct {
 	msg string
+	// reasons are the structured reasons of the warning, if any
+	reasons []Reason
+}
+
+// reasonWarning returns a warning for the structured reason.
+func reasonWarning(r Reason) warning {
+	return warning{msg: r.Error(), reasons: []Reason{r}}
 }
 
 func (w warning) Error() string {
@@ -115,10 +215,22 @@ type Handler struct {
 	Registry                 Registry
 	matchNodeLabels          []string
 	metrics                  HandlerMetrics
-	decoder                  *admission.Decoder
+	decoder                  admission.Decoder
 	preferredArchitecture    string
 	schedulableArchitectures []string
-	systemOS                 string
+	systemOSes               []string
+	ignoredImages            []string
+	policies                 PolicyResolver
+	rules                    Rules
+	emulation                EmulationMode
+	cpuFeatureLabels         CPUFeatureLabels
+	substitutions            SubstitutionResolver
+	pinDigests               bool
+	schedulingGateBudget     time.Duration
+	admissionBudget          time.Duration
+	decisions                *DecisionCache
+	events                   events.EventRecorder
+	namespaces               client.Reader
 }
 
 func NewHandler(client client.Client, registry Registry, opts ...HandlerOption) *Handler {
@@ -128,9 +240,32 @@ func NewHandler(client client.Client, registry Registry, opts ...HandlerOption)
 	for _, opt := range opts {
 		opt(h)
 	}
+	if h.namespaces == nil {
+		h.namespaces = client
+	}
 	return h
 }
 
+// WithNamespaceReader reads the namespaces of the pods from the reader, such as the manager cache,
+// as they are needed for every admission evaluating rules.
+func WithNamespaceReader(reader client.Reader) HandlerOption {
+	return func(h *Handler) {
+		h.namespaces = reader
+	}
+}
+
+func (h *Handler) getNamespace(ctx context.Context, name string) (*v1.Namespace, error) {
+	ns := &v1.Namespace{}
+	return ns, h.namespaces.Get(ctx, client.ObjectKey{Name: name}, ns)
+}
+
+// WithEventRecorder records the events of the admitted objects with the recorder.
+func WithEventRecorder(recorder events.EventRecorder) HandlerOption {
+	return func(h *Handler) {
+		h.events = recorder
+	}
+}
+
 func WithMetricsRegistry(reg metrics.RegistererGatherer) HandlerOption {
 	return func(h *Handler) {
 		h.metrics.MustRegister(reg)
@@ -149,13 +284,12 @@ func WithSchedulableArchitectures(archs []string) HandlerOption {
 	}
 }
 
+// WithOS sets the OSes schedulable in the cluster from a comma separated list, by order of preference.
 func WithOS(os string) HandlerOption {
-	return func(h *Handler) {
-		h.systemOS = os
-	}
+	return WithOSes(ParseOSes(os))
 }
 
-func WithDecoder(decoder *admission.Decoder) HandlerOption {
+func WithDecoder(decoder admission.Decoder) HandlerOption {
 	return func(h *Handler) {
 		h.decoder = decoder
 	}
@@ -171,11 +305,53 @@ func ParseMatchNodeLabels(labels string) []string {
 	return strings.Split(labels, ",")
 }
 
-func GetImagePullSecretFromPodSpec(ctx context.Context, k8sClient client.Client, namespace string, podSpec *v1.PodSpec) (string, error) {
+// WithIgnoredImages excludes images matching any of the glob patterns from the architecture selection.
+// This is meant for sidecars available for every architecture of the cluster.
+func WithIgnoredImages(patterns []string) HandlerOption {
+	return func(h *Handler) {
+		h.ignoredImages = patterns
+	}
+}
+
+func ParseIgnoredImages(patterns string) []string {
+	r := []string{}
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			log.DefaultLogger.WithField("pattern", pattern).WithError(err).Warn("invalid ignored image pattern, ignoring")
+			continue
+		}
+		r = append(r, pattern)
+	}
+	return r
+}
+
+// ignoredImagePattern returns the first ignored image pattern matching the image, either as written in the pod spec
+// or normalized to registry/repository:tag, so that docker.io/fluent/fluent-bit:* matches fluent/fluent-bit:2.0.
+func (h *Handler) ignoredImagePattern(image string) (string, bool) {
+	if len(h.ignoredImages) == 0 {
+		return "", false
+	}
+	normalized := registry.NormalizeImage(image)
+	for _, pattern := range h.ignoredImages {
+		for _, candidate := range []string{image, normalized} {
+			if ok, err := filepath.Match(pattern, candidate); err == nil && ok {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
+
+func GetImagePullSecretFromPodSpec(ctx context.Context, k8sClient client.Client, namespace string, podSpec *v1.PodSpec) (imagePullSecret string, lastErr error) {
+	ctx, span := tracing.Tracer().Start(ctx, "GetImagePullSecrets", trace.WithAttributes(attribute.Int("secrets", len(podSpec.ImagePullSecrets))))
+	defer func() { tracing.End(span, lastErr) }()
 	dockerCfg := registry.DockerConfig{
 		Auths: registry.DockerAuths{},
 	}
-	var lastErr error
 	for _, secretName := range podSpec.ImagePullSecrets {
 		secret := &v1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
@@ -200,7 +376,6 @@ func GetImagePullSecretFromPodSpec(ctx context.Context, k8sClient client.Client,
 			dockerCfg.Auths[k] = v
 		}
 	}
-	imagePullSecret := ""
 	if len(dockerCfg.Auths) > 0 {
 		data, err := json.Marshal(dockerCfg)
 		if err != nil {
@@ -224,6 +399,49 @@ func GetContainerImages(containerLists ...[]v1.Container) []string {
 	return images
 }
 
+// GetVolumeImages returns the OCI references mounted as image volumes.
+func GetVolumeImages(volumes []v1.Volume) []string {
+	images := []string{}
+	for _, volume := range volumes {
+		if volume.Image != nil && volume.Image.Reference != "" {
+			images = append(images, volume.Image.Reference)
+		}
+	}
+	return images
+}
+
+// GetPodSpecImages returns all the images the kubelet will pull for the pod,
+// from containers, init containers and image volumes.
+func GetPodSpecImages(podSpec *v1.PodSpec) []string {
+	images := []string{}
+	for _, podImage := range getPodImages(podSpec) {
+		images = append(images, podImage.image)
+	}
+	return images
+}
+
+type podImage struct {
+	// container is the name of the container running the image.
+	// It is empty for image volumes.
+	container string
+	image     string
+}
+
+func getPodImages(podSpec *v1.PodSpec) []podImage {
+	images := []podImage{}
+	for _, containerList := range [][]v1.Container{podSpec.Containers, podSpec.InitContainers} {
+		for _, container := range containerList {
+			if container.Image != "" {
+				images = append(images, podImage{container: container.Name, image: container.Image})
+			}
+		}
+	}
+	for _, image := range GetVolumeImages(podSpec.Volumes) {
+		images = append(images, podImage{image: image})
+	}
+	return images
+}
+
 func PodSpecHasNodeArchitectureSelection(ctx context.Context, podSpec *v1.PodSpec) (string, bool) {
 	for _, key := range []string{"beta." + archKey, archKey} {
 		if _, ok := podSpec.NodeSelector[key]; ok {
@@ -291,151 +509,352 @@ func (h *Handler) addPodNodeMatchingLabels(namespace string, podLabels map[strin
 
 type imageArchResult struct {
 	image     string
+	container string
 	platforms []registry.Platform
+	// overridden is set when the platforms are declared in the pod annotations
+	overridden bool
+	err        error
 }
 
-func (h *Handler) updatePodSpec(ctx context.Context, namespace string, podLabels map[string]string, podSpec *v1.PodSpec) error {
+func (h *Handler) updatePodSpec(ctx context.Context, namespace string, meta *metav1.ObjectMeta, podSpec *v1.PodSpec) (err error) {
+	// budgetWarning is set when some images were not resolved within the admission budget
+	var budgetWarning error
+	// overrideWarnings report the invalid container platforms overrides, ignored in favour of the registry
+	overrideWarnings := []error{}
+	defer func() {
+		err = joinWarnings(append([]error{err, budgetWarning}, overrideWarnings...)...)
+	}()
+	podLabels := meta.Labels
 	if podSpec.NodeName != "" {
 		log.DefaultLogger.WithContext(ctx).WithField("nodeName", podSpec.NodeName).Printf("pod is already scheduled")
+		explanationFromContext(ctx).skip("pod is already scheduled")
 		return nil
 	}
 	reason, found := PodSpecHasNodeArchitectureSelection(ctx, podSpec)
 	if found {
 		h.metrics.UpdateSkept.WithLabelValues(reason).Inc()
+		explanationFromContext(ctx).skip(reason)
 		h.addPodNodeMatchingLabels(namespace, podLabels, podSpec)
 		return nil
 	}
 
 	var preferredArchIsDefault bool
 	preferredArch, preferredArchDefined := podLabels["arch.noe.adevinta.com/preferred"]
+	if isDaemonSet(ctx) {
+		// daemons run on all the nodes they support, preferring an architecture would only reduce their coverage
+		preferredArch, preferredArchDefined = "", false
+	}
 	if preferredArch != "" && !h.isArchSupported(preferredArch) {
 		log.DefaultLogger.WithContext(ctx).WithField("preferredArch", preferredArch).Println("ignoring unsupported user preferred architecture")
 		preferredArch = ""
 	}
-	if preferredArch == "" && h.preferredArchitecture != "" {
+	// the label takes precedence over the rules, that take precedence over the policies and flag
+	labelPreferred := preferredArch != ""
+	if labelPreferred {
+		explanationFromContext(ctx).preference(preferredArch, PreferenceSourceLabel)
+	}
+	if preferredArch == "" && h.preferredArchitecture != "" && !isDaemonSet(ctx) {
 		preferredArch = h.preferredArchitecture
 		preferredArchDefined = true
 		preferredArchIsDefault = true
+		explanationFromContext(ctx).preference(preferredArch, PreferenceSourceDefault)
 		ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"preferredArch": preferredArch})
 		log.DefaultLogger.WithContext(ctx).Println("selecting default preferred architecture")
 	}
 
-	commonArchitectures := map[string]struct{}{}
 	imagePullSecret, err := GetImagePullSecretFromPodSpec(ctx, h.Client, namespace, podSpec)
 	if err != nil {
 		h.metrics.ImagePullSecretFailed.WithLabelValues(namespace).Inc()
 	}
-	imagePlatforms := make(chan imageArchResult)
+	podImages := getPodImages(podSpec)
+	// buffered so that lookups still running when the admission budget runs out don't block
+	imagePlatforms := make(chan imageArchResult, len(podImages))
+	requestedImages := []podImage{}
 	wg := sync.WaitGroup{}
-	for _, image := range GetContainerImages(podSpec.Containers, podSpec.InitContainers) {
+	for _, containerImage := range podImages {
+		image := containerImage.image
+		if pattern, ok := h.ignoredImagePattern(image); ok {
+			log.DefaultLogger.WithContext(ctx).WithField("image", image).WithField("pattern", pattern).Info("image is ignored, excluding it from the architecture selection")
+			h.metrics.ImageIgnored.WithLabelValues(namespace, pattern).Inc()
+			explanationFromContext(ctx).image(containerImage, PlatformSourceIgnored, nil, nil)
+			continue
+		}
+		platforms, ok, err := containerPlatformsOverride(meta.Annotations, containerImage.container)
+		if err != nil {
+			log.DefaultLogger.WithContext(ctx).WithField("image", image).WithError(err).Warn("ignoring invalid container platforms override")
+			overrideWarnings = append(overrideWarnings, warning{msg: fmt.Sprintf("%v, using the platforms of the registry", err)})
+		}
+		if ok {
+			log.DefaultLogger.WithContext(ctx).WithField("image", image).WithField("container", containerImage.container).WithField("platforms", platforms).Info("using container platforms override")
+			wg.Add(1)
+			go func(podImage podImage, platforms []registry.Platform) {
+				defer wg.Done()
+				imagePlatforms <- imageArchResult{
+					image:      podImage.image,
+					container:  podImage.container,
+					platforms:  platforms,
+					overridden: true,
+				}
+			}(containerImage, platforms)
+			requestedImages = append(requestedImages, containerImage)
+			continue
+		}
+		requestedImages = append(requestedImages, containerImage)
 		wg.Add(1)
-		go func(ctx context.Context, image string) {
+		go func(ctx context.Context, podImage podImage) {
 			defer wg.Done()
-			ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"image": image})
-			platforms, err := h.Registry.ListArchs(ctx, imagePullSecret, image)
+			ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"image": podImage.image})
+			ctx, span := tracing.Tracer().Start(ctx, "ListArchs", trace.WithAttributes(
+				attribute.String("image", podImage.image),
+				attribute.String("container", podImage.container),
+			))
+			platforms, err := h.Registry.ListArchs(ctx, imagePullSecret, podImage.image)
+			tracing.End(span, err)
 			if err != nil {
-				h.metrics.RegistryErrors.WithLabelValues(image).Inc()
+				h.metrics.RegistryErrors.WithLabelValues(podImage.image).Inc()
 				log.DefaultLogger.WithContext(ctx).WithError(err).Printf("unable to list image archs")
+				imagePlatforms <- imageArchResult{
+					image:     podImage.image,
+					container: podImage.container,
+					err:       err,
+				}
 				return
 			}
 			imagePlatforms <- imageArchResult{
-				image:     image,
+				image:     podImage.image,
+				container: podImage.container,
 				platforms: platforms,
 			}
-		}(ctx, image)
+		}(ctx, containerImage)
 	}
 	go func() {
 		wg.Wait()
 		close(imagePlatforms)
 	}()
 	firstImage := true
-	for imagePlatform := range imagePlatforms {
-		ctx := log.AddLogFieldsToContext(ctx, logrus.Fields{"image": imagePlatform.image})
-
-		imageArchitectures := map[string]struct{}{}
-		for _, platform := range imagePlatform.platforms {
-			if platform.OS != "" && platform.OS != h.systemOS {
-				log.DefaultLogger.WithContext(ctx).WithField("os", platform.OS).Info("Skipped OS does not match system's")
-				continue
+	results, timedOutImages := h.collectImagePlatforms(ctx, namespace, requestedImages, imagePlatforms)
+	if len(timedOutImages) > 0 {
+		budgetWarning = warning{msg: fmt.Sprintf("platforms of images %s not resolved within the admission budget of %s, they are excluded from the architecture selection", strings.Join(timedOutImages, ", "), h.admissionBudget)}
+	}
+	explanation := explanationFromContext(ctx)
+	for _, image := range timedOutImages {
+		explanation.image(podImage{image: image}, PlatformSourceRegistry, nil, errors.New("not resolved within the admission budget"))
+	}
+	for _, result := range results {
+		source := PlatformSourceRegistry
+		if result.overridden {
+			source = PlatformSourceAnnotation
+		}
+		explanation.image(podImage{container: result.container, image: result.image}, source, result.platforms, result.err)
+	}
+	resolvedImages := []imageArchResult{}
+	unresolvedImages := slices.Clone(timedOutImages)
+	overloaded := false
+	for _, imagePlatform := range results {
+		if imagePlatform.err != nil {
+			unresolvedImages = append(unresolvedImages, imagePlatform.image)
+			overloaded = overloaded || errors.Is(imagePlatform.err, registry.ErrOverloaded)
+			continue
+		}
+		resolvedImages = append(resolvedImages, imagePlatform)
+		if len(imagePlatform.platforms) == 0 {
+			log.DefaultLogger.WithContext(ctx).WithField("image", imagePlatform.image).Info("image is architecture neutral, ignoring it")
+			continue
+		}
+		firstImage = false
+	}
+	if len(unresolvedImages) > 0 {
+		markIncompleteDecision(ctx)
+	}
+	if len(unresolvedImages) > 0 && isDeferredResolution(ctx) {
+		return fmt.Errorf("%w: %s", ErrUnresolvedImages, strings.Join(unresolvedImages, ", "))
+	}
+	if overloaded {
+		log.DefaultLogger.WithContext(ctx).Warn("registry lookups shed, skipping the pod")
+		return registry.ErrOverloaded
+	}
+	if firstImage {
+		log.DefaultLogger.WithContext(ctx).Println("no image found")
+		h.addPodNodeMatchingLabels(namespace, podLabels, podSpec)
+		return nil
+	}
+	// Select the first OS, by order of preference, all images have a schedulable architecture for.
+	// Architectures the images can run on, natively or emulated on nodes of any schedulable architecture,
+	// are kept for emulation.
+	var selectedOS string
+	var commonArchitectures map[string]struct{}
+	var imageArchitectureSets []map[string]struct{}
+	for i, os := range h.candidateOSes(ctx, podSpec) {
+		schedulable, all := h.imageArchitectures(ctx, os, resolvedImages)
+		common := intersectArchitectures(schedulable)
+		if i == 0 || len(common) > 0 {
+			selectedOS, commonArchitectures, imageArchitectureSets = os, common, all
+		}
+		if len(common) > 0 {
+			break
+		}
+	}
+	if _, ok := commonArchitectures[preferredArch]; !ok && preferredArchDefined {
+		substituted, originals := h.substituteImages(ctx, imagePullSecret, meta, resolvedImages, selectedOS, preferredArch)
+		if len(originals) > 0 {
+			schedulable, all := h.imageArchitectures(ctx, selectedOS, substituted)
+			common := intersectArchitectures(schedulable)
+			if _, ok := common[preferredArch]; ok {
+				log.DefaultLogger.WithContext(ctx).WithField("substitutions", originals).Info("substituted images make the preferred architecture available")
+				resolvedImages, commonArchitectures, imageArchitectureSets = substituted, common, all
+				h.applySubstitutions(ctx, namespace, meta, podSpec, resolvedImages, originals)
 			}
-			if !h.isArchSupported(platform.Architecture) {
-				log.DefaultLogger.WithContext(ctx).WithField("arch", platform.OS).Info("Skipped arch does not match system's")
-				continue
+		}
+	}
+	ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"compatibleImages": commonArchitectures, "os": selectedOS})
+	explanation.selection(selectedOS, commonArchitectures)
+	if len(commonArchitectures) == 0 {
+		if h.emulation == EmulationFallback || h.emulation == EmulationAllow {
+			terms, emulated := h.emulationTerms(ctx, selectedOS, podSpec, resolvedImages, imageArchitectureSets)
+			if len(terms) > 0 {
+				log.DefaultLogger.WithContext(ctx).WithField("emulated", emulated).Println("no common architecture, selecting nodes emulating architectures")
+				injectEmulation(meta, podSpec, terms, emulated)
+				h.metrics.EmulationInjected.WithLabelValues(namespace, string(EmulationFallback)).Inc()
+				h.addPodNodeMatchingLabels(namespace, podLabels, podSpec)
+				return joinWarnings(
+					reasonWarning(h.noCommonArchitectureReason(ReasonEmulationRequired, fmt.Sprintf("no common image architecture, the pod requires nodes emulating %s", strings.Join(emulated, ", ")), selectedOS, resolvedImages)),
+					h.applyArchOverlay(ctx, namespace, meta, podSpec, ""),
+					h.rewriteArchImages(ctx, namespace, podSpec, resolvedImages, ""),
+					h.pinImageDigests(ctx, namespace, podSpec, resolvedImages),
+				)
 			}
-			imageArchitectures[platform.Architecture] = struct{}{}
 		}
+		log.DefaultLogger.WithContext(ctx).Println("no common architecture")
+		h.addPodNodeMatchingLabels(namespace, podLabels, podSpec)
+		return h.noCommonArchitectureReason(ReasonNoCommonArchitecture, "could not find a common image architecture across all containers", selectedOS, resolvedImages)
+	}
 
-		if firstImage {
-			commonArchitectures = imageArchitectures
-			firstImage = false
-		} else {
+	if len(h.rules) > 0 {
+		decision := h.evaluateRules(ctx, namespace, meta, podSpec, resolvedImages, commonArchitectures)
+		if decision.allowed != nil {
 			for k := range commonArchitectures {
-				if _, ok := imageArchitectures[k]; !ok {
+				if _, ok := decision.allowed[k]; !ok {
 					delete(commonArchitectures, k)
 				}
 			}
+			explanation.selection(selectedOS, commonArchitectures)
+			if len(commonArchitectures) == 0 {
+				log.DefaultLogger.WithContext(ctx).Println("no common architecture allowed by the rules")
+				h.addPodNodeMatchingLabels(namespace, podLabels, podSpec)
+				allowed := keys(decision.allowed)
+				slices.Sort(allowed)
+				return Reason{
+					Code:       ReasonNoAllowedArchitecture,
+					Summary:    fmt.Sprintf("could not find a common image architecture allowed by the architecture rules (allowed: %s)", strings.Join(allowed, ", ")),
+					Containers: h.containerArchitectures(selectedOS, resolvedImages, allowed),
+				}
+			}
+		}
+		if _, ok := commonArchitectures[decision.preferred]; ok && !isDaemonSet(ctx) && !labelPreferred {
+			ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"preferredArch": decision.preferred})
+			log.DefaultLogger.WithContext(ctx).Println("selecting rule preferred architecture")
+			preferredArch = decision.preferred
+			preferredArchDefined = true
+			preferredArchIsDefault = true
+			explanation.preference(preferredArch, PreferenceSourceRule)
 		}
 	}
-	if firstImage {
-		log.DefaultLogger.WithContext(ctx).Println("no image found")
-		h.addPodNodeMatchingLabels(namespace, podLabels, podSpec)
-		return nil
+
+	_, selectPreferredArch := commonArchitectures[preferredArch]
+	selectPreferredArch = selectPreferredArch && preferredArchDefined
+	archTagged := hasArchTags(resolvedImages)
+	if len(archTagged) > 0 && len(commonArchitectures) > 1 && !selectPreferredArch {
+		// a container runs the tag of a single architecture, the pod can't be scheduled on the others
+		arch := h.archTagArchitecture(commonArchitectures)
+		log.DefaultLogger.WithContext(ctx).WithField("images", archTagged).WithField("arch", arch).Info("images have architecture specific tags, selecting a single architecture")
+		commonArchitectures = map[string]struct{}{arch: {}}
+		explanation.selection(selectedOS, commonArchitectures)
 	}
-	ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"compatibleImages": commonArchitectures})
-	if len(commonArchitectures) == 0 {
-		log.DefaultLogger.WithContext(ctx).Println("no common architecture")
+	selectedArchitectures := commonArchitectures
+	if selectPreferredArch {
+		selectedArchitectures = map[string]struct{}{preferredArch: {}}
+	}
+	osRequirements, err := h.osRequirements(selectedOS, podSpec, resolvedImages, selectedArchitectures)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Println("no OS requirement matching all images")
 		h.addPodNodeMatchingLabels(namespace, podLabels, podSpec)
-		return errors.New("could not find a common image architecture across all containers")
+		return err
+	}
+	featureRequirements := h.cpuFeatureRequirements(selectedOS, resolvedImages, selectedArchitectures)
+	if len(featureRequirements) > 0 {
+		log.DefaultLogger.WithContext(ctx).WithField("cpuFeatures", featureRequirements).Info("images require CPU features")
+		h.metrics.CPUFeaturesInjected.WithLabelValues(namespace).Inc()
 	}
 
-	if _, ok := commonArchitectures[preferredArch]; ok && preferredArchDefined {
+	// selectedArch is set when the pod can only run on a single architecture
+	var selectedArch string
+	var result error
+	if selectPreferredArch {
+		selectedArch = preferredArch
 		if podSpec.NodeSelector == nil {
 			podSpec.NodeSelector = make(map[string]string)
 		}
 		podSpec.NodeSelector[archKey] = preferredArch
+		addNodeSelectorRequirements(podSpec, append(osRequirements, featureRequirements[preferredArch]...))
 		log.DefaultLogger.WithContext(ctx).Info("updating nodeSelector to match preferred architecture")
 		h.metrics.ArchSelectorInjected.WithLabelValues(namespace, "preferred").Inc()
 	} else {
-		if podSpec.Affinity == nil {
-			podSpec.Affinity = &v1.Affinity{}
-		}
-		if podSpec.Affinity.NodeAffinity == nil {
-			podSpec.Affinity.NodeAffinity = &v1.NodeAffinity{}
-		}
-		if podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
-			podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &v1.NodeSelector{}
-		}
-
-		newAffinity := v1.NodeSelectorTerm{
-			MatchExpressions: []v1.NodeSelectorRequirement{
-				{
-					Key:      archKey,
-					Operator: v1.NodeSelectorOpIn,
-					Values:   keys(commonArchitectures),
-				},
-			},
-		}
+		newAffinity := architectureTerms(keys(commonArchitectures), osRequirements, featureRequirements)
 		log.DefaultLogger.WithContext(ctx).WithField("affinity", newAffinity).Infof("updated pod affinity")
 
-		podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = append(
-			podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms,
-			newAffinity,
-		)
+		var emulationTerms []v1.NodeSelectorTerm
+		var emulated []string
+		// emulating nodes could run the images of another architecture than the selected tag
+		if h.emulation == EmulationAllow && len(archTagged) == 0 {
+			emulationTerms, emulated = h.emulationTerms(ctx, selectedOS, podSpec, resolvedImages, imageArchitectureSets)
+		}
+		if len(emulationTerms) > 0 {
+			log.DefaultLogger.WithContext(ctx).WithField("emulated", emulated).Println("allowing nodes emulating architectures, preferring native ones")
+			injectEmulation(meta, podSpec, append(newAffinity, emulationTerms...), emulated)
+			preferNativeArchitectures(podSpec, keys(commonArchitectures))
+			h.metrics.EmulationInjected.WithLabelValues(namespace, string(EmulationAllow)).Inc()
+		} else {
+			addRequiredTerms(podSpec, newAffinity)
+		}
 		h.metrics.ArchSelectorInjected.WithLabelValues(namespace, "affinity").Inc()
+		if len(commonArchitectures) == 1 && meta.Annotations[EmulationAnnotation] == "" {
+			selectedArch = keys(commonArchitectures)[0]
+		}
 		if preferredArchDefined {
 			log.DefaultLogger.WithContext(ctx).Info("preferred architecture is not supported by all images")
 			if !preferredArchIsDefault {
-				h.addPodNodeMatchingLabels(namespace, podLabels, podSpec)
-				return warning{msg: fmt.Sprintf("could not select preferred arch: %s", preferredArch)}
+				result = reasonWarning(Reason{
+					Code:       ReasonPreferredArchitectureUnavailable,
+					Summary:    fmt.Sprintf("could not select preferred arch: %s", preferredArch),
+					Containers: h.containerArchitectures(selectedOS, resolvedImages, []string{preferredArch}),
+				})
 			}
 		}
 	}
 
 	h.addPodNodeMatchingLabels(namespace, podLabels, podSpec)
-	return nil
+	return joinWarnings(
+		result,
+		h.applyArchOverlay(ctx, namespace, meta, podSpec, selectedArch),
+		h.rewriteArchImages(ctx, namespace, podSpec, resolvedImages, selectedArch),
+		h.pinImageDigests(ctx, namespace, podSpec, resolvedImages),
+	)
 }
 
 func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	ctx, span := tracing.Tracer().Start(ctx, "Admission", trace.WithAttributes(
+		attribute.String("kind", req.Kind.Kind),
+		attribute.String("operation", string(req.Operation)),
+		attribute.String("namespace", req.Namespace),
+		attribute.String("name", req.Name),
+	))
+	defer span.End()
+	resp := h.handle(ctx, req)
+	span.SetAttributes(attribute.Bool("allowed", resp.Allowed))
+	return resp
+}
+
+func (h *Handler) handle(ctx context.Context, req admission.Request) admission.Response {
 	var warningMessage string
 
 	if h.decoder == nil {
@@ -461,27 +880,44 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 			h.generatePodInjectionFailedEvent(ctx, pod, fmt.Errorf("failed to decode pod: %w", err))
 			return admission.Errored(http.StatusBadRequest, err)
 		}
-		updated := pod.DeepCopy()
+		fingerprint, decided, cached := h.cachedPodDecision(ctx, pod)
+		if cached {
+			log.DefaultLogger.WithContext(ctx).Debug("reusing the admission decision of an identical pod")
+			resp = decided.response()
+		} else {
+			decisionCtx, state := withDecisionState(ctx)
+			updated := pod.DeepCopy()
 
-		err = h.updatePodSpec(ctx, pod.Namespace, pod.Labels, &updated.Spec)
-		if err != nil {
-			var warningErr warning
-			if errors.As(err, &warningErr) {
-				warningMessage = err.Error()
-			} else {
-				h.generatePodInjectionFailedEvent(ctx, pod, err)
-				return admission.Denied(err.Error())
+			err = h.updatePodWithinBudget(decisionCtx, updated)
+			if errors.Is(err, registry.ErrOverloaded) {
+				h.metrics.UpdateSkept.WithLabelValues("overloaded").Inc()
+				return admission.Allowed("skipped: overloaded")
 			}
-		}
-		updatedRaw, err := toJson(updated)
-		if err != nil {
-			log.DefaultLogger.WithContext(ctx).Println("failed to generate patch:", err)
-			h.generatePodInjectionFailedEvent(ctx, pod, fmt.Errorf("failed to generate patch: %w", err))
-			admission.Errored(http.StatusBadRequest, err)
-		}
-		resp = admission.PatchResponseFromRaw(req.Object.Raw, updatedRaw)
-		if warningMessage != "" {
-			resp = resp.WithWarnings(warningMessage)
+			if err != nil {
+				var warningErr warning
+				if errors.As(err, &warningErr) {
+					warningMessage = err.Error()
+				} else {
+					h.generatePodInjectionFailedEvent(ctx, pod, err)
+					return admission.Denied(err.Error())
+				}
+			}
+			patches, err := podTemplatePatch("/metadata", "/spec", &pod.ObjectMeta, &updated.ObjectMeta, &pod.Spec, &updated.Spec)
+			if err != nil {
+				log.DefaultLogger.WithContext(ctx).Println("failed to generate patch:", err)
+				h.generatePodInjectionFailedEvent(ctx, pod, fmt.Errorf("failed to generate patch: %w", err))
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
+			resp = admission.Patched("", patches...)
+			if warningMessage != "" {
+				resp = resp.WithWarnings(warningMessage)
+			}
+			decided = podDecision{
+				patches:      resp.Patches,
+				warning:      warningMessage,
+				substitution: substitutionMessage(pod.Annotations, updated.Annotations, &updated.Spec),
+			}
+			h.storePodDecision(ctx, fingerprint, state, updated, decided)
 		}
 		err = resp.Complete(req)
 		if err != nil {
@@ -490,6 +926,9 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 			if len(resp.Patches) > 0 {
 				h.generatePodInjectionSuccessEvent(ctx, pod)
 			}
+			if decided.substitution != "" {
+				h.generateSubstitutionEvent(ctx, pod, decided.substitution)
+			}
 		}
 	case "DaemonSet":
 		ds := &appsv1.DaemonSet{}
@@ -499,34 +938,50 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 			h.generateInjectionFailedEvent(ctx, ds, fmt.Errorf("failed to decode pod: %w", err))
 			return admission.Errored(http.StatusBadRequest, err)
 		}
-		updated := ds.DeepCopy()
-		err = h.updatePodSpec(ctx, ds.Namespace, ds.Spec.Template.Labels, &updated.Spec.Template.Spec)
-		if err != nil {
-			var warningErr warning
-			if errors.As(err, &warningErr) {
-				warningMessage = err.Error()
-			} else {
-				h.generateInjectionFailedEvent(ctx, ds, err)
-				return admission.Denied(err.Error())
+		if req.Operation == admissionv1.Update {
+			old := &appsv1.DaemonSet{}
+			err := h.decoder.DecodeRaw(req.OldObject, old)
+			if err == nil && slices.Equal(GetPodSpecImages(&old.Spec.Template.Spec), GetPodSpecImages(&ds.Spec.Template.Spec)) && keepsInjectedSelection(ctx, &old.Spec.Template, &ds.Spec.Template) {
+				log.DefaultLogger.WithContext(ctx).Printf("daemonset images did not change, skipping")
+				return admission.Allowed("daemonset images did not change")
 			}
 		}
-		updatedRaw, err := toJson(updated)
-		if err != nil {
-			log.DefaultLogger.WithContext(ctx).Println("failed to generate patch:", err)
-			admission.Errored(http.StatusBadRequest, err)
-			h.generateInjectionFailedEvent(ctx, ds, fmt.Errorf("failed to generate patch: %w", err))
+		decision, denied := h.Decide(ctx, DecisionInput{Namespace: ds.Namespace, ObjectMeta: ds.Spec.Template.ObjectMeta, Spec: ds.Spec.Template.Spec, DaemonSet: true})
+		if errors.Is(denied, registry.ErrOverloaded) {
+			h.metrics.UpdateSkept.WithLabelValues("overloaded").Inc()
+			return admission.Allowed("skipped: overloaded")
+		}
+		coverage := &patchBuilder{patches: []jsonpatch.JsonPatchOperation{}}
+		coverage.stringMap("/metadata/annotations", ds.Annotations, daemonSetCoverageAnnotations(ds.Annotations, decision))
+		patches := []jsonpatch.JsonPatchOperation{}
+		if denied != nil {
+			// DaemonSets are never denied, so that an image missing some builds doesn't block their deployment
+			log.DefaultLogger.WithContext(ctx).WithError(denied).Warn("no node selection for the daemonset, admitting it unmodified")
+			h.generateInjectionFailedEvent(ctx, ds, denied)
+			warningMessage = denied.Error()
+		} else {
+			warningMessage = decision.Warning
+			patches, err = decision.Patch("/spec/template/metadata", "/spec/template/spec")
+			if err != nil {
+				log.DefaultLogger.WithContext(ctx).Println("failed to generate patch:", err)
+				h.generateInjectionFailedEvent(ctx, ds, fmt.Errorf("failed to generate patch: %w", err))
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
 		}
-		resp = admission.PatchResponseFromRaw(req.Object.Raw, updatedRaw)
+		resp = admission.Patched("", append(patches, coverage.patches...)...)
 		if warningMessage != "" {
 			resp = resp.WithWarnings(warningMessage)
 		}
 		err = resp.Complete(req)
 		if err != nil {
 			log.DefaultLogger.WithContext(ctx).Println("failed to patch response:", err)
-		} else {
-			if len(resp.Patches) > 0 {
+		} else if denied == nil {
+			if len(patches) > 0 {
 				h.generateInjectionSuccessEvent(ctx, ds)
 			}
+			if msg := substitutionMessage(ds.Spec.Template.Annotations, decision.ObjectMeta.Annotations, &decision.Spec); msg != "" {
+				h.generateSubstitutionEvent(ctx, ds, msg)
+			}
 		}
 	default:
 		log.DefaultLogger.WithContext(ctx).Printf("nothing to do for type %v", req.Kind.Kind)
@@ -546,58 +1001,62 @@ func (h *Handler) isArchSupported(arch string) bool {
 // A decoder will be automatically injected.
 
 // InjectDecoder injects the decoder.
-func (a *Handler) InjectDecoder(d *admission.Decoder) error {
+func (a *Handler) InjectDecoder(d admission.Decoder) error {
 	a.decoder = d
 	return nil
 }
 
 func (h *Handler) generatePodInjectionSuccessEvent(ctx context.Context, pod *v1.Pod) {
-	f := func(string) string {
-		return fmt.Sprintf("Injected node selector to pod %v", pod.Name)
-	}
-	upsertNodeSelectorInjectionEvent(
-		log.AddLogFieldsToContext(ctx, logrus.Fields{"object": "Pod", "objectName": pod.Name}),
-		h.Client,
-		pod,
-		"Normal",
-		"InjectedNodeSelector",
-		"injection-succeeded",
-		f,
-	)
-	for _, ref := range pod.OwnerReferences {
-		if ref.Controller != nil && *ref.Controller {
-			u := &unstructured.Unstructured{}
-			u.SetAPIVersion(ref.APIVersion)
-			u.SetKind(ref.Kind)
-			u.SetName(ref.Name)
-			u.SetNamespace(pod.Namespace)
-			u.SetUID(ref.UID)
-			upsertNodeSelectorInjectionEvent(
-				log.AddLogFieldsToContext(ctx, logrus.Fields{"object": ref.Kind, "objectName": ref.Name}),
-				h.Client,
-				u,
-				"Normal",
-				"InjectedNodeSelector",
-				"injection-succeeded",
-				f,
-			)
+	h.recordPodEvent(pod, v1.EventTypeNormal, "InjectedNodeSelector", "InjectNodeSelector", "Injected node selector to pod %s", podDisplayName(pod))
+}
+
+func (h *Handler) generatePodInjectionFailedEvent(ctx context.Context, pod *v1.Pod, err error) {
+	h.recordPodEvent(pod, v1.EventTypeWarning, "FailedToInjectNodeSelector", "InjectNodeSelector", "Failed to inject node selector to pod %s: %v", podDisplayName(pod), err)
+}
+
+func (h *Handler) generateInjectionFailedEvent(ctx context.Context, obj client.Object, err error) {
+	h.recordEvent(obj, nil, v1.EventTypeWarning, "FailedToInjectNodeSelector", "InjectNodeSelector", "Failed to inject node selector to %s %s: %v", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName(), err)
+}
+
+func (h *Handler) generateInjectionSuccessEvent(ctx context.Context, obj client.Object) {
+	h.recordEvent(obj, nil, v1.EventTypeNormal, "InjectedNodeSelector", "InjectNodeSelector", "Injected node selector to %s %s", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName())
+}
+
+func (h *Handler) generateSubstitutionEvent(ctx context.Context, obj client.Object, msg string) {
+	if pod, ok := obj.(*v1.Pod); ok {
+		h.recordPodEvent(pod, v1.EventTypeNormal, "SubstitutedImages", "SubstituteImages", "%s", msg)
+		return
+	}
+	h.recordEvent(obj, nil, v1.EventTypeNormal, "SubstitutedImages", "SubstituteImages", "%s", msg)
+}
+
+// recordPodEvent records the event on the pod and on its controlling owners.
+// The owner events are not related to the pod, so that the events of all the pods of an owner are aggregated in a single series.
+// Pods created with a generateName have no name yet at admission, only their owners get the event.
+func (h *Handler) recordPodEvent(pod *v1.Pod, eventtype, reason, action, note string, args ...interface{}) {
+	owners := ControllingOwners(pod)
+	if pod.Name != "" {
+		var related runtime.Object
+		if len(owners) > 0 {
+			related = owners[0]
 		}
+		h.recordEvent(pod, related, eventtype, reason, action, note, args...)
+	}
+	for _, owner := range owners {
+		h.recordEvent(owner, nil, eventtype, reason, action, note, args...)
 	}
 }
 
-func (h *Handler) generatePodInjectionFailedEvent(ctx context.Context, pod *v1.Pod, err error) {
-	f := func(string) string {
-		return fmt.Sprintf("Failed to inject node selector to pod %v: %v", pod.Name, err)
-	}
-	upsertNodeSelectorInjectionEvent(
-		log.AddLogFieldsToContext(ctx, logrus.Fields{"object": "Pod", "objectName": pod.Name}),
-		h.Client,
-		pod,
-		"Warning",
-		"FailedToInjectNodeSelector",
-		"injection-failed",
-		f,
-	)
+func (h *Handler) recordEvent(regarding, related runtime.Object, eventtype, reason, action, note string, args ...interface{}) {
+	if h.events == nil {
+		return
+	}
+	h.events.Eventf(regarding, related, eventtype, reason, action, note, args...)
+}
+
+// ControllingOwners returns the references to the controllers of the pod.
+func ControllingOwners(pod *v1.Pod) []runtime.Object {
+	owners := []runtime.Object{}
 	for _, ref := range pod.OwnerReferences {
 		if ref.Controller != nil && *ref.Controller {
 			u := &unstructured.Unstructured{}
@@ -606,47 +1065,18 @@ func (h *Handler) generatePodInjectionFailedEvent(ctx context.Context, pod *v1.P
 			u.SetName(ref.Name)
 			u.SetNamespace(pod.Namespace)
 			u.SetUID(ref.UID)
-			upsertNodeSelectorInjectionEvent(
-				log.AddLogFieldsToContext(ctx, logrus.Fields{"object": ref.Kind, "objectName": ref.Name}),
-				h.Client,
-				u,
-				"Warning",
-				"FailedToInjectNodeSelector",
-				"injection-failed",
-				f,
-			)
+			owners = append(owners, u)
 		}
 	}
+	return owners
 }
 
-func (h *Handler) generateInjectionFailedEvent(ctx context.Context, obj client.Object, err error) {
-	f := func(string) string {
-		return fmt.Sprintf("Failed to inject node selector to %v %v: %v", obj.GetObjectKind(), obj.GetName(), err)
-	}
-	upsertNodeSelectorInjectionEvent(
-		ctx,
-		h.Client,
-		obj,
-		"Warning",
-		"FailedToInjectNodeSelector",
-		"injection-failed",
-		f,
-	)
-}
-
-func (h *Handler) generateInjectionSuccessEvent(ctx context.Context, obj client.Object) {
-	f := func(string) string {
-		return fmt.Sprintf("Injected node selector to %v %v", obj.GetObjectKind(), obj.GetName())
-	}
-	upsertNodeSelectorInjectionEvent(
-		ctx,
-		h.Client,
-		obj,
-		"Normal",
-		"InjectedNodeSelector",
-		"injection-succeeded",
-		f,
-	)
+// podDisplayName returns the name of the pod, or its generateName prefix when the name is not generated yet.
+func podDisplayName(pod *v1.Pod) string {
+	if pod.Name == "" && pod.GenerateName != "" {
+		return pod.GenerateName + "*"
+	}
+	return pod.Name
 }
 
 func keys(set map[string]struct{}) []string {
@@ -657,46 +1087,3 @@ func keys(set map[string]struct{}) []string {
 	slices.Sort(r)
 	return r
 }
-
-func toJson(obj runtime.Object) ([]byte, error) {
-	return json.Marshal(obj)
-}
-
-func upsertNodeSelectorInjectionEvent(ctx context.Context, k8sClient client.Client, owner client.Object, podName, eventType, nameSuffix string, messageFunc func(string) string) {
-	evt := v1.Event{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: owner.GetNamespace(),
-			Name:      owner.GetName() + "-" + nameSuffix,
-		},
-	}
-	_, err := ctrl.CreateOrUpdate(ctx, k8sClient, &evt, func() error {
-		evt.Message = messageFunc(evt.Message)
-		evt.Message += "\n" + podName
-		evt.Type = eventType
-		if evt.Series == nil {
-			evt.Series = &v1.EventSeries{}
-		}
-		evt.Count++
-		evt.Series.Count++
-		evt.Series.LastObservedTime = metav1.NewMicroTime(time.Now())
-		evt.Reason = "AutomaticNodeSelectorInjection"
-		evt.Source.Component = "noe"
-		evt.LastTimestamp = metav1.NewTime(time.Now())
-		if evt.FirstTimestamp.IsZero() {
-			evt.FirstTimestamp = evt.LastTimestamp
-		}
-		evt.InvolvedObject = v1.ObjectReference{
-			APIVersion: owner.GetObjectKind().GroupVersionKind().GroupVersion().String(),
-			Kind:       owner.GetObjectKind().GroupVersionKind().Kind,
-			Name:       owner.GetName(),
-			Namespace:  owner.GetNamespace(),
-			UID:        owner.GetUID(),
-		}
-		return nil
-	})
-	if err != nil {
-		log.DefaultLogger.WithContext(ctx).WithError(err).Error("Failed to create pod node selector injection event")
-	} else {
-		log.DefaultLogger.WithContext(ctx).Trace("Created pod node selector injection event")
-	}
-}
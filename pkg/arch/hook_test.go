@@ -1,24 +1,38 @@
 package arch
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"slices"
 	"strings"
 	"testing"
 
 	"github.com/adevinta/noe/pkg/metric_test_helpers"
+	"github.com/adevinta/noe/pkg/policy"
 	"github.com/adevinta/noe/pkg/registry"
+	"github.com/adevinta/noe/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"gomodules.xyz/jsonpatch/v2"
 	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
@@ -41,6 +55,10 @@ func runWebhookTest(t testing.TB, webhook *Handler, obj runtime.Object) admissio
 	})
 }
 
+func toJson(obj runtime.Object) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
 func archNodeSelectorPatchForArchs(archs ...string) jsonpatch.Operation {
 	var tmp []interface{}
 	for _, a := range archs {
@@ -69,6 +87,31 @@ func archNodeSelectorPatchForArchs(archs ...string) jsonpatch.Operation {
 	}
 }
 
+// splitMetadataPatches splits the patches of the pod spec from the ones of the pod metadata.
+func splitMetadataPatches(patches []jsonpatch.Operation) (spec, metadata []jsonpatch.Operation) {
+	for _, patch := range patches {
+		if strings.HasPrefix(patch.Path, "/metadata") {
+			metadata = append(metadata, patch)
+		} else {
+			spec = append(spec, patch)
+		}
+	}
+	return spec, metadata
+}
+
+// injectedSelectionPatch is the patch recording the node selection injected in a pod without annotations.
+func injectedSelectionPatch(selection injectedSelection) jsonpatch.Operation {
+	raw, err := json.Marshal(selection)
+	if err != nil {
+		panic(err)
+	}
+	return jsonpatch.Operation{
+		Operation: "add",
+		Path:      "/metadata/annotations",
+		Value:     map[string]interface{}{InjectedSelectionAnnotation: string(raw)},
+	}
+}
+
 func TestAllMetricsShouldBeRegistered(t *testing.T) {
 	metrics := NewHandlerMetrics("test")
 	metric_test_helpers.AssertAllMetricsHaveBeenRegistered(t, metrics)
@@ -105,12 +148,14 @@ func TestHookAcceptsSingleImageAndAddsSelector(t *testing.T) {
 	)
 	assert.True(t, resp.Allowed)
 	assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-	require.Len(t, resp.Patches, 1)
+	patches, metadataPatches := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
 	assert.Equal(
 		t,
 		archNodeSelectorPatchForArchs("amd64", "arm64"),
-		resp.Patches[0],
+		patches[0],
 	)
+	assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("amd64", "arm64")}})}, metadataPatches)
 }
 
 func TestHookAcceptsSingleImageWithoutOSAndAddsSelector(t *testing.T) {
@@ -142,12 +187,14 @@ func TestHookAcceptsSingleImageWithoutOSAndAddsSelector(t *testing.T) {
 	)
 	assert.True(t, resp.Allowed)
 	assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-	require.Len(t, resp.Patches, 1)
+	patches, metadataPatches := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
 	assert.Equal(
 		t,
 		archNodeSelectorPatchForArchs("amd64"),
-		resp.Patches[0],
+		patches[0],
 	)
+	assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("amd64")}})}, metadataPatches)
 }
 
 func testPodLabelsMatchesNodeLabelsSelector(t *testing.T, selector string) {
@@ -191,16 +238,18 @@ func testPodLabelsMatchesNodeLabelsSelector(t *testing.T, selector string) {
 		)
 		assert.True(t, resp.Allowed)
 		assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-		require.Len(t, resp.Patches, 1)
+		patches, metadataPatches := splitMetadataPatches(resp.Patches)
+		require.Len(t, patches, 1)
 		assert.Contains(
 			t,
-			resp.Patches,
+			patches,
 			jsonpatch.Operation{
 				Operation: "add",
 				Path:      "/spec/nodeSelector/" + strings.Replace(selector, "/", "~1", -1),
 				Value:     "true",
 			},
 		)
+		assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelector: map[string]string{selector: "true"}})}, metadataPatches)
 	})
 
 	t.Run("When the pod already has a node selector", func(t *testing.T) {
@@ -237,16 +286,18 @@ func testPodLabelsMatchesNodeLabelsSelector(t *testing.T, selector string) {
 		)
 		assert.True(t, resp.Allowed)
 		assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-		require.Len(t, resp.Patches, 1)
+		patches, metadataPatches := splitMetadataPatches(resp.Patches)
+		require.Len(t, patches, 1)
 		assert.Contains(
 			t,
-			resp.Patches,
+			patches,
 			jsonpatch.Operation{
 				Operation: "add",
 				Path:      "/spec/nodeSelector/" + strings.Replace(selector, "/", "~1", -1),
 				Value:     "true",
 			},
 		)
+		assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelector: map[string]string{selector: "true"}})}, metadataPatches)
 	})
 	t.Run("When the pod already has a node affinity", func(t *testing.T) {
 		resp := runWebhookTest(
@@ -296,10 +347,11 @@ func testPodLabelsMatchesNodeLabelsSelector(t *testing.T, selector string) {
 		)
 		assert.True(t, resp.Allowed)
 		assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-		require.Len(t, resp.Patches, 1)
+		patches, metadataPatches := splitMetadataPatches(resp.Patches)
+		require.Len(t, patches, 1)
 		assert.Contains(
 			t,
-			resp.Patches,
+			patches,
 			jsonpatch.Operation{
 				Operation: "add",
 				Path:      "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/1",
@@ -316,6 +368,7 @@ func testPodLabelsMatchesNodeLabelsSelector(t *testing.T, selector string) {
 				},
 			},
 		)
+		assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{{Key: selector, Operator: v1.NodeSelectorOpIn, Values: []string{"true"}}}}}})}, metadataPatches)
 	})
 }
 
@@ -356,12 +409,14 @@ func TestHookSucceedsWhenPreferredArchUnavailable(t *testing.T) {
 	)
 	assert.True(t, resp.Allowed)
 	assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-	require.Len(t, resp.Patches, 1)
-	assert.Contains(
+	patches, metadataPatches := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
+	assert.Equal(
 		t,
-		resp.Patches,
 		archNodeSelectorPatchForArchs("amd64"),
+		patches[0],
 	)
+	assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("amd64")}})}, metadataPatches)
 }
 
 func TestHookSucceedsWhenPreferredArchUnschedulable(t *testing.T) {
@@ -398,12 +453,14 @@ func TestHookSucceedsWhenPreferredArchUnschedulable(t *testing.T) {
 	)
 	assert.True(t, resp.Allowed)
 	assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-	require.Len(t, resp.Patches, 1)
-	assert.Contains(
+	patches, metadataPatches := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
+	assert.Equal(
 		t,
-		resp.Patches,
 		archNodeSelectorPatchForArchs("amd64"),
+		patches[0],
 	)
+	assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("amd64")}})}, metadataPatches)
 }
 
 func TestHookHonorsDefaultPreferredArch(t *testing.T) {
@@ -438,15 +495,16 @@ func TestHookHonorsDefaultPreferredArch(t *testing.T) {
 	)
 	assert.True(t, resp.Allowed)
 	assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-	require.Len(t, resp.Patches, 1)
+	patches, metadataPatches := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
 	assert.NotContains(
 		t,
-		resp.Patches,
+		patches,
 		archNodeSelectorPatchForArchs("amd64", "arm64"),
 	)
 	assert.Contains(
 		t,
-		resp.Patches,
+		patches,
 		jsonpatch.Operation{
 			Operation: "add",
 			Path:      "/spec/nodeSelector",
@@ -455,6 +513,7 @@ func TestHookHonorsDefaultPreferredArch(t *testing.T) {
 			},
 		},
 	)
+	assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelector: map[string]string{archKey: "amd64"}})}, metadataPatches)
 }
 
 func TestHookAcceptsMultipleImagesAndAddsSelector(t *testing.T) {
@@ -497,12 +556,14 @@ func TestHookAcceptsMultipleImagesAndAddsSelector(t *testing.T) {
 	)
 	assert.True(t, resp.Allowed)
 	assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-	require.Len(t, resp.Patches, 1)
+	patches, metadataPatches := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
 	assert.Equal(
 		t,
 		archNodeSelectorPatchForArchs("arm64"),
-		resp.Patches[0],
+		patches[0],
 	)
+	assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("arm64")}})}, metadataPatches)
 	assert.Greater(t, len(resp.Patch), 1)
 }
 
@@ -556,15 +617,115 @@ func TestHookHandlesInitContainers(t *testing.T) {
 	)
 	assert.True(t, resp.Allowed)
 	assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-	require.Len(t, resp.Patches, 1)
+	patches, metadataPatches := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
 	assert.Equal(
 		t,
 		archNodeSelectorPatchForArchs("amd64"),
-		resp.Patches[0],
+		patches[0],
 	)
+	assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("amd64")}})}, metadataPatches)
 	assert.Greater(t, len(resp.Patch), 1)
 }
 
+func TestHookHandlesImageVolumes(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			switch image {
+			case "ubuntu":
+				return []registry.Platform{
+					{OS: "linux", Architecture: "arm64"},
+					{OS: "linux", Architecture: "amd64"},
+				}, nil
+			case "registry.company.corp/tools":
+				return []registry.Platform{
+					{OS: "linux", Architecture: "arm64"},
+				}, nil
+			case "registry.company.corp/model":
+				// non-runnable OCI artifact
+				return []registry.Platform{}, nil
+			default:
+				t.Errorf("unexpected image %s", image)
+				return nil, errors.New("unexpected image")
+			}
+		}),
+		WithOS("linux"),
+	)
+	t.Run("When the image volume has platform specific binaries", func(t *testing.T) {
+		resp := runWebhookTest(
+			t,
+			h,
+			&v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "object",
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "ubuntu",
+						},
+					},
+					Volumes: []v1.Volume{
+						{
+							Name: "tools",
+							VolumeSource: v1.VolumeSource{
+								Image: &v1.ImageVolumeSource{Reference: "registry.company.corp/tools"},
+							},
+						},
+					},
+				},
+			},
+		)
+		assert.True(t, resp.Allowed)
+		patches, metadataPatches := splitMetadataPatches(resp.Patches)
+		require.Len(t, patches, 1)
+		assert.Equal(
+			t,
+			archNodeSelectorPatchForArchs("arm64"),
+			patches[0],
+		)
+		assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("arm64")}})}, metadataPatches)
+	})
+	t.Run("When the image volume is architecture neutral", func(t *testing.T) {
+		resp := runWebhookTest(
+			t,
+			h,
+			&v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test",
+					Name:      "object",
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{
+							Image: "ubuntu",
+						},
+					},
+					Volumes: []v1.Volume{
+						{
+							Name: "model",
+							VolumeSource: v1.VolumeSource{
+								Image: &v1.ImageVolumeSource{Reference: "registry.company.corp/model"},
+							},
+						},
+					},
+				},
+			},
+		)
+		assert.True(t, resp.Allowed)
+		patches, metadataPatches := splitMetadataPatches(resp.Patches)
+		require.Len(t, patches, 1)
+		assert.Equal(
+			t,
+			archNodeSelectorPatchForArchs("amd64", "arm64"),
+			patches[0],
+		)
+		assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("amd64", "arm64")}})}, metadataPatches)
+	})
+}
+
 func TestHookHandlesContainerWhenCanNotInspectOneImage(t *testing.T) {
 	resp := runWebhookTest(
 		t,
@@ -613,12 +774,14 @@ func TestHookHandlesContainerWhenCanNotInspectOneImage(t *testing.T) {
 	)
 	assert.True(t, resp.Allowed)
 	assert.Equal(t, http.StatusOK, int(resp.Result.Code))
-	require.Len(t, resp.Patches, 1)
+	patches, metadataPatches := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
 	assert.Equal(
 		t,
 		archNodeSelectorPatchForArchs("amd64"),
-		resp.Patches[0],
+		patches[0],
 	)
+	assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("amd64")}})}, metadataPatches)
 	assert.Greater(t, len(resp.Patch), 1)
 }
 
@@ -923,7 +1086,7 @@ func TestUpdatePodSpecWithImagePullSecret(t *testing.T) {
 				},
 			},
 		}
-		assert.NoErrorf(t, h.updatePodSpec(context.TODO(), "my-ns", map[string]string{}, podSpec), "noe should fallback to standard credentials")
+		assert.NoErrorf(t, h.updatePodSpec(context.TODO(), "my-ns", &metav1.ObjectMeta{}, podSpec), "noe should fallback to standard credentials")
 	})
 	t.Run("When the image pull secret does not have docker config key", func(t *testing.T) {
 		client := fake.NewClientBuilder().
@@ -957,7 +1120,7 @@ func TestUpdatePodSpecWithImagePullSecret(t *testing.T) {
 				},
 			},
 		}
-		assert.NoErrorf(t, h.updatePodSpec(context.TODO(), "my-ns", map[string]string{}, podSpec), "noe should fallback to standard credentials")
+		assert.NoErrorf(t, h.updatePodSpec(context.TODO(), "my-ns", &metav1.ObjectMeta{}, podSpec), "noe should fallback to standard credentials")
 	})
 	t.Run("When the image pull secret is invalid", func(t *testing.T) {
 		client := fake.NewClientBuilder().
@@ -993,7 +1156,7 @@ func TestUpdatePodSpecWithImagePullSecret(t *testing.T) {
 				},
 			},
 		}
-		assert.NoErrorf(t, h.updatePodSpec(context.TODO(), "my-ns", map[string]string{}, podSpec), "noe should fallback to standard credentials")
+		assert.NoErrorf(t, h.updatePodSpec(context.TODO(), "my-ns", &metav1.ObjectMeta{}, podSpec), "noe should fallback to standard credentials")
 	})
 
 }
@@ -1001,6 +1164,747 @@ func TestUpdatePodSpecWithImagePullSecret(t *testing.T) {
 func testPodSpecIsNotModified(t *testing.T, h *Handler, original *v1.PodSpec) {
 	t.Helper()
 	result := original.DeepCopy()
-	assert.NoError(t, h.updatePodSpec(context.TODO(), "my-ns", map[string]string{}, result))
+	assert.NoError(t, h.updatePodSpec(context.TODO(), "my-ns", &metav1.ObjectMeta{}, result))
 	assert.Equal(t, original, result)
 }
+
+func archNodeSelectorTerm(archs ...string) v1.NodeSelectorTerm {
+	return v1.NodeSelectorTerm{
+		MatchExpressions: []v1.NodeSelectorRequirement{
+			{
+				Key:      "kubernetes.io/arch",
+				Operator: v1.NodeSelectorOpIn,
+				Values:   archs,
+			},
+		},
+	}
+}
+
+func requiredAffinity(terms ...v1.NodeSelectorTerm) *v1.Affinity {
+	return &v1.Affinity{
+		NodeAffinity: &v1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+				NodeSelectorTerms: terms,
+			},
+		},
+	}
+}
+
+func TestUpdatePodTemplateRecomputesInjectedSelection(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			switch image {
+			case "ubuntu":
+				return []registry.Platform{
+					{OS: "linux", Architecture: "arm64"},
+					{OS: "linux", Architecture: "amd64"},
+				}, nil
+			case "sidecar":
+				return []registry.Platform{
+					{OS: "linux", Architecture: "amd64"},
+				}, nil
+			default:
+				return nil, errors.New("image not found")
+			}
+		}),
+		WithOS("linux"),
+		WithMetricsRegistry(prometheus.NewRegistry()),
+	)
+
+	t.Run("When noe injects a selection, it is recorded", func(t *testing.T) {
+		meta := &metav1.ObjectMeta{}
+		podSpec := &v1.PodSpec{
+			Containers: []v1.Container{{Image: "ubuntu"}},
+		}
+		require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("amd64", "arm64")), podSpec.Affinity)
+		assert.JSONEq(
+			t,
+			`{"nodeSelectorTerms":[{"matchExpressions":[{"key":"kubernetes.io/arch","operator":"In","values":["amd64","arm64"]}]}]}`,
+			meta.Annotations[InjectedSelectionAnnotation],
+		)
+	})
+
+	t.Run("When a sidecar was injected after noe, the selection is recomputed", func(t *testing.T) {
+		meta := &metav1.ObjectMeta{
+			Annotations: map[string]string{
+				InjectedSelectionAnnotation: `{"nodeSelectorTerms":[{"matchExpressions":[{"key":"kubernetes.io/arch","operator":"In","values":["amd64","arm64"]}]}]}`,
+			},
+		}
+		podSpec := &v1.PodSpec{
+			Affinity:   requiredAffinity(archNodeSelectorTerm("amd64", "arm64")),
+			Containers: []v1.Container{{Image: "ubuntu"}, {Image: "sidecar"}},
+		}
+		require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("amd64")), podSpec.Affinity)
+		assert.JSONEq(
+			t,
+			`{"nodeSelectorTerms":[{"matchExpressions":[{"key":"kubernetes.io/arch","operator":"In","values":["amd64"]}]}]}`,
+			meta.Annotations[InjectedSelectionAnnotation],
+		)
+	})
+
+	t.Run("When the preferred architecture was injected, the node selector is recomputed", func(t *testing.T) {
+		h := NewHandler(h.Client, h.Registry, WithOS("linux"), WithArchitecture("arm64"))
+		meta := &metav1.ObjectMeta{
+			Annotations: map[string]string{
+				InjectedSelectionAnnotation: `{"nodeSelector":{"kubernetes.io/arch":"arm64"}}`,
+			},
+		}
+		podSpec := &v1.PodSpec{
+			NodeSelector: map[string]string{"kubernetes.io/arch": "arm64", "team": "platform"},
+			Containers:   []v1.Container{{Image: "ubuntu"}, {Image: "sidecar"}},
+		}
+		require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, map[string]string{"team": "platform"}, podSpec.NodeSelector)
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("amd64")), podSpec.Affinity)
+	})
+
+	t.Run("When the architecture selection was authored by the user, it is left untouched", func(t *testing.T) {
+		meta := &metav1.ObjectMeta{}
+		podSpec := &v1.PodSpec{
+			Affinity:   requiredAffinity(archNodeSelectorTerm("arm64")),
+			Containers: []v1.Container{{Image: "ubuntu"}, {Image: "sidecar"}},
+		}
+		original := podSpec.DeepCopy()
+		require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, original, podSpec)
+		assert.NotContains(t, meta.Annotations, InjectedSelectionAnnotation)
+	})
+
+	t.Run("When user and noe selectors are mixed, only noe's are recomputed", func(t *testing.T) {
+		userTerm := v1.NodeSelectorTerm{
+			MatchExpressions: []v1.NodeSelectorRequirement{
+				{
+					Key:      "topology.kubernetes.io/zone",
+					Operator: v1.NodeSelectorOpIn,
+					Values:   []string{"eu-west-1a"},
+				},
+			},
+		}
+		meta := &metav1.ObjectMeta{
+			Annotations: map[string]string{
+				InjectedSelectionAnnotation: `{"nodeSelectorTerms":[{"matchExpressions":[{"key":"kubernetes.io/arch","operator":"In","values":["amd64","arm64"]}]}]}`,
+			},
+		}
+		podSpec := &v1.PodSpec{
+			Affinity:   requiredAffinity(userTerm, archNodeSelectorTerm("amd64", "arm64")),
+			Containers: []v1.Container{{Image: "ubuntu"}, {Image: "sidecar"}},
+		}
+		require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+		combined := v1.NodeSelectorTerm{
+			MatchExpressions: append(slices.Clone(userTerm.MatchExpressions), archNodeSelectorTerm("amd64").MatchExpressions...),
+		}
+		assert.Equal(t, requiredAffinity(combined), podSpec.Affinity)
+		assert.Equal(
+			t,
+			`{"nodeSelectorTerms":[{"matchExpressions":[{"key":"topology.kubernetes.io/zone","operator":"In","values":["eu-west-1a"]},{"key":"kubernetes.io/arch","operator":"In","values":["amd64"]}]}],"replacedTerms":[{"matchExpressions":[{"key":"topology.kubernetes.io/zone","operator":"In","values":["eu-west-1a"]}]}]}`,
+			meta.Annotations[InjectedSelectionAnnotation],
+		)
+
+		t.Run("and the combined terms are recomputed from the user authored ones", func(t *testing.T) {
+			require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+			assert.Equal(t, requiredAffinity(combined), podSpec.Affinity)
+		})
+
+		t.Run("and the combined terms are left untouched once modified by the user", func(t *testing.T) {
+			removeInjectedSelection(podSpec, getInjectedSelection(context.Background(), meta))
+			assert.Equal(t, requiredAffinity(userTerm), podSpec.Affinity)
+
+			modified := requiredAffinity(userTerm, combined)
+			removeInjectedSelection(&v1.PodSpec{Affinity: modified}, getInjectedSelection(context.Background(), meta))
+			assert.Equal(t, requiredAffinity(userTerm, combined), modified)
+		})
+	})
+
+	t.Run("When the selection can not be recomputed, the previous one is kept", func(t *testing.T) {
+		meta := &metav1.ObjectMeta{
+			Annotations: map[string]string{
+				InjectedSelectionAnnotation: `{"nodeSelectorTerms":[{"matchExpressions":[{"key":"kubernetes.io/arch","operator":"In","values":["amd64","arm64"]}]}]}`,
+			},
+		}
+		podSpec := &v1.PodSpec{
+			Affinity:   requiredAffinity(archNodeSelectorTerm("amd64", "arm64")),
+			Containers: []v1.Container{{Image: "unknown"}},
+		}
+		original := podSpec.DeepCopy()
+		require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, original, podSpec)
+		assert.Contains(t, meta.Annotations, InjectedSelectionAnnotation)
+	})
+}
+
+func TestHookRecomputesDaemonSetSelectionOnlyWhenImagesChange(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			switch image {
+			case "agent:v2":
+				return []registry.Platform{
+					{OS: "linux", Architecture: "amd64"},
+				}, nil
+			default:
+				return []registry.Platform{
+					{OS: "linux", Architecture: "arm64"},
+					{OS: "linux", Architecture: "amd64"},
+				}, nil
+			}
+		}),
+		WithOS("linux"),
+	)
+	h.InjectDecoder(admission.NewDecoder(scheme.Scheme))
+
+	daemonSet := func(image string) *appsv1.DaemonSet {
+		return &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "test",
+				Name:      "agent",
+				Annotations: map[string]string{
+					DaemonSetOSAnnotation:            "linux",
+					DaemonSetArchitecturesAnnotation: "amd64,arm64",
+				},
+			},
+			Spec: appsv1.DaemonSetSpec{
+				Template: v1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							InjectedSelectionAnnotation: `{"nodeSelectorTerms":[{"matchExpressions":[{"key":"kubernetes.io/arch","operator":"In","values":["amd64","arm64"]}]}]}`,
+						},
+					},
+					Spec: v1.PodSpec{
+						Affinity:   requiredAffinity(archNodeSelectorTerm("amd64", "arm64")),
+						Containers: []v1.Container{{Image: image}},
+					},
+				},
+			},
+		}
+	}
+	update := func(t *testing.T, old, new *appsv1.DaemonSet) admission.Response {
+		t.Helper()
+		oldRaw, err := toJson(old)
+		require.NoError(t, err)
+		newRaw, err := toJson(new)
+		require.NoError(t, err)
+		return h.Handle(context.Background(), admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+				Operation: admissionv1.Update,
+				Object:    runtime.RawExtension{Raw: newRaw},
+				OldObject: runtime.RawExtension{Raw: oldRaw},
+			},
+		})
+	}
+
+	t.Run("When the images did not change", func(t *testing.T) {
+		resp := update(t, daemonSet("agent:v1"), daemonSet("agent:v1"))
+		assert.True(t, resp.Allowed)
+		assert.Len(t, resp.Patches, 0)
+	})
+	t.Run("When the images did not change but the injected selection was removed", func(t *testing.T) {
+		updated := daemonSet("agent:v1")
+		updated.Spec.Template.Spec.Affinity = nil
+		resp := update(t, daemonSet("agent:v1"), updated)
+		assert.True(t, resp.Allowed)
+		require.Len(t, resp.Patches, 1)
+		assert.Equal(
+			t,
+			jsonpatch.Operation{
+				Operation: "add",
+				Path:      "/spec/template/spec/affinity",
+				Value:     archNodeSelectorPatchForArchs("amd64", "arm64").Value,
+			},
+			resp.Patches[0],
+		)
+
+		updated = daemonSet("agent:v1")
+		updated.Spec.Template.Spec.Affinity = nil
+		delete(updated.Spec.Template.Annotations, InjectedSelectionAnnotation)
+		resp = update(t, daemonSet("agent:v1"), updated)
+		assert.True(t, resp.Allowed)
+		assert.ElementsMatch(
+			t,
+			[]jsonpatch.Operation{
+				{
+					Operation: "add",
+					Path:      "/spec/template/spec/affinity",
+					Value:     archNodeSelectorPatchForArchs("amd64", "arm64").Value,
+				},
+				{
+					Operation: "add",
+					Path:      "/spec/template/metadata/annotations",
+					Value:     injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("amd64", "arm64")}}).Value,
+				},
+			},
+			resp.Patches,
+		)
+	})
+	t.Run("When the images changed", func(t *testing.T) {
+		resp := update(t, daemonSet("agent:v1"), daemonSet("agent:v2"))
+		assert.True(t, resp.Allowed)
+		require.Len(t, resp.Patches, 3)
+		assert.ElementsMatch(
+			t,
+			[]jsonpatch.Operation{
+				{
+					Operation: "replace",
+					Path:      "/metadata/annotations/arch.noe.adevinta.com~1daemonset-architectures",
+					Value:     "amd64",
+				},
+				{
+					Operation: "remove",
+					Path:      "/spec/template/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms/0/matchExpressions/0/values/1",
+				},
+				{
+					Operation: "replace",
+					Path:      "/spec/template/metadata/annotations/arch.noe.adevinta.com~1injected-selection",
+					Value:     `{"nodeSelectorTerms":[{"matchExpressions":[{"key":"kubernetes.io/arch","operator":"In","values":["amd64"]}]}]}`,
+				},
+			},
+			resp.Patches,
+		)
+	})
+}
+
+func TestHookConstrainsDaemonSetsToCompatibleNodes(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			switch image {
+			case "agent:amd64":
+				return []registry.Platform{{OS: "linux", Architecture: "amd64"}}, nil
+			case "agent:arm64":
+				return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+			}
+			return []registry.Platform{{OS: "linux", Architecture: "arm64"}, {OS: "linux", Architecture: "amd64"}}, nil
+		}),
+		WithOS("linux"),
+		WithArchitecture("arm64"),
+	)
+	h.InjectDecoder(admission.NewDecoder(scheme.Scheme))
+	create := func(t *testing.T, images ...string) admission.Response {
+		t.Helper()
+		ds := &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "agent"},
+		}
+		for i, image := range images {
+			ds.Spec.Template.Spec.Containers = append(ds.Spec.Template.Spec.Containers, v1.Container{Name: fmt.Sprintf("c%d", i), Image: image})
+		}
+		raw, err := toJson(ds)
+		require.NoError(t, err)
+		return h.Handle(context.Background(), admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+	}
+
+	coverage := func(archs string) jsonpatch.Operation {
+		return jsonpatch.Operation{
+			Operation: "add",
+			Path:      "/metadata/annotations",
+			Value:     map[string]interface{}{DaemonSetOSAnnotation: "linux", DaemonSetArchitecturesAnnotation: archs},
+		}
+	}
+
+	t.Run("When the images support all the nodes, the preferred architecture is ignored", func(t *testing.T) {
+		resp := create(t, "agent:multiarch")
+		assert.True(t, resp.Allowed)
+		assert.Contains(t, resp.Patches, jsonpatch.Operation{
+			Operation: "add",
+			Path:      "/spec/template/spec/affinity",
+			Value: map[string]interface{}{"nodeAffinity": map[string]interface{}{"requiredDuringSchedulingIgnoredDuringExecution": map[string]interface{}{
+				"nodeSelectorTerms": []interface{}{map[string]interface{}{"matchExpressions": []interface{}{map[string]interface{}{"key": archKey, "operator": "In", "values": []interface{}{"amd64", "arm64"}}}}},
+			}}},
+		})
+		assert.Contains(t, resp.Patches, coverage("amd64,arm64"))
+	})
+
+	t.Run("When the images support some architectures, the affinity is narrowed and the supported architectures recorded", func(t *testing.T) {
+		resp := create(t, "agent:amd64", "agent:multiarch")
+		assert.True(t, resp.Allowed)
+		assert.Contains(t, resp.Patches, jsonpatch.Operation{
+			Operation: "add",
+			Path:      "/spec/template/spec/affinity",
+			Value: map[string]interface{}{"nodeAffinity": map[string]interface{}{"requiredDuringSchedulingIgnoredDuringExecution": map[string]interface{}{
+				"nodeSelectorTerms": []interface{}{map[string]interface{}{"matchExpressions": []interface{}{map[string]interface{}{"key": archKey, "operator": "In", "values": []interface{}{"amd64"}}}}},
+			}}},
+		})
+		assert.Contains(t, resp.Patches, coverage("amd64"))
+	})
+
+	t.Run("When the images share no architecture, the daemonset is admitted unmodified with a warning", func(t *testing.T) {
+		resp := create(t, "agent:amd64", "agent:arm64")
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, []jsonpatch.Operation{coverage("")}, resp.Patches)
+		require.Len(t, resp.Warnings, 1)
+		assert.Contains(t, resp.Warnings[0], "could not find a common image architecture across all containers")
+	})
+}
+
+func TestParseIgnoredImages(t *testing.T) {
+	assert.Equal(t, []string{}, ParseIgnoredImages(""))
+	assert.Equal(t, []string{"istio/proxyv2:*", "docker.io/fluent/*"}, ParseIgnoredImages("istio/proxyv2:*, docker.io/fluent/*"))
+	assert.Equal(t, []string{"istio/proxyv2:*"}, ParseIgnoredImages("istio/proxyv2:*,[invalid"))
+}
+
+func TestHookExcludesIgnoredImages(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			assert.Equal(t, "ubuntu", image)
+			return []registry.Platform{
+				{OS: "linux", Architecture: "arm64"},
+				{OS: "linux", Architecture: "amd64"},
+			}, nil
+		}),
+		WithOS("linux"),
+		WithIgnoredImages([]string{"istio/proxyv2:*"}),
+	)
+	resp := runWebhookTest(
+		t,
+		h,
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "test",
+				Name:      "object",
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{
+						Image: "ubuntu",
+					},
+					{
+						Image: "istio/proxyv2:1.20.0",
+					},
+				},
+			},
+		},
+	)
+	assert.True(t, resp.Allowed)
+	patches, metadataPatches := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
+	assert.Equal(
+		t,
+		archNodeSelectorPatchForArchs("amd64", "arm64"),
+		patches[0],
+	)
+	assert.Equal(t, []jsonpatch.Operation{injectedSelectionPatch(injectedSelection{NodeSelectorTerms: []v1.NodeSelectorTerm{archNodeSelectorTerm("amd64", "arm64")}})}, metadataPatches)
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.ImageIgnored.WithLabelValues("test", "istio/proxyv2:*")))
+}
+
+func TestHookMatchesIgnoredImagesOnNormalizedReferences(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			assert.Equal(t, "ubuntu", image)
+			return []registry.Platform{
+				{OS: "linux", Architecture: "arm64"},
+				{OS: "linux", Architecture: "amd64"},
+			}, nil
+		}),
+		WithOS("linux"),
+		WithIgnoredImages(ParseIgnoredImages("docker.io/fluent/fluent-bit:*,*/istio/proxyv2:*")),
+	)
+	resp := runWebhookTest(
+		t,
+		h,
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "test",
+				Name:      "object",
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{
+						Image: "ubuntu",
+					},
+					{
+						Image: "fluent/fluent-bit:2.0",
+					},
+					{
+						Image: "istio/proxyv2:1.20.0",
+					},
+				},
+			},
+		},
+	)
+	assert.True(t, resp.Allowed)
+	patches, _ := splitMetadataPatches(resp.Patches)
+	require.Len(t, patches, 1)
+	assert.Equal(t, archNodeSelectorPatchForArchs("amd64", "arm64"), patches[0])
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.ImageIgnored.WithLabelValues("test", "docker.io/fluent/fluent-bit:*")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.ImageIgnored.WithLabelValues("test", "*/istio/proxyv2:*")))
+}
+
+func TestHookHonorsContainerPlatformsOverride(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			switch image {
+			case "ubuntu":
+				return []registry.Platform{
+					{OS: "linux", Architecture: "arm64"},
+					{OS: "linux", Architecture: "amd64"},
+				}, nil
+			case "vendor/broken":
+				// the manifest claims arm64 support while binaries are amd64
+				return []registry.Platform{
+					{OS: "linux", Architecture: "arm64"},
+				}, nil
+			}
+			return nil, errors.New("image not found")
+		}),
+		WithOS("linux"),
+	)
+	pod := func(annotations map[string]string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        "object",
+				Annotations: annotations,
+			},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{
+						Name:  "app",
+						Image: "ubuntu",
+					},
+					{
+						Name:  "vendor",
+						Image: "vendor/broken",
+					},
+				},
+			},
+		}
+	}
+	t.Run("When the container has a platforms override", func(t *testing.T) {
+		resp := runWebhookTest(t, h, pod(map[string]string{
+			"arch.noe.adevinta.com/container-platforms.vendor": "linux/amd64",
+		}))
+		assert.True(t, resp.Allowed)
+		assert.Contains(
+			t,
+			resp.Patches,
+			archNodeSelectorPatchForArchs("amd64"),
+		)
+	})
+	t.Run("When the platforms override is invalid", func(t *testing.T) {
+		resp := runWebhookTest(t, h, pod(map[string]string{
+			"arch.noe.adevinta.com/container-platforms.vendor": "amd64",
+		}))
+		assert.True(t, resp.Allowed)
+		assert.Contains(
+			t,
+			resp.Patches,
+			archNodeSelectorPatchForArchs("arm64"),
+		)
+		require.Len(t, resp.Warnings, 1)
+		assert.Contains(t, resp.Warnings[0], `invalid platforms override "amd64" for container vendor`)
+	})
+}
+
+func TestUpdatePodTemplateAppliesNamespacePolicy(t *testing.T) {
+	policies := policy.NewStore(fake.NewClientBuilder().WithObjects(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "arm-team", Labels: map[string]string{"team": "arm"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+	).Build())
+	policies.Set(policy.NamedPolicy{
+		Name:              "arm",
+		NamespaceSelector: labels.SelectorFromSet(labels.Set{"team": "arm"}),
+		Policy: policy.Policy{
+			PreferredArchitecture: "arm64",
+			RegistryProxies:       []registry.RegistryProxy{{Registry: "docker.io", Proxy: "proxy.company.corp"}},
+		},
+	})
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			return []registry.Platform{
+				{OS: "linux", Architecture: "arm64"},
+				{OS: "linux", Architecture: "amd64"},
+			}, nil
+		}),
+		WithOS("linux"),
+		WithArchitecture("amd64"),
+		WithPolicies(policies),
+	)
+
+	for namespace, expected := range map[string]string{"arm-team": "arm64", "other": "amd64"} {
+		t.Run(namespace, func(t *testing.T) {
+			podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "ubuntu"}}}
+			require.NoError(t, h.updatePodTemplate(context.Background(), namespace, &metav1.ObjectMeta{}, podSpec))
+			assert.Equal(t, map[string]string{archKey: expected}, podSpec.NodeSelector)
+		})
+	}
+
+	t.Run("registry settings are carried to the registry", func(t *testing.T) {
+		h.Registry = RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			config, ok := registry.ConfigFromContext(ctx)
+			require.True(t, ok)
+			assert.Equal(t, []registry.RegistryProxy{{Registry: "docker.io", Proxy: "proxy.company.corp"}}, config.Proxies)
+			return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+		})
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "ubuntu"}}}
+		require.NoError(t, h.updatePodTemplate(context.Background(), "arm-team", &metav1.ObjectMeta{}, podSpec))
+	})
+
+	t.Run("the handler configuration is used when the namespace can't be read", func(t *testing.T) {
+		h.Registry = RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			return []registry.Platform{
+				{OS: "linux", Architecture: "arm64"},
+				{OS: "linux", Architecture: "amd64"},
+			}, nil
+		})
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "ubuntu"}}}
+		require.NoError(t, h.updatePodTemplate(context.Background(), "missing", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+	})
+}
+
+type recordedEvent struct {
+	regarding string
+	related   string
+	reason    string
+	note      string
+}
+
+type recordingEventRecorder struct {
+	events []recordedEvent
+}
+
+func (r *recordingEventRecorder) Eventf(regarding runtime.Object, related runtime.Object, eventtype, reason, action, note string, args ...interface{}) {
+	evt := recordedEvent{
+		regarding: regarding.(metav1.Object).GetName(),
+		reason:    reason,
+		note:      fmt.Sprintf(note, args...),
+	}
+	if related != nil {
+		evt.related = related.(metav1.Object).GetName()
+	}
+	r.events = append(r.events, evt)
+}
+
+func TestHookRecordsEventsOnPodsAndOwners(t *testing.T) {
+	newPod := func(name, generateName string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:    "ns",
+				Name:         name,
+				GenerateName: generateName,
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-7d9f", UID: "web-7d9f-uid", Controller: pointer.Bool(true)},
+				},
+			},
+			Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "ubuntu"}}},
+		}
+	}
+	newHandler := func(recorder *recordingEventRecorder) *Handler {
+		return NewHandler(
+			fake.NewClientBuilder().Build(),
+			RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+				return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+			}),
+			WithOS("linux"),
+			WithEventRecorder(recorder),
+		)
+	}
+
+	t.Run("When the pod has a name, the event is recorded on the pod and its owner", func(t *testing.T) {
+		recorder := &recordingEventRecorder{}
+		runWebhookTest(t, newHandler(recorder), newPod("web-7d9f-abcde", ""))
+		assert.Equal(t, []recordedEvent{
+			{regarding: "web-7d9f-abcde", related: "web-7d9f", reason: "InjectedNodeSelector", note: "Injected node selector to pod web-7d9f-abcde"},
+			{regarding: "web-7d9f", reason: "InjectedNodeSelector", note: "Injected node selector to pod web-7d9f-abcde"},
+		}, recorder.events)
+	})
+
+	t.Run("When the pod name is generated, the event is only recorded on its owner", func(t *testing.T) {
+		recorder := &recordingEventRecorder{}
+		runWebhookTest(t, newHandler(recorder), newPod("", "web-7d9f-"))
+		assert.Equal(t, []recordedEvent{
+			{regarding: "web-7d9f", reason: "InjectedNodeSelector", note: "Injected node selector to pod web-7d9f-*"},
+		}, recorder.events)
+	})
+}
+
+func TestHookTracesAdmissionsFromThePropagatedContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := tracing.Setup(context.Background(), tracing.WithExporter(exporter))
+	require.NoError(t, err)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	h := NewHandler(
+		fake.NewClientBuilder().WithObjects(&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "registry"},
+			Data:       map[string][]byte{".dockerconfigjson": []byte(`{"auths":{"registry.company.corp":{"auth":"dXNlcjpwYXNz"}}}`)},
+		}).Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			assert.NotEmpty(t, imagePullSecret)
+			return []registry.Platform{{OS: "linux", Architecture: "amd64"}}, nil
+		}),
+		WithOS("linux"),
+		WithArchitecture("amd64"),
+		WithDecoder(admission.NewDecoder(scheme.Scheme)),
+	)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod"},
+		Spec: v1.PodSpec{
+			ImagePullSecrets: []v1.LocalObjectReference{{Name: "registry"}},
+			Containers: []v1.Container{
+				{Name: "app", Image: "registry.company.corp/app"},
+				{Name: "side", Image: "registry.company.corp/side"},
+			},
+		},
+	}
+	raw, err := toJson(pod)
+	require.NoError(t, err)
+	review, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Namespace: "ns",
+			Name:      "pod",
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(review))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	w := httptest.NewRecorder()
+	tracing.Handler("admission", &webhook.Admission{Handler: h}).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	byName := map[string][]tracetest.SpanStub{}
+	for _, s := range exporter.GetSpans() {
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", s.SpanContext.TraceID().String())
+		byName[s.Name] = append(byName[s.Name], s)
+	}
+	require.Len(t, byName["admission"], 1)
+	assert.Equal(t, "b7ad6b7169203331", byName["admission"][0].Parent.SpanID().String())
+
+	require.Len(t, byName["Admission"], 1)
+	admissionSpan := byName["Admission"][0]
+	assert.Equal(t, byName["admission"][0].SpanContext.SpanID(), admissionSpan.Parent.SpanID())
+	assert.Contains(t, admissionSpan.Attributes, attribute.String("kind", "Pod"))
+	assert.Contains(t, admissionSpan.Attributes, attribute.Bool("allowed", true))
+
+	require.Len(t, byName["GetImagePullSecrets"], 1)
+	assert.Equal(t, admissionSpan.SpanContext.SpanID(), byName["GetImagePullSecrets"][0].Parent.SpanID())
+
+	images := []string{}
+	for _, s := range byName["ListArchs"] {
+		assert.Equal(t, admissionSpan.SpanContext.SpanID(), s.Parent.SpanID())
+		for _, attr := range s.Attributes {
+			if attr.Key == "image" {
+				images = append(images, attr.Value.AsString())
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{"registry.company.corp/app", "registry.company.corp/side"}, images)
+}
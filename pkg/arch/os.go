@@ -0,0 +1,231 @@
+package arch
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/adevinta/noe/pkg/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+const osKey = "kubernetes.io/os"
+
+// windowsBuildKey is the node label holding the Windows build of the node, in the form of major.minor.build
+const windowsBuildKey = "node.kubernetes.io/windows-build"
+
+const windowsOS = "windows"
+
+// ParseOSes parses a comma separated list of OSes, e.g. linux,windows
+func ParseOSes(oses string) []string {
+	r := []string{}
+	for _, os := range strings.Split(oses, ",") {
+		os = strings.TrimSpace(os)
+		if os != "" {
+			r = append(r, os)
+		}
+	}
+	return r
+}
+
+// WithOSes sets the OSes schedulable in the cluster, by order of preference.
+// When more than one OS is schedulable, Noe also selects the OS of the pods.
+func WithOSes(oses []string) HandlerOption {
+	return func(h *Handler) {
+		h.systemOSes = oses
+	}
+}
+
+func (h *Handler) isMixedOS() bool {
+	return len(h.systemOSes) > 1
+}
+
+// candidateOSes returns the OSes the pod can run on, by order of preference.
+// The pod OS (spec.os.name) or an OS node selector restrict them to a single one.
+func (h *Handler) candidateOSes(ctx context.Context, podSpec *v1.PodSpec) []string {
+	if podSpec.OS != nil && podSpec.OS.Name != "" {
+		log.DefaultLogger.WithContext(ctx).WithField("os", podSpec.OS.Name).Debug("using the pod OS")
+		return []string{string(podSpec.OS.Name)}
+	}
+	if os, ok := podSpec.NodeSelector[osKey]; ok && os != "" {
+		log.DefaultLogger.WithContext(ctx).WithField("os", os).Debug("using the pod OS node selector")
+		return []string{os}
+	}
+	if len(h.systemOSes) == 0 {
+		return []string{""}
+	}
+	return h.systemOSes
+}
+
+// imageArchitectures returns, for each non architecture neutral image, the schedulable architectures
+// it supports on the OS, and all the architectures it supports on the OS.
+// Platforms without OS are considered to support any OS.
+func (h *Handler) imageArchitectures(ctx context.Context, os string, images []imageArchResult) ([]map[string]struct{}, []map[string]struct{}) {
+	schedulable := []map[string]struct{}{}
+	all := []map[string]struct{}{}
+	for _, image := range images {
+		if len(image.platforms) == 0 {
+			continue
+		}
+		ctx := log.AddLogFieldsToContext(ctx, map[string]interface{}{"image": image.image})
+		imageSchedulable := map[string]struct{}{}
+		imageAll := map[string]struct{}{}
+		for _, platform := range image.platforms {
+			if platform.OS != "" && platform.OS != os {
+				log.DefaultLogger.WithContext(ctx).WithField("os", platform.OS).Info("Skipped OS does not match system's")
+				continue
+			}
+			imageAll[platform.Architecture] = struct{}{}
+			if !h.isArchSupported(platform.Architecture) {
+				log.DefaultLogger.WithContext(ctx).WithField("arch", platform.Architecture).Info("Skipped arch does not match system's")
+				continue
+			}
+			imageSchedulable[platform.Architecture] = struct{}{}
+		}
+		schedulable = append(schedulable, imageSchedulable)
+		all = append(all, imageAll)
+	}
+	return schedulable, all
+}
+
+func intersectArchitectures(sets []map[string]struct{}) map[string]struct{} {
+	if len(sets) == 0 {
+		return map[string]struct{}{}
+	}
+	r := maps.Clone(sets[0])
+	for _, set := range sets[1:] {
+		for k := range r {
+			if _, ok := set[k]; !ok {
+				delete(r, k)
+			}
+		}
+	}
+	return r
+}
+
+// windowsBuild returns the major.minor.build part of a Windows os.version, e.g. 10.0.17763 for 10.0.17763.1234
+func windowsBuild(osVersion string) string {
+	split := strings.Split(osVersion, ".")
+	if len(split) > 3 {
+		split = split[:3]
+	}
+	return strings.Join(split, ".")
+}
+
+// windowsBuilds returns the Windows builds supported by all the images for the architectures.
+// Images or platforms without os.version don't constrain the build. The boolean reports
+// whether at least one image constrains the build.
+func windowsBuilds(images []imageArchResult, archs map[string]struct{}) (map[string]struct{}, bool) {
+	var r map[string]struct{}
+	for _, image := range images {
+		builds := map[string]struct{}{}
+		constrained := len(image.platforms) > 0
+		for _, platform := range image.platforms {
+			if platform.OS != windowsOS {
+				continue
+			}
+			if _, ok := archs[platform.Architecture]; !ok {
+				continue
+			}
+			if platform.OSVersion == "" {
+				constrained = false
+				break
+			}
+			builds[windowsBuild(platform.OSVersion)] = struct{}{}
+		}
+		if !constrained || len(builds) == 0 && !hasOS(image, windowsOS) {
+			continue
+		}
+		if r == nil {
+			r = builds
+			continue
+		}
+		for k := range r {
+			if _, ok := builds[k]; !ok {
+				delete(r, k)
+			}
+		}
+	}
+	return r, r != nil
+}
+
+func hasOS(image imageArchResult, os string) bool {
+	for _, platform := range image.platforms {
+		if platform.OS == os {
+			return true
+		}
+	}
+	return false
+}
+
+// osRequirements returns the node requirements to inject alongside the architecture for the selected OS:
+// the OS itself in mixed-OS clusters, and the Windows build for Windows pods.
+func (h *Handler) osRequirements(os string, podSpec *v1.PodSpec, images []imageArchResult, archs map[string]struct{}) ([]v1.NodeSelectorRequirement, error) {
+	requirements := []v1.NodeSelectorRequirement{}
+	if _, ok := podSpec.NodeSelector[osKey]; !ok && os != "" && h.isMixedOS() {
+		requirements = append(requirements, v1.NodeSelectorRequirement{
+			Key:      osKey,
+			Operator: v1.NodeSelectorOpIn,
+			Values:   []string{os},
+		})
+	}
+	if os == windowsOS {
+		if _, ok := podSpec.NodeSelector[windowsBuildKey]; ok {
+			return requirements, nil
+		}
+		builds, constrained := windowsBuilds(images, archs)
+		if constrained {
+			if len(builds) == 0 {
+				return nil, errors.New("could not find a common windows build across all containers")
+			}
+			requirements = append(requirements, v1.NodeSelectorRequirement{
+				Key:      windowsBuildKey,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   keys(builds),
+			})
+		}
+	}
+	return requirements, nil
+}
+
+// addNodeSelectorRequirements adds single valued requirements to the pod node selector,
+// and the others to every required node affinity term.
+func addNodeSelectorRequirements(podSpec *v1.PodSpec, requirements []v1.NodeSelectorRequirement) {
+	term := v1.NodeSelectorTerm{}
+	for _, requirement := range requirements {
+		if requirement.Operator == v1.NodeSelectorOpIn && len(requirement.Values) == 1 {
+			if podSpec.NodeSelector == nil {
+				podSpec.NodeSelector = map[string]string{}
+			}
+			podSpec.NodeSelector[requirement.Key] = requirement.Values[0]
+			continue
+		}
+		term.MatchExpressions = append(term.MatchExpressions, requirement)
+	}
+	if len(term.MatchExpressions) > 0 {
+		addRequiredTerms(podSpec, []v1.NodeSelectorTerm{term})
+	}
+}
+
+// addRequiredTerms requires the pod to match one of the terms on top of its existing required node affinity.
+// As node selector terms are ORed, each existing term is combined with each of the new ones,
+// so that a node matching a user authored term must also match one of the new terms.
+func addRequiredTerms(podSpec *v1.PodSpec, terms []v1.NodeSelectorTerm) {
+	nodeSelector := ensureRequiredNodeSelector(podSpec)
+	if len(nodeSelector.NodeSelectorTerms) == 0 {
+		nodeSelector.NodeSelectorTerms = terms
+		return
+	}
+	combined := []v1.NodeSelectorTerm{}
+	for _, existing := range nodeSelector.NodeSelectorTerms {
+		for _, term := range terms {
+			combined = append(combined, v1.NodeSelectorTerm{
+				MatchExpressions: append(slices.Clone(existing.MatchExpressions), term.MatchExpressions...),
+				MatchFields:      append(slices.Clone(existing.MatchFields), term.MatchFields...),
+			})
+		}
+	}
+	nodeSelector.NodeSelectorTerms = combined
+}
@@ -0,0 +1,117 @@
+package arch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func mixedOSTestRegistry(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+	switch image {
+	case "linux-only":
+		return []registry.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}, nil
+	case "windows-only":
+		return []registry.Platform{{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1234"}}, nil
+	case "windows-ltsc2022":
+		return []registry.Platform{{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.887"}}, nil
+	case "windows-multi-build":
+		return []registry.Platform{
+			{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1234"},
+			{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.887"},
+		}, nil
+	case "windows-unversioned":
+		return []registry.Platform{{OS: "windows", Architecture: "amd64"}}, nil
+	}
+	return []registry.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+		{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1234"},
+	}, nil
+}
+
+func TestParseOSes(t *testing.T) {
+	assert.Equal(t, []string{"linux", "windows"}, ParseOSes("linux, windows,"))
+	assert.Equal(t, []string{}, ParseOSes(""))
+}
+
+func TestWindowsBuild(t *testing.T) {
+	assert.Equal(t, "10.0.17763", windowsBuild("10.0.17763.1234"))
+	assert.Equal(t, "10.0.17763", windowsBuild("10.0.17763"))
+}
+
+func TestUpdatePodSpecMixedOS(t *testing.T) {
+	newHandler := func() *Handler {
+		return NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(mixedOSTestRegistry), WithOS("linux,windows"), WithArchitecture("amd64"))
+	}
+
+	t.Run("the first OS supported by all images is selected", func(t *testing.T) {
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "linux-only"}, {Image: "multi-os"}}}
+		require.NoError(t, newHandler().updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64", osKey: "linux"}, podSpec.NodeSelector)
+	})
+
+	t.Run("windows images select windows nodes of a matching build", func(t *testing.T) {
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "windows-only"}, {Image: "multi-os"}}}
+		require.NoError(t, newHandler().updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64", osKey: "windows", windowsBuildKey: "10.0.17763"}, podSpec.NodeSelector)
+	})
+
+	t.Run("the pod OS restricts the candidate OSes", func(t *testing.T) {
+		podSpec := &v1.PodSpec{
+			OS:         &v1.PodOS{Name: v1.Windows},
+			Containers: []v1.Container{{Image: "multi-os"}},
+		}
+		require.NoError(t, newHandler().updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64", osKey: "windows", windowsBuildKey: "10.0.17763"}, podSpec.NodeSelector)
+	})
+
+	t.Run("an OS node selector restricts the candidate OSes and is kept", func(t *testing.T) {
+		podSpec := &v1.PodSpec{
+			NodeSelector: map[string]string{osKey: "windows"},
+			Containers:   []v1.Container{{Image: "multi-os"}, {Image: "windows-multi-build"}},
+		}
+		require.NoError(t, newHandler().updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64", osKey: "windows", windowsBuildKey: "10.0.17763"}, podSpec.NodeSelector)
+	})
+
+	t.Run("images requiring different windows builds are rejected", func(t *testing.T) {
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "windows-only"}, {Image: "windows-ltsc2022"}}}
+		assert.Error(t, newHandler().updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+	})
+
+	t.Run("images without os version do not constrain the windows build", func(t *testing.T) {
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "windows-unversioned"}}}
+		require.NoError(t, newHandler().updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64", osKey: "windows"}, podSpec.NodeSelector)
+	})
+
+	t.Run("the OS is added to the architecture affinity", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(mixedOSTestRegistry), WithOS("linux,windows"))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "linux-only"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Empty(t, podSpec.NodeSelector)
+		assert.Equal(
+			t,
+			requiredAffinity(v1.NodeSelectorTerm{
+				MatchExpressions: []v1.NodeSelectorRequirement{
+					{Key: archKey, Operator: v1.NodeSelectorOpIn, Values: []string{"amd64", "arm64"}},
+					{Key: osKey, Operator: v1.NodeSelectorOpIn, Values: []string{"linux"}},
+				},
+			}),
+			podSpec.Affinity,
+		)
+	})
+
+	t.Run("single OS clusters do not inject the OS", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(mixedOSTestRegistry), WithOS("linux"), WithArchitecture("amd64"))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "multi-os"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+	})
+}
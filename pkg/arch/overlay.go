@@ -0,0 +1,193 @@
+package arch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/adevinta/noe/pkg/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// OverlaysAnnotation holds the architecture overlays of a pod, as a YAML or JSON map of architectures to overlays, e.g.
+//
+//	arm64:
+//	  containers:
+//	  - name: app
+//	    env:
+//	    - name: JAVA_OPTS
+//	      value: -XX:+UseSVE=0
+const OverlaysAnnotation = "arch.noe.adevinta.com/overlays"
+
+// OverlaysConfigMapAnnotation references a ConfigMap of the pod namespace holding the overlay of each architecture,
+// keyed by architecture. Overlays declared in OverlaysAnnotation take precedence.
+const OverlaysConfigMapAnnotation = "arch.noe.adevinta.com/overlays-configmap"
+
+// OverlayAppliedAnnotation records the architecture of the overlay applied to the pod.
+// Overlays are applied only once, so that reinvocations do not append the arguments twice.
+// As overlays can't be reverted, the node selection of pods with an applied overlay is never moved to another architecture.
+const OverlayAppliedAnnotation = "arch.noe.adevinta.com/overlay-applied"
+
+// overlayArchChanged is returned when the recomputed node selection doesn't match the architecture of the overlay
+// already applied to the pod. The previous node selection is then kept.
+type overlayArchChanged struct {
+	applied string
+}
+
+func (e overlayArchChanged) Error() string {
+	return fmt.Sprintf("the %s architecture overlay was already applied, keeping the previous node selection", e.applied)
+}
+
+// ContainerOverlay is applied to the container with the given name, or to all the containers when the name is empty.
+// Init containers are overlaid as well.
+type ContainerOverlay struct {
+	Name string `json:"name,omitempty"`
+	// Resources override the container requests and limits of the same resources
+	Resources v1.ResourceRequirements `json:"resources,omitempty"`
+	// Env override the container variables of the same name, the others are appended
+	Env []v1.EnvVar `json:"env,omitempty"`
+	// Args are appended to the container arguments
+	Args []string `json:"args,omitempty"`
+}
+
+// ArchOverlay is applied to the pods running on a single architecture.
+type ArchOverlay struct {
+	Containers []ContainerOverlay `json:"containers,omitempty"`
+}
+
+type ArchOverlays map[string]ArchOverlay
+
+func (h *Handler) archOverlays(ctx context.Context, namespace string, meta *metav1.ObjectMeta) (ArchOverlays, error) {
+	overlays := ArchOverlays{}
+	if name, ok := meta.Annotations[OverlaysConfigMapAnnotation]; ok {
+		cm := &v1.ConfigMap{}
+		if err := h.Client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, cm); err != nil {
+			return nil, fmt.Errorf("failed to read overlays configmap %s: %w", name, err)
+		}
+		for arch, data := range cm.Data {
+			overlay := ArchOverlay{}
+			if err := yaml.UnmarshalStrict([]byte(data), &overlay); err != nil {
+				return nil, fmt.Errorf("invalid %s overlay in configmap %s: %w", arch, name, err)
+			}
+			overlays[arch] = overlay
+		}
+	}
+	if value, ok := meta.Annotations[OverlaysAnnotation]; ok {
+		annotationOverlays := ArchOverlays{}
+		if err := yaml.UnmarshalStrict([]byte(value), &annotationOverlays); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", OverlaysAnnotation, err)
+		}
+		for arch, overlay := range annotationOverlays {
+			overlays[arch] = overlay
+		}
+	}
+	return overlays, nil
+}
+
+// applyArchOverlay applies the overlay of the architecture the pod will run on.
+// arch is empty when several architectures remain possible, the overlays are then ignored with a warning.
+func (h *Handler) applyArchOverlay(ctx context.Context, namespace string, meta *metav1.ObjectMeta, podSpec *v1.PodSpec, arch string) error {
+	_, hasOverlays := meta.Annotations[OverlaysAnnotation]
+	_, hasConfigMap := meta.Annotations[OverlaysConfigMapAnnotation]
+	if !hasOverlays && !hasConfigMap {
+		return nil
+	}
+	if applied, ok := meta.Annotations[OverlayAppliedAnnotation]; ok {
+		if applied != arch {
+			log.DefaultLogger.WithContext(ctx).WithField("arch", arch).WithField("applied", applied).Info("architecture overlay of another architecture already applied")
+			return overlayArchChanged{applied: applied}
+		}
+		log.DefaultLogger.WithContext(ctx).WithField("arch", applied).Debug("architecture overlay already applied")
+		return nil
+	}
+	overlays, err := h.archOverlays(ctx, namespace, meta)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("ignoring architecture overlays")
+		markIncompleteDecision(ctx)
+		return warning{msg: fmt.Sprintf("architecture overlays ignored: %v", err)}
+	}
+	if len(overlays) == 0 {
+		return nil
+	}
+	if arch == "" {
+		log.DefaultLogger.WithContext(ctx).Info("several architectures are possible, ignoring architecture overlays")
+		return warning{msg: "architecture overlays ignored as the pod can run on several architectures"}
+	}
+	if isDeferredResolution(ctx) {
+		log.DefaultLogger.WithContext(ctx).Info("the pod scheduling was deferred, ignoring architecture overlays")
+		return warning{msg: "architecture overlays ignored as the containers of pods with a deferred scheduling can't be changed"}
+	}
+	overlay, ok := overlays[arch]
+	if !ok {
+		return nil
+	}
+	for _, containerOverlay := range overlay.Containers {
+		for _, containers := range [][]v1.Container{podSpec.InitContainers, podSpec.Containers} {
+			for i := range containers {
+				if containerOverlay.Name == "" || containerOverlay.Name == containers[i].Name {
+					containerOverlay.apply(&containers[i])
+				}
+			}
+		}
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[OverlayAppliedAnnotation] = arch
+	log.DefaultLogger.WithContext(ctx).WithField("arch", arch).Info("applied architecture overlay")
+	h.metrics.OverlayApplied.WithLabelValues(namespace, arch).Inc()
+	return nil
+}
+
+func (o ContainerOverlay) apply(container *v1.Container) {
+	if len(o.Resources.Requests) > 0 && container.Resources.Requests == nil {
+		container.Resources.Requests = v1.ResourceList{}
+	}
+	for name, quantity := range o.Resources.Requests {
+		container.Resources.Requests[name] = quantity
+	}
+	if len(o.Resources.Limits) > 0 && container.Resources.Limits == nil {
+		container.Resources.Limits = v1.ResourceList{}
+	}
+	for name, quantity := range o.Resources.Limits {
+		container.Resources.Limits[name] = quantity
+	}
+	for _, env := range o.Env {
+		replaced := false
+		for i := range container.Env {
+			if container.Env[i].Name == env.Name {
+				container.Env[i] = env
+				replaced = true
+			}
+		}
+		if !replaced {
+			container.Env = append(container.Env, env)
+		}
+	}
+	container.Args = append(container.Args, o.Args...)
+}
+
+// joinWarnings combines the warnings returned by the different steps of the pod update.
+// Errors take precedence over warnings.
+func joinWarnings(errs ...error) error {
+	msgs := []string{}
+	var reasons []Reason
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		w, ok := err.(warning)
+		if !ok {
+			return err
+		}
+		msgs = append(msgs, w.msg)
+		reasons = append(reasons, w.reasons...)
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return warning{msg: strings.Join(msgs, "; "), reasons: reasons}
+}
@@ -0,0 +1,161 @@
+package arch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testOverlays = `
+arm64:
+  containers:
+  - name: app
+    resources:
+      requests:
+        cpu: 500m
+    env:
+    - name: JAVA_OPTS
+      value: -Xmx1g
+    args:
+    - --arm
+  - env:
+    - name: ARCH
+      value: arm64
+amd64:
+  containers:
+  - args:
+    - --amd
+`
+
+func overlayPodSpec(images ...string) *v1.PodSpec {
+	podSpec := &v1.PodSpec{}
+	for i, image := range images {
+		container := v1.Container{Name: "sidecar", Image: image}
+		if i == 0 {
+			container = v1.Container{
+				Name:  "app",
+				Image: image,
+				Args:  []string{"--port=8080"},
+				Env:   []v1.EnvVar{{Name: "JAVA_OPTS", Value: "-Xmx2g"}},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1"), v1.ResourceMemory: resource.MustParse("1Gi")},
+				},
+			}
+		}
+		podSpec.Containers = append(podSpec.Containers, container)
+	}
+	return podSpec
+}
+
+func TestUpdatePodSpecAppliesArchOverlays(t *testing.T) {
+	t.Run("the overlay of the selected architecture is applied", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"), WithArchitecture("amd64"))
+		meta := &metav1.ObjectMeta{Annotations: map[string]string{OverlaysAnnotation: testOverlays}}
+		podSpec := overlayPodSpec("arm64-only", "multi-arch")
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+
+		app := podSpec.Containers[0]
+		assert.Equal(t, []string{"--port=8080", "--arm"}, app.Args)
+		assert.Equal(t, []v1.EnvVar{{Name: "JAVA_OPTS", Value: "-Xmx1g"}, {Name: "ARCH", Value: "arm64"}}, app.Env)
+		assert.Equal(t, resource.MustParse("500m"), app.Resources.Requests[v1.ResourceCPU])
+		assert.Equal(t, resource.MustParse("1Gi"), app.Resources.Requests[v1.ResourceMemory])
+		assert.Equal(t, []v1.EnvVar{{Name: "ARCH", Value: "arm64"}}, podSpec.Containers[1].Env)
+		assert.Empty(t, podSpec.Containers[1].Args)
+		assert.Equal(t, "arm64", meta.Annotations[OverlayAppliedAnnotation])
+		assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.OverlayApplied.WithLabelValues("ns", "arm64")))
+
+		// Reinvocations do not apply the overlay twice
+		podSpec.Affinity = nil
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, []string{"--port=8080", "--arm"}, podSpec.Containers[0].Args)
+	})
+
+	t.Run("the overlay is applied to the init containers", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"), WithArchitecture("amd64"))
+		meta := &metav1.ObjectMeta{Annotations: map[string]string{OverlaysAnnotation: testOverlays}}
+		podSpec := overlayPodSpec("arm64-only")
+		podSpec.InitContainers = []v1.Container{{Name: "migrate", Image: "multi-arch"}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, []v1.EnvVar{{Name: "ARCH", Value: "arm64"}}, podSpec.InitContainers[0].Env)
+		assert.Empty(t, podSpec.InitContainers[0].Args)
+	})
+
+	t.Run("the previous selection is kept when the overlay of another architecture was applied", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"), WithArchitecture("amd64"))
+		meta := &metav1.ObjectMeta{Annotations: map[string]string{OverlaysAnnotation: testOverlays}}
+		podSpec := overlayPodSpec("arm64-only")
+		require.NoError(t, h.updatePodTemplate(context.Background(), "ns", meta, podSpec))
+		require.Equal(t, "arm64", meta.Annotations[OverlayAppliedAnnotation])
+
+		// The image now supports amd64, which is preferred
+		podSpec.Containers[0].Image = "multi-arch"
+		previousMeta, previousSpec := meta.DeepCopy(), podSpec.DeepCopy()
+		err := h.updatePodTemplate(context.Background(), "ns", meta, podSpec)
+		var warningErr warning
+		require.ErrorAs(t, err, &warningErr)
+		assert.Equal(t, "the arm64 architecture overlay was already applied, keeping the previous node selection", err.Error())
+		assert.Equal(t, previousSpec, podSpec)
+		assert.Equal(t, previousMeta, meta)
+	})
+
+	t.Run("overlays can be read from a configmap", func(t *testing.T) {
+		cm := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "overlays"},
+			Data: map[string]string{
+				"amd64": "containers:\n- args: [--from-configmap]\n",
+				"arm64": "containers:\n- args: [--arm-from-configmap]\n",
+			},
+		}
+		h := NewHandler(fake.NewClientBuilder().WithObjects(cm).Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"), WithArchitecture("amd64"))
+		meta := &metav1.ObjectMeta{Annotations: map[string]string{
+			OverlaysConfigMapAnnotation: "overlays",
+			OverlaysAnnotation:          "arm64:\n  containers:\n  - args: [--arm-from-annotation]\n",
+		}}
+		podSpec := overlayPodSpec("multi-arch")
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, []string{"--port=8080", "--from-configmap"}, podSpec.Containers[0].Args)
+
+		meta.Annotations = map[string]string{
+			OverlaysConfigMapAnnotation: "overlays",
+			OverlaysAnnotation:          "arm64:\n  containers:\n  - args: [--arm-from-annotation]\n",
+		}
+		podSpec = overlayPodSpec("arm64-only")
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, []string{"--port=8080", "--arm-from-annotation"}, podSpec.Containers[0].Args)
+	})
+
+	t.Run("overlays are ignored with a warning when several architectures are possible", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"))
+		meta := &metav1.ObjectMeta{Annotations: map[string]string{OverlaysAnnotation: testOverlays}}
+		podSpec := overlayPodSpec("multi-arch")
+		err := h.updatePodSpec(context.Background(), "ns", meta, podSpec)
+		var warningErr warning
+		require.ErrorAs(t, err, &warningErr)
+		assert.Contains(t, err.Error(), "several architectures")
+		assert.Equal(t, []string{"--port=8080"}, podSpec.Containers[0].Args)
+		assert.NotContains(t, meta.Annotations, OverlayAppliedAnnotation)
+	})
+
+	t.Run("invalid overlays are ignored with a warning", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(emulationTestRegistry), WithOS("linux"), WithArchitecture("amd64"))
+		meta := &metav1.ObjectMeta{Annotations: map[string]string{OverlaysAnnotation: "arm64: [invalid"}}
+		podSpec := overlayPodSpec("multi-arch")
+		err := h.updatePodSpec(context.Background(), "ns", meta, podSpec)
+		var warningErr warning
+		require.ErrorAs(t, err, &warningErr)
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+	})
+}
+
+func TestJoinWarnings(t *testing.T) {
+	assert.NoError(t, joinWarnings(nil, nil))
+	assert.Equal(t, warning{msg: "a; b"}, joinWarnings(warning{msg: "a"}, nil, warning{msg: "b"}))
+	assert.EqualError(t, joinWarnings(warning{msg: "a"}, assert.AnError), assert.AnError.Error())
+}
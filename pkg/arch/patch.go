@@ -0,0 +1,153 @@
+package arch
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"gomodules.xyz/jsonpatch/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pointerEscaper escapes the JSON pointer reference tokens, such as annotation keys containing slashes.
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// patchBuilder builds the JSON patch operations of the fields Noe mutates, instead of diffing the whole objects.
+// Only the changed fields are patched, so that the patches are minimal, deterministic
+// and not polluted by the normalisation of the fields Noe doesn't own.
+type patchBuilder struct {
+	patches []jsonpatch.JsonPatchOperation
+	err     error
+}
+
+// podTemplatePatch returns the operations turning the original pod metadata and spec into the updated ones.
+// metaPath and specPath are the locations of the pod metadata and spec in the patched object.
+func podTemplatePatch(metaPath, specPath string, original, updated *metav1.ObjectMeta, originalSpec, updatedSpec *v1.PodSpec) ([]jsonpatch.JsonPatchOperation, error) {
+	b := &patchBuilder{patches: []jsonpatch.JsonPatchOperation{}}
+	b.stringMap(metaPath+"/annotations", original.Annotations, updated.Annotations)
+	b.stringMap(metaPath+"/labels", original.Labels, updated.Labels)
+	b.stringMap(specPath+"/nodeSelector", originalSpec.NodeSelector, updatedSpec.NodeSelector)
+	b.field(specPath+"/affinity", originalSpec.Affinity == nil, updatedSpec.Affinity == nil, originalSpec.Affinity, updatedSpec.Affinity)
+	b.field(specPath+"/schedulingGates", len(originalSpec.SchedulingGates) == 0, len(updatedSpec.SchedulingGates) == 0, originalSpec.SchedulingGates, updatedSpec.SchedulingGates)
+	b.containers(specPath+"/initContainers", originalSpec.InitContainers, updatedSpec.InitContainers)
+	b.containers(specPath+"/containers", originalSpec.Containers, updatedSpec.Containers)
+	return b.patches, b.err
+}
+
+func (b *patchBuilder) containers(path string, original, updated []v1.Container) {
+	if len(original) != len(updated) {
+		b.err = fmt.Errorf("unexpected change of the number of containers at %s", path)
+		return
+	}
+	for i := range original {
+		containerPath := fmt.Sprintf("%s/%d", path, i)
+		b.field(containerPath+"/image", original[i].Image == "", updated[i].Image == "", original[i].Image, updated[i].Image)
+		b.field(containerPath+"/args", len(original[i].Args) == 0, len(updated[i].Args) == 0, original[i].Args, updated[i].Args)
+		b.field(containerPath+"/env", len(original[i].Env) == 0, len(updated[i].Env) == 0, original[i].Env, updated[i].Env)
+		b.field(containerPath+"/resources", false, false, original[i].Resources, updated[i].Resources)
+	}
+}
+
+// stringMap patches the changed keys of a map, or the whole map when it was empty.
+func (b *patchBuilder) stringMap(path string, original, updated map[string]string) {
+	if len(original) == 0 {
+		if len(updated) > 0 {
+			b.add("add", path, updated)
+		}
+		return
+	}
+	if len(updated) == 0 {
+		b.add("remove", path, nil)
+		return
+	}
+	for _, key := range sortedKeys(original) {
+		if _, ok := updated[key]; !ok {
+			b.add("remove", path+"/"+pointerEscaper.Replace(key), nil)
+		}
+	}
+	for _, key := range sortedKeys(updated) {
+		value, ok := original[key]
+		switch {
+		case !ok:
+			b.add("add", path+"/"+pointerEscaper.Replace(key), updated[key])
+		case value != updated[key]:
+			b.add("replace", path+"/"+pointerEscaper.Replace(key), updated[key])
+		}
+	}
+}
+
+// field patches a field when it changed.
+// Empty fields are omitted from the serialized objects: they are added as a whole when they were empty,
+// and removed when they become empty. Otherwise, only the changed members of the field are patched.
+func (b *patchBuilder) field(path string, originalEmpty, updatedEmpty bool, original, updated interface{}) {
+	switch {
+	case originalEmpty && updatedEmpty:
+	case updatedEmpty:
+		b.add("remove", path, nil)
+	case originalEmpty:
+		b.add("add", path, updated)
+	case !equality.Semantic.DeepEqual(original, updated):
+		b.diff(path, original, updated)
+	}
+}
+
+// diff patches the changed members of a field, diffing the field alone rather than the whole object.
+func (b *patchBuilder) diff(path string, original, updated interface{}) {
+	if b.err != nil {
+		return
+	}
+	originalRaw, err := json.Marshal(original)
+	if err != nil {
+		b.err = fmt.Errorf("failed to generate the %s patch: %w", path, err)
+		return
+	}
+	updatedRaw, err := json.Marshal(updated)
+	if err != nil {
+		b.err = fmt.Errorf("failed to generate the %s patch: %w", path, err)
+		return
+	}
+	patches, err := jsonpatch.CreatePatch(originalRaw, updatedRaw)
+	if err != nil {
+		b.err = fmt.Errorf("failed to generate the %s patch: %w", path, err)
+		return
+	}
+	for _, patch := range patches {
+		patch.Path = path + patch.Path
+		b.patches = append(b.patches, patch)
+	}
+}
+
+func (b *patchBuilder) add(operation, path string, value interface{}) {
+	if b.err != nil {
+		return
+	}
+	patch := jsonpatch.JsonPatchOperation{Operation: operation, Path: path}
+	if operation != "remove" {
+		v, err := jsonValue(value)
+		if err != nil {
+			b.err = fmt.Errorf("failed to generate the %s patch: %w", path, err)
+			return
+		}
+		patch.Value = v
+	}
+	b.patches = append(b.patches, patch)
+}
+
+// jsonValue converts a value to its generic JSON representation, as found in JSON patches.
+func jsonValue(value interface{}) (interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(raw, &v)
+	return v, err
+}
+
+func sortedKeys(m map[string]string) []string {
+	return slices.Sorted(maps.Keys(m))
+}
@@ -0,0 +1,77 @@
+package arch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gomodules.xyz/jsonpatch/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodTemplatePatch(t *testing.T) {
+	original := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod",
+			Annotations: map[string]string{"team": "web", "obsolete": "true"},
+		},
+		Spec: v1.PodSpec{
+			NodeSelector: map[string]string{"pool": "default"},
+			InitContainers: []v1.Container{
+				{Name: "init", Image: "busybox"},
+			},
+			Containers: []v1.Container{
+				{Name: "app", Image: "nginx", Env: []v1.EnvVar{{Name: "A", Value: "a"}}},
+			},
+		},
+	}
+
+	t.Run("When nothing changed, no patch is generated", func(t *testing.T) {
+		patches, err := podTemplatePatch("/metadata", "/spec", &original.ObjectMeta, &original.ObjectMeta, &original.Spec, &original.Spec)
+		require.NoError(t, err)
+		assert.Empty(t, patches)
+	})
+
+	t.Run("When fields changed, only the changed members are patched", func(t *testing.T) {
+		updated := original.DeepCopy()
+		delete(updated.Annotations, "obsolete")
+		updated.Annotations["arch.noe.adevinta.com/overlay-applied"] = "arm64"
+		updated.Spec.NodeSelector["kubernetes.io/arch"] = "arm64"
+		updated.Spec.Containers[0].Image = "nginx:latest@sha256:abc"
+		updated.Spec.Containers[0].Env = append(updated.Spec.Containers[0].Env, v1.EnvVar{Name: "B", Value: "b"})
+		updated.Spec.SchedulingGates = []v1.PodSchedulingGate{{Name: SchedulingGate}}
+
+		patches, err := podTemplatePatch("/metadata", "/spec", &original.ObjectMeta, &updated.ObjectMeta, &original.Spec, &updated.Spec)
+		require.NoError(t, err)
+		assert.Equal(t, []jsonpatch.JsonPatchOperation{
+			{Operation: "remove", Path: "/metadata/annotations/obsolete"},
+			{Operation: "add", Path: "/metadata/annotations/arch.noe.adevinta.com~1overlay-applied", Value: "arm64"},
+			{Operation: "add", Path: "/spec/nodeSelector/kubernetes.io~1arch", Value: "arm64"},
+			{Operation: "add", Path: "/spec/schedulingGates", Value: []interface{}{map[string]interface{}{"name": SchedulingGate}}},
+			{Operation: "replace", Path: "/spec/containers/0/image", Value: "nginx:latest@sha256:abc"},
+			{Operation: "add", Path: "/spec/containers/0/env/1", Value: map[string]interface{}{"name": "B", "value": "b"}},
+		}, patches)
+	})
+
+	t.Run("When a pod template changed, the patches are located in the template", func(t *testing.T) {
+		updated := original.DeepCopy()
+		updated.Spec.InitContainers[0].Image = "busybox:1.36"
+		updated.Spec.NodeSelector = nil
+
+		patches, err := podTemplatePatch("/spec/template/metadata", "/spec/template/spec", &original.ObjectMeta, &updated.ObjectMeta, &original.Spec, &updated.Spec)
+		require.NoError(t, err)
+		assert.Equal(t, []jsonpatch.JsonPatchOperation{
+			{Operation: "remove", Path: "/spec/template/spec/nodeSelector"},
+			{Operation: "replace", Path: "/spec/template/spec/initContainers/0/image", Value: "busybox:1.36"},
+		}, patches)
+	})
+
+	t.Run("When containers are added, the patch fails", func(t *testing.T) {
+		updated := original.DeepCopy()
+		updated.Spec.Containers = append(updated.Spec.Containers, v1.Container{Name: "sidecar", Image: "envoy"})
+
+		_, err := podTemplatePatch("/metadata", "/spec", &original.ObjectMeta, &updated.ObjectMeta, &original.Spec, &updated.Spec)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,32 @@
+package arch
+
+import (
+	"fmt"
+
+	"github.com/adevinta/noe/pkg/registry"
+)
+
+// ContainerPlatformsAnnotationPrefix allows to override the platforms reported by the registry for a given container.
+// The annotation arch.noe.adevinta.com/container-platforms.<container-name> holds a comma separated
+// list of platforms in the form of os/arch[/variant], e.g. linux/amd64,linux/arm64/v8
+const ContainerPlatformsAnnotationPrefix = "arch.noe.adevinta.com/container-platforms."
+
+// containerPlatformsOverride returns the platforms declared in the pod annotations for the container, if any,
+// or an error when the annotation is invalid.
+func containerPlatformsOverride(annotations map[string]string, container string) ([]registry.Platform, bool, error) {
+	if container == "" {
+		return nil, false, nil
+	}
+	value, ok := annotations[ContainerPlatformsAnnotationPrefix+container]
+	if !ok {
+		return nil, false, nil
+	}
+	platforms, err := registry.ParsePlatforms(value)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid platforms override %q for container %s: %w", value, container, err)
+	}
+	if len(platforms) == 0 {
+		return nil, false, fmt.Errorf("invalid platforms override %q for container %s: no platform", value, container)
+	}
+	return platforms, true, nil
+}
@@ -0,0 +1,54 @@
+package arch
+
+import (
+	"context"
+
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/policy"
+	"github.com/adevinta/noe/pkg/registry"
+)
+
+// PolicyResolver returns the policy applying to a namespace.
+type PolicyResolver interface {
+	Resolve(ctx context.Context, namespace string) (policy.Policy, error)
+}
+
+// WithPolicies makes the handler read its configuration from the policies at request time.
+// The other handler options are used as defaults.
+func WithPolicies(policies PolicyResolver) HandlerOption {
+	return func(h *Handler) {
+		h.policies = policies
+	}
+}
+
+func (h *Handler) defaultPolicy() policy.Policy {
+	return policy.Policy{
+		PreferredArchitecture:    h.preferredArchitecture,
+		SchedulableArchitectures: h.schedulableArchitectures,
+		SystemOSes:               h.systemOSes,
+		MatchNodeLabels:          h.matchNodeLabels,
+	}
+}
+
+// forNamespace returns a handler configured with the policy applying to the namespace,
+// and a context carrying the registry settings of the policy.
+func (h *Handler) forNamespace(ctx context.Context, namespace string) (context.Context, *Handler) {
+	if h.policies == nil {
+		return ctx, h
+	}
+	p, err := h.policies.Resolve(ctx, namespace)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("failed to resolve the namespace policy, using defaults")
+		return ctx, h
+	}
+	if p.PreferredArchitecture != "" {
+		explanationFromContext(ctx).preferenceFromPolicy()
+	}
+	p = h.defaultPolicy().Merge(p)
+	scoped := *h
+	scoped.preferredArchitecture = p.PreferredArchitecture
+	scoped.schedulableArchitectures = p.SchedulableArchitectures
+	scoped.systemOSes = p.SystemOSes
+	scoped.matchNodeLabels = p.MatchNodeLabels
+	return registry.ContextWithConfig(ctx, p.RegistryConfig()), &scoped
+}
@@ -0,0 +1,140 @@
+package arch
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Codes of the reasons of the denials and warnings of the architecture selection.
+const (
+	ReasonNoCommonArchitecture             = "NoCommonArchitecture"
+	ReasonNoAllowedArchitecture            = "NoAllowedArchitecture"
+	ReasonPreferredArchitectureUnavailable = "PreferredArchitectureUnavailable"
+	ReasonEmulationRequired                = "EmulationRequired"
+	ReasonArchitectureSpecificTags         = "ArchitectureSpecificTags"
+)
+
+// ContainerArchitectures are the schedulable architectures a container image runs on, for the selected OS.
+type ContainerArchitectures struct {
+	// Container is the name of the container running the image. It is empty for image volumes.
+	Container     string   `json:"container,omitempty"`
+	Image         string   `json:"image"`
+	Architectures []string `json:"architectures"`
+	// Excludes are the architectures the image prevents from being selected.
+	Excludes []string `json:"excludes,omitempty"`
+}
+
+func (c ContainerArchitectures) name() string {
+	if c.Container == "" {
+		return "image volume"
+	}
+	return c.Container
+}
+
+// Reason is a structured reason of a denial, or of a warning, of the architecture selection.
+// It lists the architectures of each container, so that users can tell which images to fix.
+type Reason struct {
+	Code       string                   `json:"code"`
+	Summary    string                   `json:"summary"`
+	Containers []ContainerArchitectures `json:"containers,omitempty"`
+}
+
+// Error returns the reason as a single line, e.g.
+// could not select preferred arch: arm64 (excluded by side); container architectures: app (nginx) amd64, arm64; side (vendor/side:1.0) amd64
+func (r Reason) Error() string {
+	msg := r.Summary
+	excluding := []string{}
+	for _, c := range r.Containers {
+		if len(c.Excludes) > 0 {
+			excluding = append(excluding, c.name())
+		}
+	}
+	if len(excluding) > 0 {
+		msg += fmt.Sprintf(" (excluded by %s)", strings.Join(excluding, ", "))
+	}
+	if len(r.Containers) == 0 {
+		return msg
+	}
+	containers := []string{}
+	for _, c := range r.Containers {
+		archs := "none"
+		if len(c.Architectures) > 0 {
+			archs = strings.Join(c.Architectures, ", ")
+		}
+		containers = append(containers, fmt.Sprintf("%s (%s) %s", c.name(), c.Image, archs))
+	}
+	return msg + "; container architectures: " + strings.Join(containers, "; ")
+}
+
+// containerArchitectures returns the architectures of the images for the OS, and the candidate architectures each of them excludes.
+// Architecture neutral images are omitted, as they don't take part in the selection.
+func (h *Handler) containerArchitectures(os string, images []imageArchResult, candidates []string) []ContainerArchitectures {
+	containers := []ContainerArchitectures{}
+	for _, image := range images {
+		if len(image.platforms) == 0 {
+			continue
+		}
+		archs := []string{}
+		for _, platform := range image.platforms {
+			if platform.OS != "" && platform.OS != os {
+				continue
+			}
+			if !slices.Contains(archs, platform.Architecture) {
+				archs = append(archs, platform.Architecture)
+			}
+		}
+		slices.Sort(archs)
+		c := ContainerArchitectures{Container: image.container, Image: image.image, Architectures: archs}
+		for _, candidate := range candidates {
+			if !slices.Contains(archs, candidate) {
+				c.Excludes = append(c.Excludes, candidate)
+			}
+		}
+		containers = append(containers, c)
+	}
+	slices.SortStableFunc(containers, func(a, b ContainerArchitectures) int {
+		return strings.Compare(a.Container, b.Container)
+	})
+	return containers
+}
+
+// allArchitectures returns the sorted union of the architectures of the containers.
+func allArchitectures(containers []ContainerArchitectures) []string {
+	archs := []string{}
+	for _, c := range containers {
+		for _, arch := range c.Architectures {
+			if !slices.Contains(archs, arch) {
+				archs = append(archs, arch)
+			}
+		}
+	}
+	slices.Sort(archs)
+	return archs
+}
+
+// noCommonArchitectureReason blames the containers not supporting the architectures supported by other containers.
+func (h *Handler) noCommonArchitectureReason(code, summary, os string, images []imageArchResult) Reason {
+	candidates := []string{}
+	for _, arch := range allArchitectures(h.containerArchitectures(os, images, nil)) {
+		if h.isArchSupported(arch) {
+			candidates = append(candidates, arch)
+		}
+	}
+	return Reason{
+		Code:       code,
+		Summary:    summary,
+		Containers: h.containerArchitectures(os, images, candidates),
+	}
+}
+
+// reasonsOf returns the structured reasons of a denial or of warnings.
+func reasonsOf(err error) []Reason {
+	switch err := err.(type) {
+	case warning:
+		return err.reasons
+	case Reason:
+		return []Reason{err}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package arch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReasonError(t *testing.T) {
+	r := Reason{
+		Code:    ReasonNoCommonArchitecture,
+		Summary: "could not find a common image architecture across all containers",
+		Containers: []ContainerArchitectures{
+			{Container: "app", Image: "nginx", Architectures: []string{"amd64", "arm64"}},
+			{Container: "side", Image: "vendor/side:1.0", Architectures: []string{"amd64"}, Excludes: []string{"arm64"}},
+			{Image: "vendor/data:1.0", Excludes: []string{"amd64", "arm64"}},
+		},
+	}
+	assert.Equal(t, "could not find a common image architecture across all containers (excluded by side, image volume); container architectures: app (nginx) amd64, arm64; side (vendor/side:1.0) amd64; image volume (vendor/data:1.0) none", r.Error())
+	assert.Equal(t, "summary", Reason{Summary: "summary"}.Error())
+}
+
+func TestHookDenialsAndWarningsListContainerArchitectures(t *testing.T) {
+	h := NewHandler(
+		fake.NewClientBuilder().Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			switch image {
+			case "vendor/agent:1.0":
+				return []registry.Platform{{OS: "linux", Architecture: "amd64"}}, nil
+			case "vendor/tool:1.0":
+				return []registry.Platform{{OS: "linux", Architecture: "arm64"}, {OS: "windows", Architecture: "amd64"}}, nil
+			}
+			return []registry.Platform{{OS: "linux", Architecture: "arm64"}, {OS: "linux", Architecture: "amd64"}}, nil
+		}),
+		WithOS("linux"),
+		WithArchitecture("amd64"),
+	)
+	pod := func(images map[string]string, labels map[string]string) *v1.Pod {
+		p := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod", Labels: labels}}
+		for _, name := range sortedKeys(images) {
+			p.Spec.Containers = append(p.Spec.Containers, v1.Container{Name: name, Image: images[name]})
+		}
+		return p
+	}
+
+	t.Run("When the images share no architecture, the denial lists the architectures of each container", func(t *testing.T) {
+		resp := runWebhookTest(t, h, pod(map[string]string{"app": "nginx", "agent": "vendor/agent:1.0", "tool": "vendor/tool:1.0"}, nil))
+		assert.False(t, resp.Allowed)
+		require.NotNil(t, resp.Result)
+		assert.Equal(t, "could not find a common image architecture across all containers (excluded by agent, tool); container architectures: agent (vendor/agent:1.0) amd64; app (nginx) amd64, arm64; tool (vendor/tool:1.0) arm64", resp.Result.Message)
+	})
+
+	t.Run("When the preferred architecture is not supported by a container, the warning names it", func(t *testing.T) {
+		resp := runWebhookTest(t, h, pod(map[string]string{"app": "nginx", "tool": "vendor/tool:1.0"}, map[string]string{"arch.noe.adevinta.com/preferred": "amd64"}))
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, []string{"could not select preferred arch: amd64 (excluded by tool); container architectures: app (nginx) amd64, arm64; tool (vendor/tool:1.0) arm64"}, resp.Warnings)
+	})
+
+	t.Run("When an image only supports unschedulable architectures, the denial still lists them", func(t *testing.T) {
+		h := NewHandler(
+			fake.NewClientBuilder().Build(),
+			RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+				if image == "vendor/mainframe:1.0" {
+					return []registry.Platform{{OS: "linux", Architecture: "s390x"}}, nil
+				}
+				return []registry.Platform{{OS: "linux", Architecture: "arm64"}, {OS: "linux", Architecture: "amd64"}}, nil
+			}),
+			WithOS("linux"),
+			WithSchedulableArchitectures([]string{"amd64", "arm64"}),
+		)
+		resp := runWebhookTest(t, h, pod(map[string]string{"app": "nginx", "mainframe": "vendor/mainframe:1.0"}, nil))
+		assert.False(t, resp.Allowed)
+		require.NotNil(t, resp.Result)
+		assert.Contains(t, resp.Result.Message, "(excluded by mainframe); container architectures: app (nginx) amd64, arm64; mainframe (vendor/mainframe:1.0) s390x")
+	})
+}
@@ -0,0 +1,220 @@
+package arch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/google/cel-go/cel"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// RuleEffect defines how the architectures returned by a rule are used.
+type RuleEffect string
+
+const (
+	// RuleEffectPrefer selects the first architecture of the returned list supported by all images.
+	// It takes precedence over the preferred architecture of the policies and flag, not over the pod label.
+	RuleEffectPrefer RuleEffect = "Prefer"
+	// RuleEffectAllow restricts the architectures the pod can be scheduled on to the returned set.
+	RuleEffectAllow RuleEffect = "Allow"
+)
+
+// Rule is a CEL expression returning a list of architectures.
+// The expression has access to the following variables:
+//   - pod: the pod (or pod template), with its metadata and spec
+//   - namespaceObject: the namespace of the pod, with its name and labels
+//     (namespace is a reserved CEL identifier)
+//   - images: the images of the pod, each with its image, registry, container and platforms
+//
+// An empty list means the rule does not apply to the pod.
+type Rule struct {
+	Name       string     `json:"name"`
+	Effect     RuleEffect `json:"effect"`
+	Expression string     `json:"expression"`
+}
+
+type compiledRule struct {
+	Rule
+	program cel.Program
+}
+
+// Rules are compiled architecture decision rules, evaluated in order.
+type Rules []compiledRule
+
+// LoadRules reads a YAML or JSON list of rules from a file.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := []Rule{}
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to decode rules from %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// CompileRules compiles the rules, reporting any invalid expression.
+func CompileRules(rules []Rule) (Rules, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("pod", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("namespaceObject", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("images", cel.ListType(cel.MapType(cel.StringType, cel.DynType))),
+	)
+	if err != nil {
+		return nil, err
+	}
+	compiled := Rules{}
+	errs := []error{}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.Effect != RuleEffectPrefer && rule.Effect != RuleEffectAllow {
+			errs = append(errs, fmt.Errorf("rule %s: unsupported effect %q, expecting %s or %s", rule.Name, rule.Effect, RuleEffectPrefer, RuleEffectAllow))
+			continue
+		}
+		ast, issues := env.Compile(rule.Expression)
+		if issues != nil && issues.Err() != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.Name, issues.Err()))
+			continue
+		}
+		if !ast.OutputType().IsAssignableType(cel.ListType(cel.StringType)) {
+			errs = append(errs, fmt.Errorf("rule %s: expression must return a list of architectures, got %s", rule.Name, ast.OutputType()))
+			continue
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.Name, err))
+			continue
+		}
+		compiled = append(compiled, compiledRule{Rule: rule, program: program})
+	}
+	return compiled, errors.Join(errs...)
+}
+
+// WithRules evaluates the rules against each pod. A Prefer rule overrides the preferred architecture
+// of the policies and flag, but not the arch.noe.adevinta.com/preferred label of the pod.
+func WithRules(rules Rules) HandlerOption {
+	return func(h *Handler) {
+		h.rules = rules
+	}
+}
+
+type ruleDecision struct {
+	// preferred is the architecture selected by the first matching Prefer rule
+	preferred string
+	// allowed is the intersection of the sets returned by the matching Allow rules.
+	// nil when no Allow rule matched.
+	allowed map[string]struct{}
+}
+
+func ruleImages(images []imageArchResult) []interface{} {
+	r := []interface{}{}
+	for _, image := range images {
+		platforms := []interface{}{}
+		for _, platform := range image.platforms {
+			platforms = append(platforms, map[string]interface{}{
+				"os":           platform.OS,
+				"architecture": platform.Architecture,
+				"variant":      platform.Variant,
+				"features":     platform.Features,
+			})
+		}
+		r = append(r, map[string]interface{}{
+			"image":     image.image,
+			"registry":  registry.ImageRegistry(image.image),
+			"container": image.container,
+			"platforms": platforms,
+		})
+	}
+	return r
+}
+
+func (h *Handler) ruleNamespace(ctx context.Context, namespace string) map[string]interface{} {
+	ns, err := h.getNamespace(ctx, namespace)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("failed to read namespace, evaluating rules without its labels")
+	}
+	namespaceLabels := map[string]interface{}{}
+	for k, v := range ns.Labels {
+		namespaceLabels[k] = v
+	}
+	return map[string]interface{}{
+		"name":   namespace,
+		"labels": namespaceLabels,
+	}
+}
+
+// evaluateRules evaluates the rules in order against the pod and the architectures supported by all its images.
+// Rules failing to evaluate are skipped.
+func (h *Handler) evaluateRules(ctx context.Context, namespace string, meta *metav1.ObjectMeta, podSpec *v1.PodSpec, images []imageArchResult, commonArchitectures map[string]struct{}) ruleDecision {
+	decision := ruleDecision{}
+	pod, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&v1.Pod{ObjectMeta: *meta, Spec: *podSpec})
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Error("failed to convert pod for rule evaluation, skipping rules")
+		return decision
+	}
+	vars := map[string]interface{}{
+		"pod":             pod,
+		"namespaceObject": h.ruleNamespace(ctx, namespace),
+		"images":          ruleImages(images),
+	}
+	for _, rule := range h.rules {
+		ctx := log.AddLogFieldsToContext(ctx, logrus.Fields{"rule": rule.Name})
+		out, _, err := rule.program.ContextEval(ctx, vars)
+		if err != nil {
+			log.DefaultLogger.WithContext(ctx).WithError(err).Warn("failed to evaluate rule, skipping it")
+			h.metrics.RuleErrors.WithLabelValues(rule.Name).Inc()
+			continue
+		}
+		native, err := out.ConvertToNative(reflect.TypeOf([]string{}))
+		if err != nil {
+			log.DefaultLogger.WithContext(ctx).WithError(err).Warn("rule did not return a list of architectures, skipping it")
+			h.metrics.RuleErrors.WithLabelValues(rule.Name).Inc()
+			continue
+		}
+		archs := native.([]string)
+		if len(archs) == 0 {
+			continue
+		}
+		switch rule.Effect {
+		case RuleEffectPrefer:
+			if decision.preferred != "" {
+				continue
+			}
+			i := slices.IndexFunc(archs, func(arch string) bool {
+				_, ok := commonArchitectures[arch]
+				return ok
+			})
+			if i < 0 {
+				log.DefaultLogger.WithContext(ctx).WithField("archs", archs).Info("none of the rule preferred architectures is supported by all images")
+				continue
+			}
+			decision.preferred = archs[i]
+		case RuleEffectAllow:
+			allowed := map[string]struct{}{}
+			for _, arch := range archs {
+				if decision.allowed == nil {
+					allowed[arch] = struct{}{}
+				} else if _, ok := decision.allowed[arch]; ok {
+					allowed[arch] = struct{}{}
+				}
+			}
+			decision.allowed = allowed
+		}
+		log.DefaultLogger.WithContext(ctx).WithField("archs", archs).WithField("effect", rule.Effect).Info("rule applies to the pod")
+		h.metrics.RuleApplied.WithLabelValues(namespace, rule.Name).Inc()
+	}
+	return decision
+}
@@ -0,0 +1,121 @@
+package arch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCompileRules(t *testing.T) {
+	_, err := CompileRules([]Rule{
+		{Name: "valid", Effect: RuleEffectPrefer, Expression: `namespaceObject.name == "batch" ? ["arm64"] : []`},
+	})
+	assert.NoError(t, err)
+
+	_, err = CompileRules([]Rule{
+		{Name: "syntax", Effect: RuleEffectPrefer, Expression: `namespaceObject.name ==`},
+		{Name: "effect", Effect: "Deny", Expression: `["arm64"]`},
+		{Name: "type", Effect: RuleEffectAllow, Expression: `namespaceObject.name == "batch"`},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rule syntax")
+	assert.Contains(t, err.Error(), "rule effect")
+	assert.Contains(t, err.Error(), "rule type")
+}
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- name: batch-on-arm
+  effect: Prefer
+  expression: 'namespaceObject.name == "batch" ? ["arm64"] : []'
+`), 0o644))
+	rules, err := LoadRules(path)
+	require.NoError(t, err)
+	assert.Equal(t, []Rule{{Name: "batch-on-arm", Effect: RuleEffectPrefer, Expression: `namespaceObject.name == "batch" ? ["arm64"] : []`}}, rules)
+}
+
+func TestUpdatePodSpecAppliesRules(t *testing.T) {
+	rules, err := CompileRules([]Rule{
+		{
+			Name:       "batch-on-arm",
+			Effect:     RuleEffectPrefer,
+			Expression: `has(pod.metadata.ownerReferences) && pod.metadata.ownerReferences.exists(o, o.kind == "Job") ? ["riscv64", "arm64"] : []`,
+		},
+		{
+			Name:       "team-on-amd",
+			Effect:     RuleEffectPrefer,
+			Expression: `"team" in namespaceObject.labels && namespaceObject.labels["team"] == "x" ? ["amd64"] : []`,
+		},
+		{
+			Name:       "legacy-registry-on-amd64",
+			Effect:     RuleEffectAllow,
+			Expression: `images.exists(i, i.registry == "legacy.company.corp") ? ["amd64"] : []`,
+		},
+		{
+			Name:       "broken",
+			Effect:     RuleEffectAllow,
+			Expression: `pod.spec.unknownField`,
+		},
+	})
+	require.NoError(t, err)
+	h := NewHandler(
+		fake.NewClientBuilder().WithObjects(
+			&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-x", Labels: map[string]string{"team": "x"}}},
+		).Build(),
+		RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			return []registry.Platform{
+				{OS: "linux", Architecture: "arm64"},
+				{OS: "linux", Architecture: "amd64"},
+			}, nil
+		}),
+		WithOS("linux"),
+		WithArchitecture("amd64"),
+		WithRules(rules),
+	)
+
+	t.Run("the first matching Prefer rule wins over the preferred flag", func(t *testing.T) {
+		meta := &metav1.ObjectMeta{
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Job", Name: "job"}},
+		}
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "ubuntu"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "team-x", meta, podSpec))
+		assert.Equal(t, map[string]string{archKey: "arm64"}, podSpec.NodeSelector)
+		assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.RuleApplied.WithLabelValues("team-x", "batch-on-arm")))
+	})
+
+	t.Run("the preferred label wins over the Prefer rules", func(t *testing.T) {
+		meta := &metav1.ObjectMeta{
+			Labels:          map[string]string{"arch.noe.adevinta.com/preferred": "amd64"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Job", Name: "job"}},
+		}
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "ubuntu"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "team-x", meta, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+	})
+
+	t.Run("Allow rules restrict the architectures", func(t *testing.T) {
+		meta := &metav1.ObjectMeta{
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Job", Name: "job"}},
+		}
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "ubuntu"}, {Image: "legacy.company.corp/app"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "other", meta, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+	})
+
+	t.Run("rules failing to evaluate are skipped", func(t *testing.T) {
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Image: "ubuntu"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "other", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, map[string]string{archKey: "amd64"}, podSpec.NodeSelector)
+		assert.Less(t, 0.0, testutil.ToFloat64(h.metrics.RuleErrors.WithLabelValues("broken")))
+	})
+}
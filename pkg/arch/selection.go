@@ -0,0 +1,238 @@
+package arch
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/adevinta/noe/pkg/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// InjectedSelectionAnnotation records the node selection Noe injected in a pod (template).
+// It allows Noe to tell apart its own selectors from user authored ones, so it can
+// recompute them when the pod is reinvoked or the workload images change.
+const InjectedSelectionAnnotation = "arch.noe.adevinta.com/injected-selection"
+
+type injectedSelection struct {
+	NodeSelector      map[string]string     `json:"nodeSelector,omitempty"`
+	NodeSelectorTerms []v1.NodeSelectorTerm `json:"nodeSelectorTerms,omitempty"`
+	// ReplacedTerms holds the user authored required terms Noe combined its requirements with.
+	// When set, NodeSelectorTerms holds all the resulting terms rather than the appended ones.
+	ReplacedTerms  []v1.NodeSelectorTerm        `json:"replacedTerms,omitempty"`
+	PreferredTerms []v1.PreferredSchedulingTerm `json:"preferredTerms,omitempty"`
+}
+
+func (s injectedSelection) isEmpty() bool {
+	return len(s.NodeSelector) == 0 && len(s.NodeSelectorTerms) == 0 && len(s.PreferredTerms) == 0
+}
+
+func requiredNodeSelectorTerms(podSpec *v1.PodSpec) []v1.NodeSelectorTerm {
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil || podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return nil
+	}
+	return podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+}
+
+func preferredSchedulingTerms(podSpec *v1.PodSpec) []v1.PreferredSchedulingTerm {
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil {
+		return nil
+	}
+	return podSpec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+}
+
+// diffInjectedSelection returns the node selection added to before to obtain after.
+// Noe only ever adds node selector keys, appends preferred node selector terms, and either
+// appends required node selector terms or combines its requirements with the user authored ones.
+func diffInjectedSelection(before, after *v1.PodSpec) injectedSelection {
+	selection := injectedSelection{}
+	for k, v := range after.NodeSelector {
+		if previous, ok := before.NodeSelector[k]; !ok || previous != v {
+			if selection.NodeSelector == nil {
+				selection.NodeSelector = map[string]string{}
+			}
+			selection.NodeSelector[k] = v
+		}
+	}
+	beforeTerms := requiredNodeSelectorTerms(before)
+	afterTerms := requiredNodeSelectorTerms(after)
+	switch {
+	case len(afterTerms) > len(beforeTerms) && equality.Semantic.DeepEqual(beforeTerms, afterTerms[:len(beforeTerms)]):
+		selection.NodeSelectorTerms = slices.Clone(afterTerms[len(beforeTerms):])
+	case len(beforeTerms) > 0 && !equality.Semantic.DeepEqual(beforeTerms, afterTerms):
+		selection.ReplacedTerms = slices.Clone(beforeTerms)
+		selection.NodeSelectorTerms = slices.Clone(afterTerms)
+	}
+	beforePreferred := preferredSchedulingTerms(before)
+	afterPreferred := preferredSchedulingTerms(after)
+	if len(afterPreferred) > len(beforePreferred) {
+		selection.PreferredTerms = slices.Clone(afterPreferred[len(beforePreferred):])
+	}
+	return selection
+}
+
+func getInjectedSelection(ctx context.Context, meta *metav1.ObjectMeta) injectedSelection {
+	selection := injectedSelection{}
+	raw, ok := meta.Annotations[InjectedSelectionAnnotation]
+	if !ok {
+		return selection
+	}
+	if err := json.Unmarshal([]byte(raw), &selection); err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("ignoring invalid injected selection annotation")
+		return injectedSelection{}
+	}
+	return selection
+}
+
+func setInjectedSelection(ctx context.Context, meta *metav1.ObjectMeta, selection injectedSelection) {
+	if selection.isEmpty() {
+		delete(meta.Annotations, InjectedSelectionAnnotation)
+		return
+	}
+	raw, err := json.Marshal(selection)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Error("failed to encode injected selection")
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[InjectedSelectionAnnotation] = string(raw)
+}
+
+// removeInjectedSelection removes from the pod spec the node selection previously injected by Noe.
+// User authored selectors are left untouched.
+func removeInjectedSelection(podSpec *v1.PodSpec, selection injectedSelection) {
+	for k, v := range selection.NodeSelector {
+		if podSpec.NodeSelector[k] == v {
+			delete(podSpec.NodeSelector, k)
+		}
+	}
+	if len(podSpec.NodeSelector) == 0 {
+		podSpec.NodeSelector = nil
+	}
+	if len(selection.NodeSelectorTerms) == 0 && len(selection.PreferredTerms) == 0 {
+		return
+	}
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil {
+		return
+	}
+	nodeAffinity := podSpec.Affinity.NodeAffinity
+	if terms := requiredNodeSelectorTerms(podSpec); len(selection.ReplacedTerms) > 0 {
+		// The user authored terms are only restored when the terms were not modified since Noe combined them.
+		if equality.Semantic.DeepEqual(terms, selection.NodeSelectorTerms) {
+			nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = slices.Clone(selection.ReplacedTerms)
+		}
+	} else if len(terms) > 0 && len(selection.NodeSelectorTerms) > 0 {
+		remaining := removeTerms(terms, selection.NodeSelectorTerms)
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = remaining
+		if len(remaining) == 0 {
+			nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = nil
+		}
+	}
+	if terms := preferredSchedulingTerms(podSpec); len(terms) > 0 && len(selection.PreferredTerms) > 0 {
+		nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = removeTerms(terms, selection.PreferredTerms)
+		if len(nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+			nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = nil
+		}
+	}
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil && len(nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+		podSpec.Affinity.NodeAffinity = nil
+	}
+	if podSpec.Affinity.NodeAffinity == nil && podSpec.Affinity.PodAffinity == nil && podSpec.Affinity.PodAntiAffinity == nil {
+		podSpec.Affinity = nil
+	}
+}
+
+// UserPodSpec returns the pod spec of the template without the node selection injected by Noe,
+// that is with the node selectors and affinities authored by users only.
+func UserPodSpec(ctx context.Context, template *v1.PodTemplateSpec) *v1.PodSpec {
+	podSpec := template.Spec.DeepCopy()
+	removeInjectedSelection(podSpec, getInjectedSelection(ctx, &template.ObjectMeta))
+	return podSpec
+}
+
+// containsInjectedSelection reports whether the pod spec still holds the node selection injected by Noe.
+func containsInjectedSelection(podSpec *v1.PodSpec, selection injectedSelection) bool {
+	for k, v := range selection.NodeSelector {
+		if podSpec.NodeSelector[k] != v {
+			return false
+		}
+	}
+	terms := requiredNodeSelectorTerms(podSpec)
+	if len(selection.ReplacedTerms) > 0 {
+		if !equality.Semantic.DeepEqual(terms, selection.NodeSelectorTerms) {
+			return false
+		}
+	} else if len(removeTerms(terms, selection.NodeSelectorTerms)) != len(terms)-len(selection.NodeSelectorTerms) {
+		return false
+	}
+	preferred := preferredSchedulingTerms(podSpec)
+	return len(removeTerms(preferred, selection.PreferredTerms)) == len(preferred)-len(selection.PreferredTerms)
+}
+
+// keepsInjectedSelection reports whether the updated pod template still holds the node selection
+// Noe injected in the previous version of the template.
+func keepsInjectedSelection(ctx context.Context, previous, updated *v1.PodTemplateSpec) bool {
+	selection := getInjectedSelection(ctx, &updated.ObjectMeta)
+	if !equality.Semantic.DeepEqual(getInjectedSelection(ctx, &previous.ObjectMeta), selection) {
+		return false
+	}
+	return containsInjectedSelection(&updated.Spec, selection)
+}
+
+// removeTerms removes from terms the injected ones, each injected term being removed at most once.
+func removeTerms[T any](terms, injected []T) []T {
+	remaining := []T{}
+	toRemove := slices.Clone(injected)
+	for _, term := range terms {
+		i := slices.IndexFunc(toRemove, func(injected T) bool {
+			return equality.Semantic.DeepEqual(injected, term)
+		})
+		if i >= 0 {
+			toRemove = slices.Delete(toRemove, i, i+1)
+			continue
+		}
+		remaining = append(remaining, term)
+	}
+	return remaining
+}
+
+// updatePodTemplate updates the pod spec and records the node selection Noe injected in the pod annotations.
+// Any selection previously injected by Noe is recomputed, while user authored ones are kept.
+// When no new selection can be computed, or when it would not match the architecture overlay already applied,
+// the previous decision is kept.
+func (h *Handler) updatePodTemplate(ctx context.Context, namespace string, meta *metav1.ObjectMeta, podSpec *v1.PodSpec) error {
+	ctx, h = h.forNamespace(ctx, namespace)
+	original := podSpec.DeepCopy()
+	originalMeta := meta.DeepCopy()
+	previous := getInjectedSelection(ctx, meta)
+	if !previous.isEmpty() {
+		log.DefaultLogger.WithContext(ctx).Info("recomputing node selection previously injected by noe")
+		removeInjectedSelection(podSpec, previous)
+	}
+	previousEmulation, emulated := meta.Annotations[EmulationAnnotation]
+	delete(meta.Annotations, EmulationAnnotation)
+	base := podSpec.DeepCopy()
+	err := h.updatePodSpec(ctx, namespace, meta, podSpec)
+	var changed overlayArchChanged
+	if errors.As(err, &changed) {
+		*podSpec = *original
+		*meta = *originalMeta
+		return warning{msg: changed.Error()}
+	}
+	injected := diffInjectedSelection(base, podSpec)
+	if injected.isEmpty() && !previous.isEmpty() {
+		log.DefaultLogger.WithContext(ctx).Info("no new node selection computed, keeping the previous one")
+		*podSpec = *original
+		if emulated {
+			meta.Annotations[EmulationAnnotation] = previousEmulation
+		}
+		return err
+	}
+	setInjectedSelection(ctx, meta, injected)
+	return err
+}
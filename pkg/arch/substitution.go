@@ -0,0 +1,151 @@
+package arch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/registry"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SubstituteImagesAnnotation opts a pod in the substitution of its images by their multi-arch equivalents.
+const SubstituteImagesAnnotation = "arch.noe.adevinta.com/substitute-images"
+
+// SubstitutedImagesAnnotation records the original image of each substituted container, as a JSON map.
+const SubstitutedImagesAnnotation = "arch.noe.adevinta.com/substituted-images"
+
+// SubstitutionResolver returns the substitution of an image.
+type SubstitutionResolver interface {
+	Match(image string) (registry.ImageSubstitution, bool)
+}
+
+// WithSubstitutions allows the handler to substitute images of opted-in pods with the catalog.
+func WithSubstitutions(substitutions SubstitutionResolver) HandlerOption {
+	return func(h *Handler) {
+		h.substitutions = substitutions
+	}
+}
+
+func supportsArchitecture(platforms []registry.Platform, os, arch string) bool {
+	for _, platform := range platforms {
+		if platform.Architecture == arch && (platform.OS == "" || platform.OS == os) {
+			return true
+		}
+	}
+	return false
+}
+
+// substituteImages replaces the images not supporting the preferred architecture by their substitutes.
+// The images are substituted only when all of them then support the preferred architecture.
+// It returns the resolved images after substitution and the original image of each substituted container.
+func (h *Handler) substituteImages(ctx context.Context, imagePullSecret string, meta *metav1.ObjectMeta, images []imageArchResult, os, preferredArch string) ([]imageArchResult, map[string]string) {
+	if h.substitutions == nil || preferredArch == "" || meta.Annotations[SubstituteImagesAnnotation] != "true" {
+		return images, nil
+	}
+	substituted := []imageArchResult{}
+	originals := map[string]string{}
+	for _, image := range images {
+		if len(image.platforms) == 0 || supportsArchitecture(image.platforms, os, preferredArch) {
+			substituted = append(substituted, image)
+			continue
+		}
+		if image.container == "" {
+			return images, nil
+		}
+		substitution, ok := h.substitutions.Match(image.image)
+		if !ok {
+			return images, nil
+		}
+		replacement, ok := substitution.Substitute(image.image)
+		if !ok {
+			return images, nil
+		}
+		platforms, err := h.Registry.ListArchs(ctx, imagePullSecret, replacement)
+		if err != nil {
+			log.DefaultLogger.WithContext(ctx).WithField("image", replacement).WithError(err).Warn("unable to list the substitute image archs")
+			markIncompleteDecision(ctx)
+			return images, nil
+		}
+		if !supportsArchitecture(platforms, os, preferredArch) {
+			log.DefaultLogger.WithContext(ctx).WithField("image", replacement).Info("substitute image does not support the preferred architecture")
+			return images, nil
+		}
+		originals[image.container] = image.image
+		substituted = append(substituted, imageArchResult{
+			image:     replacement,
+			container: image.container,
+			platforms: platforms,
+		})
+	}
+	if len(originals) == 0 {
+		return images, nil
+	}
+	return substituted, originals
+}
+
+// applySubstitutions rewrites the substituted container images and records the original ones in the pod annotations.
+func (h *Handler) applySubstitutions(ctx context.Context, namespace string, meta *metav1.ObjectMeta, podSpec *v1.PodSpec, images []imageArchResult, originals map[string]string) {
+	if len(originals) == 0 {
+		return
+	}
+	replacements := map[string]string{}
+	for _, image := range images {
+		if _, ok := originals[image.container]; ok {
+			replacements[image.container] = image.image
+		}
+	}
+	for _, containers := range [][]v1.Container{podSpec.Containers, podSpec.InitContainers} {
+		for i := range containers {
+			replacement, ok := replacements[containers[i].Name]
+			if !ok {
+				continue
+			}
+			log.DefaultLogger.WithContext(ctx).WithField("container", containers[i].Name).WithField("original", containers[i].Image).WithField("image", replacement).Info("substituting image")
+			containers[i].Image = replacement
+			h.metrics.ImageSubstituted.WithLabelValues(namespace).Inc()
+		}
+	}
+	recorded := map[string]string{}
+	if value, ok := meta.Annotations[SubstitutedImagesAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &recorded); err != nil {
+			log.DefaultLogger.WithContext(ctx).WithError(err).Warn("overriding invalid substituted images annotation")
+			recorded = map[string]string{}
+		}
+	}
+	for container, original := range originals {
+		recorded[container] = original
+	}
+	b, err := json.Marshal(recorded)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Error("failed to record substituted images")
+		return
+	}
+	meta.Annotations[SubstitutedImagesAnnotation] = string(b)
+}
+
+// substitutionMessage describes the substitutions recorded in the annotations that were not in the previous ones.
+func substitutionMessage(previous, current map[string]string, podSpec *v1.PodSpec) string {
+	if previous[SubstitutedImagesAnnotation] == current[SubstitutedImagesAnnotation] {
+		return ""
+	}
+	recorded := map[string]string{}
+	if err := json.Unmarshal([]byte(current[SubstitutedImagesAnnotation]), &recorded); err != nil {
+		return ""
+	}
+	substitutions := []string{}
+	for _, containers := range [][]v1.Container{podSpec.Containers, podSpec.InitContainers} {
+		for _, container := range containers {
+			if original, ok := recorded[container.Name]; ok && original != container.Image {
+				substitutions = append(substitutions, fmt.Sprintf("%s: %s by %s", container.Name, original, container.Image))
+			}
+		}
+	}
+	if len(substitutions) == 0 {
+		return ""
+	}
+	return "Substituted images " + strings.Join(substitutions, ", ")
+}
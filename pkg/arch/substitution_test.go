@@ -0,0 +1,74 @@
+package arch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func substitutionTestRegistry(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+	switch image {
+	case "vendor/nginx:1.25", "vendor/legacy:1.0":
+		return []registry.Platform{{OS: "linux", Architecture: "amd64"}}, nil
+	case "legacy/rebuild:1.0":
+		return []registry.Platform{{OS: "linux", Architecture: "amd64"}}, nil
+	}
+	return []registry.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}, nil
+}
+
+func newSubstitutionStore() *registry.ImageSubstitutionStore {
+	store := registry.NewImageSubstitutionStore()
+	store.Set(registry.ImageSubstitution{Name: "nginx", Images: []string{"vendor/nginx:*"}, Repository: "bitnami/nginx"})
+	store.Set(registry.ImageSubstitution{Name: "legacy", Images: []string{"vendor/legacy:*"}, Repository: "legacy/rebuild"})
+	return store
+}
+
+func TestUpdatePodSpecSubstitutesImages(t *testing.T) {
+	t.Run("opted-in pods get the multi-arch substitute of their images", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(substitutionTestRegistry), WithOS("linux"), WithArchitecture("arm64"), WithSubstitutions(newSubstitutionStore()))
+		meta := &metav1.ObjectMeta{Annotations: map[string]string{SubstituteImagesAnnotation: "true"}}
+		podSpec := &v1.PodSpec{
+			Containers: []v1.Container{{Name: "nginx", Image: "vendor/nginx:1.25"}, {Name: "sidecar", Image: "ubuntu"}},
+		}
+		previous := map[string]string{SubstituteImagesAnnotation: "true"}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, "bitnami/nginx:1.25", podSpec.Containers[0].Image)
+		assert.Equal(t, "ubuntu", podSpec.Containers[1].Image)
+		assert.Equal(t, map[string]string{"kubernetes.io/arch": "arm64"}, podSpec.NodeSelector)
+		assert.JSONEq(t, `{"nginx":"vendor/nginx:1.25"}`, meta.Annotations[SubstitutedImagesAnnotation])
+		assert.Equal(t, 1.0, testutil.ToFloat64(h.metrics.ImageSubstituted.WithLabelValues("ns")))
+		assert.Equal(t, "Substituted images nginx: vendor/nginx:1.25 by bitnami/nginx:1.25", substitutionMessage(previous, meta.Annotations, podSpec))
+	})
+
+	t.Run("images are kept when the pod did not opt-in", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(substitutionTestRegistry), WithOS("linux"), WithArchitecture("arm64"), WithSubstitutions(newSubstitutionStore()))
+		meta := &metav1.ObjectMeta{}
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "nginx", Image: "vendor/nginx:1.25"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, "vendor/nginx:1.25", podSpec.Containers[0].Image)
+		assert.NotContains(t, meta.Annotations, SubstitutedImagesAnnotation)
+	})
+
+	t.Run("images are kept when the substitute does not support the preferred architecture", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(substitutionTestRegistry), WithOS("linux"), WithArchitecture("arm64"), WithSubstitutions(newSubstitutionStore()))
+		meta := &metav1.ObjectMeta{Annotations: map[string]string{SubstituteImagesAnnotation: "true"}}
+		podSpec := &v1.PodSpec{
+			Containers: []v1.Container{{Name: "nginx", Image: "vendor/nginx:1.25"}, {Name: "legacy", Image: "vendor/legacy:1.0"}},
+		}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", meta, podSpec))
+		assert.Equal(t, "vendor/nginx:1.25", podSpec.Containers[0].Image)
+		assert.Equal(t, "vendor/legacy:1.0", podSpec.Containers[1].Image)
+		assert.NotContains(t, meta.Annotations, SubstitutedImagesAnnotation)
+		assert.Equal(t, 0.0, testutil.ToFloat64(h.metrics.ImageSubstituted.WithLabelValues("ns")))
+	})
+}
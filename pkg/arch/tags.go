@@ -0,0 +1,80 @@
+package arch
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/adevinta/noe/pkg/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// archImages returns, for each container, the image to use on the architecture,
+// when its image is published with architecture specific tags.
+func archImages(images []imageArchResult, arch string) map[string]string {
+	r := map[string]string{}
+	for _, image := range images {
+		for _, platform := range image.platforms {
+			if platform.Image != "" && platform.Architecture == arch && image.container != "" {
+				r[image.container] = platform.Image
+			}
+		}
+	}
+	return r
+}
+
+func hasArchTags(images []imageArchResult) []string {
+	r := []string{}
+	for _, image := range images {
+		for _, platform := range image.platforms {
+			if platform.Image != "" {
+				r = append(r, image.image)
+				break
+			}
+		}
+	}
+	return r
+}
+
+// archTagArchitecture returns the architecture to run the images with architecture specific tags on,
+// when several are supported by all the images: the first one by order of the schedulable architectures.
+func (h *Handler) archTagArchitecture(commonArchitectures map[string]struct{}) string {
+	for _, arch := range h.schedulableArchitectures {
+		if _, ok := commonArchitectures[arch]; ok {
+			return arch
+		}
+	}
+	archs := keys(commonArchitectures)
+	slices.Sort(archs)
+	return archs[0]
+}
+
+// rewriteArchImages replaces the images published with architecture specific tags by the tag of the architecture
+// the pod will run on. arch is empty when the pod can only run on nodes emulating an architecture,
+// the pod is then denied as the tag to run can't be selected.
+func (h *Handler) rewriteArchImages(ctx context.Context, namespace string, podSpec *v1.PodSpec, images []imageArchResult, arch string) error {
+	if arch == "" {
+		if tagged := hasArchTags(images); len(tagged) > 0 {
+			log.DefaultLogger.WithContext(ctx).WithField("images", tagged).Info("no single architecture is selected for the images with architecture specific tags")
+			return Reason{
+				Code:    ReasonArchitectureSpecificTags,
+				Summary: fmt.Sprintf("images %s have architecture specific tags and need a single architecture to be selected", strings.Join(tagged, ", ")),
+			}
+		}
+		return nil
+	}
+	rewrites := archImages(images, arch)
+	for _, containers := range [][]v1.Container{podSpec.Containers, podSpec.InitContainers} {
+		for i := range containers {
+			image, ok := rewrites[containers[i].Name]
+			if !ok || containers[i].Image == image {
+				continue
+			}
+			log.DefaultLogger.WithContext(ctx).WithField("container", containers[i].Name).WithField("archImage", image).Info("using the architecture specific image tag")
+			containers[i].Image = image
+			h.metrics.ImageRewritten.WithLabelValues(namespace, arch).Inc()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package arch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func archTagsTestRegistry(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+	switch image {
+	case "vendor.io/product:1.2.3":
+		return []registry.Platform{
+			{Architecture: "amd64", Image: "vendor.io/product:1.2.3-amd64"},
+			{Architecture: "arm64", Image: "vendor.io/product:1.2.3-arm64"},
+		}, nil
+	case "arm64-only":
+		return []registry.Platform{{OS: "linux", Architecture: "arm64"}}, nil
+	case "s390x-only":
+		return []registry.Platform{{OS: "linux", Architecture: "s390x"}}, nil
+	}
+	return []registry.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}, nil
+}
+
+func TestUpdatePodSpecRewritesArchTags(t *testing.T) {
+	t.Run("images are replaced by the tag of the selected architecture", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(archTagsTestRegistry), WithOS("linux"), WithArchitecture("amd64"))
+		podSpec := &v1.PodSpec{
+			InitContainers: []v1.Container{{Name: "init", Image: "vendor.io/product:1.2.3"}},
+			Containers:     []v1.Container{{Name: "app", Image: "vendor.io/product:1.2.3"}, {Name: "sidecar", Image: "arm64-only"}},
+		}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("arm64")), podSpec.Affinity)
+		assert.Equal(t, "vendor.io/product:1.2.3-arm64", podSpec.InitContainers[0].Image)
+		assert.Equal(t, "vendor.io/product:1.2.3-arm64", podSpec.Containers[0].Image)
+		assert.Equal(t, "arm64-only", podSpec.Containers[1].Image)
+		assert.Equal(t, 2.0, testutil.ToFloat64(h.metrics.ImageRewritten.WithLabelValues("ns", "arm64")))
+	})
+
+	t.Run("pods are restricted to the first schedulable architecture when several are possible", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(archTagsTestRegistry), WithOS("linux"), WithSchedulableArchitectures([]string{"arm64", "amd64"}))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "vendor.io/product:1.2.3"}}}
+		require.NoError(t, h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("arm64")), podSpec.Affinity)
+		assert.Equal(t, "vendor.io/product:1.2.3-arm64", podSpec.Containers[0].Image)
+	})
+
+	t.Run("daemonsets are restricted to a single architecture", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(archTagsTestRegistry), WithOS("linux"), WithArchitecture("arm64"))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "vendor.io/product:1.2.3"}}}
+		require.NoError(t, h.updatePodSpec(context.WithValue(context.Background(), daemonSetKey{}, true), "ns", &metav1.ObjectMeta{}, podSpec))
+		assert.Equal(t, requiredAffinity(archNodeSelectorTerm("amd64")), podSpec.Affinity)
+		assert.Equal(t, "vendor.io/product:1.2.3-amd64", podSpec.Containers[0].Image)
+	})
+
+	t.Run("pods only running on emulating nodes are denied", func(t *testing.T) {
+		h := NewHandler(fake.NewClientBuilder().Build(), RegistryFunc(archTagsTestRegistry), WithOS("linux"), WithEmulation(EmulationFallback))
+		podSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: "vendor.io/product:1.2.3"}, {Name: "sidecar", Image: "s390x-only"}}}
+		err := h.updatePodSpec(context.Background(), "ns", &metav1.ObjectMeta{}, podSpec)
+		var reason Reason
+		require.ErrorAs(t, err, &reason)
+		assert.Equal(t, ReasonArchitectureSpecificTags, reason.Code)
+		assert.Equal(t, "vendor.io/product:1.2.3", podSpec.Containers[0].Image)
+	})
+}
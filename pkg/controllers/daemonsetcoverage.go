@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/adevinta/noe/pkg/arch"
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// NodeOSIndex indexes the nodes by their kubernetes.io/os label, empty for the nodes without it.
+const NodeOSIndex = "noe.adevinta.com/node-os"
+
+// IndexNodeOS returns the NodeOSIndex values of a node.
+func IndexNodeOS(obj client.Object) []string {
+	return []string{obj.GetLabels()["kubernetes.io/os"]}
+}
+
+type DaemonSetCoverageMetrics struct {
+	UncoveredNodes *prometheus.GaugeVec
+}
+
+func (m DaemonSetCoverageMetrics) MustRegister(reg metrics.RegistererGatherer) {
+	reg.MustRegister(
+		m.UncoveredNodes,
+	)
+}
+
+func NewDaemonSetCoverageMetrics(prefix string) *DaemonSetCoverageMetrics {
+	return &DaemonSetCoverageMetrics{
+		UncoveredNodes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: prefix,
+				Subsystem: "daemonsets",
+				Name:      "uncovered_nodes",
+				Help:      "Number of nodes that will not run a daemonset, as their architecture is not supported by all its images.",
+			},
+			[]string{"namespace", "daemonset"},
+		),
+	}
+}
+
+// DaemonSetCoverageReconciler reports the nodes that will not run the DaemonSets admitted by Noe,
+// from the OS and architectures their images support, recorded by the webhook in the DaemonSet annotations.
+// The nodes are read from the cache, through the NodeOSIndex.
+type DaemonSetCoverageReconciler struct {
+	client.Client
+	Events  events.EventRecorder
+	metrics *DaemonSetCoverageMetrics
+
+	mu sync.Mutex
+	// uncovered is the last number of uncovered nodes reported for each DaemonSet,
+	// so that events are only recorded when it changes.
+	uncovered map[types.NamespacedName]int
+}
+
+type DaemonSetCoverageReconcilerOption func(*DaemonSetCoverageReconciler)
+
+func WithCoverageClient(cl client.Client) DaemonSetCoverageReconcilerOption {
+	return func(r *DaemonSetCoverageReconciler) {
+		r.Client = cl
+	}
+}
+
+// WithCoverageEventRecorder records an UncoveredNodes event on the DaemonSets whenever their number of uncovered nodes changes.
+func WithCoverageEventRecorder(recorder events.EventRecorder) DaemonSetCoverageReconcilerOption {
+	return func(r *DaemonSetCoverageReconciler) {
+		r.Events = recorder
+	}
+}
+
+func WithCoverageMetricsRegistry(reg metrics.RegistererGatherer) DaemonSetCoverageReconcilerOption {
+	return func(r *DaemonSetCoverageReconciler) {
+		r.metrics.MustRegister(reg)
+	}
+}
+
+func NewDaemonSetCoverageReconciler(opts ...DaemonSetCoverageReconcilerOption) *DaemonSetCoverageReconciler {
+	r := &DaemonSetCoverageReconciler{
+		metrics:   NewDaemonSetCoverageMetrics("noe"),
+		uncovered: map[types.NamespacedName]int{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *DaemonSetCoverageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"controller": fmt.Sprintf("%T", r), "namespace": req.Namespace, "name": req.Name})
+
+	log.DefaultLogger.WithContext(ctx).Debug("Reconciling DaemonSet coverage")
+
+	ds := &appsv1.DaemonSet{}
+	err := r.Client.Get(ctx, req.NamespacedName, ds)
+	if client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+	os, ok := ds.Annotations[arch.DaemonSetOSAnnotation]
+	if apierrors.IsNotFound(err) || !ok || !ds.DeletionTimestamp.IsZero() {
+		r.forget(req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+	supported := []string{}
+	if archs := ds.Annotations[arch.DaemonSetArchitecturesAnnotation]; archs != "" {
+		supported = strings.Split(archs, ",")
+	}
+
+	// only the nodes the users scoped the daemon to are expected to run it
+	userPodSpec := arch.UserPodSpec(ctx, &ds.Spec.Template)
+	uncovered := 0
+	// nodes without OS label are considered as running any OS
+	for _, nodeOS := range []string{os, ""} {
+		nodes := &v1.NodeList{}
+		if err := r.Client.List(ctx, nodes, client.MatchingFields{NodeOSIndex: nodeOS}); err != nil {
+			return ctrl.Result{}, err
+		}
+		for _, node := range nodes.Items {
+			if !nodeMatchesSelection(userPodSpec, &node) {
+				continue
+			}
+			if !slices.Contains(supported, node.Labels["kubernetes.io/arch"]) {
+				uncovered++
+			}
+		}
+	}
+	r.metrics.UncoveredNodes.WithLabelValues(ds.Namespace, ds.Name).Set(float64(uncovered))
+
+	r.mu.Lock()
+	previous, reported := r.uncovered[req.NamespacedName]
+	r.uncovered[req.NamespacedName] = uncovered
+	r.mu.Unlock()
+	if uncovered == 0 || (reported && previous == uncovered) {
+		return ctrl.Result{}, nil
+	}
+	log.DefaultLogger.WithContext(ctx).WithField("uncoveredNodes", uncovered).Info("daemonset images don't support all the nodes")
+	if r.Events != nil {
+		summary := "none"
+		if len(supported) > 0 {
+			summary = strings.Join(supported, ", ")
+		}
+		r.Events.Eventf(ds, nil, v1.EventTypeWarning, "UncoveredNodes", "InjectNodeSelector", "%d nodes will not run daemonset %s, their architecture is not supported by all its images (supported: %s)", uncovered, ds.Name, summary)
+	}
+	return ctrl.Result{}, nil
+}
+
+// nodeMatchesSelection reports whether the node matches the node selector and the required node affinity of the pod spec.
+func nodeMatchesSelection(podSpec *v1.PodSpec, node *v1.Node) bool {
+	for k, v := range podSpec.NodeSelector {
+		if node.Labels[k] != v {
+			return false
+		}
+	}
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil || podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+	// terms are ORed, the requirements of a term ANDed
+	for _, term := range podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			continue
+		}
+		matches := true
+		for _, requirement := range term.MatchExpressions {
+			value, ok := node.Labels[requirement.Key]
+			matches = matches && requirementMatches(requirement, value, ok)
+		}
+		for _, requirement := range term.MatchFields {
+			matches = matches && requirement.Key == "metadata.name" && requirementMatches(requirement, node.Name, true)
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+func requirementMatches(requirement v1.NodeSelectorRequirement, value string, exists bool) bool {
+	switch requirement.Operator {
+	case v1.NodeSelectorOpIn:
+		return exists && slices.Contains(requirement.Values, value)
+	case v1.NodeSelectorOpNotIn:
+		return !exists || !slices.Contains(requirement.Values, value)
+	case v1.NodeSelectorOpExists:
+		return exists
+	case v1.NodeSelectorOpDoesNotExist:
+		return !exists
+	case v1.NodeSelectorOpGt, v1.NodeSelectorOpLt:
+		if !exists || len(requirement.Values) != 1 {
+			return false
+		}
+		actual, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		expected, err := strconv.ParseInt(requirement.Values[0], 10, 64)
+		if err != nil {
+			return false
+		}
+		if requirement.Operator == v1.NodeSelectorOpGt {
+			return actual > expected
+		}
+		return actual < expected
+	}
+	return false
+}
+
+// forget deletes the metric series of a DaemonSet that is gone, or that Noe no longer reports.
+func (r *DaemonSetCoverageReconciler) forget(name types.NamespacedName) {
+	r.mu.Lock()
+	delete(r.uncovered, name)
+	r.mu.Unlock()
+	r.metrics.UncoveredNodes.DeleteLabelValues(name.Namespace, name.Name)
+}
+
+func (r *DaemonSetCoverageReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &v1.Node{}, NodeOSIndex, IndexNodeOS); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("daemonsetcoverage").
+		For(&appsv1.DaemonSet{}, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		// Nodes joining, leaving or changing their platform labels change the coverage of all the DaemonSets
+		Watches(&v1.Node{}, handler.EnqueueRequestsFromMapFunc(r.reportedDaemonSets), builder.WithPredicates(predicate.LabelChangedPredicate{})).
+		Complete(r)
+}
+
+func (r *DaemonSetCoverageReconciler) reportedDaemonSets(ctx context.Context, _ client.Object) []reconcile.Request {
+	daemonSets := &appsv1.DaemonSetList{}
+	if err := r.Client.List(ctx, daemonSets); err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Error("failed to list daemonsets")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, ds := range daemonSets.Items {
+		if _, ok := ds.Annotations[arch.DaemonSetOSAnnotation]; ok {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: ds.Namespace, Name: ds.Name}})
+		}
+	}
+	return requests
+}
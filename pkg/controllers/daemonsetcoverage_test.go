@@ -0,0 +1,150 @@
+package controllers_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/arch"
+	"github.com/adevinta/noe/pkg/controllers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestReconcileDaemonSetCoverage(t *testing.T) {
+	node := func(name string, labels map[string]string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	k8sClient := fake.NewClientBuilder().
+		WithIndex(&v1.Node{}, controllers.NodeOSIndex, controllers.IndexNodeOS).
+		WithObjects(
+			node("amd64-1", map[string]string{"kubernetes.io/os": "linux", "kubernetes.io/arch": "amd64"}),
+			node("amd64-2", map[string]string{"kubernetes.io/os": "linux", "kubernetes.io/arch": "amd64"}),
+			node("arm64-1", map[string]string{"kubernetes.io/os": "linux", "kubernetes.io/arch": "arm64"}),
+			node("unlabelled-arm64-1", map[string]string{"kubernetes.io/arch": "arm64"}),
+			node("windows-1", map[string]string{"kubernetes.io/os": "windows", "kubernetes.io/arch": "amd64"}),
+			&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "agent", Annotations: map[string]string{
+				arch.DaemonSetOSAnnotation:            "linux",
+				arch.DaemonSetArchitecturesAnnotation: "amd64",
+			}}},
+			&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "multiarch", Annotations: map[string]string{
+				arch.DaemonSetOSAnnotation:            "linux",
+				arch.DaemonSetArchitecturesAnnotation: "amd64,arm64",
+			}}},
+			&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "broken", Annotations: map[string]string{
+				arch.DaemonSetOSAnnotation:            "linux",
+				arch.DaemonSetArchitecturesAnnotation: "",
+			}}},
+		).Build()
+	metricsRegistry := prometheus.NewRegistry()
+	recorder := &recordingEventRecorder{}
+	reconciler := controllers.NewDaemonSetCoverageReconciler(
+		controllers.WithCoverageClient(k8sClient),
+		controllers.WithCoverageEventRecorder(recorder),
+		controllers.WithCoverageMetricsRegistry(metricsRegistry),
+	)
+	reconcileDaemonSet := func(t *testing.T, name string) {
+		t.Helper()
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "monitoring", Name: name}})
+		require.NoError(t, err)
+	}
+
+	t.Run("When the images support some architectures, the nodes of the other architectures are reported", func(t *testing.T) {
+		reconcileDaemonSet(t, "agent")
+		reconcileDaemonSet(t, "multiarch")
+		reconcileDaemonSet(t, "broken")
+		assert.NoError(t, testutil.GatherAndCompare(metricsRegistry, strings.NewReader(`
+# HELP noe_daemonsets_uncovered_nodes Number of nodes that will not run a daemonset, as their architecture is not supported by all its images.
+# TYPE noe_daemonsets_uncovered_nodes gauge
+noe_daemonsets_uncovered_nodes{daemonset="agent",namespace="monitoring"} 2
+noe_daemonsets_uncovered_nodes{daemonset="broken",namespace="monitoring"} 4
+noe_daemonsets_uncovered_nodes{daemonset="multiarch",namespace="monitoring"} 0
+`)))
+		assert.Equal(t, []recordedEvent{
+			{Regarding: "/agent", Type: v1.EventTypeWarning, Reason: "UncoveredNodes", Action: "InjectNodeSelector", Note: "2 nodes will not run daemonset agent, their architecture is not supported by all its images (supported: amd64)"},
+			{Regarding: "/broken", Type: v1.EventTypeWarning, Reason: "UncoveredNodes", Action: "InjectNodeSelector", Note: "4 nodes will not run daemonset broken, their architecture is not supported by all its images (supported: none)"},
+		}, recorder.events)
+	})
+
+	t.Run("When the number of uncovered nodes did not change, no new event is recorded", func(t *testing.T) {
+		recorder.events = nil
+		reconcileDaemonSet(t, "agent")
+		assert.Empty(t, recorder.events)
+	})
+
+	t.Run("When a node joins, the coverage is updated", func(t *testing.T) {
+		recorder.events = nil
+		require.NoError(t, k8sClient.Create(context.Background(), node("arm64-2", map[string]string{"kubernetes.io/os": "linux", "kubernetes.io/arch": "arm64"})))
+		reconcileDaemonSet(t, "agent")
+		assert.NoError(t, testutil.GatherAndCompare(metricsRegistry, strings.NewReader(`
+# HELP noe_daemonsets_uncovered_nodes Number of nodes that will not run a daemonset, as their architecture is not supported by all its images.
+# TYPE noe_daemonsets_uncovered_nodes gauge
+noe_daemonsets_uncovered_nodes{daemonset="agent",namespace="monitoring"} 3
+noe_daemonsets_uncovered_nodes{daemonset="broken",namespace="monitoring"} 4
+noe_daemonsets_uncovered_nodes{daemonset="multiarch",namespace="monitoring"} 0
+`)))
+		require.Len(t, recorder.events, 1)
+		assert.Equal(t, "3 nodes will not run daemonset agent, their architecture is not supported by all its images (supported: amd64)", recorder.events[0].Note)
+	})
+
+	t.Run("When the daemonset is deleted, its metric series is deleted", func(t *testing.T) {
+		require.NoError(t, k8sClient.Delete(context.Background(), &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "agent"}}))
+		reconcileDaemonSet(t, "agent")
+		count, err := testutil.GatherAndCount(metricsRegistry, "noe_daemonsets_uncovered_nodes")
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+	})
+}
+
+func TestReconcileDaemonSetCoverageOnlyCountsTheSelectedNodes(t *testing.T) {
+	node := func(name string, labels map[string]string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	k8sClient := fake.NewClientBuilder().
+		WithIndex(&v1.Node{}, controllers.NodeOSIndex, controllers.IndexNodeOS).
+		WithObjects(
+			node("gpu-amd64", map[string]string{"kubernetes.io/os": "linux", "kubernetes.io/arch": "amd64", "gpu": "true"}),
+			node("gpu-arm64", map[string]string{"kubernetes.io/os": "linux", "kubernetes.io/arch": "arm64", "gpu": "true"}),
+			node("arm64", map[string]string{"kubernetes.io/os": "linux", "kubernetes.io/arch": "arm64"}),
+			&appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "gpu-agent", Annotations: map[string]string{
+					arch.DaemonSetOSAnnotation:            "linux",
+					arch.DaemonSetArchitecturesAnnotation: "amd64",
+				}},
+				Spec: appsv1.DaemonSetSpec{Template: v1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+						arch.InjectedSelectionAnnotation: `{"nodeSelectorTerms":[{"matchExpressions":[{"key":"kubernetes.io/arch","operator":"In","values":["amd64"]}]}]}`,
+					}},
+					Spec: v1.PodSpec{
+						NodeSelector: map[string]string{"gpu": "true"},
+						Affinity: &v1.Affinity{NodeAffinity: &v1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+							NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{
+								{Key: "kubernetes.io/arch", Operator: v1.NodeSelectorOpIn, Values: []string{"amd64"}},
+							}}},
+						}}},
+					},
+				}},
+			},
+		).Build()
+	metricsRegistry := prometheus.NewRegistry()
+	reconciler := controllers.NewDaemonSetCoverageReconciler(
+		controllers.WithCoverageClient(k8sClient),
+		controllers.WithCoverageMetricsRegistry(metricsRegistry),
+	)
+
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "monitoring", Name: "gpu-agent"}})
+	require.NoError(t, err)
+	assert.NoError(t, testutil.GatherAndCompare(metricsRegistry, strings.NewReader(`
+# HELP noe_daemonsets_uncovered_nodes Number of nodes that will not run a daemonset, as their architecture is not supported by all its images.
+# TYPE noe_daemonsets_uncovered_nodes gauge
+noe_daemonsets_uncovered_nodes{daemonset="gpu-agent",namespace="monitoring"} 1
+`)))
+}
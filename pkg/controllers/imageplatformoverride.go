@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	noev1alpha1 "github.com/adevinta/noe/pkg/apis/noe/v1alpha1"
+	"github.com/adevinta/noe/pkg/arch"
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Invalidator discards the state derived from the reconciled objects, such as memoized admission decisions.
+type Invalidator interface {
+	Invalidate()
+}
+
+// ImagePlatformOverrideReconciler keeps the platform override store in sync with
+// the ImagePlatformOverride objects, and reports how many running pods they affect.
+type ImagePlatformOverrideReconciler struct {
+	client.Client
+	Overrides    *registry.PlatformOverrideStore
+	ResyncPeriod time.Duration
+	Invalidator  Invalidator
+
+	mu sync.Mutex
+	// runningImages counts the running pods by set of images. It is listed once per resync period,
+	// and shared by all the overrides, rather than listing all the pods for each of them.
+	runningImages       map[string]int32
+	runningImagesListed time.Time
+}
+
+type ImagePlatformOverrideReconcilerOption func(*ImagePlatformOverrideReconciler)
+
+func WithOverrideClient(cl client.Client) ImagePlatformOverrideReconcilerOption {
+	return func(r *ImagePlatformOverrideReconciler) {
+		r.Client = cl
+	}
+}
+
+func WithOverrideStore(store *registry.PlatformOverrideStore) ImagePlatformOverrideReconcilerOption {
+	return func(r *ImagePlatformOverrideReconciler) {
+		r.Overrides = store
+	}
+}
+
+func WithOverrideResyncPeriod(period time.Duration) ImagePlatformOverrideReconcilerOption {
+	return func(r *ImagePlatformOverrideReconciler) {
+		r.ResyncPeriod = period
+	}
+}
+
+// WithOverrideInvalidator notifies the invalidator whenever the platform override store changes.
+func WithOverrideInvalidator(invalidator Invalidator) ImagePlatformOverrideReconcilerOption {
+	return func(r *ImagePlatformOverrideReconciler) {
+		r.Invalidator = invalidator
+	}
+}
+
+func NewImagePlatformOverrideReconciler(opts ...ImagePlatformOverrideReconcilerOption) *ImagePlatformOverrideReconciler {
+	r := &ImagePlatformOverrideReconciler{
+		Overrides:    registry.NewPlatformOverrideStore(),
+		ResyncPeriod: 5 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *ImagePlatformOverrideReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"controller": fmt.Sprintf("%T", r), "name": req.Name})
+
+	log.DefaultLogger.WithContext(ctx).Debug("Reconciling ImagePlatformOverride")
+
+	override := &noev1alpha1.ImagePlatformOverride{}
+	err := r.Client.Get(ctx, req.NamespacedName, override)
+	if apierrors.IsNotFound(err) {
+		r.deleteOverride(req.Name)
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := override.Status.DeepCopy()
+	status.ObservedGeneration = override.Generation
+
+	platformOverride, err := ParseImagePlatformOverride(override)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("invalid image platform override")
+		r.deleteOverride(override.Name)
+		status.AffectedPods = 0
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               noev1alpha1.ImagePlatformOverrideConditionReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             "InvalidSpec",
+			Message:            err.Error(),
+			ObservedGeneration: override.Generation,
+		})
+		return ctrl.Result{}, r.updateStatus(ctx, override, status)
+	}
+	r.setOverride(platformOverride)
+
+	affectedPods, err := r.countAffectedPods(ctx, platformOverride)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	status.AffectedPods = affectedPods
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               noev1alpha1.ImagePlatformOverrideConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Applied",
+		Message:            fmt.Sprintf("override applies to %d running pods", affectedPods),
+		ObservedGeneration: override.Generation,
+	})
+	// Pods come and go, refresh the number of affected pods periodically
+	return ctrl.Result{RequeueAfter: r.ResyncPeriod}, r.updateStatus(ctx, override, status)
+}
+
+// setOverride stores the override, invalidating the decisions taken with its previous version when it changed.
+// Overrides are reconciled periodically to refresh their status, they mostly did not change.
+func (r *ImagePlatformOverrideReconciler) setOverride(override registry.PlatformOverride) {
+	if previous, ok := r.Overrides.Get(override.Name); ok && equality.Semantic.DeepEqual(previous, override) {
+		return
+	}
+	r.Overrides.Set(override)
+	r.invalidate()
+}
+
+func (r *ImagePlatformOverrideReconciler) deleteOverride(name string) {
+	if _, ok := r.Overrides.Get(name); !ok {
+		return
+	}
+	r.Overrides.Delete(name)
+	r.invalidate()
+}
+
+func (r *ImagePlatformOverrideReconciler) invalidate() {
+	if r.Invalidator != nil {
+		r.Invalidator.Invalidate()
+	}
+}
+
+func (r *ImagePlatformOverrideReconciler) updateStatus(ctx context.Context, override *noev1alpha1.ImagePlatformOverride, status *noev1alpha1.ImagePlatformOverrideStatus) error {
+	if equality.Semantic.DeepEqual(&override.Status, status) {
+		return nil
+	}
+	override.Status = *status
+	return r.Client.Status().Update(ctx, override)
+}
+
+func (r *ImagePlatformOverrideReconciler) countAffectedPods(ctx context.Context, override registry.PlatformOverride) (int32, error) {
+	runningImages, err := r.listRunningImages(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var count int32
+	for images, pods := range runningImages {
+		if slices.ContainsFunc(strings.Split(images, "\n"), override.MatchesImage) {
+			count += pods
+		}
+	}
+	return count, nil
+}
+
+// listRunningImages returns the number of running pods by set of images, listing the pods when the previous
+// listing is older than the resync period.
+func (r *ImagePlatformOverrideReconciler) listRunningImages(ctx context.Context) (map[string]int32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.runningImages != nil && time.Since(r.runningImagesListed) < r.ResyncPeriod {
+		return r.runningImages, nil
+	}
+	pods := &v1.PodList{}
+	if err := r.Client.List(ctx, pods); err != nil {
+		return nil, err
+	}
+	runningImages := map[string]int32{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		runningImages[strings.Join(arch.GetPodSpecImages(&pod.Spec), "\n")]++
+	}
+	r.runningImages, r.runningImagesListed = runningImages, time.Now()
+	return runningImages, nil
+}
+
+// ParseImagePlatformOverride converts an ImagePlatformOverride to its registry representation, validating it.
+func ParseImagePlatformOverride(override *noev1alpha1.ImagePlatformOverride) (registry.PlatformOverride, error) {
+	r := registry.PlatformOverride{
+		Name:   override.Name,
+		Images: override.Spec.Images,
+		Mode:   registry.PlatformOverrideReplace,
+	}
+	switch override.Spec.Mode {
+	case "", noev1alpha1.ImagePlatformOverrideReplace:
+	case noev1alpha1.ImagePlatformOverrideAdd:
+		r.Mode = registry.PlatformOverrideAdd
+	default:
+		return r, fmt.Errorf("unsupported mode %q", override.Spec.Mode)
+	}
+	if len(override.Spec.Images) == 0 {
+		return r, errors.New("at least one image pattern is required")
+	}
+	for _, pattern := range override.Spec.Images {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return r, fmt.Errorf("invalid image pattern %q: %w", pattern, err)
+		}
+	}
+	for _, platform := range override.Spec.Platforms {
+		p, err := registry.ParsePlatform(platform)
+		if err != nil {
+			return r, err
+		}
+		r.Platforms = append(r.Platforms, p)
+	}
+	if len(r.Platforms) == 0 {
+		return r, errors.New("at least one platform is required")
+	}
+	return r, nil
+}
+
+func (r *ImagePlatformOverrideReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&noev1alpha1.ImagePlatformOverride{}).
+		Complete(r)
+}
@@ -0,0 +1,203 @@
+package controllers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	noev1alpha1 "github.com/adevinta/noe/pkg/apis/noe/v1alpha1"
+	"github.com/adevinta/noe/pkg/controllers"
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func newOverrideScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, noev1alpha1.AddToScheme(scheme))
+	return scheme
+}
+
+func runningPod(name string, images ...string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "ns",
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+		},
+	}
+	for _, image := range images {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Image: image})
+	}
+	return pod
+}
+
+func TestReconcileImagePlatformOverride(t *testing.T) {
+	pending := runningPod("pending", "vendor/image:1.0")
+	pending.Status.Phase = v1.PodPending
+	k8sClient := fake.NewClientBuilder().
+		WithScheme(newOverrideScheme(t)).
+		WithStatusSubresource(&noev1alpha1.ImagePlatformOverride{}).
+		WithObjects(
+			runningPod("matching", "ubuntu", "vendor/image:1.0"),
+			runningPod("other", "ubuntu"),
+			pending,
+			&noev1alpha1.ImagePlatformOverride{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       "vendor",
+					Generation: 2,
+				},
+				Spec: noev1alpha1.ImagePlatformOverrideSpec{
+					Images:    []string{"vendor/*"},
+					Platforms: []string{"linux/amd64"},
+				},
+			},
+		).Build()
+
+	store := registry.NewPlatformOverrideStore()
+	invalidator := &countingInvalidator{}
+	reconciler := controllers.NewImagePlatformOverrideReconciler(
+		controllers.WithOverrideClient(k8sClient),
+		controllers.WithOverrideStore(store),
+		controllers.WithOverrideResyncPeriod(time.Minute),
+		controllers.WithOverrideInvalidator(invalidator),
+	)
+
+	result, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "vendor"}})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, result.RequeueAfter)
+
+	assert.Equal(
+		t,
+		[]registry.PlatformOverride{
+			{
+				Name:      "vendor",
+				Images:    []string{"vendor/*"},
+				Platforms: []registry.Platform{{OS: "linux", Architecture: "amd64"}},
+				Mode:      registry.PlatformOverrideReplace,
+			},
+		},
+		store.Match("vendor/image:1.0"),
+	)
+
+	override := &noev1alpha1.ImagePlatformOverride{}
+	require.NoError(t, k8sClient.Get(context.Background(), client.ObjectKey{Name: "vendor"}, override))
+	assert.EqualValues(t, 1, override.Status.AffectedPods)
+	assert.EqualValues(t, 2, override.Status.ObservedGeneration)
+	assert.True(t, meta.IsStatusConditionTrue(override.Status.Conditions, noev1alpha1.ImagePlatformOverrideConditionReady))
+	assert.Equal(t, 1, invalidator.count)
+
+	t.Run("When the override did not change, the decisions are kept", func(t *testing.T) {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "vendor"}})
+		require.NoError(t, err)
+		assert.Equal(t, 1, invalidator.count)
+	})
+
+	t.Run("When the override becomes invalid, it is no longer applied", func(t *testing.T) {
+		override.Spec.Platforms = []string{"amd64"}
+		require.NoError(t, k8sClient.Update(context.Background(), override))
+
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "vendor"}})
+		require.NoError(t, err)
+		assert.Len(t, store.Match("vendor/image:1.0"), 0)
+		assert.Equal(t, 2, invalidator.count)
+
+		require.NoError(t, k8sClient.Get(context.Background(), client.ObjectKey{Name: "vendor"}, override))
+		condition := meta.FindStatusCondition(override.Status.Conditions, noev1alpha1.ImagePlatformOverrideConditionReady)
+		require.NotNil(t, condition)
+		assert.Equal(t, metav1.ConditionFalse, condition.Status)
+		assert.Equal(t, "InvalidSpec", condition.Reason)
+	})
+
+	t.Run("When the override is deleted, it is no longer applied", func(t *testing.T) {
+		store.Set(registry.PlatformOverride{Name: "vendor", Images: []string{"vendor/*"}})
+		require.NoError(t, k8sClient.Delete(context.Background(), override))
+
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "vendor"}})
+		require.NoError(t, err)
+		assert.Len(t, store.Match("vendor/image:1.0"), 0)
+		assert.Equal(t, 3, invalidator.count)
+	})
+}
+
+func TestImagePlatformOverridesShareThePodListing(t *testing.T) {
+	override := func(name string, images ...string) *noev1alpha1.ImagePlatformOverride {
+		return &noev1alpha1.ImagePlatformOverride{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: noev1alpha1.ImagePlatformOverrideSpec{
+				Images:    images,
+				Platforms: []string{"linux/amd64"},
+			},
+		}
+	}
+	podLists := 0
+	k8sClient := fake.NewClientBuilder().
+		WithScheme(newOverrideScheme(t)).
+		WithStatusSubresource(&noev1alpha1.ImagePlatformOverride{}).
+		WithObjects(
+			runningPod("vendor-1", "ubuntu", "vendor/image:1.0"),
+			runningPod("vendor-2", "ubuntu", "vendor/image:1.0"),
+			runningPod("ubuntu", "ubuntu"),
+			override("vendor", "vendor/*"),
+			override("ubuntu", "ubuntu"),
+		).
+		WithInterceptorFuncs(interceptor.Funcs{
+			List: func(ctx context.Context, client client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+				if _, ok := list.(*v1.PodList); ok {
+					podLists++
+				}
+				return client.List(ctx, list, opts...)
+			},
+		}).Build()
+	reconciler := controllers.NewImagePlatformOverrideReconciler(
+		controllers.WithOverrideClient(k8sClient),
+		controllers.WithOverrideResyncPeriod(time.Minute),
+	)
+
+	for name, affectedPods := range map[string]int32{"vendor": 2, "ubuntu": 3} {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: name}})
+		require.NoError(t, err)
+		reconciled := &noev1alpha1.ImagePlatformOverride{}
+		require.NoError(t, k8sClient.Get(context.Background(), client.ObjectKey{Name: name}, reconciled))
+		assert.Equal(t, affectedPods, reconciled.Status.AffectedPods)
+	}
+	assert.Equal(t, 1, podLists)
+}
+
+func TestParseImagePlatformOverride(t *testing.T) {
+	override := &noev1alpha1.ImagePlatformOverride{
+		ObjectMeta: metav1.ObjectMeta{Name: "patched"},
+		Spec: noev1alpha1.ImagePlatformOverrideSpec{
+			Images:    []string{"patched/*"},
+			Platforms: []string{"linux/arm64/v8"},
+			Mode:      noev1alpha1.ImagePlatformOverrideAdd,
+		},
+	}
+	parsed, err := controllers.ParseImagePlatformOverride(override)
+	require.NoError(t, err)
+	assert.Equal(t, registry.PlatformOverrideAdd, parsed.Mode)
+	assert.Equal(t, []registry.Platform{{OS: "linux", Architecture: "arm64", Variant: "v8"}}, parsed.Platforms)
+
+	override.Spec.Images = []string{"[invalid"}
+	_, err = controllers.ParseImagePlatformOverride(override)
+	assert.Error(t, err)
+
+	override.Spec.Images = []string{"patched/*"}
+	override.Spec.Mode = "Merge"
+	_, err = controllers.ParseImagePlatformOverride(override)
+	assert.Error(t, err)
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	noev1alpha1 "github.com/adevinta/noe/pkg/apis/noe/v1alpha1"
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ImageSubstitutionReconciler keeps the image substitution store in sync with the ImageSubstitution objects.
+type ImageSubstitutionReconciler struct {
+	client.Client
+	Substitutions *registry.ImageSubstitutionStore
+	Invalidator   Invalidator
+}
+
+type ImageSubstitutionReconcilerOption func(*ImageSubstitutionReconciler)
+
+func WithSubstitutionClient(cl client.Client) ImageSubstitutionReconcilerOption {
+	return func(r *ImageSubstitutionReconciler) {
+		r.Client = cl
+	}
+}
+
+func WithSubstitutionStore(store *registry.ImageSubstitutionStore) ImageSubstitutionReconcilerOption {
+	return func(r *ImageSubstitutionReconciler) {
+		r.Substitutions = store
+	}
+}
+
+// WithSubstitutionInvalidator notifies the invalidator whenever the image substitution store changes.
+func WithSubstitutionInvalidator(invalidator Invalidator) ImageSubstitutionReconcilerOption {
+	return func(r *ImageSubstitutionReconciler) {
+		r.Invalidator = invalidator
+	}
+}
+
+func NewImageSubstitutionReconciler(opts ...ImageSubstitutionReconcilerOption) *ImageSubstitutionReconciler {
+	r := &ImageSubstitutionReconciler{
+		Substitutions: registry.NewImageSubstitutionStore(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *ImageSubstitutionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"controller": fmt.Sprintf("%T", r), "name": req.Name})
+
+	log.DefaultLogger.WithContext(ctx).Debug("Reconciling ImageSubstitution")
+
+	substitution := &noev1alpha1.ImageSubstitution{}
+	err := r.Client.Get(ctx, req.NamespacedName, substitution)
+	if apierrors.IsNotFound(err) {
+		r.deleteSubstitution(req.Name)
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := substitution.Status.DeepCopy()
+	status.ObservedGeneration = substitution.Generation
+
+	parsed, err := ParseImageSubstitution(substitution)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("invalid image substitution")
+		r.deleteSubstitution(substitution.Name)
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               noev1alpha1.ImageSubstitutionConditionReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             "InvalidSpec",
+			Message:            err.Error(),
+			ObservedGeneration: substitution.Generation,
+		})
+		return ctrl.Result{}, r.updateStatus(ctx, substitution, status)
+	}
+	r.setSubstitution(parsed)
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               noev1alpha1.ImageSubstitutionConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Applied",
+		Message:            fmt.Sprintf("images are substituted by %s", parsed.Repository),
+		ObservedGeneration: substitution.Generation,
+	})
+	return ctrl.Result{}, r.updateStatus(ctx, substitution, status)
+}
+
+// setSubstitution stores the substitution, invalidating the decisions taken with its previous version when it changed.
+func (r *ImageSubstitutionReconciler) setSubstitution(substitution registry.ImageSubstitution) {
+	if previous, ok := r.Substitutions.Get(substitution.Name); ok && equality.Semantic.DeepEqual(previous, substitution) {
+		return
+	}
+	r.Substitutions.Set(substitution)
+	r.invalidate()
+}
+
+func (r *ImageSubstitutionReconciler) deleteSubstitution(name string) {
+	if _, ok := r.Substitutions.Get(name); !ok {
+		return
+	}
+	r.Substitutions.Delete(name)
+	r.invalidate()
+}
+
+func (r *ImageSubstitutionReconciler) invalidate() {
+	if r.Invalidator != nil {
+		r.Invalidator.Invalidate()
+	}
+}
+
+func (r *ImageSubstitutionReconciler) updateStatus(ctx context.Context, substitution *noev1alpha1.ImageSubstitution, status *noev1alpha1.ImageSubstitutionStatus) error {
+	if equality.Semantic.DeepEqual(&substitution.Status, status) {
+		return nil
+	}
+	substitution.Status = *status
+	return r.Client.Status().Update(ctx, substitution)
+}
+
+// ParseImageSubstitution converts an ImageSubstitution to its registry representation, validating it.
+func ParseImageSubstitution(substitution *noev1alpha1.ImageSubstitution) (registry.ImageSubstitution, error) {
+	r := registry.ImageSubstitution{
+		Name:       substitution.Name,
+		Images:     substitution.Spec.Images,
+		Repository: substitution.Spec.Repository,
+	}
+	if len(substitution.Spec.Images) == 0 {
+		return r, errors.New("at least one image pattern is required")
+	}
+	for _, pattern := range substitution.Spec.Images {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return r, fmt.Errorf("invalid image pattern %q: %w", pattern, err)
+		}
+	}
+	if r.Repository == "" {
+		return r, errors.New("a replacement repository is required")
+	}
+	if strings.ContainsAny(r.Repository, "@*") || strings.LastIndex(r.Repository, ":") > strings.LastIndex(r.Repository, "/") {
+		return r, fmt.Errorf("invalid repository %q, expecting a repository without tag nor digest", r.Repository)
+	}
+	return r, nil
+}
+
+func (r *ImageSubstitutionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&noev1alpha1.ImageSubstitution{}).
+		Complete(r)
+}
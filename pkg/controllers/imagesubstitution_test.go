@@ -0,0 +1,121 @@
+package controllers_test
+
+import (
+	"context"
+	"testing"
+
+	noev1alpha1 "github.com/adevinta/noe/pkg/apis/noe/v1alpha1"
+	"github.com/adevinta/noe/pkg/controllers"
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+type countingInvalidator struct {
+	count int
+}
+
+func (i *countingInvalidator) Invalidate() {
+	i.count++
+}
+
+func TestReconcileImageSubstitution(t *testing.T) {
+	k8sClient := fake.NewClientBuilder().
+		WithScheme(newOverrideScheme(t)).
+		WithStatusSubresource(&noev1alpha1.ImageSubstitution{}).
+		WithObjects(
+			&noev1alpha1.ImageSubstitution{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       "nginx",
+					Generation: 3,
+				},
+				Spec: noev1alpha1.ImageSubstitutionSpec{
+					Images:     []string{"vendor/nginx:*"},
+					Repository: "bitnami/nginx",
+				},
+			},
+		).Build()
+
+	store := registry.NewImageSubstitutionStore()
+	invalidator := &countingInvalidator{}
+	reconciler := controllers.NewImageSubstitutionReconciler(
+		controllers.WithSubstitutionClient(k8sClient),
+		controllers.WithSubstitutionStore(store),
+		controllers.WithSubstitutionInvalidator(invalidator),
+	)
+
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "nginx"}})
+	require.NoError(t, err)
+	substitution, ok := store.Match("vendor/nginx:1.25")
+	require.True(t, ok)
+	assert.Equal(t, registry.ImageSubstitution{Name: "nginx", Images: []string{"vendor/nginx:*"}, Repository: "bitnami/nginx"}, substitution)
+	assert.Equal(t, 1, invalidator.count)
+
+	current := &noev1alpha1.ImageSubstitution{}
+	require.NoError(t, k8sClient.Get(context.Background(), client.ObjectKey{Name: "nginx"}, current))
+	assert.EqualValues(t, 3, current.Status.ObservedGeneration)
+	assert.True(t, meta.IsStatusConditionTrue(current.Status.Conditions, noev1alpha1.ImageSubstitutionConditionReady))
+
+	t.Run("When the substitution did not change, the decisions are kept", func(t *testing.T) {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "nginx"}})
+		require.NoError(t, err)
+		assert.Equal(t, 1, invalidator.count)
+	})
+
+	t.Run("When the substitution becomes invalid, it is no longer applied", func(t *testing.T) {
+		current.Spec.Repository = "bitnami/nginx:latest"
+		require.NoError(t, k8sClient.Update(context.Background(), current))
+
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "nginx"}})
+		require.NoError(t, err)
+		_, ok := store.Match("vendor/nginx:1.25")
+		assert.False(t, ok)
+		assert.Equal(t, 2, invalidator.count)
+
+		require.NoError(t, k8sClient.Get(context.Background(), client.ObjectKey{Name: "nginx"}, current))
+		condition := meta.FindStatusCondition(current.Status.Conditions, noev1alpha1.ImageSubstitutionConditionReady)
+		require.NotNil(t, condition)
+		assert.Equal(t, metav1.ConditionFalse, condition.Status)
+		assert.Equal(t, "InvalidSpec", condition.Reason)
+	})
+
+	t.Run("When the substitution is deleted, it is no longer applied", func(t *testing.T) {
+		store.Set(registry.ImageSubstitution{Name: "nginx", Images: []string{"vendor/nginx:*"}, Repository: "bitnami/nginx"})
+		require.NoError(t, k8sClient.Delete(context.Background(), current))
+
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "nginx"}})
+		require.NoError(t, err)
+		_, ok := store.Match("vendor/nginx:1.25")
+		assert.False(t, ok)
+		assert.Equal(t, 3, invalidator.count)
+	})
+}
+
+func TestParseImageSubstitution(t *testing.T) {
+	substitution := &noev1alpha1.ImageSubstitution{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+		Spec: noev1alpha1.ImageSubstitutionSpec{
+			Images:     []string{"vendor/nginx:*"},
+			Repository: "registry.example.com:5000/bitnami/nginx",
+		},
+	}
+	_, err := controllers.ParseImageSubstitution(substitution)
+	require.NoError(t, err)
+
+	substitution.Spec.Images = []string{"[invalid"}
+	_, err = controllers.ParseImageSubstitution(substitution)
+	assert.Error(t, err)
+
+	substitution.Spec.Images = []string{"vendor/nginx:*"}
+	for _, repository := range []string{"", "bitnami/nginx:1.25", "bitnami/nginx@sha256:0123", "bitnami/*"} {
+		substitution.Spec.Repository = repository
+		_, err = controllers.ParseImageSubstitution(substitution)
+		assert.Error(t, err, repository)
+	}
+}
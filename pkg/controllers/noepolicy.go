@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	noev1alpha1 "github.com/adevinta/noe/pkg/apis/noe/v1alpha1"
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/policy"
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// NoePolicyReconciler keeps the policy store in sync with the NoePolicy objects,
+// and reports the namespaces they apply to.
+type NoePolicyReconciler struct {
+	client.Client
+	Policies *policy.Store
+	// Defaults is the policy configured from the command line flags.
+	// It is used to validate the policy effectively applied to each namespace.
+	Defaults     policy.Policy
+	ResyncPeriod time.Duration
+	Invalidator  Invalidator
+}
+
+type NoePolicyReconcilerOption func(*NoePolicyReconciler)
+
+func WithPolicyClient(cl client.Client) NoePolicyReconcilerOption {
+	return func(r *NoePolicyReconciler) {
+		r.Client = cl
+	}
+}
+
+func WithPolicyStore(store *policy.Store) NoePolicyReconcilerOption {
+	return func(r *NoePolicyReconciler) {
+		r.Policies = store
+	}
+}
+
+func WithPolicyDefaults(defaults policy.Policy) NoePolicyReconcilerOption {
+	return func(r *NoePolicyReconciler) {
+		r.Defaults = defaults
+	}
+}
+
+// WithPolicyInvalidator notifies the invalidator whenever a policy of the store changes.
+func WithPolicyInvalidator(invalidator Invalidator) NoePolicyReconcilerOption {
+	return func(r *NoePolicyReconciler) {
+		r.Invalidator = invalidator
+	}
+}
+
+func WithPolicyResyncPeriod(period time.Duration) NoePolicyReconcilerOption {
+	return func(r *NoePolicyReconciler) {
+		r.ResyncPeriod = period
+	}
+}
+
+func NewNoePolicyReconciler(opts ...NoePolicyReconcilerOption) *NoePolicyReconciler {
+	r := &NoePolicyReconciler{
+		ResyncPeriod: 5 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.Policies == nil {
+		r.Policies = policy.NewStore(r.Client)
+	}
+	return r
+}
+
+func (r *NoePolicyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"controller": fmt.Sprintf("%T", r), "name": req.Name})
+
+	log.DefaultLogger.WithContext(ctx).Debug("Reconciling NoePolicy")
+
+	noePolicy := &noev1alpha1.NoePolicy{}
+	err := r.Client.Get(ctx, req.NamespacedName, noePolicy)
+	if apierrors.IsNotFound(err) {
+		r.deletePolicy(req.Name)
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := noePolicy.Status.DeepCopy()
+	status.ObservedGeneration = noePolicy.Generation
+
+	parsed, err := ParseNoePolicy(noePolicy)
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("invalid noe policy")
+		r.deletePolicy(noePolicy.Name)
+		status.Namespaces = nil
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               noev1alpha1.NoePolicyConditionReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             "InvalidSpec",
+			Message:            err.Error(),
+			ObservedGeneration: noePolicy.Generation,
+		})
+		return ctrl.Result{}, r.updateStatus(ctx, noePolicy, status)
+	}
+	r.setPolicy(parsed)
+
+	namespaces := &v1.NamespaceList{}
+	if err := r.Client.List(ctx, namespaces); err != nil {
+		return ctrl.Result{}, err
+	}
+	status.Namespaces = []string{}
+	invalid := []string{}
+	for _, namespace := range namespaces.Items {
+		if !parsed.AppliesTo(namespace.Labels) {
+			continue
+		}
+		status.Namespaces = append(status.Namespaces, namespace.Name)
+		effective := r.Defaults.Merge(r.Policies.ResolveLabels(namespace.Labels))
+		if err := effective.Validate(); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %v", namespace.Name, err))
+		}
+	}
+	sort.Strings(status.Namespaces)
+
+	condition := metav1.Condition{
+		Type:               noev1alpha1.NoePolicyConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Applied",
+		Message:            fmt.Sprintf("policy applies to %d namespaces", len(status.Namespaces)),
+		ObservedGeneration: noePolicy.Generation,
+	}
+	if len(invalid) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "InvalidEffectivePolicy"
+		condition.Message = strings.Join(invalid, "; ")
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+	// Other policies may change the effective policy of the namespaces, refresh the status periodically
+	return ctrl.Result{RequeueAfter: r.ResyncPeriod}, r.updateStatus(ctx, noePolicy, status)
+}
+
+// setPolicy stores the policy, invalidating the decisions taken with its previous version when it changed.
+// Policies are reconciled periodically and on every namespace change, they mostly did not change.
+func (r *NoePolicyReconciler) setPolicy(p policy.NamedPolicy) {
+	if previous, ok := r.Policies.Get(p.Name); ok && equality.Semantic.DeepEqual(previous, p) {
+		return
+	}
+	r.Policies.Set(p)
+	r.invalidate()
+}
+
+func (r *NoePolicyReconciler) deletePolicy(name string) {
+	if _, ok := r.Policies.Get(name); !ok {
+		return
+	}
+	r.Policies.Delete(name)
+	r.invalidate()
+}
+
+func (r *NoePolicyReconciler) invalidate() {
+	if r.Invalidator != nil {
+		r.Invalidator.Invalidate()
+	}
+}
+
+func (r *NoePolicyReconciler) updateStatus(ctx context.Context, noePolicy *noev1alpha1.NoePolicy, status *noev1alpha1.NoePolicyStatus) error {
+	if equality.Semantic.DeepEqual(&noePolicy.Status, status) {
+		return nil
+	}
+	noePolicy.Status = *status
+	return r.Client.Status().Update(ctx, noePolicy)
+}
+
+// ParseNoePolicy converts a NoePolicy to its policy representation, validating it.
+func ParseNoePolicy(noePolicy *noev1alpha1.NoePolicy) (policy.NamedPolicy, error) {
+	r := policy.NamedPolicy{
+		Name: noePolicy.Name,
+		Policy: policy.Policy{
+			PreferredArchitecture:    noePolicy.Spec.PreferredArchitecture,
+			SchedulableArchitectures: noePolicy.Spec.SchedulableArchitectures,
+			SystemOSes:               noePolicy.Spec.SystemOSes,
+			MatchNodeLabels:          noePolicy.Spec.MatchNodeLabels,
+			PrivateRegistries:        noePolicy.Spec.PrivateRegistries,
+		},
+	}
+	if noePolicy.Spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(noePolicy.Spec.NamespaceSelector)
+		if err != nil {
+			return r, fmt.Errorf("invalid namespace selector: %w", err)
+		}
+		r.NamespaceSelector = selector
+	}
+	for _, proxy := range noePolicy.Spec.RegistryProxies {
+		if proxy.Registry == "" || proxy.Proxy == "" {
+			return r, errors.New("registry proxies require both a registry and a proxy")
+		}
+		r.Policy.RegistryProxies = append(r.Policy.RegistryProxies, registry.RegistryProxy{Registry: proxy.Registry, Proxy: proxy.Proxy})
+	}
+	return r, r.Policy.Validate()
+}
+
+func (r *NoePolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&noev1alpha1.NoePolicy{}).
+		// Namespace labels decide which policies apply to them
+		Watches(&v1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.allPolicies)).
+		Complete(r)
+}
+
+func (r *NoePolicyReconciler) allPolicies(ctx context.Context, _ client.Object) []reconcile.Request {
+	policies := &noev1alpha1.NoePolicyList{}
+	if err := r.Client.List(ctx, policies); err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Error("failed to list noe policies")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, p := range policies.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: p.Name}})
+	}
+	return requests
+}
@@ -0,0 +1,146 @@
+package controllers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	noev1alpha1 "github.com/adevinta/noe/pkg/apis/noe/v1alpha1"
+	"github.com/adevinta/noe/pkg/controllers"
+	"github.com/adevinta/noe/pkg/policy"
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestReconcileNoePolicy(t *testing.T) {
+	k8sClient := fake.NewClientBuilder().
+		WithScheme(newOverrideScheme(t)).
+		WithStatusSubresource(&noev1alpha1.NoePolicy{}).
+		WithObjects(
+			&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"team": "arm"}}},
+			&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "arm"}}},
+			&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+			&noev1alpha1.NoePolicy{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       "arm",
+					Generation: 3,
+				},
+				Spec: noev1alpha1.NoePolicySpec{
+					NamespaceSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"team": "arm"}},
+					PreferredArchitecture: "arm64",
+				},
+			},
+		).Build()
+
+	store := policy.NewStore(k8sClient)
+	invalidator := &countingInvalidator{}
+	reconciler := controllers.NewNoePolicyReconciler(
+		controllers.WithPolicyClient(k8sClient),
+		controllers.WithPolicyStore(store),
+		controllers.WithPolicyInvalidator(invalidator),
+		controllers.WithPolicyResyncPeriod(time.Minute),
+		controllers.WithPolicyDefaults(policy.Policy{
+			PreferredArchitecture:    "amd64",
+			SchedulableArchitectures: []string{"amd64", "arm64"},
+		}),
+	)
+
+	result, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "arm"}})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, result.RequeueAfter)
+
+	resolved, err := store.Resolve(context.Background(), "team-a")
+	require.NoError(t, err)
+	assert.Equal(t, "arm64", resolved.PreferredArchitecture)
+	resolved, err = store.Resolve(context.Background(), "other")
+	require.NoError(t, err)
+	assert.Equal(t, "", resolved.PreferredArchitecture)
+
+	noePolicy := &noev1alpha1.NoePolicy{}
+	require.NoError(t, k8sClient.Get(context.Background(), client.ObjectKey{Name: "arm"}, noePolicy))
+	assert.Equal(t, []string{"team-a", "team-b"}, noePolicy.Status.Namespaces)
+	assert.EqualValues(t, 3, noePolicy.Status.ObservedGeneration)
+	assert.True(t, meta.IsStatusConditionTrue(noePolicy.Status.Conditions, noev1alpha1.NoePolicyConditionReady))
+	assert.Equal(t, 1, invalidator.count)
+
+	t.Run("When the policy did not change, the decisions are kept", func(t *testing.T) {
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "arm"}})
+		require.NoError(t, err)
+		assert.Equal(t, 1, invalidator.count)
+	})
+
+	t.Run("When the effective policy is invalid, it is reported in the status", func(t *testing.T) {
+		noePolicy.Spec.PreferredArchitecture = "riscv64"
+		require.NoError(t, k8sClient.Update(context.Background(), noePolicy))
+
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "arm"}})
+		require.NoError(t, err)
+
+		require.NoError(t, k8sClient.Get(context.Background(), client.ObjectKey{Name: "arm"}, noePolicy))
+		condition := meta.FindStatusCondition(noePolicy.Status.Conditions, noev1alpha1.NoePolicyConditionReady)
+		require.NotNil(t, condition)
+		assert.Equal(t, metav1.ConditionFalse, condition.Status)
+		assert.Equal(t, "InvalidEffectivePolicy", condition.Reason)
+		assert.Contains(t, condition.Message, "team-a")
+		assert.Contains(t, condition.Message, "riscv64")
+		assert.Equal(t, 2, invalidator.count)
+	})
+
+	t.Run("When the policy spec is invalid, it is no longer applied", func(t *testing.T) {
+		noePolicy.Spec.SchedulableArchitectures = []string{"amd64"}
+		require.NoError(t, k8sClient.Update(context.Background(), noePolicy))
+
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "arm"}})
+		require.NoError(t, err)
+		assert.Equal(t, policy.Policy{}, store.ResolveLabels(map[string]string{"team": "arm"}))
+
+		require.NoError(t, k8sClient.Get(context.Background(), client.ObjectKey{Name: "arm"}, noePolicy))
+		condition := meta.FindStatusCondition(noePolicy.Status.Conditions, noev1alpha1.NoePolicyConditionReady)
+		require.NotNil(t, condition)
+		assert.Equal(t, "InvalidSpec", condition.Reason)
+		assert.Empty(t, noePolicy.Status.Namespaces)
+		assert.Equal(t, 3, invalidator.count)
+	})
+
+	t.Run("When the policy is deleted, it is no longer applied", func(t *testing.T) {
+		store.Set(policy.NamedPolicy{Name: "arm", Policy: policy.Policy{PreferredArchitecture: "arm64"}})
+		require.NoError(t, k8sClient.Delete(context.Background(), noePolicy))
+
+		_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "arm"}})
+		require.NoError(t, err)
+		assert.Equal(t, policy.Policy{}, store.ResolveLabels(nil))
+		assert.Equal(t, 4, invalidator.count)
+	})
+}
+
+func TestParseNoePolicy(t *testing.T) {
+	noePolicy := &noev1alpha1.NoePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "proxies"},
+		Spec: noev1alpha1.NoePolicySpec{
+			RegistryProxies: []noev1alpha1.RegistryProxy{{Registry: "docker.io", Proxy: "docker-proxy.company.corp"}},
+		},
+	}
+	parsed, err := controllers.ParseNoePolicy(noePolicy)
+	require.NoError(t, err)
+	assert.Nil(t, parsed.NamespaceSelector)
+	assert.Equal(t, []registry.RegistryProxy{{Registry: "docker.io", Proxy: "docker-proxy.company.corp"}}, parsed.Policy.RegistryProxies)
+
+	noePolicy.Spec.RegistryProxies = []noev1alpha1.RegistryProxy{{Registry: "docker.io"}}
+	_, err = controllers.ParseNoePolicy(noePolicy)
+	assert.Error(t, err)
+
+	noePolicy.Spec.RegistryProxies = nil
+	noePolicy.Spec.NamespaceSelector = &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Unknown"}},
+	}
+	_, err = controllers.ParseNoePolicy(noePolicy)
+	assert.Error(t, err)
+}
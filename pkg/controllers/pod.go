@@ -15,7 +15,6 @@ package controllers
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"github.com/adevinta/noe/pkg/arch"
 	"github.com/adevinta/noe/pkg/log"
@@ -24,8 +23,8 @@ import (
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/events"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
@@ -83,6 +82,7 @@ type PodReconciler struct {
 	podImages      map[string][]string
 	imagePlatforms map[string]*imageUsage
 	metrics        *ControllerMetrics
+	Events         events.EventRecorder
 }
 
 type PodReconcilerOption func(*PodReconciler)
@@ -97,6 +97,14 @@ func WithRegistry(reg Registry) PodReconcilerOption {
 		h.Registry = reg
 	}
 }
+
+// WithEventRecorder records the deletion of the pods scheduled on nodes of unsupported platforms with the recorder.
+func WithEventRecorder(recorder events.EventRecorder) PodReconcilerOption {
+	return func(h *PodReconciler) {
+		h.Events = recorder
+	}
+}
+
 func WithClient(cl client.Client) PodReconcilerOption {
 	return func(h *PodReconciler) {
 		h.Client = cl
@@ -136,7 +144,7 @@ func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 		return ctrl.Result{}, nil
 	}
 
-	podImages := arch.GetContainerImages(pod.Spec.InitContainers, pod.Spec.Containers)
+	podImages := append(arch.GetContainerImages(pod.Spec.InitContainers, pod.Spec.Containers), arch.GetVolumeImages(pod.Spec.Volumes)...)
 
 	ctx, podScheduledOnMatchingNode, err := r.podScheduledOnMatchingNode(ctx, req.Namespace, pod, podImages)
 	if err != nil {
@@ -169,6 +177,8 @@ func (r *PodReconciler) podScheduledOnMatchingNode(ctx context.Context, namespac
 
 	nodeOs := ""
 	nodeArch := ""
+	// nodeEmulatedArch is the foreign architecture the node executes through emulation, if any
+	nodeEmulatedArch := ""
 	if pod.Spec.NodeName != "" {
 		// the pod was already scheduled
 		node := v1.Node{}
@@ -183,12 +193,13 @@ func (r *PodReconciler) podScheduledOnMatchingNode(ctx context.Context, namespac
 		} else if value, ok := node.Labels["beta.kubernetes.io/arch"]; ok {
 			nodeArch = value
 		}
+		nodeEmulatedArch = node.Labels[arch.EmulatesLabel]
 		if value, ok := node.Labels["kubernetes.io/os"]; ok {
 			nodeOs = value
 		} else if value, ok := node.Labels["beta.kubernetes.io/os"]; ok {
 			nodeOs = value
 		}
-		ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"node": pod.Spec.NodeName, "nodeOs": nodeOs, "nodeArch": nodeArch})
+		ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"node": pod.Spec.NodeName, "nodeOs": nodeOs, "nodeArch": nodeArch, "nodeEmulatedArch": nodeEmulatedArch})
 	}
 
 	podScheduledOnMatchingNode := true
@@ -198,10 +209,14 @@ func (r *PodReconciler) podScheduledOnMatchingNode(ctx context.Context, namespac
 			return ctx, false, err
 		}
 		r.incrementPlatformStatistics(image, platforms)
+		if len(platforms) == 0 {
+			// architecture neutral images (e.g. OCI artifacts) can run anywhere
+			continue
+		}
 		if nodeOs != "" && nodeArch != "" {
 			hasMatchingPlatform := false
 			for _, platform := range platforms {
-				if platform.OS == nodeOs && platform.Architecture == nodeArch {
+				if platform.OS == nodeOs && (platform.Architecture == nodeArch || (nodeEmulatedArch != "" && platform.Architecture == nodeEmulatedArch)) {
 					hasMatchingPlatform = true
 				}
 			}
@@ -276,41 +291,29 @@ func (r *PodReconciler) decrementPlatformStatistics(image string) {
 func (r *PodReconciler) deletePodAndNotifyUser(ctx context.Context, pod *v1.Pod) {
 	err := r.Client.Delete(ctx, pod)
 
-	eventType := "Normal"
-	nameSuffix := "-deleted-pod"
-	messagePrefix := "Pod(s) was deleted because it was scheduled on a node with a platform that is not supported by the image:"
+	eventType := v1.EventTypeNormal
+	note := "Pod %s was deleted because it was scheduled on a node with a platform that is not supported by the image"
 	if err != nil {
-		eventType = "Warning"
-		nameSuffix = "-failed-to-delete-pod"
-		messagePrefix = "Failed to delete pod(s) scheduled on a node with a platform that is not supported by the image. Pod(s):"
+		eventType = v1.EventTypeWarning
+		note = "Failed to delete pod %s scheduled on a node with a platform that is not supported by the image"
 		r.metrics.PodDeletedTotal.WithLabelValues(pod.Namespace, "failed").Inc()
 		log.DefaultLogger.WithContext(ctx).WithError(err).Error("Failed to delete pod scheduled on node with no matching platform")
 	} else {
 		r.metrics.PodDeletedTotal.WithLabelValues(pod.Namespace, "success").Inc()
 		log.DefaultLogger.WithContext(ctx).Info("Deleted pod scheduled on node with no matching platform")
 	}
+	if r.Events == nil {
+		return
+	}
 	// give visibility to the user that the pod has been deleted for both the pod and its owner
-	upsertPodDeletionEvent(ctx, r.Client, pod, pod.GetName(), eventType, nameSuffix, messagePrefix)
-	if len(pod.OwnerReferences) > 0 {
-		for _, ref := range pod.OwnerReferences {
-			if ref.Controller != nil && *ref.Controller {
-				u := &unstructured.Unstructured{}
-				u.SetAPIVersion(ref.APIVersion)
-				u.SetKind(ref.Kind)
-				u.SetName(ref.Name)
-				u.SetNamespace(pod.Namespace)
-				u.SetUID(ref.UID)
-				upsertPodDeletionEvent(
-					ctx,
-					r.Client,
-					u,
-					pod.GetName(),
-					eventType,
-					nameSuffix,
-					messagePrefix,
-				)
-			}
-		}
+	owners := arch.ControllingOwners(pod)
+	var related runtime.Object
+	if len(owners) > 0 {
+		related = owners[0]
+	}
+	r.Events.Eventf(pod, related, eventType, "PlatformMismatch", "DeletePod", note, pod.Name)
+	for _, owner := range owners {
+		r.Events.Eventf(owner, nil, eventType, "PlatformMismatch", "DeletePod", note, pod.Name)
 	}
 }
 
@@ -356,42 +359,3 @@ func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		For(&v1.Pod{}).
 		Complete(r)
 }
-
-func upsertPodDeletionEvent(ctx context.Context, k8sClient client.Client, owner client.Object, podName, eventType, nameSuffix, messagePrefix string) {
-	evt := v1.Event{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: owner.GetNamespace(),
-			Name:      owner.GetName() + "-" + nameSuffix,
-		},
-	}
-	_, err := ctrl.CreateOrUpdate(ctx, k8sClient, &evt, func() error {
-		if evt.Message == "" {
-			evt.Message = messagePrefix
-		}
-		evt.Message += "\n" + podName
-		evt.Type = eventType
-		if evt.Series == nil {
-			evt.Series = &v1.EventSeries{}
-		}
-		evt.Count++
-		evt.Series.Count++
-		evt.Series.LastObservedTime = metav1.NewMicroTime(time.Now())
-		evt.Reason = "PlatformMismatch"
-		evt.Source.Component = "noe"
-		evt.LastTimestamp = metav1.NewTime(time.Now())
-		if evt.FirstTimestamp.IsZero() {
-			evt.FirstTimestamp = evt.LastTimestamp
-		}
-		evt.InvolvedObject = v1.ObjectReference{
-			APIVersion: owner.GetObjectKind().GroupVersionKind().GroupVersion().String(),
-			Kind:       owner.GetObjectKind().GroupVersionKind().Kind,
-			Name:       owner.GetName(),
-			Namespace:  owner.GetNamespace(),
-			UID:        owner.GetUID(),
-		}
-		return nil
-	})
-	if err != nil {
-		log.DefaultLogger.WithContext(ctx).WithError(err).Error("Failed to create pod deletion event")
-	}
-}
@@ -18,7 +18,9 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/utils/pointer"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -418,10 +420,12 @@ func TestReconcileShouldDeletePodsOnMismatchingNodes(t *testing.T) {
 
 	metricsRegistry := prometheus.NewRegistry()
 
+	recorder := &recordingEventRecorder{}
 	reconciler := controllers.NewPodReconciler(
 		"test",
 		controllers.WithClient(k8sClient),
 		controllers.WithMetricsRegistry(metricsRegistry),
+		controllers.WithEventRecorder(recorder),
 		controllers.WithRegistry(arch.RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
 			assert.Equal(t, "test-image", image)
 			return []registry.Platform{
@@ -457,25 +461,79 @@ func TestReconcileShouldDeletePodsOnMismatchingNodes(t *testing.T) {
 	assert.Error(t, err)
 	assert.True(t, apierrors.IsNotFound(err))
 
-	evts := v1.EventList{}
-	err = k8sClient.List(context.Background(), &evts)
-	require.NoError(t, err)
-	assert.GreaterOrEqual(t, len(evts.Items), 2)
-	for _, evt := range evts.Items {
-		assert.Regexp(t, ".*-deleted-pod", evt.Name)
-		assert.Equal(t, "Normal", evt.Type)
-		assert.Equal(t, "PlatformMismatch", evt.Reason)
-		assert.Equal(t, "noe", evt.Source.Component)
-		assert.Equal(t, "ns", evt.Namespace)
-		assert.NotEmpty(t, evt.FirstTimestamp)
-		assert.NotEmpty(t, evt.LastTimestamp)
-		assert.Equal(t, 1, int(evt.Count))
-		assert.Contains(t, evt.Message, "Pod(s) was deleted because it was scheduled on a node with a platform that is not supported by the image:\ntest-pod-1")
-		assert.Contains(t, []string{"test-pod-1", "deployment-1"}, evt.InvolvedObject.Name)
-		assert.Contains(t, []string{"test-pod-1-uid", "deployment-1-uid"}, string(evt.InvolvedObject.UID))
-		assert.NotEmpty(t, evt.InvolvedObject.APIVersion, evt.InvolvedObject.APIVersion)
-		assert.Equal(t, "ns", evt.InvolvedObject.Namespace)
-	}
+	assert.Equal(t, []recordedEvent{
+		{
+			Regarding: "Pod/test-pod-1",
+			Related:   "Deployment/deployment-1",
+			Type:      "Normal",
+			Reason:    "PlatformMismatch",
+			Action:    "DeletePod",
+			Note:      "Pod test-pod-1 was deleted because it was scheduled on a node with a platform that is not supported by the image",
+		},
+		{
+			Regarding: "Deployment/deployment-1",
+			Type:      "Normal",
+			Reason:    "PlatformMismatch",
+			Action:    "DeletePod",
+			Note:      "Pod test-pod-1 was deleted because it was scheduled on a node with a platform that is not supported by the image",
+		},
+	}, recorder.events)
+}
+
+func TestReconcileShouldKeepPodsOnNodesEmulatingTheirArchitecture(t *testing.T) {
+	k8sClient := fake.NewClientBuilder().WithObjects(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "emulated-pod",
+				Namespace:   "ns",
+				Annotations: map[string]string{arch.EmulationAnnotation: "amd64"},
+			},
+			Spec: v1.PodSpec{
+				NodeName: "arm64-node",
+				Affinity: &v1.Affinity{NodeAffinity: &v1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{
+						{Key: arch.EmulatesLabel, Operator: v1.NodeSelectorOpIn, Values: []string{"amd64"}},
+						{Key: "kubernetes.io/os", Operator: v1.NodeSelectorOpIn, Values: []string{"linux"}},
+					}}},
+				}}},
+				Containers: []v1.Container{
+					{
+						Image: "amd64-image",
+					},
+				},
+			},
+		},
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "arm64-node",
+				Labels: map[string]string{
+					"kubernetes.io/arch": "arm64",
+					"kubernetes.io/os":   "linux",
+					arch.EmulatesLabel:   "amd64",
+				},
+			},
+		},
+	).Build()
+
+	recorder := &recordingEventRecorder{}
+	reconciler := controllers.NewPodReconciler(
+		"test",
+		controllers.WithClient(k8sClient),
+		controllers.WithMetricsRegistry(prometheus.NewRegistry()),
+		controllers.WithEventRecorder(recorder),
+		controllers.WithRegistry(arch.RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
+			return []registry.Platform{
+				{
+					OS:           "linux",
+					Architecture: "amd64",
+				},
+			}, nil
+		})))
+
+	_, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "emulated-pod", Namespace: "ns"}})
+	assert.NoError(t, err)
+	assert.NoError(t, k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: "emulated-pod"}, &v1.Pod{}))
+	assert.Empty(t, recorder.events)
 }
 
 func TestReconcileShouldReportMetricsAndEventsWhenPodDeletionFails(t *testing.T) {
@@ -534,10 +592,12 @@ func TestReconcileShouldReportMetricsAndEventsWhenPodDeletionFails(t *testing.T)
 
 	metricsRegistry := prometheus.NewRegistry()
 
+	recorder := &recordingEventRecorder{}
 	reconciler := controllers.NewPodReconciler(
 		"test",
 		controllers.WithClient(k8sClient),
 		controllers.WithMetricsRegistry(metricsRegistry),
+		controllers.WithEventRecorder(recorder),
 		controllers.WithRegistry(arch.RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]registry.Platform, error) {
 			assert.Equal(t, "test-image", image)
 			return []registry.Platform{
@@ -570,25 +630,14 @@ func TestReconcileShouldReportMetricsAndEventsWhenPodDeletionFails(t *testing.T)
 		},
 	)
 
-	evts := v1.EventList{}
-	err = k8sClient.List(context.Background(), &evts)
-	require.NoError(t, err)
-	assert.GreaterOrEqual(t, len(evts.Items), 2)
-	for _, evt := range evts.Items {
-		assert.Regexp(t, ".*-failed-to-delete-pod", evt.Name)
+	require.Len(t, recorder.events, 2)
+	for _, evt := range recorder.events {
 		assert.Equal(t, "Warning", evt.Type)
 		assert.Equal(t, "PlatformMismatch", evt.Reason)
-		assert.Equal(t, "noe", evt.Source.Component)
-		assert.Equal(t, "ns", evt.Namespace)
-		assert.NotEmpty(t, evt.FirstTimestamp)
-		assert.NotEmpty(t, evt.LastTimestamp)
-		assert.Equal(t, 1, int(evt.Count))
-		assert.Contains(t, evt.Message, "Failed to delete pod(s) scheduled on a node with a platform that is not supported by the image. Pod(s):\ntest-pod-1")
-		assert.Contains(t, []string{"test-pod-1", "deployment-1"}, evt.InvolvedObject.Name)
-		assert.Contains(t, []string{"test-pod-1-uid", "deployment-1-uid"}, string(evt.InvolvedObject.UID))
-		assert.NotEmpty(t, evt.InvolvedObject.APIVersion, evt.InvolvedObject.APIVersion)
-		assert.Equal(t, "ns", evt.InvolvedObject.Namespace)
+		assert.Equal(t, "Failed to delete pod test-pod-1 scheduled on a node with a platform that is not supported by the image", evt.Note)
 	}
+	assert.Equal(t, "Pod/test-pod-1", recorder.events[0].Regarding)
+	assert.Equal(t, "Deployment/deployment-1", recorder.events[1].Regarding)
 }
 
 type deleteErrorK8sClient struct {
@@ -934,3 +983,38 @@ func TestReconcileWhenPodBelongsToStatefulSetIsAlwaysChecked(t *testing.T) {
 		},
 	)
 }
+
+type recordedEvent struct {
+	Regarding string
+	Related   string
+	Type      string
+	Reason    string
+	Action    string
+	Note      string
+}
+
+type recordingEventRecorder struct {
+	events []recordedEvent
+}
+
+func (r *recordingEventRecorder) Eventf(regarding runtime.Object, related runtime.Object, eventtype, reason, action, note string, args ...interface{}) {
+	r.events = append(r.events, recordedEvent{
+		Regarding: eventObject(regarding),
+		Related:   eventObject(related),
+		Type:      eventtype,
+		Reason:    reason,
+		Action:    action,
+		Note:      fmt.Sprintf(note, args...),
+	})
+}
+
+func eventObject(obj runtime.Object) string {
+	if obj == nil {
+		return ""
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return obj.GetObjectKind().GroupVersionKind().Kind + "/" + accessor.GetName()
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/adevinta/noe/pkg/arch"
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// GatedPodUpdater computes the node selection of the pods whose scheduling was deferred at admission.
+type GatedPodUpdater interface {
+	UpdateGatedPod(ctx context.Context, pod *v1.Pod) error
+}
+
+type SchedulingGateMetrics struct {
+	GateReleased *prometheus.CounterVec
+}
+
+func (m SchedulingGateMetrics) MustRegister(reg metrics.RegistererGatherer) {
+	reg.MustRegister(
+		m.GateReleased,
+	)
+}
+
+func NewSchedulingGateMetrics(prefix string) *SchedulingGateMetrics {
+	return &SchedulingGateMetrics{
+		GateReleased: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: prefix,
+				Subsystem: "pods",
+				Name:      "scheduling_gate_released_total",
+				Help:      "Number of pods whose scheduling gate was removed, by reason.",
+			},
+			[]string{"namespace", "reason"},
+		),
+	}
+}
+
+// SchedulingGateReconciler computes the node selection of the pods gated at admission, and removes their scheduling gate.
+// The gate is removed without node selection once the pod waited for MaxWait, so that pods are never stuck.
+type SchedulingGateReconciler struct {
+	client.Client
+	Updater     GatedPodUpdater
+	MaxWait     time.Duration
+	RetryPeriod time.Duration
+	metrics     *SchedulingGateMetrics
+}
+
+type SchedulingGateReconcilerOption func(*SchedulingGateReconciler)
+
+func WithGateClient(cl client.Client) SchedulingGateReconcilerOption {
+	return func(r *SchedulingGateReconciler) {
+		r.Client = cl
+	}
+}
+
+func WithGatedPodUpdater(updater GatedPodUpdater) SchedulingGateReconcilerOption {
+	return func(r *SchedulingGateReconciler) {
+		r.Updater = updater
+	}
+}
+
+func WithGateMaxWait(maxWait time.Duration) SchedulingGateReconcilerOption {
+	return func(r *SchedulingGateReconciler) {
+		r.MaxWait = maxWait
+	}
+}
+
+func WithGateRetryPeriod(period time.Duration) SchedulingGateReconcilerOption {
+	return func(r *SchedulingGateReconciler) {
+		r.RetryPeriod = period
+	}
+}
+
+func WithGateMetricsRegistry(reg metrics.RegistererGatherer) SchedulingGateReconcilerOption {
+	return func(r *SchedulingGateReconciler) {
+		r.metrics.MustRegister(reg)
+	}
+}
+
+func NewSchedulingGateReconciler(opts ...SchedulingGateReconcilerOption) *SchedulingGateReconciler {
+	r := &SchedulingGateReconciler{
+		MaxWait:     5 * time.Minute,
+		RetryPeriod: 10 * time.Second,
+		metrics:     NewSchedulingGateMetrics("noe"),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *SchedulingGateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"controller": fmt.Sprintf("%T", r), "namespace": req.Namespace, "name": req.Name})
+
+	log.DefaultLogger.WithContext(ctx).Debug("Reconciling gated Pod")
+
+	pod := &v1.Pod{}
+	err := r.Client.Get(ctx, req.NamespacedName, pod)
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !arch.HasSchedulingGate(pod) {
+		return ctrl.Result{}, nil
+	}
+
+	waited := time.Since(pod.CreationTimestamp.Time)
+	if waited >= r.MaxWait {
+		log.DefaultLogger.WithContext(ctx).WithField("waited", waited).Warn("image platforms not resolved in time, scheduling the pod without node selection")
+		return ctrl.Result{}, r.releaseGate(ctx, pod, "timeout")
+	}
+
+	updated := pod.DeepCopy()
+	err = r.Updater.UpdateGatedPod(ctx, updated)
+	if errors.Is(err, arch.ErrUnresolvedImages) {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Info("image platforms not resolved yet, retrying")
+		return ctrl.Result{RequeueAfter: min(r.RetryPeriod, r.MaxWait-waited)}, nil
+	}
+	if err != nil {
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("unable to select the pod nodes, scheduling the pod without node selection")
+		return ctrl.Result{}, r.releaseGate(ctx, pod, "failed")
+	}
+
+	arch.RemoveSchedulingGate(updated)
+	err = r.Client.Update(ctx, updated)
+	if apierrors.IsInvalid(err) {
+		// The node affinity of gated pods can only be narrowed, e.g. when the pod already had required terms
+		log.DefaultLogger.WithContext(ctx).WithError(err).Warn("node selection rejected, scheduling the pod without node selection")
+		return ctrl.Result{}, r.releaseGate(ctx, pod, "invalid")
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	log.DefaultLogger.WithContext(ctx).Info("applied the deferred node selection")
+	r.metrics.GateReleased.WithLabelValues(pod.Namespace, "resolved").Inc()
+	return ctrl.Result{}, nil
+}
+
+func (r *SchedulingGateReconciler) releaseGate(ctx context.Context, pod *v1.Pod, reason string) error {
+	arch.RemoveSchedulingGate(pod)
+	if err := r.Client.Update(ctx, pod); err != nil {
+		return err
+	}
+	r.metrics.GateReleased.WithLabelValues(pod.Namespace, reason).Inc()
+	return nil
+}
+
+func (r *SchedulingGateReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("schedulinggate").
+		For(&v1.Pod{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			pod, ok := obj.(*v1.Pod)
+			return ok && arch.HasSchedulingGate(pod)
+		}))).
+		Complete(r)
+}
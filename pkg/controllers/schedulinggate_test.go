@@ -0,0 +1,95 @@
+package controllers_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adevinta/noe/pkg/arch"
+	"github.com/adevinta/noe/pkg/controllers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+type gatedPodUpdaterFunc func(ctx context.Context, pod *v1.Pod) error
+
+func (f gatedPodUpdaterFunc) UpdateGatedPod(ctx context.Context, pod *v1.Pod) error {
+	return f(ctx, pod)
+}
+
+func gatedPod(name string, created time.Time) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "ns",
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: v1.PodSpec{
+			Containers:      []v1.Container{{Name: "app", Image: "ubuntu"}},
+			SchedulingGates: []v1.PodSchedulingGate{{Name: "other"}, {Name: arch.SchedulingGate}},
+		},
+	}
+}
+
+func TestReconcileSchedulingGate(t *testing.T) {
+	k8sClient := fake.NewClientBuilder().
+		WithScheme(newOverrideScheme(t)).
+		WithObjects(
+			gatedPod("resolved", time.Now()),
+			gatedPod("unresolved", time.Now()),
+			gatedPod("expired", time.Now().Add(-time.Hour)),
+		).Build()
+
+	reconciler := controllers.NewSchedulingGateReconciler(
+		controllers.WithGateClient(k8sClient),
+		controllers.WithGateMaxWait(time.Minute),
+		controllers.WithGateRetryPeriod(5*time.Second),
+		controllers.WithGatedPodUpdater(gatedPodUpdaterFunc(func(ctx context.Context, pod *v1.Pod) error {
+			if pod.Name == "unresolved" {
+				return arch.ErrUnresolvedImages
+			}
+			pod.Spec.NodeSelector = map[string]string{"kubernetes.io/arch": "arm64"}
+			return nil
+		})),
+	)
+
+	reconcilePod := func(t *testing.T, name string) (reconcile.Result, *v1.Pod) {
+		t.Helper()
+		result, err := reconciler.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: name}})
+		require.NoError(t, err)
+		pod := &v1.Pod{}
+		require.NoError(t, k8sClient.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: name}, pod))
+		return result, pod
+	}
+
+	t.Run("When the node selection is computed, it is applied and the gate is removed", func(t *testing.T) {
+		_, pod := reconcilePod(t, "resolved")
+		assert.Equal(t, map[string]string{"kubernetes.io/arch": "arm64"}, pod.Spec.NodeSelector)
+		assert.Equal(t, []v1.PodSchedulingGate{{Name: "other"}}, pod.Spec.SchedulingGates)
+	})
+
+	t.Run("When the platforms are not resolved, the pod stays gated", func(t *testing.T) {
+		result, pod := reconcilePod(t, "unresolved")
+		assert.Equal(t, 5*time.Second, result.RequeueAfter)
+		assert.Nil(t, pod.Spec.NodeSelector)
+		assert.True(t, arch.HasSchedulingGate(pod))
+	})
+
+	t.Run("When the pod waited for too long, the gate is removed without node selection", func(t *testing.T) {
+		_, pod := reconcilePod(t, "expired")
+		assert.Nil(t, pod.Spec.NodeSelector)
+		assert.Equal(t, []v1.PodSchedulingGate{{Name: "other"}}, pod.Spec.SchedulingGates)
+	})
+
+	t.Run("When the pod is not gated, it is left untouched", func(t *testing.T) {
+		result, pod := reconcilePod(t, "resolved")
+		assert.Equal(t, reconcile.Result{}, result)
+		assert.Equal(t, map[string]string{"kubernetes.io/arch": "arm64"}, pod.Spec.NodeSelector)
+	})
+}
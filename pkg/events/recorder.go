@@ -0,0 +1,155 @@
+package events
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sevents "k8s.io/client-go/tools/events"
+	"k8s.io/client-go/util/flowcontrol"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// maxNoteLength is the maximum length of the note of events.k8s.io/v1 events.
+const maxNoteLength = 1024
+
+type Metrics struct {
+	Emitted *prometheus.CounterVec
+	Dropped *prometheus.CounterVec
+}
+
+func (m Metrics) MustRegister(reg metrics.RegistererGatherer) {
+	reg.MustRegister(
+		m.Emitted,
+		m.Dropped,
+	)
+}
+
+func NewMetrics(prefix string) *Metrics {
+	return &Metrics{
+		Emitted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "events",
+			Name:      "emitted_total",
+			Help:      "Number of Kubernetes events emitted, by reason",
+		}, []string{"reason"}),
+		Dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "events",
+			Name:      "dropped_total",
+			Help:      "Number of Kubernetes events dropped, by cause (queue_full, over_budget or unnamed)",
+		}, []string{"cause"}),
+	}
+}
+
+type event struct {
+	regarding runtime.Object
+	related   runtime.Object
+	eventtype string
+	reason    string
+	action    string
+	note      string
+}
+
+type Option func(*Recorder)
+
+// Recorder emits the Kubernetes events from a background queue, within a budget,
+// so that event problems never slow down the admissions nor the reconciliations.
+// Events exceeding the queue size or the budget are dropped.
+// It implements the events.k8s.io/v1 EventRecorder, and delegates the aggregation of
+// the repeated events into series to the underlying recorder.
+type Recorder struct {
+	recorder  k8sevents.EventRecorder
+	queueSize int
+	queue     chan event
+	limiter   flowcontrol.RateLimiter
+	metrics   *Metrics
+}
+
+func NewRecorder(recorder k8sevents.EventRecorder, opts ...Option) *Recorder {
+	r := &Recorder{
+		recorder:  recorder,
+		queueSize: 1000,
+		metrics:   NewMetrics("noe"),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.queue = make(chan event, r.queueSize)
+	return r
+}
+
+func WithQueueSize(size int) Option {
+	return func(r *Recorder) {
+		r.queueSize = size
+	}
+}
+
+// WithBudget limits the rate of the emitted events, in events per second with bursts of burst events.
+func WithBudget(qps float32, burst int) Option {
+	return func(r *Recorder) {
+		r.limiter = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	}
+}
+
+func WithMetricsRegistry(reg metrics.RegistererGatherer) Option {
+	return func(r *Recorder) {
+		r.metrics.MustRegister(reg)
+	}
+}
+
+// Eventf queues the event without blocking.
+func (r *Recorder) Eventf(regarding runtime.Object, related runtime.Object, eventtype, reason, action, note string, args ...interface{}) {
+	e := event{
+		regarding: regarding,
+		related:   related,
+		eventtype: eventtype,
+		reason:    reason,
+		action:    action,
+		note:      fmt.Sprintf(note, args...),
+	}
+	select {
+	case r.queue <- e:
+	default:
+		r.metrics.Dropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+// Start emits the queued events until the context is done.
+func (r *Recorder) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e := <-r.queue:
+			r.emit(ctx, e)
+		}
+	}
+}
+
+// NeedLeaderElection reports that events are emitted by all the replicas, as all of them admit pods.
+func (r *Recorder) NeedLeaderElection() bool {
+	return false
+}
+
+func (r *Recorder) emit(ctx context.Context, e event) {
+	// Objects without names, such as pods created with a generateName, can't be referred to
+	if accessor, err := meta.Accessor(e.regarding); err != nil || accessor.GetName() == "" {
+		log.DefaultLogger.WithContext(ctx).WithField("reason", e.reason).Debug("dropping event regarding an unnamed object")
+		r.metrics.Dropped.WithLabelValues("unnamed").Inc()
+		return
+	}
+	if r.limiter != nil && !r.limiter.TryAccept() {
+		log.DefaultLogger.WithContext(ctx).WithField("reason", e.reason).Debug("event budget exhausted, dropping event")
+		r.metrics.Dropped.WithLabelValues("over_budget").Inc()
+		return
+	}
+	if len(e.note) > maxNoteLength {
+		e.note = e.note[:maxNoteLength-3] + "..."
+	}
+	r.recorder.Eventf(e.regarding, e.related, e.eventtype, e.reason, e.action, "%s", e.note)
+	r.metrics.Emitted.WithLabelValues(e.reason).Inc()
+}
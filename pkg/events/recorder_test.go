@@ -0,0 +1,79 @@
+package events
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adevinta/noe/pkg/metric_test_helpers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sevents "k8s.io/client-go/tools/events"
+)
+
+func TestAllMetricsShouldBeRegistered(t *testing.T) {
+	metrics := NewMetrics("test")
+	metric_test_helpers.AssertAllMetricsHaveBeenRegistered(t, metrics)
+}
+
+func TestRecorder(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod"}}
+
+	t.Run("When events are queued, they are emitted in the background", func(t *testing.T) {
+		fake := k8sevents.NewFakeRecorder(10)
+		r := NewRecorder(fake)
+		r.Eventf(pod, nil, v1.EventTypeNormal, "InjectedNodeSelector", "InjectNodeSelector", "Injected node selector to pod %s", "pod")
+		assert.Empty(t, fake.Events)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go r.Start(ctx)
+		select {
+		case evt := <-fake.Events:
+			assert.Equal(t, "Normal InjectedNodeSelector Injected node selector to pod pod", evt)
+		case <-time.After(time.Second):
+			t.Fatal("event not emitted")
+		}
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(r.metrics.Emitted.WithLabelValues("InjectedNodeSelector")) == 1
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("When the queue is full, events are dropped without blocking", func(t *testing.T) {
+		r := NewRecorder(k8sevents.NewFakeRecorder(10), WithQueueSize(1))
+		r.Eventf(pod, nil, v1.EventTypeNormal, "InjectedNodeSelector", "InjectNodeSelector", "first")
+		r.Eventf(pod, nil, v1.EventTypeNormal, "InjectedNodeSelector", "InjectNodeSelector", "second")
+		assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.Dropped.WithLabelValues("queue_full")))
+	})
+
+	t.Run("When the budget is exhausted, events are dropped", func(t *testing.T) {
+		fake := k8sevents.NewFakeRecorder(10)
+		r := NewRecorder(fake, WithBudget(0.001, 1))
+		r.emit(context.Background(), event{regarding: pod, eventtype: v1.EventTypeNormal, reason: "InjectedNodeSelector", note: "first"})
+		r.emit(context.Background(), event{regarding: pod, eventtype: v1.EventTypeNormal, reason: "InjectedNodeSelector", note: "second"})
+		require.Len(t, fake.Events, 1)
+		assert.Equal(t, "Normal InjectedNodeSelector first", <-fake.Events)
+		assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.Dropped.WithLabelValues("over_budget")))
+	})
+
+	t.Run("When the regarding object has no name yet, the event is dropped", func(t *testing.T) {
+		fake := k8sevents.NewFakeRecorder(10)
+		r := NewRecorder(fake)
+		unnamed := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", GenerateName: "web-"}}
+		r.emit(context.Background(), event{regarding: unnamed, eventtype: v1.EventTypeNormal, reason: "InjectedNodeSelector", note: "note"})
+		assert.Empty(t, fake.Events)
+		assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.Dropped.WithLabelValues("unnamed")))
+	})
+
+	t.Run("When the note is too long, it is truncated", func(t *testing.T) {
+		fake := k8sevents.NewFakeRecorder(10)
+		r := NewRecorder(fake)
+		r.emit(context.Background(), event{regarding: pod, eventtype: v1.EventTypeWarning, reason: "FailedToInjectNodeSelector", note: strings.Repeat("x", 2000)})
+		require.Len(t, fake.Events, 1)
+		assert.Len(t, <-fake.Events, len("Warning FailedToInjectNodeSelector ")+maxNoteLength)
+	})
+}
@@ -0,0 +1,94 @@
+package httputils
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/adevinta/noe/pkg/log"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type userKey struct{}
+
+// ContextWithUser returns a context holding the user the request is served for.
+func ContextWithUser(ctx context.Context, user authenticationv1.UserInfo) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFromContext returns the user the request is served for, as authenticated by RequireAuthorization, if any.
+func UserFromContext(ctx context.Context) (authenticationv1.UserInfo, bool) {
+	user, ok := ctx.Value(userKey{}).(authenticationv1.UserInfo)
+	return user, ok
+}
+
+// AuthorizeResource reports whether the user is allowed to access the resource, as reviewed by the Kubernetes API server.
+func AuthorizeResource(ctx context.Context, c client.Client, user authenticationv1.UserInfo, attributes authorizationv1.ResourceAttributes) (bool, error) {
+	access := subjectAccessReview(user)
+	access.Spec.ResourceAttributes = &attributes
+	if err := c.Create(ctx, access); err != nil {
+		return false, err
+	}
+	return access.Status.Allowed, nil
+}
+
+func subjectAccessReview(user authenticationv1.UserInfo) *authorizationv1.SubjectAccessReview {
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	return &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+		},
+	}
+}
+
+// RequireAuthorization only serves the requests whose bearer token is authenticated by the Kubernetes API server,
+// and whose user is allowed to use the request method on the request path as a non-resource URL.
+// For instance, POST requests to /explain are allowed by the RBAC rule {nonResourceURLs: ["/explain"], verbs: ["post"]}.
+// The authenticated user is available to the handler through UserFromContext, to authorize the resources it serves.
+func RequireAuthorization(c client.Client, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		review := &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token},
+		}
+		if err := c.Create(ctx, review); err != nil {
+			log.DefaultLogger.WithContext(ctx).WithError(err).Error("failed to review the request token")
+			http.Error(w, "failed to authenticate the request", http.StatusInternalServerError)
+			return
+		}
+		if !review.Status.Authenticated {
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		user := review.Status.User
+		access := subjectAccessReview(user)
+		access.Spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{
+			Path: r.URL.Path,
+			Verb: strings.ToLower(r.Method),
+		}
+		if err := c.Create(ctx, access); err != nil {
+			log.DefaultLogger.WithContext(ctx).WithError(err).Error("failed to review the request access")
+			http.Error(w, "failed to authorize the request", http.StatusInternalServerError)
+			return
+		}
+		if !access.Status.Allowed {
+			log.DefaultLogger.WithContext(ctx).WithField("user", user.Username).WithField("path", r.URL.Path).Info("request denied")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(ContextWithUser(ctx, user)))
+	})
+}
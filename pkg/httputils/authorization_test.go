@@ -0,0 +1,90 @@
+package httputils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestRequireAuthorization(t *testing.T) {
+	var reviewed *authorizationv1.SubjectAccessReview
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithInterceptorFuncs(interceptor.Funcs{
+		Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			switch review := obj.(type) {
+			case *authenticationv1.TokenReview:
+				switch review.Spec.Token {
+				case "failing":
+					return errors.New("api server unavailable")
+				case "alice", "bob":
+					review.Status.Authenticated = true
+					review.Status.User = authenticationv1.UserInfo{Username: review.Spec.Token, Groups: []string{"platform"}}
+				}
+			case *authorizationv1.SubjectAccessReview:
+				reviewed = review
+				review.Status.Allowed = review.Spec.User == "alice"
+			}
+			return nil
+		},
+	}).Build()
+	var served authenticationv1.UserInfo
+	handler := RequireAuthorization(k8sClient, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served, _ = UserFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/explain", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("When no token is provided, the request is unauthorized", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, serve(""))
+	})
+
+	t.Run("When the token is not authenticated, the request is unauthorized", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, serve("unknown"))
+	})
+
+	t.Run("When the token can't be reviewed, the request fails", func(t *testing.T) {
+		assert.Equal(t, http.StatusInternalServerError, serve("failing"))
+	})
+
+	t.Run("When the user is not allowed, the request is forbidden", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, serve("bob"))
+	})
+
+	t.Run("When the user is allowed, the request is served", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve("alice"))
+		assert.Equal(t, []string{"platform"}, reviewed.Spec.Groups)
+		assert.Equal(t, &authorizationv1.NonResourceAttributes{Path: "/explain", Verb: "post"}, reviewed.Spec.NonResourceAttributes)
+		assert.Equal(t, "alice", served.Username)
+	})
+
+	t.Run("When the user is allowed to access a resource, it is authorized", func(t *testing.T) {
+		attributes := authorizationv1.ResourceAttributes{Namespace: "ns", Verb: "create", Resource: "pods"}
+		allowed, err := AuthorizeResource(context.Background(), k8sClient, authenticationv1.UserInfo{Username: "alice"}, attributes)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, &attributes, reviewed.Spec.ResourceAttributes)
+		assert.Nil(t, reviewed.Spec.NonResourceAttributes)
+
+		allowed, err = AuthorizeResource(context.Background(), k8sClient, authenticationv1.UserInfo{Username: "bob"}, attributes)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+	})
+}
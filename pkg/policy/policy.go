@@ -0,0 +1,153 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/adevinta/noe/pkg/registry"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Policy is the configuration Noe applies to the pods of a namespace.
+// Empty fields inherit from less specific policies.
+type Policy struct {
+	PreferredArchitecture    string
+	SchedulableArchitectures []string
+	SystemOSes               []string
+	MatchNodeLabels          []string
+	RegistryProxies          []registry.RegistryProxy
+	PrivateRegistries        []string
+}
+
+// Merge returns the policy with the non empty fields of other overriding its own.
+func (p Policy) Merge(other Policy) Policy {
+	if other.PreferredArchitecture != "" {
+		p.PreferredArchitecture = other.PreferredArchitecture
+	}
+	if len(other.SchedulableArchitectures) > 0 {
+		p.SchedulableArchitectures = other.SchedulableArchitectures
+	}
+	if len(other.SystemOSes) > 0 {
+		p.SystemOSes = other.SystemOSes
+	}
+	if len(other.MatchNodeLabels) > 0 {
+		p.MatchNodeLabels = other.MatchNodeLabels
+	}
+	if len(other.RegistryProxies) > 0 {
+		p.RegistryProxies = other.RegistryProxies
+	}
+	if len(other.PrivateRegistries) > 0 {
+		p.PrivateRegistries = other.PrivateRegistries
+	}
+	return p
+}
+
+// Validate checks the consistency of the policy.
+func (p Policy) Validate() error {
+	if p.PreferredArchitecture != "" && len(p.SchedulableArchitectures) > 0 && !slices.Contains(p.SchedulableArchitectures, p.PreferredArchitecture) {
+		return fmt.Errorf("preferred architecture %s is not schedulable in the cluster (%v)", p.PreferredArchitecture, p.SchedulableArchitectures)
+	}
+	return nil
+}
+
+// RegistryConfig returns the registry settings of the policy.
+func (p Policy) RegistryConfig() registry.Config {
+	return registry.Config{
+		Proxies:                  p.RegistryProxies,
+		SchedulableArchitectures: p.SchedulableArchitectures,
+		PrivateRegistryPatterns:  p.PrivateRegistries,
+	}
+}
+
+// NamedPolicy is a policy declared in the cluster.
+type NamedPolicy struct {
+	Name string
+	// NamespaceSelector restricts the namespaces the policy applies to.
+	// A nil selector applies to all namespaces.
+	NamespaceSelector labels.Selector
+	Policy            Policy
+}
+
+// AppliesTo reports whether the policy applies to a namespace with the given labels.
+func (p NamedPolicy) AppliesTo(namespaceLabels map[string]string) bool {
+	return p.NamespaceSelector == nil || p.NamespaceSelector.Matches(labels.Set(namespaceLabels))
+}
+
+// Store holds the policies currently declared in the cluster.
+// It is safe for concurrent use.
+type Store struct {
+	Client   client.Reader
+	lock     sync.RWMutex
+	policies map[string]NamedPolicy
+}
+
+func NewStore(client client.Reader) *Store {
+	return &Store{
+		Client:   client,
+		policies: map[string]NamedPolicy{},
+	}
+}
+
+// Get returns the policy stored with the name.
+func (s *Store) Get(name string) (NamedPolicy, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	policy, ok := s.policies[name]
+	return policy, ok
+}
+
+func (s *Store) Set(policy NamedPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.policies[policy.Name] = policy
+}
+
+func (s *Store) Delete(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.policies, name)
+}
+
+// ResolveLabels returns the policy applying to a namespace with the given labels.
+// Cluster wide policies are applied first, then the namespaced ones, each sorted by name.
+func (s *Store) ResolveLabels(namespaceLabels map[string]string) Policy {
+	s.lock.RLock()
+	clusterWide := []NamedPolicy{}
+	namespaced := []NamedPolicy{}
+	for _, policy := range s.policies {
+		if !policy.AppliesTo(namespaceLabels) {
+			continue
+		}
+		if policy.NamespaceSelector == nil {
+			clusterWide = append(clusterWide, policy)
+		} else {
+			namespaced = append(namespaced, policy)
+		}
+	}
+	s.lock.RUnlock()
+
+	r := Policy{}
+	for _, policies := range [][]NamedPolicy{clusterWide, namespaced} {
+		sort.Slice(policies, func(i, j int) bool {
+			return policies[i].Name < policies[j].Name
+		})
+		for _, policy := range policies {
+			r = r.Merge(policy.Policy)
+		}
+	}
+	return r
+}
+
+// Resolve returns the policy applying to the namespace.
+func (s *Store) Resolve(ctx context.Context, namespace string) (Policy, error) {
+	ns := &v1.Namespace{}
+	if err := s.Client.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		return Policy{}, err
+	}
+	return s.ResolveLabels(ns.Labels), nil
+}
@@ -0,0 +1,65 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/adevinta/noe/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestResolveLabels(t *testing.T) {
+	store := NewStore(nil)
+	store.Set(NamedPolicy{
+		Name: "b-cluster",
+		Policy: Policy{
+			PreferredArchitecture: "amd64",
+			SystemOSes:            []string{"linux"},
+		},
+	})
+	store.Set(NamedPolicy{
+		Name: "a-cluster",
+		Policy: Policy{
+			PreferredArchitecture:    "arm64",
+			SchedulableArchitectures: []string{"amd64", "arm64"},
+		},
+	})
+	store.Set(NamedPolicy{
+		Name:              "0-team",
+		NamespaceSelector: labels.SelectorFromSet(labels.Set{"team": "arm"}),
+		Policy: Policy{
+			PreferredArchitecture: "arm64",
+			RegistryProxies:       []registry.RegistryProxy{{Registry: "docker.io", Proxy: "proxy"}},
+		},
+	})
+
+	assert.Equal(
+		t,
+		Policy{
+			PreferredArchitecture:    "amd64",
+			SchedulableArchitectures: []string{"amd64", "arm64"},
+			SystemOSes:               []string{"linux"},
+		},
+		store.ResolveLabels(map[string]string{"team": "other"}),
+	)
+	assert.Equal(
+		t,
+		Policy{
+			PreferredArchitecture:    "arm64",
+			SchedulableArchitectures: []string{"amd64", "arm64"},
+			SystemOSes:               []string{"linux"},
+			RegistryProxies:          []registry.RegistryProxy{{Registry: "docker.io", Proxy: "proxy"}},
+		},
+		store.ResolveLabels(map[string]string{"team": "arm"}),
+	)
+
+	store.Delete("0-team")
+	assert.Equal(t, "amd64", store.ResolveLabels(map[string]string{"team": "arm"}).PreferredArchitecture)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Policy{}.Validate())
+	assert.NoError(t, Policy{PreferredArchitecture: "arm64"}.Validate())
+	assert.NoError(t, Policy{PreferredArchitecture: "arm64", SchedulableArchitectures: []string{"arm64"}}.Validate())
+	assert.Error(t, Policy{PreferredArchitecture: "arm64", SchedulableArchitectures: []string{"amd64"}}.Validate())
+}
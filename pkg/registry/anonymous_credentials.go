@@ -11,7 +11,11 @@ type AnonymousAuthenticator struct {
 }
 
 func (r AnonymousAuthenticator) Authenticate(ctx context.Context, imagePullSecret, registry, image, tag string, candidates chan AuthenticationToken) {
-	for _, pattern := range r.PrivateRegistryPatterns {
+	patterns := r.PrivateRegistryPatterns
+	if config, ok := ConfigFromContext(ctx); ok && len(config.PrivateRegistryPatterns) > 0 {
+		patterns = config.PrivateRegistryPatterns
+	}
+	for _, pattern := range patterns {
 		if imageMatchesLoginPattern(ctx, registry, image, pattern) {
 			log.DefaultLogger.WithContext(ctx).WithField("pattern", pattern).WithField("image", image).WithField("registry", registry).Error("image is registered as private. Skipping anonymous authentication")
 			return
@@ -132,8 +132,15 @@ func NewCacheMetrics(prefix, system string) *CacheMetrics {
 }
 
 type CacheOption func(*CachedRegistry)
+
+// resolvedPlatforms are the cached platforms of an image, with the way they were resolved.
+type resolvedPlatforms struct {
+	platforms  []Platform
+	resolution Resolution
+}
+
 type CachedRegistry struct {
-	cache    Cache[[]Platform]
+	cache    Cache[resolvedPlatforms]
 	registry Registry
 	metrics  *CacheMetrics
 }
@@ -159,18 +166,25 @@ func WithCacheMetricsRegistry(reg metrics.RegistererGatherer) CacheOption {
 func (cr *CachedRegistry) ListArchs(ctx context.Context, imagePullSecret, image string) ([]Platform, error) {
 	cr.metrics.Requests.WithLabelValues().Inc()
 	cacheKey := imagePullSecret + ":" + image
+	if config, ok := ConfigFromContext(ctx); ok {
+		// Registry settings change the resolved platforms, don't share results across them
+		cacheKey = config.Key() + ":" + cacheKey
+	}
 
 	// Trigger a cleanup of the cache, but don't wait for it to finish
 	// Waiting for the cleanup to finish would block the request and
 	// slow down the response time.
 	defer func() { go cr.cache.CleanUp(time.Now()) }()
 
-	archs, cached, err := cr.cache.LoadOrCall(cacheKey, func() ([]Platform, error) {
-		archs, err := cr.registry.ListArchs(ctx, imagePullSecret, image)
+	resolved, cached, err := cr.cache.LoadOrCall(cacheKey, func() (resolvedPlatforms, error) {
+		// Trace the lookup on its own, so that the resolution can be reported on cache hits too
+		lookupCtx, trace := ContextWithResolutionTrace(ctx)
+		archs, err := cr.registry.ListArchs(lookupCtx, imagePullSecret, image)
 		if err != nil {
-			return nil, err
+			return resolvedPlatforms{}, err
 		}
-		return archs, nil
+		resolution, _ := trace.Get(image)
+		return resolvedPlatforms{platforms: archs, resolution: resolution}, nil
 	})
 	if err != nil {
 		return nil, err
@@ -180,5 +194,9 @@ func (cr *CachedRegistry) ListArchs(ctx context.Context, imagePullSecret, image
 	} else {
 		cr.metrics.Responses.WithLabelValues("miss").Inc()
 	}
-	return archs, nil
+	recordResolution(ctx, image, func(resolution *Resolution) {
+		*resolution = resolved.resolution
+		resolution.Cached = cached
+	})
+	return resolved.platforms, nil
 }
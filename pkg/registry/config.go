@@ -0,0 +1,52 @@
+package registry
+
+import (
+	"context"
+	"slices"
+	"strings"
+)
+
+// Config holds the registry settings that can be overridden for a single request,
+// e.g. by a NoePolicy applying to the namespace of the pod.
+// Empty fields keep the settings the registry was created with.
+type Config struct {
+	Proxies                  []RegistryProxy
+	SchedulableArchitectures []string
+	PrivateRegistryPatterns  []string
+}
+
+func (c Config) IsEmpty() bool {
+	return len(c.Proxies) == 0 && len(c.SchedulableArchitectures) == 0 && len(c.PrivateRegistryPatterns) == 0
+}
+
+// Key returns a stable representation of the config, suitable to be used in cache keys.
+func (c Config) Key() string {
+	if c.IsEmpty() {
+		return ""
+	}
+	proxies := []string{}
+	for _, proxy := range c.Proxies {
+		proxies = append(proxies, proxy.Registry+"="+proxy.Proxy)
+	}
+	archs := slices.Clone(c.SchedulableArchitectures)
+	slices.Sort(archs)
+	patterns := slices.Clone(c.PrivateRegistryPatterns)
+	slices.Sort(patterns)
+	return strings.Join(proxies, ",") + ";" + strings.Join(archs, ",") + ";" + strings.Join(patterns, ",")
+}
+
+type configContextKey struct{}
+
+// ContextWithConfig returns a context carrying registry settings overriding the registry defaults.
+func ContextWithConfig(ctx context.Context, config Config) context.Context {
+	if config.IsEmpty() {
+		return ctx
+	}
+	return context.WithValue(ctx, configContextKey{}, config)
+}
+
+// ConfigFromContext returns the registry settings carried by the context, if any.
+func ConfigFromContext(ctx context.Context) (Config, bool) {
+	config, ok := ctx.Value(configContextKey{}).(Config)
+	return config, ok
+}
@@ -12,8 +12,11 @@ import (
 	"strings"
 
 	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/tracing"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
@@ -234,7 +237,9 @@ func (r KubeletAuthenticator) tryIndividualKubeletProvider(ctx context.Context,
 		return
 	}
 
-	err = execCommandOutput(ctx, &stdin, &stdout, &stderr, kubeToExec(provider.Env), filepath.Join(r.BinDir, provider.Name), provider.Args...)
+	execCtx, span := tracing.Tracer().Start(ctx, "KubeletCredentialProvider", trace.WithAttributes(attribute.String("provider", provider.Name)))
+	err = execCommandOutput(execCtx, &stdin, &stdout, &stderr, kubeToExec(provider.Env), filepath.Join(r.BinDir, provider.Name), provider.Args...)
+	tracing.End(span, err)
 	if stderr.Len() > 0 {
 		for _, line := range strings.Split(stderr.String(), "\n") {
 			log.DefaultLogger.WithContext(ctx).WithField("error", "stderr").Warn(line)
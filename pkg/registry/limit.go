@@ -0,0 +1,161 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// ErrOverloaded is returned when a lookup is shed as too many lookups are already running or queued.
+var ErrOverloaded = errors.New("overloaded")
+
+type LimiterMetrics struct {
+	InFlight    prometheus.Gauge
+	QueueDepth  prometheus.Gauge
+	WaitSeconds prometheus.Histogram
+	Shed        *prometheus.CounterVec
+}
+
+func (m LimiterMetrics) MustRegister(reg metrics.RegistererGatherer) {
+	reg.MustRegister(
+		m.InFlight,
+		m.QueueDepth,
+		m.WaitSeconds,
+		m.Shed,
+	)
+}
+
+func NewLimiterMetrics(prefix string) *LimiterMetrics {
+	return &LimiterMetrics{
+		InFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: prefix,
+			Subsystem: "registry_limiter",
+			Name:      "in_flight",
+			Help:      "Number of registry lookups currently running",
+		}),
+		QueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: prefix,
+			Subsystem: "registry_limiter",
+			Name:      "queue_depth",
+			Help:      "Number of registry lookups waiting for a worker",
+		}),
+		WaitSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: prefix,
+			Subsystem: "registry_limiter",
+			Name:      "wait_seconds",
+			Help:      "Time registry lookups waited for a worker",
+			Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		}),
+		Shed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prefix,
+			Subsystem: "registry_limiter",
+			Name:      "shed_total",
+			Help:      "Number of registry lookups shed, by reason (queue_full or wait_timeout)",
+		}, []string{"reason"}),
+	}
+}
+
+type LimitOption func(*LimitedRegistry)
+
+// LimitedRegistry is a Registry decorator bounding the number of concurrent lookups, shared across admissions.
+// Lookups exceeding the concurrency wait in a queue, and fail with ErrOverloaded when the queue is full
+// or when they waited for longer than the maximum wait.
+type LimitedRegistry struct {
+	registry Registry
+	workers  chan struct{}
+	queued   atomic.Int64
+	// MaxQueue is the maximum number of lookups waiting for a worker, 0 meaning unbounded
+	MaxQueue int
+	// MaxWait is the maximum time a lookup waits for a worker, 0 meaning unbounded
+	MaxWait time.Duration
+	metrics *LimiterMetrics
+}
+
+func NewLimitedRegistry(registry Registry, concurrency int, opts ...LimitOption) *LimitedRegistry {
+	r := &LimitedRegistry{
+		registry: registry,
+		workers:  make(chan struct{}, concurrency),
+		metrics:  NewLimiterMetrics("noe"),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func WithMaxQueue(size int) LimitOption {
+	return func(r *LimitedRegistry) {
+		r.MaxQueue = size
+	}
+}
+
+func WithMaxQueueWait(wait time.Duration) LimitOption {
+	return func(r *LimitedRegistry) {
+		r.MaxWait = wait
+	}
+}
+
+func WithLimiterMetricsRegistry(reg metrics.RegistererGatherer) LimitOption {
+	return func(r *LimitedRegistry) {
+		r.metrics.MustRegister(reg)
+	}
+}
+
+func (r *LimitedRegistry) ListArchs(ctx context.Context, imagePullSecret, image string) ([]Platform, error) {
+	if err := r.acquire(ctx); err != nil {
+		log.DefaultLogger.WithContext(ctx).WithField("image", image).WithError(err).Warn("registry lookup shed")
+		return nil, err
+	}
+	defer r.release()
+	return r.registry.ListArchs(ctx, imagePullSecret, image)
+}
+
+func (r *LimitedRegistry) acquire(ctx context.Context) error {
+	select {
+	case r.workers <- struct{}{}:
+		r.metrics.WaitSeconds.Observe(0)
+		r.metrics.InFlight.Inc()
+		return nil
+	default:
+	}
+	if queued := r.queued.Add(1); r.MaxQueue > 0 && queued > int64(r.MaxQueue) {
+		r.queued.Add(-1)
+		r.metrics.Shed.WithLabelValues("queue_full").Inc()
+		return ErrOverloaded
+	}
+	r.metrics.QueueDepth.Inc()
+	defer func() {
+		r.queued.Add(-1)
+		r.metrics.QueueDepth.Dec()
+	}()
+
+	var timeout <-chan time.Time
+	if r.MaxWait > 0 {
+		timer := time.NewTimer(r.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	start := time.Now()
+	select {
+	case r.workers <- struct{}{}:
+		r.metrics.WaitSeconds.Observe(time.Since(start).Seconds())
+		r.metrics.InFlight.Inc()
+		return nil
+	case <-timeout:
+		r.metrics.WaitSeconds.Observe(time.Since(start).Seconds())
+		r.metrics.Shed.WithLabelValues("wait_timeout").Inc()
+		return ErrOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *LimitedRegistry) release() {
+	r.metrics.InFlight.Dec()
+	<-r.workers
+}
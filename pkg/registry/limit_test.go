@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedRegistry(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]Platform, error) {
+		started <- struct{}{}
+		<-release
+		return []Platform{{OS: "linux", Architecture: "arm64"}}, nil
+	})
+
+	t.Run("When the queue is full, lookups are shed immediately", func(t *testing.T) {
+		r := NewLimitedRegistry(blocking, 1, WithMaxQueue(1))
+		go r.ListArchs(context.Background(), "", "running")
+		<-started
+		queued := make(chan error)
+		go func() {
+			_, err := r.ListArchs(context.Background(), "", "queued")
+			queued <- err
+		}()
+		require.Eventually(t, func() bool { return testutil.ToFloat64(r.metrics.QueueDepth) == 1 }, time.Second, time.Millisecond)
+
+		_, err := r.ListArchs(context.Background(), "", "shed")
+		assert.ErrorIs(t, err, ErrOverloaded)
+		assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.Shed.WithLabelValues("queue_full")))
+
+		release <- struct{}{}
+		<-started
+		release <- struct{}{}
+		assert.NoError(t, <-queued)
+		assert.Equal(t, 0.0, testutil.ToFloat64(r.metrics.QueueDepth))
+		assert.Equal(t, 0.0, testutil.ToFloat64(r.metrics.InFlight))
+	})
+
+	t.Run("When lookups wait for too long, they are shed", func(t *testing.T) {
+		r := NewLimitedRegistry(blocking, 1, WithMaxQueueWait(10*time.Millisecond))
+		go r.ListArchs(context.Background(), "", "running")
+		<-started
+
+		_, err := r.ListArchs(context.Background(), "", "shed")
+		assert.ErrorIs(t, err, ErrOverloaded)
+		assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.Shed.WithLabelValues("wait_timeout")))
+
+		release <- struct{}{}
+	})
+}
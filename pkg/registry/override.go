@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/sirupsen/logrus"
+)
+
+type PlatformOverrideMode string
+
+const (
+	// PlatformOverrideReplace ignores the registry and only considers the declared platforms.
+	PlatformOverrideReplace PlatformOverrideMode = "Replace"
+	// PlatformOverrideAdd adds the declared platforms to the ones found in the registry.
+	PlatformOverrideAdd PlatformOverrideMode = "Add"
+)
+
+// PlatformOverride declares the platforms supported by images matching any of the patterns.
+type PlatformOverride struct {
+	Name      string
+	Images    []string
+	Platforms []Platform
+	Mode      PlatformOverrideMode
+}
+
+// MatchesImage reports whether the image matches any of the override patterns.
+// Patterns use the same glob matching as registry proxies.
+func (o PlatformOverride) MatchesImage(image string) bool {
+	for _, pattern := range o.Images {
+		if ok, err := filepath.Match(pattern, image); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PlatformOverrideStore holds the platform overrides currently declared in the cluster.
+// It is safe for concurrent use.
+type PlatformOverrideStore struct {
+	lock      sync.RWMutex
+	overrides map[string]PlatformOverride
+}
+
+func NewPlatformOverrideStore() *PlatformOverrideStore {
+	return &PlatformOverrideStore{
+		overrides: map[string]PlatformOverride{},
+	}
+}
+
+// Get returns the override stored with the name.
+func (s *PlatformOverrideStore) Get(name string) (PlatformOverride, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	override, ok := s.overrides[name]
+	return override, ok
+}
+
+func (s *PlatformOverrideStore) Set(override PlatformOverride) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.overrides[override.Name] = override
+}
+
+func (s *PlatformOverrideStore) Delete(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.overrides, name)
+}
+
+// Match returns the overrides matching the image, sorted by name.
+func (s *PlatformOverrideStore) Match(image string) []PlatformOverride {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r := []PlatformOverride{}
+	for _, override := range s.overrides {
+		if override.MatchesImage(image) {
+			r = append(r, override)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Name < r[j].Name
+	})
+	return r
+}
+
+// OverrideRegistry is a Registry decorator applying cluster-wide platform overrides.
+// When an image matches a Replace override, the underlying registry is not queried.
+type OverrideRegistry struct {
+	registry  Registry
+	overrides *PlatformOverrideStore
+}
+
+func NewOverrideRegistry(registry Registry, overrides *PlatformOverrideStore) *OverrideRegistry {
+	return &OverrideRegistry{
+		registry:  registry,
+		overrides: overrides,
+	}
+}
+
+func (r *OverrideRegistry) ListArchs(ctx context.Context, imagePullSecret, image string) ([]Platform, error) {
+	overrides := r.overrides.Match(image)
+	if len(overrides) == 0 {
+		return r.registry.ListArchs(ctx, imagePullSecret, image)
+	}
+	replaced := false
+	platforms := []Platform{}
+	names := []string{}
+	for _, override := range overrides {
+		names = append(names, override.Name)
+		ctx := log.AddLogFieldsToContext(ctx, logrus.Fields{"image": image, "override": override.Name, "mode": override.Mode})
+		log.DefaultLogger.WithContext(ctx).Debug("applying image platform override")
+		if override.Mode != PlatformOverrideAdd {
+			replaced = true
+		}
+		platforms = appendMissingPlatforms(platforms, override.Platforms...)
+	}
+	if replaced {
+		recordResolution(ctx, image, func(resolution *Resolution) {
+			resolution.Overrides = names
+		})
+		return platforms, nil
+	}
+	registryPlatforms, err := r.registry.ListArchs(ctx, imagePullSecret, image)
+	if err != nil {
+		return nil, err
+	}
+	recordResolution(ctx, image, func(resolution *Resolution) {
+		resolution.Overrides = names
+	})
+	return appendMissingPlatforms(slices.Clone(registryPlatforms), platforms...), nil
+}
+
+func appendMissingPlatforms(platforms []Platform, others ...Platform) []Platform {
+	for _, other := range others {
+		if !slices.ContainsFunc(platforms, other.Equal) {
+			platforms = append(platforms, other)
+		}
+	}
+	return platforms
+}
@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverrideRegistry(t *testing.T) {
+	calls := 0
+	store := NewPlatformOverrideStore()
+	r := NewOverrideRegistry(RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]Platform, error) {
+		calls++
+		if image == "failing" {
+			return nil, errors.New("registry error")
+		}
+		return []Platform{{OS: "linux", Architecture: "amd64"}}, nil
+	}), store)
+
+	t.Run("When no override matches the image, the registry is used", func(t *testing.T) {
+		calls = 0
+		platforms, err := r.ListArchs(context.Background(), "", "vendor/image:1.0")
+		require.NoError(t, err)
+		assert.Equal(t, []Platform{{OS: "linux", Architecture: "amd64"}}, platforms)
+		assert.Equal(t, 1, calls)
+	})
+
+	store.Set(PlatformOverride{
+		Name:      "vendor",
+		Images:    []string{"vendor/*:1.*"},
+		Platforms: []Platform{{OS: "linux", Architecture: "arm64"}},
+		Mode:      PlatformOverrideReplace,
+	})
+	t.Run("When a replace override matches the image, the registry is not called", func(t *testing.T) {
+		calls = 0
+		platforms, err := r.ListArchs(context.Background(), "", "vendor/image:1.0")
+		require.NoError(t, err)
+		assert.Equal(t, []Platform{{OS: "linux", Architecture: "arm64"}}, platforms)
+		assert.Equal(t, 0, calls)
+	})
+
+	store.Set(PlatformOverride{
+		Name:      "patched",
+		Images:    []string{"patched/*", "failing"},
+		Platforms: []Platform{{OS: "linux", Architecture: "arm64"}, {OS: "linux", Architecture: "amd64"}},
+		Mode:      PlatformOverrideAdd,
+	})
+	t.Run("When an add override matches the image, the platforms are merged", func(t *testing.T) {
+		calls = 0
+		platforms, err := r.ListArchs(context.Background(), "", "patched/image")
+		require.NoError(t, err)
+		assert.Equal(t, []Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}, platforms)
+		assert.Equal(t, 1, calls)
+	})
+	t.Run("When an add override matches the image and the registry fails", func(t *testing.T) {
+		_, err := r.ListArchs(context.Background(), "", "failing")
+		assert.Error(t, err)
+	})
+
+	store.Delete("vendor")
+	t.Run("When the override is deleted", func(t *testing.T) {
+		calls = 0
+		_, err := r.ListArchs(context.Background(), "", "vendor/image:1.0")
+		require.NoError(t, err)
+		assert.Equal(t, 1, calls)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"io"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,8 +20,11 @@ import (
 
 	"github.com/adevinta/noe/pkg/httputils"
 	"github.com/adevinta/noe/pkg/log"
+	"github.com/adevinta/noe/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
@@ -118,6 +123,13 @@ type registryManifestListResponse struct {
 	Architecture string `json:"architecture"`
 	// for application/vnd.docker.distribution.manifest.list.v2+json
 	Manifests []registryManifestRef `json:"manifests"`
+	// for application/vnd.oci.image.manifest.v1+json
+	// https://github.com/opencontainers/image-spec/blob/main/manifest.md
+	Config registryDescriptor `json:"config"`
+}
+
+type registryDescriptor struct {
+	MediaType string `json:"mediaType"`
 }
 
 type registryManifestRef struct {
@@ -129,6 +141,69 @@ type Platform struct {
 	Architecture string `json:"architecture"`
 	OS           string `json:"os"`
 	Variant      string `json:"variant"`
+	// OSVersion is the version of the OS the image requires, e.g. 10.0.17763.1234 for Windows images
+	OSVersion string `json:"os.version,omitempty"`
+	// Features are the CPU features the image requires, e.g. avx2
+	Features []string `json:"features,omitempty"`
+	// Image is the image providing the platform, when published under an architecture specific tag
+	Image string `json:"-"`
+	// Digest is the digest of the manifest, or manifest list, the image tag resolved to
+	Digest string `json:"-"`
+}
+
+func (p Platform) Equal(other Platform) bool {
+	return p.Architecture == other.Architecture &&
+		p.OS == other.OS &&
+		p.Variant == other.Variant &&
+		p.OSVersion == other.OSVersion &&
+		slices.Equal(p.Features, other.Features) &&
+		p.Image == other.Image
+}
+
+// manifestDigest returns the digest of the manifest returned by the registry,
+// computing it from the content when the registry does not provide it.
+func manifestDigest(resp *http.Response, content []byte) string {
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ParsePlatform parses a platform in the form of os/arch[/variant], e.g. linux/arm64/v8
+func ParsePlatform(platform string) (Platform, error) {
+	split := strings.Split(strings.TrimSpace(platform), "/")
+	if len(split) < 2 || len(split) > 3 || split[0] == "" || split[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expecting os/arch[/variant]", platform)
+	}
+	p := Platform{OS: split[0], Architecture: split[1]}
+	if len(split) == 3 {
+		p.Variant = split[2]
+	}
+	return p, nil
+}
+
+// ParsePlatforms parses a comma separated list of platforms in the form of os/arch[/variant]
+func ParsePlatforms(platforms string) ([]Platform, error) {
+	r := []Platform{}
+	for _, platform := range strings.Split(platforms, ",") {
+		if strings.TrimSpace(platform) == "" {
+			continue
+		}
+		p, err := ParsePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, p)
+	}
+	return r, nil
 }
 
 func WithTransport(transport http.RoundTripper) func(*PlainRegistry) {
@@ -175,6 +250,12 @@ func WithAuthenticator(authenticator Authenticator) func(*PlainRegistry) {
 	}
 }
 
+func WithDigestResolution(enabled bool) func(*PlainRegistry) {
+	return func(r *PlainRegistry) {
+		r.ResolveDigests = enabled
+	}
+}
+
 func WithSchedulableArchitectures(archs []string) func(*PlainRegistry) {
 	return func(r *PlainRegistry) {
 		r.SchedulableArchitectures = archs
@@ -182,6 +263,23 @@ func WithSchedulableArchitectures(archs []string) func(*PlainRegistry) {
 }
 
 func (r *PlainRegistry) parseImage(image string) (string, string, string, bool) {
+	return parseImage(image, r.Proxies)
+}
+
+// ImageRegistry returns the registry hosting the image, e.g. docker.io for ubuntu:22.04
+func ImageRegistry(image string) string {
+	registry, _, _, _ := parseImage(image, nil)
+	return registry
+}
+
+// NormalizeImage returns the image in the form of registry/repository:tag, e.g. docker.io/library/ubuntu:latest for ubuntu.
+// The digest, if any, is dropped.
+func NormalizeImage(image string) string {
+	registry, repository, tag, _ := parseImage(image, nil)
+	return registry + "/" + repository + ":" + tag
+}
+
+func parseImage(image string, proxies []RegistryProxy) (string, string, string, bool) {
 	registry := ""
 	tag := ""
 	hasRef := false
@@ -209,7 +307,7 @@ func (r *PlainRegistry) parseImage(image string) (string, string, string, bool)
 	if registry == "docker.io" && !strings.Contains(image, "/") {
 		image = "library/" + image
 	}
-	for _, proxy := range r.Proxies {
+	for _, proxy := range proxies {
 		if ok, err := filepath.Match(proxy.Registry, registry); err == nil && ok {
 			log.DefaultLogger.WithField("registry", registry).WithField("proxy", proxy.Proxy).Debug("using docker registry proxy")
 			registry = proxy.Proxy
@@ -232,6 +330,9 @@ type PlainRegistry struct {
 	cacheMetrics             *CacheMetrics
 	Metrics                  *RegistryMetrics
 	SchedulableArchitectures []string
+	ArchTagTemplates         []ArchTagTemplate
+	// ResolveDigests records the digest each image tag resolved to in the listed platforms
+	ResolveDigests bool
 }
 
 type WWWAuthenticateTransport struct {
@@ -246,7 +347,7 @@ func (t *WWWAuthenticateTransport) RoundTrip(req *http.Request) (*http.Response,
 	if t.Transport != nil {
 		transport = t.Transport
 	}
-	headReq, err := http.NewRequest("HEAD", req.URL.String(), nil)
+	headReq, err := http.NewRequestWithContext(ctx, "HEAD", req.URL.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -289,20 +390,7 @@ func (t *WWWAuthenticateTransport) RoundTrip(req *http.Request) (*http.Response,
 			return resp, err
 		}
 
-		query := authRequest.URL.Query()
-		query.Set("scope", fmt.Sprintf("repository:%s:pull", image))
-		authRequest.URL.RawQuery = query.Encode()
-
-		authResp, authErr := transport.RoundTrip(authRequest)
-		if authErr != nil {
-			return resp, err
-		}
-		defer authResp.Body.Close()
-		if authResp.StatusCode != http.StatusOK {
-			return resp, err
-		}
-		authResponse := registryAuthResponse{}
-		authErr = json.NewDecoder(authResp.Body).Decode(&authResponse)
+		authResponse, authErr := fetchToken(ctx, transport, authRequest, image)
 		if authErr != nil {
 			return resp, err
 		}
@@ -325,6 +413,10 @@ func (t *WWWAuthenticateTransport) RoundTrip(req *http.Request) (*http.Response,
 		log.DefaultLogger.WithContext(ctx).Debug("Using cached authentication")
 		req.Header.Set("Authorization", *cachedAuthHeader)
 	}
+	// release the probe, ending its span when traced
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
 	resp, err = transport.RoundTrip(req)
 	if err != nil {
 		return nil, err
@@ -332,6 +424,30 @@ func (t *WWWAuthenticateTransport) RoundTrip(req *http.Request) (*http.Response,
 	return resp, nil
 }
 
+// fetchToken requests a pull token for the image to the authorization server of the registry.
+func fetchToken(ctx context.Context, transport http.RoundTripper, authRequest *http.Request, image string) (authResponse registryAuthResponse, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "FetchRegistryToken", trace.WithAttributes(
+		attribute.String("image", image),
+		attribute.String("realm", authRequest.URL.Host),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	query := authRequest.URL.Query()
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", image))
+	authRequest.URL.RawQuery = query.Encode()
+
+	authResp, err := transport.RoundTrip(authRequest.WithContext(ctx))
+	if err != nil {
+		return authResponse, err
+	}
+	defer authResp.Body.Close()
+	if authResp.StatusCode != http.StatusOK {
+		return authResponse, fmt.Errorf("failed to get a registry token. Unexpected status code %d. Expecting %d", authResp.StatusCode, http.StatusOK)
+	}
+	err = json.NewDecoder(authResp.Body).Decode(&authResponse)
+	return authResponse, err
+}
+
 func newGetManifestRequest(ctx context.Context, scheme, registry, image, tag string, auth AuthenticationToken) (*http.Request, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, registry, image, tag), nil)
 	if err != nil {
@@ -372,6 +488,17 @@ func manifestKindFromMediaType(mediaType string) string {
 	return "unknown"
 }
 
+// isRunnableConfigMediaType reports whether a manifest config media type describes
+// a runnable container image. Other OCI artifacts (helm charts, signatures, data images...)
+// don't carry platform specific binaries.
+func isRunnableConfigMediaType(mediaType string) bool {
+	switch mediaType {
+	case "", "application/vnd.oci.image.config.v1+json", "application/vnd.docker.container.image.v1+json":
+		return true
+	}
+	return false
+}
+
 func (r *PlainRegistry) getImageManifest(ctx context.Context, client http.Client, auth AuthenticationToken, scheme, registry, image, tag string, acceptHeaders ...string) (*http.Response, error) {
 	r.Metrics.Requests.WithLabelValues().Inc()
 
@@ -456,7 +583,26 @@ type archListResult struct {
 	err      error
 }
 
+// config returns the registry settings for the request, giving precedence to the ones carried by the context.
+func (r *PlainRegistry) config(ctx context.Context) Config {
+	config := Config{
+		Proxies:                  r.Proxies,
+		SchedulableArchitectures: r.SchedulableArchitectures,
+	}
+	if override, ok := ConfigFromContext(ctx); ok {
+		if len(override.Proxies) > 0 {
+			config.Proxies = override.Proxies
+		}
+		if len(override.SchedulableArchitectures) > 0 {
+			config.SchedulableArchitectures = override.SchedulableArchitectures
+		}
+		config.PrivateRegistryPatterns = override.PrivateRegistryPatterns
+	}
+	return config
+}
+
 func (r *PlainRegistry) listArchsWithAuth(ctx context.Context, client http.Client, auth AuthenticationToken, registry, image, tag string) ([]Platform, error) {
+	schedulableArchitectures := r.config(ctx).SchedulableArchitectures
 	if registry == "docker.io" {
 		registry = "registry-1." + registry
 	}
@@ -471,6 +617,9 @@ func (r *PlainRegistry) listArchsWithAuth(ctx context.Context, client http.Clien
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
 		return nil, fmt.Errorf("failed to get manifest list for image %s in registry %s using the provider %s. Unexpected status code %d. Expecting %d", image, registry, auth.Ref.Provider, resp.StatusCode, http.StatusOK)
 	}
 	r.updateRemaingRateLimits(ctx, registry, resp)
@@ -478,6 +627,7 @@ func (r *PlainRegistry) listArchsWithAuth(ctx context.Context, client http.Clien
 	response := registryManifestListResponse{}
 	b := bytes.Buffer{}
 	io.Copy(&b, resp.Body)
+	digest := manifestDigest(resp, b.Bytes())
 	// keep buffer for easier debug until it stabilizes
 	// fmt.Println(b.String())
 	err = json.NewDecoder(&b).Decode(&response)
@@ -495,9 +645,9 @@ func (r *PlainRegistry) listArchsWithAuth(ctx context.Context, client http.Clien
 				log.DefaultLogger.WithContext(ctx).Printf("skipping %s %s:%s since it contains an unknown supported platform.\n", manifest.Platform.Architecture, registry, image)
 				continue
 			}
-			if len(r.SchedulableArchitectures) > 0 {
+			if len(schedulableArchitectures) > 0 {
 				found := false
-				for _, arch := range r.SchedulableArchitectures {
+				for _, arch := range schedulableArchitectures {
 					if arch == manifest.Platform.Architecture {
 						found = true
 						break
@@ -560,20 +710,49 @@ func (r *PlainRegistry) listArchsWithAuth(ctx context.Context, client http.Clien
 		}
 
 	default:
+		if !isRunnableConfigMediaType(response.Config.MediaType) {
+			log.DefaultLogger.WithContext(ctx).WithField("configMediaType", response.Config.MediaType).Printf("%s:%s is not a runnable image, considering it as architecture neutral", registry, image)
+			return []Platform{}, nil
+		}
 		if response.Architecture != "" {
 			platforms = append(platforms, Platform{Architecture: response.Architecture})
 		}
 	}
+	if len(platforms) == 0 {
+		platforms = append(platforms, Platform{Architecture: "amd64", OS: "linux"})
+	}
+	if r.ResolveDigests {
+		for i := range platforms {
+			platforms[i].Digest = digest
+		}
+	}
 	return platforms, nil
 }
 
+// ListArchs returns the platforms supported by the image.
+// An empty list means the image is architecture neutral (e.g. a non-runnable OCI artifact).
+// Settings carried by the context (see ContextWithConfig) take precedence over the registry ones.
 func (r *PlainRegistry) ListArchs(ctx context.Context, imagePullSecret, image string) ([]Platform, error) {
+	if template, ok := r.archTagTemplate(image); ok {
+		platforms := r.listArchTags(log.AddLogFieldsToContext(ctx, logrus.Fields{"image": image}), imagePullSecret, image, template)
+		if len(platforms) > 0 {
+			return platforms, nil
+		}
+		log.DefaultLogger.WithContext(ctx).WithField("image", image).Info("no architecture specific tag found, listing the image architectures")
+	}
+	return r.listArchs(ctx, imagePullSecret, image)
+}
+
+func (r *PlainRegistry) listArchs(ctx context.Context, imagePullSecret, image string) ([]Platform, error) {
 	ctx = log.AddLogFieldsToContext(ctx, logrus.Fields{"image": image})
+	requestedImage := image
 	transport := http.DefaultTransport
 	if r.Transport != nil {
 		transport = r.Transport
 	}
-	registry, image, tag, _ := r.parseImage(image)
+	// traced underneath the authentication, so that each manifest request, and each token request, has its own span
+	transport = tracing.Transport(transport)
+	registry, image, tag, _ := parseImage(image, r.config(ctx).Proxies)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	client := http.Client{
@@ -591,13 +770,15 @@ func (r *PlainRegistry) ListArchs(ctx context.Context, imagePullSecret, image st
 		close(candidates)
 	}()
 	for auth := range candidates {
-		platforms, err = r.listArchsWithAuth(ctx, client, auth, registry, image, tag)
+		authCtx, span := tracing.Tracer().Start(ctx, "ListArchsWithAuth", trace.WithAttributes(attribute.String("provider", auth.Ref.Provider)))
+		platforms, err = r.listArchsWithAuth(authCtx, client, auth, registry, image, tag)
+		tracing.End(span, err)
 		if err != nil {
 			continue
 		}
-		if len(platforms) == 0 {
-			platforms = append(platforms, Platform{Architecture: "amd64", OS: "linux"})
-		}
+		recordResolution(ctx, requestedImage, func(resolution *Resolution) {
+			resolution.Provider = auth.Ref.Provider
+		})
 		return platforms, nil
 	}
 	if err != nil {
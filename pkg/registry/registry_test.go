@@ -2,7 +2,11 @@ package registry
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -10,8 +14,12 @@ import (
 
 	"github.com/adevinta/noe/pkg/httputils"
 	"github.com/adevinta/noe/pkg/metric_test_helpers"
+	"github.com/adevinta/noe/pkg/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 const WellKnownMultiArchImage = "alpine:3.17.2"
@@ -114,6 +122,14 @@ func TestRegistryLabeller(t *testing.T) {
 
 }
 
+func TestNormalizeImage(t *testing.T) {
+	assert.Equal(t, "docker.io/library/ubuntu:latest", NormalizeImage("ubuntu"))
+	assert.Equal(t, "docker.io/fluent/fluent-bit:2.0", NormalizeImage("fluent/fluent-bit:2.0"))
+	assert.Equal(t, "docker.io/fluent/fluent-bit:2.0", NormalizeImage("docker.io/fluent/fluent-bit:2.0"))
+	assert.Equal(t, "gcr.io/istio/proxyv2:1.20.0", NormalizeImage("gcr.io/istio/proxyv2:1.20.0@sha256:0123"))
+	assert.Equal(t, "localhost:5000/app:latest", NormalizeImage("localhost:5000/app"))
+}
+
 func TestParseImageSubstituteRegistries(t *testing.T) {
 	reg := PlainRegistry{
 		Proxies: []RegistryProxy{
@@ -387,6 +403,138 @@ func TestListArchsWithAuthenticationAndPlainManifest(t *testing.T) {
 	assert.Contains(t, platforms, Platform{Architecture: "amd64"})
 }
 
+func TestListArchsWithNonRunnableArtifact(t *testing.T) {
+	registry := NewPlainRegistry(WithTransport(httputils.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		switch req.Method {
+		case "HEAD":
+			return &http.Response{
+				StatusCode: http.StatusOK,
+			}, nil
+		case "GET":
+			switch req.URL.Path {
+			case "/v2/my/model/manifests/latest":
+				headers := http.Header{}
+				headers.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     headers,
+					Body: io.NopCloser(strings.NewReader(`{
+						"mediaType": "application/vnd.oci.image.manifest.v1+json",
+						"artifactType": "application/vnd.company.model.v1",
+						"config": {
+							"mediaType": "application/vnd.oci.empty.v1+json"
+						}
+					}`)),
+				}, nil
+			case "/v2/my/image/manifests/latest":
+				headers := http.Header{}
+				headers.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     headers,
+					Body: io.NopCloser(strings.NewReader(`{
+						"mediaType": "application/vnd.oci.image.manifest.v1+json",
+						"config": {
+							"mediaType": "application/vnd.oci.image.config.v1+json"
+						}
+					}`)),
+				}, nil
+			}
+		}
+		t.Errorf("unexpected %v to %v", req.Method, req.URL)
+		return nil, errors.New("unexpected request")
+	})))
+	t.Run("When the config is not an image config", func(t *testing.T) {
+		platforms, err := registry.ListArchs(context.Background(), "", "registry.company.corp/my/model")
+		assert.NoError(t, err)
+		assert.NotNil(t, platforms)
+		assert.Len(t, platforms, 0)
+	})
+	t.Run("When the config is an image config", func(t *testing.T) {
+		platforms, err := registry.ListArchs(context.Background(), "", "registry.company.corp/my/image")
+		assert.NoError(t, err)
+		assert.Equal(t, []Platform{{Architecture: "amd64", OS: "linux"}}, platforms)
+	})
+}
+
+func TestListArchsWithDigestResolution(t *testing.T) {
+	manifest := `{"architecture": "arm64"}`
+	registry := NewPlainRegistry(
+		WithDigestResolution(true),
+		WithTransport(httputils.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			switch req.Method {
+			case "HEAD":
+				return &http.Response{
+					StatusCode: http.StatusOK,
+				}, nil
+			case "GET":
+				headers := http.Header{}
+				headers.Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+				switch req.URL.Path {
+				case "/v2/my/image/manifests/latest":
+					headers.Set("Docker-Content-Digest", "sha256:registry-digest")
+					fallthrough
+				case "/v2/my/other/manifests/latest":
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Header:     headers,
+						Body:       io.NopCloser(strings.NewReader(manifest)),
+					}, nil
+				}
+			}
+			t.Errorf("unexpected %v to %v", req.Method, req.URL)
+			return nil, errors.New("unexpected request")
+		})),
+	)
+	t.Run("When the registry returns the manifest digest", func(t *testing.T) {
+		platforms, err := registry.ListArchs(context.Background(), "", "registry.company.corp/my/image")
+		assert.NoError(t, err)
+		assert.Equal(t, []Platform{{Architecture: "arm64", Digest: "sha256:registry-digest"}}, platforms)
+	})
+	t.Run("When the registry does not return the manifest digest", func(t *testing.T) {
+		platforms, err := registry.ListArchs(context.Background(), "", "registry.company.corp/my/other")
+		assert.NoError(t, err)
+		assert.Equal(t, []Platform{{Architecture: "arm64", Digest: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))}}, platforms)
+	})
+}
+
+func TestListArchsWithContextConfig(t *testing.T) {
+	registry := NewPlainRegistry(
+		WithDockerProxies([]RegistryProxy{{Registry: "docker.io", Proxy: "default.proxy.tld"}}),
+		WithTransport(httputils.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method == "HEAD" {
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}
+			if req.URL.Host == "policy.proxy.tld" && req.URL.Path == "/v2/library/ubuntu/manifests/latest" {
+				headers := http.Header{}
+				headers.Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     headers,
+					Body:       io.NopCloser(strings.NewReader(`{"architecture": "arm64"}`)),
+				}, nil
+			}
+			t.Errorf("unexpected %v to %v", req.Method, req.URL)
+			return nil, errors.New("unexpected request")
+		})),
+	)
+	ctx := ContextWithConfig(context.Background(), Config{
+		Proxies: []RegistryProxy{{Registry: "docker.io", Proxy: "policy.proxy.tld"}},
+	})
+	platforms, err := registry.ListArchs(ctx, "", "ubuntu")
+	require.NoError(t, err)
+	assert.Equal(t, []Platform{{Architecture: "arm64"}}, platforms)
+
+	t.Run("private registries in the context disable anonymous pulls", func(t *testing.T) {
+		ctx := ContextWithConfig(ctx, Config{
+			Proxies:                 []RegistryProxy{{Registry: "docker.io", Proxy: "policy.proxy.tld"}},
+			PrivateRegistryPatterns: []string{"policy.proxy.tld"},
+		})
+		_, err := registry.ListArchs(ctx, "", "ubuntu")
+		assert.Error(t, err)
+	})
+}
+
 func TestParseRegistryProxies(t *testing.T) {
 	assert.Equal(
 		t,
@@ -404,3 +552,88 @@ func TestParseRegistryProxies(t *testing.T) {
 		ParseRegistryProxies("docker.io=docker-proxy.company.corp,quay.io=quay-proxy.company.corp"),
 	)
 }
+
+func TestParsePlatforms(t *testing.T) {
+	platforms, err := ParsePlatforms("linux/amd64, linux/arm64/v8")
+	require.NoError(t, err)
+	assert.Equal(t, []Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64", Variant: "v8"}}, platforms)
+	assert.Equal(t, "linux/arm64/v8", platforms[1].String())
+
+	platforms, err = ParsePlatforms("")
+	require.NoError(t, err)
+	assert.Len(t, platforms, 0)
+
+	_, err = ParsePlatforms("amd64")
+	assert.Error(t, err)
+	_, err = ParsePlatforms("linux/arm64/v8/extra")
+	assert.Error(t, err)
+}
+
+func TestDecodePlatform(t *testing.T) {
+	platform := Platform{}
+	require.NoError(t, json.Unmarshal([]byte(`{"architecture":"amd64","os":"windows","os.version":"10.0.17763.1234","features":["avx2"]}`), &platform))
+	assert.Equal(t, Platform{Architecture: "amd64", OS: "windows", OSVersion: "10.0.17763.1234", Features: []string{"avx2"}}, platform)
+	assert.True(t, platform.Equal(Platform{Architecture: "amd64", OS: "windows", OSVersion: "10.0.17763.1234", Features: []string{"avx2"}}))
+	assert.False(t, platform.Equal(Platform{Architecture: "amd64", OS: "windows", OSVersion: "10.0.17763.1234"}))
+}
+
+func TestListArchsTracesAuthenticationCandidatesAndRoundTrips(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := tracing.Setup(context.Background(), tracing.WithExporter(exporter))
+	require.NoError(t, err)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	registry := NewPlainRegistry(
+		WithAuthenticator(AuthenticatorFunc(func(ctx context.Context, imagePullSecret, registry, image, tag string, candidates chan AuthenticationToken) {
+			candidates <- AuthenticationToken{Kind: "Basic", Token: "revoked", Ref: AuthenticationSourceRef{Provider: "ImagePullSecret"}}
+			candidates <- AuthenticationToken{Ref: AuthenticationSourceRef{Provider: "anonymous"}}
+		})),
+		WithTransport(httputils.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			assert.NotEmpty(t, req.Header.Get("Traceparent"))
+			if req.Header.Get("Authorization") == "Basic revoked" {
+				return &http.Response{StatusCode: http.StatusForbidden}, nil
+			}
+			switch {
+			case req.Method == "HEAD":
+				headers := http.Header{}
+				headers.Set("Www-Authenticate", "Bearer realm=\"https://auth.company.corp/token\",service=\"registry.company.corp\"")
+				return &http.Response{StatusCode: http.StatusUnauthorized, Header: headers}, nil
+			case req.URL.Host == "auth.company.corp":
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"token":"my-token"}`))}, nil
+			}
+			headers := http.Header{}
+			headers.Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			return &http.Response{StatusCode: http.StatusOK, Header: headers, Body: io.NopCloser(strings.NewReader(`{"architecture": "arm64"}`))}, nil
+		})),
+	)
+	ctx, span := tracing.Tracer().Start(context.Background(), "test")
+	platforms, err := registry.ListArchs(ctx, "", "registry.company.corp/my/image")
+	span.End()
+	require.NoError(t, err)
+	assert.Equal(t, []Platform{{Architecture: "arm64"}}, platforms)
+
+	spans := exporter.GetSpans()
+	byName := map[string][]tracetest.SpanStub{}
+	for _, s := range spans {
+		assert.Equal(t, span.SpanContext().TraceID(), s.SpanContext.TraceID())
+		byName[s.Name] = append(byName[s.Name], s)
+	}
+	require.Len(t, byName["ListArchsWithAuth"], 2)
+	assert.Contains(t, byName["ListArchsWithAuth"][0].Attributes, attribute.String("provider", "ImagePullSecret"))
+	assert.Equal(t, codes.Error, byName["ListArchsWithAuth"][0].Status.Code)
+	assert.Contains(t, byName["ListArchsWithAuth"][1].Attributes, attribute.String("provider", "anonymous"))
+	assert.Equal(t, codes.Unset, byName["ListArchsWithAuth"][1].Status.Code)
+
+	require.Len(t, byName["FetchRegistryToken"], 1)
+	assert.Equal(t, byName["ListArchsWithAuth"][1].SpanContext.SpanID(), byName["FetchRegistryToken"][0].Parent.SpanID())
+
+	// the rejected candidate probes and gets the manifest, the anonymous one also fetches a token
+	assert.Len(t, byName["HTTP HEAD"], 2)
+	assert.Len(t, byName["HTTP GET"], 3)
+	for _, s := range byName["HTTP GET"] {
+		if s.Parent.SpanID() == byName["FetchRegistryToken"][0].SpanContext.SpanID() {
+			return
+		}
+	}
+	t.Error("the token request is not traced under the token fetch")
+}
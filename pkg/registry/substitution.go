@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ImageSubstitution declares a drop-in replacement repository for images matching any of the patterns,
+// e.g. a multi-arch rebuild of an amd64-only image.
+type ImageSubstitution struct {
+	Name   string
+	Images []string
+	// Repository replaces the repository of the matching images, their tag being kept.
+	Repository string
+}
+
+// MatchesImage reports whether the image matches any of the substitution patterns.
+// Patterns use the same glob matching as registry proxies.
+func (s ImageSubstitution) MatchesImage(image string) bool {
+	for _, pattern := range s.Images {
+		if ok, err := filepath.Match(pattern, image); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Substitute returns the image from the replacement repository, with the same tag.
+// Images referenced by digest can't be substituted as the digest would not exist in the replacement repository.
+func (s ImageSubstitution) Substitute(image string) (string, bool) {
+	if strings.Contains(image, "@") {
+		return "", false
+	}
+	tag := "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		tag = image[i+1:]
+	}
+	return s.Repository + ":" + tag, true
+}
+
+// ImageSubstitutionStore holds the image substitutions currently declared in the cluster.
+// It is safe for concurrent use.
+type ImageSubstitutionStore struct {
+	lock          sync.RWMutex
+	substitutions map[string]ImageSubstitution
+}
+
+func NewImageSubstitutionStore() *ImageSubstitutionStore {
+	return &ImageSubstitutionStore{
+		substitutions: map[string]ImageSubstitution{},
+	}
+}
+
+// Get returns the substitution stored with the name.
+func (s *ImageSubstitutionStore) Get(name string) (ImageSubstitution, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	substitution, ok := s.substitutions[name]
+	return substitution, ok
+}
+
+func (s *ImageSubstitutionStore) Set(substitution ImageSubstitution) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.substitutions[substitution.Name] = substitution
+}
+
+func (s *ImageSubstitutionStore) Delete(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.substitutions, name)
+}
+
+// Match returns the first substitution, sorted by name, matching the image.
+func (s *ImageSubstitutionStore) Match(image string) (ImageSubstitution, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r := []ImageSubstitution{}
+	for _, substitution := range s.substitutions {
+		if substitution.MatchesImage(image) {
+			r = append(r, substitution)
+		}
+	}
+	if len(r) == 0 {
+		return ImageSubstitution{}, false
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Name < r[j].Name
+	})
+	return r[0], true
+}
@@ -0,0 +1,40 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageSubstitutionSubstitute(t *testing.T) {
+	substitution := ImageSubstitution{Name: "nginx", Images: []string{"vendor/nginx*"}, Repository: "registry.example.com:5000/bitnami/nginx"}
+
+	image, ok := substitution.Substitute("vendor/nginx:1.25")
+	assert.True(t, ok)
+	assert.Equal(t, "registry.example.com:5000/bitnami/nginx:1.25", image)
+
+	image, ok = substitution.Substitute("vendor/nginx")
+	assert.True(t, ok)
+	assert.Equal(t, "registry.example.com:5000/bitnami/nginx:latest", image)
+
+	_, ok = substitution.Substitute("vendor/nginx@sha256:0123456789abcdef")
+	assert.False(t, ok)
+}
+
+func TestImageSubstitutionStoreMatch(t *testing.T) {
+	store := NewImageSubstitutionStore()
+	store.Set(ImageSubstitution{Name: "b", Images: []string{"vendor/*"}, Repository: "b/image"})
+	store.Set(ImageSubstitution{Name: "a", Images: []string{"vendor/nginx:*"}, Repository: "a/nginx"})
+
+	substitution, ok := store.Match("vendor/nginx:1.25")
+	assert.True(t, ok)
+	assert.Equal(t, "a", substitution.Name)
+
+	store.Delete("a")
+	substitution, ok = store.Match("vendor/nginx:1.25")
+	assert.True(t, ok)
+	assert.Equal(t, "b", substitution.Name)
+
+	_, ok = store.Match("ubuntu")
+	assert.False(t, ok)
+}
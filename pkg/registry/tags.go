@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/adevinta/noe/pkg/log"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTagArchitectures are the architectures probed for per-architecture tags
+// when the schedulable architectures of the cluster are not configured.
+var DefaultTagArchitectures = []string{"amd64", "arm64"}
+
+// ArchTagTemplate declares images published with a tag per architecture instead of a manifest list,
+// e.g. vendor.io/product:1.2.3-amd64 and vendor.io/product:1.2.3-arm64
+type ArchTagTemplate struct {
+	// Pattern matches the images as written in the pod spec, e.g. vendor.io/product:*
+	Pattern string
+	// Template renders the architecture specific tag from the {tag} and {arch} placeholders, e.g. {tag}-{arch}
+	Template string
+}
+
+// ParseArchTagTemplates parses a comma separated list of templates in the form of
+// vendor.io/product:*={tag}-{arch},vendor.io/other:*={arch}-{tag}
+func ParseArchTagTemplates(templates string) []ArchTagTemplate {
+	r := []ArchTagTemplate{}
+	for _, template := range strings.Split(templates, ",") {
+		template = strings.TrimSpace(template)
+		if template == "" {
+			continue
+		}
+		split := strings.SplitN(template, "=", 2)
+		if len(split) == 2 && strings.Contains(split[1], "{arch}") {
+			r = append(r, ArchTagTemplate{Pattern: split[0], Template: split[1]})
+		} else {
+			log.DefaultLogger.WithField("archTagTemplate", template).Warn("invalid architecture tag template syntax, ignoring")
+		}
+	}
+	return r
+}
+
+func WithArchTagTemplates(templates []ArchTagTemplate) func(*PlainRegistry) {
+	return func(r *PlainRegistry) {
+		r.ArchTagTemplates = append(r.ArchTagTemplates, templates...)
+	}
+}
+
+// Image returns the image reference of the architecture specific tag.
+// Images referenced by digest are returned unchanged.
+func (t ArchTagTemplate) Image(image, arch string) string {
+	if strings.Contains(image, "@") {
+		return image
+	}
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	return name + ":" + strings.NewReplacer("{tag}", tag, "{arch}", arch).Replace(t.Template)
+}
+
+func (r *PlainRegistry) archTagTemplate(image string) (ArchTagTemplate, bool) {
+	if strings.Contains(image, "@") {
+		return ArchTagTemplate{}, false
+	}
+	for _, template := range r.ArchTagTemplates {
+		if ok, err := filepath.Match(template.Pattern, image); err == nil && ok {
+			return template, true
+		}
+	}
+	return ArchTagTemplate{}, false
+}
+
+// listArchTags probes the architecture specific tags of the image and returns the union of their platforms,
+// each referencing the image providing it.
+// Tags that can't be listed are skipped, as vendors rarely publish all architectures.
+func (r *PlainRegistry) listArchTags(ctx context.Context, imagePullSecret, image string, template ArchTagTemplate) []Platform {
+	archs := r.config(ctx).SchedulableArchitectures
+	if len(archs) == 0 {
+		archs = DefaultTagArchitectures
+	}
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	platforms := []Platform{}
+	for _, arch := range archs {
+		wg.Add(1)
+		go func(arch string) {
+			defer wg.Done()
+			archImage := template.Image(image, arch)
+			ctx := log.AddLogFieldsToContext(ctx, logrus.Fields{"archImage": archImage})
+			archPlatforms, err := r.listArchs(ctx, imagePullSecret, archImage)
+			if err != nil {
+				log.DefaultLogger.WithContext(ctx).WithError(err).Debug("unable to list architecture specific tag, skipping it")
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, platform := range archPlatforms {
+				if platform.Architecture != arch {
+					continue
+				}
+				platform.Image = archImage
+				platforms = append(platforms, platform)
+			}
+		}(arch)
+	}
+	wg.Wait()
+	slices.SortFunc(platforms, func(a, b Platform) int {
+		return strings.Compare(a.Architecture, b.Architecture)
+	})
+	return platforms
+}
@@ -0,0 +1,74 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/adevinta/noe/pkg/httputils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArchTagTemplates(t *testing.T) {
+	assert.Equal(
+		t,
+		[]ArchTagTemplate{
+			{Pattern: "vendor.io/product:*", Template: "{tag}-{arch}"},
+			{Pattern: "vendor.io/other:*", Template: "{arch}-{tag}"},
+		},
+		ParseArchTagTemplates("vendor.io/product:*={tag}-{arch}, vendor.io/other:*={arch}-{tag},invalid,vendor.io/no-arch:*={tag}"),
+	)
+}
+
+func TestArchTagTemplateImage(t *testing.T) {
+	template := ArchTagTemplate{Template: "{tag}-{arch}"}
+	assert.Equal(t, "vendor.io/product:1.2.3-arm64", template.Image("vendor.io/product:1.2.3", "arm64"))
+	assert.Equal(t, "localhost:5000/product:latest-arm64", template.Image("localhost:5000/product", "arm64"))
+	assert.Equal(t, "vendor.io/product@sha256:abc", template.Image("vendor.io/product@sha256:abc", "arm64"))
+}
+
+func TestListArchsWithArchTagTemplates(t *testing.T) {
+	registry := NewPlainRegistry(
+		WithSchedulableArchitectures([]string{"amd64", "arm64", "ppc64le"}),
+		WithArchTagTemplates([]ArchTagTemplate{{Pattern: "vendor.io/product:*", Template: "{tag}-{arch}"}}),
+		WithTransport(httputils.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method == "HEAD" {
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}
+			headers := http.Header{}
+			headers.Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			switch req.URL.Path {
+			case "/v2/product/manifests/1.2.3-amd64", "/v2/other/manifests/1.2.3":
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     headers,
+					Body:       io.NopCloser(strings.NewReader(`{"architecture": "amd64"}`)),
+				}, nil
+			case "/v2/product/manifests/1.2.3-arm64":
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     headers,
+					Body:       io.NopCloser(strings.NewReader(`{"architecture": "arm64"}`)),
+				}, nil
+			case "/v2/product/manifests/1.2.3-ppc64le":
+				return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader(``))}, nil
+			}
+			t.Errorf("unexpected %v to %v", req.Method, req.URL)
+			return nil, errors.New("unexpected request")
+		})),
+	)
+	platforms, err := registry.ListArchs(context.Background(), "", "vendor.io/product:1.2.3")
+	require.NoError(t, err)
+	assert.Equal(t, []Platform{
+		{Architecture: "amd64", Image: "vendor.io/product:1.2.3-amd64"},
+		{Architecture: "arm64", Image: "vendor.io/product:1.2.3-arm64"},
+	}, platforms)
+
+	platforms, err = registry.ListArchs(context.Background(), "", "vendor.io/other:1.2.3")
+	require.NoError(t, err)
+	assert.Equal(t, []Platform{{Architecture: "amd64"}}, platforms)
+}
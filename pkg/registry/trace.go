@@ -0,0 +1,55 @@
+package registry
+
+import (
+	"context"
+	"sync"
+)
+
+// Resolution describes how the platforms of an image were resolved.
+type Resolution struct {
+	// Provider is the authentication provider the registry accepted, e.g. ImagePullSecret, kubelet or anonymous.
+	Provider string `json:"provider,omitempty"`
+	// Cached reports the platforms were served from the registry cache.
+	Cached bool `json:"cached,omitempty"`
+	// Overrides are the names of the image platform overrides applied to the image.
+	Overrides []string `json:"overrides,omitempty"`
+}
+
+// ResolutionTrace records the resolutions of the images listed with a context, for troubleshooting.
+type ResolutionTrace struct {
+	mu          sync.Mutex
+	resolutions map[string]Resolution
+}
+
+type resolutionTraceContextKey struct{}
+
+// ContextWithResolutionTrace returns a context recording the resolutions of the images listed with it.
+func ContextWithResolutionTrace(ctx context.Context) (context.Context, *ResolutionTrace) {
+	trace := &ResolutionTrace{resolutions: map[string]Resolution{}}
+	return context.WithValue(ctx, resolutionTraceContextKey{}, trace), trace
+}
+
+// Get returns the resolution recorded for the image, if any.
+func (t *ResolutionTrace) Get(image string) (Resolution, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	resolution, ok := t.resolutions[image]
+	return resolution, ok
+}
+
+func (t *ResolutionTrace) update(image string, mutate func(*Resolution)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	resolution := t.resolutions[image]
+	mutate(&resolution)
+	t.resolutions[image] = resolution
+}
+
+// recordResolution updates the resolution of the image when the context is traced.
+func recordResolution(ctx context.Context, image string, mutate func(*Resolution)) {
+	trace, ok := ctx.Value(resolutionTraceContextKey{}).(*ResolutionTrace)
+	if !ok {
+		return
+	}
+	trace.update(image, mutate)
+}
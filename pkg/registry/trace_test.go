@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolutionTrace(t *testing.T) {
+	inner := RegistryFunc(func(ctx context.Context, imagePullSecret, image string) ([]Platform, error) {
+		recordResolution(ctx, image, func(resolution *Resolution) {
+			resolution.Provider = "kubelet"
+		})
+		return []Platform{{OS: "linux", Architecture: "amd64"}}, nil
+	})
+
+	t.Run("When the context is not traced, nothing is recorded", func(t *testing.T) {
+		_, err := inner.ListArchs(context.Background(), "", "image")
+		require.NoError(t, err)
+	})
+
+	t.Run("When the platforms are cached, the provider of the original lookup is reported", func(t *testing.T) {
+		cr := NewCachedRegistry(inner, time.Hour)
+
+		ctx, trace := ContextWithResolutionTrace(context.Background())
+		_, err := cr.ListArchs(ctx, "", "image")
+		require.NoError(t, err)
+		resolution, ok := trace.Get("image")
+		require.True(t, ok)
+		assert.Equal(t, Resolution{Provider: "kubelet"}, resolution)
+
+		ctx, trace = ContextWithResolutionTrace(context.Background())
+		_, err = cr.ListArchs(ctx, "", "image")
+		require.NoError(t, err)
+		resolution, ok = trace.Get("image")
+		require.True(t, ok)
+		assert.Equal(t, Resolution{Provider: "kubelet", Cached: true}, resolution)
+	})
+
+	t.Run("When overrides apply, their names are reported", func(t *testing.T) {
+		store := NewPlatformOverrideStore()
+		store.Set(PlatformOverride{
+			Name:      "vendor",
+			Images:    []string{"vendor/*"},
+			Platforms: []Platform{{OS: "linux", Architecture: "arm64"}},
+			Mode:      PlatformOverrideAdd,
+		})
+		r := NewOverrideRegistry(NewCachedRegistry(inner, time.Hour), store)
+
+		ctx, trace := ContextWithResolutionTrace(context.Background())
+		_, err := r.ListArchs(ctx, "", "vendor/image")
+		require.NoError(t, err)
+		resolution, ok := trace.Get("vendor/image")
+		require.True(t, ok)
+		assert.Equal(t, Resolution{Provider: "kubelet", Overrides: []string{"vendor"}}, resolution)
+	})
+}
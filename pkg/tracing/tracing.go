@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer creating the Noe spans.
+const instrumentationName = "github.com/adevinta/noe"
+
+type config struct {
+	endpointURL string
+	exporter    sdktrace.SpanExporter
+	sampleRatio float64
+}
+
+type Option func(*config)
+
+// WithEndpointURL exports the spans to an OTLP/HTTP collector, e.g. http://otel-collector.observability:4318.
+// The OTEL_EXPORTER_OTLP_* environment variables apply to the headers, the TLS configuration and the timeouts.
+func WithEndpointURL(url string) Option {
+	return func(c *config) {
+		c.endpointURL = url
+	}
+}
+
+// WithExporter exports the spans synchronously to the exporter, instead of an OTLP collector.
+// It is meant for tests, together with tracetest.NewInMemoryExporter.
+func WithExporter(exporter sdktrace.SpanExporter) Option {
+	return func(c *config) {
+		c.exporter = exporter
+	}
+}
+
+// WithSampleRatio samples the given ratio of the traces not started by the caller.
+// Traces propagated from the admission requests are sampled as decided by the caller.
+func WithSampleRatio(ratio float64) Option {
+	return func(c *config) {
+		c.sampleRatio = ratio
+	}
+}
+
+// Setup installs the global tracer provider and the W3C trace context propagator.
+// Until then, spans are not recorded and the trace context is not propagated.
+// The returned provider must be shut down to flush the remaining spans.
+func Setup(ctx context.Context, opts ...Option) (*sdktrace.TracerProvider, error) {
+	c := config{sampleRatio: 1}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	providerOptions := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("noe"))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.sampleRatio))),
+	}
+	if c.exporter != nil {
+		providerOptions = append(providerOptions, sdktrace.WithSyncer(c.exporter))
+	}
+	if c.endpointURL != "" {
+		exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(c.endpointURL))
+		if err != nil {
+			return nil, err
+		}
+		providerOptions = append(providerOptions, sdktrace.WithBatcher(exporter))
+	}
+	provider := sdktrace.NewTracerProvider(providerOptions...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider, nil
+}
+
+// Tracer returns the tracer of the Noe spans, from the global tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// End ends the span, recording the error if any.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler traces the requests served by the handler, continuing the trace propagated by the caller, if any.
+func Handler(operation string, handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(handler, operation)
+}
+
+// Transport traces the round trips of the transport, propagating the trace context to the server.
+func Transport(transport http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(transport)
+}
@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSetup(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := Setup(context.Background(), WithExporter(exporter), WithSampleRatio(0))
+	require.NoError(t, err)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	t.Run("When the trace is not sampled by the caller, the sample ratio applies", func(t *testing.T) {
+		exporter.Reset()
+		_, span := Tracer().Start(context.Background(), "unsampled")
+		End(span, nil)
+		assert.Empty(t, exporter.GetSpans())
+	})
+
+	t.Run("When the trace is sampled by the caller, it is recorded regardless of the sample ratio", func(t *testing.T) {
+		exporter.Reset()
+		var traced bool
+		handler := Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, span := Tracer().Start(r.Context(), "child")
+			traced = span.IsRecording()
+			End(span, assert.AnError)
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.True(t, traced)
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 2)
+		assert.Equal(t, "child", spans[0].Name)
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spans[0].SpanContext.TraceID().String())
+		assert.Equal(t, codes.Error, spans[0].Status.Code)
+		assert.Equal(t, assert.AnError.Error(), spans[0].Status.Description)
+	})
+
+	t.Run("When a traced transport is used, the trace context is propagated to the server", func(t *testing.T) {
+		exporter.Reset()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Contains(t, r.Header.Get("Traceparent"), "0af7651916cd43dd8448eb211c80319c")
+		}))
+		defer server.Close()
+		handler := Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, server.URL, nil)
+			require.NoError(t, err)
+			resp, err := (&http.Client{Transport: Transport(http.DefaultTransport)}).Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Len(t, exporter.GetSpans(), 2)
+	})
+}